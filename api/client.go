@@ -18,12 +18,17 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand/v2"
 	"net"
 	"net/http"
 	"net/url"
 	"runtime"
+	"strconv"
+	"sync/atomic"
+	"time"
 
 	"github.com/ollama/ollama/envconfig"
 	"github.com/ollama/ollama/format"
@@ -35,6 +40,59 @@ import (
 type Client struct {
 	base *url.URL
 	http *http.Client
+
+	// failover holds base followed by the servers set with SetFailover, and
+	// active is the index of the one requests currently go to
+	failover []*url.URL
+	active   atomic.Int32
+
+	retry RetryPolicy
+}
+
+// RetryPolicy controls how a [Client] retries idempotent calls, such as
+// [Client.List] and [Client.Embed], that fail because the server couldn't be
+// reached, was busy or had an internal error. Other calls are never retried.
+type RetryPolicy struct {
+	// MaxAttempts is the number of times a call is tried, including the
+	// first. Calls aren't retried if it's less than 2.
+	MaxAttempts int
+
+	// MinBackoff is the delay before the first retry. It doubles with each
+	// retry after that up to MaxBackoff, and is jittered so that clients
+	// don't retry in lockstep. A Retry-After header in the failed response
+	// takes precedence.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// DefaultRetryPolicy is a [RetryPolicy] that suits most clients.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 4,
+	MinBackoff:  250 * time.Millisecond,
+	MaxBackoff:  8 * time.Second,
+}
+
+// backoff returns the jittered delay before the given retry, counting from 0
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	d := p.MinBackoff
+	for range retry {
+		if p.MaxBackoff > 0 && d >= p.MaxBackoff {
+			break
+		}
+
+		d *= 2
+	}
+
+	if p.MaxBackoff > 0 {
+		d = min(d, p.MaxBackoff)
+	}
+
+	if d <= 0 {
+		return 0
+	}
+
+	// anywhere between half and all of d
+	return d/2 + rand.N(d/2+1)
 }
 
 func checkError(resp *http.Response, body []byte) error {
@@ -81,7 +139,180 @@ func NewClient(base *url.URL, http *http.Client) *Client {
 	}
 }
 
+// SetRetryPolicy makes c retry idempotent calls according to p. It must be
+// called before c is used.
+func (c *Client) SetRetryPolicy(p RetryPolicy) {
+	c.retry = p
+}
+
+// SetFailover sets servers for c to fall back to, in order, when the one it
+// uses can't be reached. Idempotent calls also fail over when the server
+// returns an error that would be retried, without waiting for a backoff
+// unless every server has been tried. c keeps using the server it failed over
+// to until that one fails too. SetFailover must be called before c is used.
+func (c *Client) SetFailover(bases ...*url.URL) {
+	c.failover = append([]*url.URL{c.base}, bases...)
+	c.active.Store(0)
+}
+
+func (c *Client) server(i int32) *url.URL {
+	if len(c.failover) == 0 {
+		return c.base
+	}
+
+	return c.failover[i]
+}
+
+// retryable reports whether a response with the given status is worth
+// retrying: the server is busy, rate limited or had a transient failure
+func retryable(status int) bool {
+	switch {
+	case status == http.StatusTooManyRequests:
+		return true
+	case status == http.StatusNotImplemented, status == http.StatusHTTPVersionNotSupported:
+		return false
+	default:
+		return status >= http.StatusInternalServerError
+	}
+}
+
+// retryAfter parses the Retry-After header of resp, which is either a number
+// of seconds or a date
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(v); err == nil {
+		return max(time.Duration(seconds)*time.Second, 0), true
+	}
+
+	if t, err := http.ParseTime(v); err == nil {
+		return max(time.Until(t), 0), true
+	}
+
+	return 0, false
+}
+
+// unreachable reports whether err means the request never got to the server,
+// so it's safe to send it elsewhere
+func unreachable(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// send sends a request to the server c is using and returns its response,
+// which is the caller's to close. Requests that can't reach the server fail
+// over to the next one, if any, and idempotent requests are retried
+// following c's retry policy. Retrying needs a body that is nil or an
+// io.Seeker; other bodies are only sent once.
+func (c *Client) send(ctx context.Context, method, path, accept string, body io.Reader, idempotent bool) (*http.Response, error) {
+	seeker, replayable := body.(io.Seeker)
+	var offset int64
+	if replayable {
+		var err error
+		if offset, err = seeker.Seek(0, io.SeekCurrent); err != nil {
+			replayable = false
+		}
+	}
+
+	if body == nil {
+		replayable = true
+	}
+
+	servers := max(len(c.failover), 1)
+	attempts := 1
+	if idempotent {
+		attempts = max(c.retry.MaxAttempts, 1)
+	}
+
+	var backoffs int
+	for attempt := 1; ; attempt++ {
+		active := c.active.Load()
+
+		// keep the transport from closing bodies that are sent again
+		reqBody := body
+		if _, ok := body.(io.Closer); ok && replayable {
+			reqBody = io.NopCloser(body)
+		}
+
+		requestURL := c.server(active).JoinPath(path)
+		request, err := http.NewRequestWithContext(ctx, method, requestURL.String(), reqBody)
+		if err != nil {
+			return nil, err
+		}
+
+		request.Header.Set("Content-Type", "application/json")
+		request.Header.Set("Accept", accept)
+		request.Header.Set("User-Agent", fmt.Sprintf("ollama/%s (%s %s) Go/%s", version.Version, runtime.GOARCH, runtime.GOOS, runtime.Version()))
+
+		resp, err := c.http.Do(request)
+
+		var retry bool
+		var wait time.Duration
+		var waitSet bool
+		switch {
+		case err != nil && ctx.Err() != nil:
+			return nil, err
+		case err != nil && unreachable(err) && attempt < max(attempts, servers):
+			retry = true
+		case err != nil:
+			retry = idempotent && attempt < attempts
+		default:
+			retry = idempotent && attempt < attempts && retryable(resp.StatusCode)
+			if retry {
+				wait, waitSet = retryAfter(resp)
+			}
+		}
+
+		if !retry || !replayable {
+			return resp, err
+		}
+
+		if resp != nil {
+			_, _ = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		// move on to the next server, unless another request already has
+		c.active.CompareAndSwap(active, (active+1)%int32(servers))
+
+		// servers that haven't been tried for this request yet are tried
+		// straight away, the rest after a backoff
+		if attempt >= servers {
+			if !waitSet {
+				wait = c.retry.backoff(backoffs)
+			}
+			backoffs++
+
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return nil, ctx.Err()
+			case <-timer.C:
+			}
+		}
+
+		if seeker != nil {
+			if _, err := seeker.Seek(offset, io.SeekStart); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
 func (c *Client) do(ctx context.Context, method, path string, reqData, respData any) error {
+	return c.doRequest(ctx, method, path, reqData, respData, false)
+}
+
+// doIdempotent is like do for calls that are safe to retry
+func (c *Client) doIdempotent(ctx context.Context, method, path string, reqData, respData any) error {
+	return c.doRequest(ctx, method, path, reqData, respData, true)
+}
+
+func (c *Client) doRequest(ctx context.Context, method, path string, reqData, respData any, idempotent bool) error {
 	var reqBody io.Reader
 	var data []byte
 	var err error
@@ -101,17 +332,7 @@ func (c *Client) do(ctx context.Context, method, path string, reqData, respData
 		reqBody = bytes.NewReader(data)
 	}
 
-	requestURL := c.base.JoinPath(path)
-	request, err := http.NewRequestWithContext(ctx, method, requestURL.String(), reqBody)
-	if err != nil {
-		return err
-	}
-
-	request.Header.Set("Content-Type", "application/json")
-	request.Header.Set("Accept", "application/json")
-	request.Header.Set("User-Agent", fmt.Sprintf("ollama/%s (%s %s) Go/%s", version.Version, runtime.GOARCH, runtime.GOOS, runtime.Version()))
-
-	respObj, err := c.http.Do(request)
+	respObj, err := c.send(ctx, method, path, "application/json", reqBody, idempotent)
 	if err != nil {
 		return err
 	}
@@ -137,27 +358,17 @@ func (c *Client) do(ctx context.Context, method, path string, reqData, respData
 const maxBufferSize = 512 * format.KiloByte
 
 func (c *Client) stream(ctx context.Context, method, path string, data any, fn func([]byte) error) error {
-	var buf *bytes.Buffer
+	var body io.Reader
 	if data != nil {
 		bts, err := json.Marshal(data)
 		if err != nil {
 			return err
 		}
 
-		buf = bytes.NewBuffer(bts)
-	}
-
-	requestURL := c.base.JoinPath(path)
-	request, err := http.NewRequestWithContext(ctx, method, requestURL.String(), buf)
-	if err != nil {
-		return err
+		body = bytes.NewReader(bts)
 	}
 
-	request.Header.Set("Content-Type", "application/json")
-	request.Header.Set("Accept", "application/x-ndjson")
-	request.Header.Set("User-Agent", fmt.Sprintf("ollama/%s (%s %s) Go/%s", version.Version, runtime.GOARCH, runtime.GOOS, runtime.Version()))
-
-	response, err := c.http.Do(request)
+	response, err := c.send(ctx, method, path, "application/x-ndjson", body, false)
 	if err != nil {
 		return err
 	}
@@ -294,10 +505,11 @@ func (c *Client) Create(ctx context.Context, req *CreateRequest, fn CreateProgre
 	})
 }
 
-// List lists models that are available locally.
+// List lists models that are available locally. It's retried following the
+// client's [RetryPolicy].
 func (c *Client) List(ctx context.Context) (*ListResponse, error) {
 	var lr ListResponse
-	if err := c.do(ctx, http.MethodGet, "/api/tags", nil, &lr); err != nil {
+	if err := c.doIdempotent(ctx, http.MethodGet, "/api/tags", nil, &lr); err != nil {
 		return nil, err
 	}
 	return &lr, nil
@@ -330,9 +542,10 @@ func (c *Client) Delete(ctx context.Context, req *DeleteRequest) error {
 }
 
 // Show obtains model information, including details, modelfile, license etc.
+// It's retried following the client's [RetryPolicy].
 func (c *Client) Show(ctx context.Context, req *ShowRequest) (*ShowResponse, error) {
 	var resp ShowResponse
-	if err := c.do(ctx, http.MethodPost, "/api/show", req, &resp); err != nil {
+	if err := c.doIdempotent(ctx, http.MethodPost, "/api/show", req, &resp); err != nil {
 		return nil, err
 	}
 	return &resp, nil
@@ -347,10 +560,11 @@ func (c *Client) Heartbeat(ctx context.Context) error {
 	return nil
 }
 
-// Embed generates embeddings from a model.
+// Embed generates embeddings from a model. It's retried following the
+// client's [RetryPolicy].
 func (c *Client) Embed(ctx context.Context, req *EmbedRequest) (*EmbedResponse, error) {
 	var resp EmbedResponse
-	if err := c.do(ctx, http.MethodPost, "/api/embed", req, &resp); err != nil {
+	if err := c.doIdempotent(ctx, http.MethodPost, "/api/embed", req, &resp); err != nil {
 		return nil, err
 	}
 	return &resp, nil
@@ -365,19 +579,81 @@ func (c *Client) Embeddings(ctx context.Context, req *EmbeddingRequest) (*Embedd
 	return &resp, nil
 }
 
+// Tokenize splits text into a model's tokens. Only the model's vocabulary is
+// loaded if it isn't already running.
+func (c *Client) Tokenize(ctx context.Context, req *TokenizeRequest) (*TokenizeResponse, error) {
+	var resp TokenizeResponse
+	if err := c.do(ctx, http.MethodPost, "/api/tokenize", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Detokenize turns a model's tokens back into text.
+func (c *Client) Detokenize(ctx context.Context, req *DetokenizeRequest) (*DetokenizeResponse, error) {
+	var resp DetokenizeResponse
+	if err := c.do(ctx, http.MethodPost, "/api/detokenize", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Rerank scores documents by their relevance to a query with a reranking
+// model.
+func (c *Client) Rerank(ctx context.Context, req *RerankRequest) (*RerankResponse, error) {
+	var resp RerankResponse
+	if err := c.do(ctx, http.MethodPost, "/api/rerank", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// ListSessions lists the chat sessions stored on the server.
+func (c *Client) ListSessions(ctx context.Context) (*ListSessionsResponse, error) {
+	var resp ListSessionsResponse
+	if err := c.do(ctx, http.MethodGet, "/api/sessions", nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Session obtains a chat session, including its history.
+func (c *Client) Session(ctx context.Context, id string) (*Session, error) {
+	var resp Session
+	if err := c.do(ctx, http.MethodGet, "/api/sessions/"+url.PathEscape(id), nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// ForkSession copies the history of a chat session into a new session.
+func (c *Client) ForkSession(ctx context.Context, id string, req *ForkSessionRequest) (*Session, error) {
+	var resp Session
+	if err := c.do(ctx, http.MethodPost, "/api/sessions/"+url.PathEscape(id)+"/fork", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// DeleteSession deletes a chat session.
+func (c *Client) DeleteSession(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/api/sessions/"+url.PathEscape(id), nil, nil)
+}
+
 // CreateBlob creates a blob from a file on the server. digest is the
 // expected SHA256 digest of the file, and r represents the file.
 func (c *Client) CreateBlob(ctx context.Context, digest string, r io.Reader) error {
 	return c.do(ctx, http.MethodPost, fmt.Sprintf("/api/blobs/%s", digest), r, nil)
 }
 
-// Version returns the Ollama server version as a string.
+// Version returns the Ollama server version as a string. It's retried
+// following the client's [RetryPolicy].
 func (c *Client) Version(ctx context.Context) (string, error) {
 	var version struct {
 		Version string `json:"version"`
 	}
 
-	if err := c.do(ctx, http.MethodGet, "/api/version", nil, &version); err != nil {
+	if err := c.doIdempotent(ctx, http.MethodGet, "/api/version", nil, &version); err != nil {
 		return "", err
 	}
 
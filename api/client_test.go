@@ -1,7 +1,15 @@
 package api
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/ollama/ollama/envconfig"
 )
@@ -46,3 +54,204 @@ func TestClientFromEnvironment(t *testing.T) {
 		})
 	}
 }
+
+// testServer counts the requests to it, failing the first failures of them
+// with status and replying to the rest with a version
+func testServer(t *testing.T, failures, status int, header http.Header) (*url.URL, *atomic.Int32) {
+	t.Helper()
+
+	var requests atomic.Int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if n := requests.Add(1); int(n) <= failures {
+			for k, v := range header {
+				w.Header()[k] = v
+			}
+
+			w.WriteHeader(status)
+			fmt.Fprint(w, `{"error":"server busy, please try again"}`)
+			return
+		}
+
+		fmt.Fprint(w, `{"version":"0.0.0","models":[]}`)
+	}))
+	t.Cleanup(s.Close)
+
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return u, &requests
+}
+
+// downServer returns the URL of a server that refuses connections
+func downServer(t *testing.T) *url.URL {
+	t.Helper()
+
+	s := httptest.NewServer(http.NotFoundHandler())
+	s.Close()
+
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return u
+}
+
+func TestClientRetry(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 3, MinBackoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond}
+
+	cases := []struct {
+		name     string
+		failures int
+		status   int
+		requests int32
+		err      int
+	}{
+		{"busy", 2, http.StatusServiceUnavailable, 3, 0},
+		{"internal error", 1, http.StatusInternalServerError, 2, 0},
+		{"rate limited", 1, http.StatusTooManyRequests, 2, 0},
+		{"gives up", 3, http.StatusServiceUnavailable, 3, http.StatusServiceUnavailable},
+		{"not implemented", 1, http.StatusNotImplemented, 1, http.StatusNotImplemented},
+		{"client error", 1, http.StatusBadRequest, 1, http.StatusBadRequest},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			u, requests := testServer(t, tt.failures, tt.status, nil)
+			c := NewClient(u, http.DefaultClient)
+			c.SetRetryPolicy(policy)
+
+			_, err := c.Version(context.Background())
+			if tt.err == 0 && err != nil {
+				t.Fatal(err)
+			}
+
+			var statusErr StatusError
+			if tt.err != 0 && (!errors.As(err, &statusErr) || statusErr.StatusCode != tt.err) {
+				t.Errorf("expected status %d, got %v", tt.err, err)
+			}
+
+			if n := requests.Load(); n != tt.requests {
+				t.Errorf("expected %d requests, got %d", tt.requests, n)
+			}
+		})
+	}
+
+	t.Run("not idempotent", func(t *testing.T) {
+		u, requests := testServer(t, 1, http.StatusServiceUnavailable, nil)
+		c := NewClient(u, http.DefaultClient)
+		c.SetRetryPolicy(policy)
+
+		if err := c.Copy(context.Background(), &CopyRequest{Source: "a", Destination: "b"}); err == nil {
+			t.Error("expected an error")
+		}
+
+		if n := requests.Load(); n != 1 {
+			t.Errorf("expected 1 request, got %d", n)
+		}
+	})
+
+	t.Run("no policy", func(t *testing.T) {
+		u, requests := testServer(t, 1, http.StatusServiceUnavailable, nil)
+		c := NewClient(u, http.DefaultClient)
+
+		if _, err := c.List(context.Background()); err == nil {
+			t.Error("expected an error")
+		}
+
+		if n := requests.Load(); n != 1 {
+			t.Errorf("expected 1 request, got %d", n)
+		}
+	})
+
+	t.Run("retry after", func(t *testing.T) {
+		// the backoff is far longer than the test would run, so only
+		// following Retry-After lets it finish
+		u, requests := testServer(t, 1, http.StatusServiceUnavailable, http.Header{"Retry-After": {"0"}})
+		c := NewClient(u, http.DefaultClient)
+		c.SetRetryPolicy(RetryPolicy{MaxAttempts: 2, MinBackoff: time.Hour, MaxBackoff: time.Hour})
+
+		if _, err := c.Show(context.Background(), &ShowRequest{Model: "test"}); err != nil {
+			t.Fatal(err)
+		}
+
+		if n := requests.Load(); n != 2 {
+			t.Errorf("expected 2 requests, got %d", n)
+		}
+	})
+
+	t.Run("cancel during backoff", func(t *testing.T) {
+		u, _ := testServer(t, 1, http.StatusServiceUnavailable, nil)
+		c := NewClient(u, http.DefaultClient)
+		c.SetRetryPolicy(RetryPolicy{MaxAttempts: 2, MinBackoff: time.Hour, MaxBackoff: time.Hour})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		if _, err := c.Embed(ctx, &EmbedRequest{Model: "test", Input: "hi"}); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected the deadline to be exceeded, got %v", err)
+		}
+	})
+}
+
+func TestClientFailover(t *testing.T) {
+	t.Run("unreachable", func(t *testing.T) {
+		u, requests := testServer(t, 0, 0, nil)
+		c := NewClient(downServer(t), http.DefaultClient)
+		c.SetFailover(u)
+
+		// even calls that aren't retried fail over when the server is down
+		if err := c.Copy(context.Background(), &CopyRequest{Source: "a", Destination: "b"}); err != nil {
+			t.Fatal(err)
+		}
+
+		// and later calls stay on the server that answered
+		if _, err := c.List(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		if n := requests.Load(); n != 2 {
+			t.Errorf("expected 2 requests, got %d", n)
+		}
+	})
+
+	t.Run("server error", func(t *testing.T) {
+		failing, failed := testServer(t, 1, http.StatusInternalServerError, nil)
+		u, requests := testServer(t, 0, 0, nil)
+		c := NewClient(failing, http.DefaultClient)
+		c.SetFailover(u)
+		c.SetRetryPolicy(RetryPolicy{MaxAttempts: 2, MinBackoff: time.Hour, MaxBackoff: time.Hour})
+
+		// the other server is tried without waiting for the backoff
+		if _, err := c.Version(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		if failed.Load() != 1 || requests.Load() != 1 {
+			t.Errorf("expected 1 request to each server, got %d and %d", failed.Load(), requests.Load())
+		}
+	})
+
+	t.Run("all down", func(t *testing.T) {
+		c := NewClient(downServer(t), http.DefaultClient)
+		c.SetFailover(downServer(t))
+
+		if err := c.Generate(context.Background(), &GenerateRequest{Model: "test"}, func(GenerateResponse) error { return nil }); err == nil {
+			t.Error("expected an error")
+		}
+	})
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := RetryPolicy{MinBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+
+	for retry, want := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second} {
+		for range 10 {
+			if d := p.backoff(retry); d < want/2 || d > want {
+				t.Errorf("retry %d: expected a backoff between %s and %s, got %s", retry, want/2, want, d)
+			}
+		}
+	}
+}
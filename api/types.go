@@ -66,13 +66,29 @@ type GenerateRequest struct {
 	// Raw set to true means that no formatting will be applied to the prompt.
 	Raw bool `json:"raw,omitempty"`
 
-	// Format specifies the format to return a response in.
-	Format string `json:"format"`
+	// Format specifies the format to return a response in, either "json" or
+	// a JSON schema the response must validate against.
+	Format json.RawMessage `json:"format,omitempty"`
+
+	// Grammar is a GBNF grammar the response must match. It replaces the
+	// model's default grammar and can't be used with Format.
+	Grammar string `json:"grammar,omitempty"`
+
+	// Logprobs returns the log probability of each token of the response.
+	Logprobs bool `json:"logprobs,omitempty"`
+
+	// TopLogprobs is the number of most likely alternatives, up to 20,
+	// returned for each token. It requires Logprobs.
+	TopLogprobs int `json:"top_logprobs,omitempty"`
 
 	// KeepAlive controls how long the model will stay loaded in memory following
 	// this request.
 	KeepAlive *Duration `json:"keep_alive,omitempty"`
 
+	// Priority is the scheduling class of the request, either "interactive"
+	// or "batch". It defaults to "interactive".
+	Priority string `json:"priority,omitempty"`
+
 	// Images is an optional list of base64-encoded images accompanying this
 	// request, for multimodal models.
 	Images []ImageData `json:"images,omitempty"`
@@ -93,16 +109,36 @@ type ChatRequest struct {
 	// Stream enable streaming of returned response; true by default.
 	Stream *bool `json:"stream,omitempty"`
 
-	// Format is the format to return the response in (e.g. "json").
-	Format string `json:"format"`
+	// Format is the format to return the response in, as in
+	// [GenerateRequest].
+	Format json.RawMessage `json:"format,omitempty"`
+
+	// Grammar is a GBNF grammar the response must match, as in
+	// [GenerateRequest].
+	Grammar string `json:"grammar,omitempty"`
+
+	// Logprobs and TopLogprobs return token log probabilities, as in
+	// [GenerateRequest].
+	Logprobs    bool `json:"logprobs,omitempty"`
+	TopLogprobs int  `json:"top_logprobs,omitempty"`
 
 	// KeepAlive controls how long the model will stay loaded into memory
 	// followin the request.
 	KeepAlive *Duration `json:"keep_alive,omitempty"`
 
+	// Priority is the scheduling class of the request, either "interactive"
+	// or "batch". It defaults to "interactive".
+	Priority string `json:"priority,omitempty"`
+
 	// Tools is an optional list of tools the model has access to.
 	Tools `json:"tools,omitempty"`
 
+	// Session is the ID of a conversation stored on the server. Messages
+	// are appended to the session's history, along with the model's reply,
+	// so only new messages need to be sent. Model may be left empty to use
+	// the session's model.
+	Session string `json:"session,omitempty"`
+
 	// Options lists model-specific options.
 	Options map[string]interface{} `json:"options"`
 }
@@ -184,18 +220,41 @@ type ChatResponse struct {
 	Message    Message   `json:"message"`
 	DoneReason string    `json:"done_reason,omitempty"`
 
+	// Logprobs are the tokens of the message, if requested.
+	Logprobs []Logprob `json:"logprobs,omitempty"`
+
 	Done bool `json:"done"`
 
 	Metrics
 }
 
+// TokenLogprob is a token and its log probability.
+type TokenLogprob struct {
+	Token   string  `json:"token"`
+	ID      int     `json:"id"`
+	Logprob float64 `json:"logprob"`
+
+	// Bytes is the token's UTF-8 bytes. Tokens holding part of a character
+	// aren't valid UTF-8 on their own, so their Token may differ.
+	Bytes []int `json:"bytes,omitempty"`
+}
+
+// Logprob is a token of a response with its log probability and the most
+// likely alternatives to it.
+type Logprob struct {
+	TokenLogprob
+	TopLogprobs []TokenLogprob `json:"top_logprobs,omitempty"`
+}
+
 type Metrics struct {
-	TotalDuration      time.Duration `json:"total_duration,omitempty"`
-	LoadDuration       time.Duration `json:"load_duration,omitempty"`
-	PromptEvalCount    int           `json:"prompt_eval_count,omitempty"`
-	PromptEvalDuration time.Duration `json:"prompt_eval_duration,omitempty"`
-	EvalCount          int           `json:"eval_count,omitempty"`
-	EvalDuration       time.Duration `json:"eval_duration,omitempty"`
+	TotalDuration       time.Duration `json:"total_duration,omitempty"`
+	LoadDuration        time.Duration `json:"load_duration,omitempty"`
+	PromptEvalCount     int           `json:"prompt_eval_count,omitempty"`
+	PromptEvalDuration  time.Duration `json:"prompt_eval_duration,omitempty"`
+	EvalCount           int           `json:"eval_count,omitempty"`
+	EvalDuration        time.Duration `json:"eval_duration,omitempty"`
+	PromptCacheCount    int           `json:"prompt_cache_count,omitempty"`
+	DraftAcceptanceRate float64       `json:"draft_acceptance_rate,omitempty"`
 }
 
 // Options specified in [GenerateRequest], if you add a new option here add it
@@ -251,6 +310,10 @@ type EmbedRequest struct {
 	// this request.
 	KeepAlive *Duration `json:"keep_alive,omitempty"`
 
+	// Priority is the scheduling class of the request, either "interactive"
+	// or "batch". It defaults to "batch".
+	Priority string `json:"priority,omitempty"`
+
 	Truncate *bool `json:"truncate,omitempty"`
 
 	// Options lists model-specific options.
@@ -275,6 +338,10 @@ type EmbeddingRequest struct {
 	// this request.
 	KeepAlive *Duration `json:"keep_alive,omitempty"`
 
+	// Priority is the scheduling class of the request, either "interactive"
+	// or "batch". It defaults to "batch".
+	Priority string `json:"priority,omitempty"`
+
 	// Options lists model-specific options.
 	Options map[string]interface{} `json:"options"`
 }
@@ -284,6 +351,95 @@ type EmbeddingResponse struct {
 	Embedding []float64 `json:"embedding"`
 }
 
+// TokenizeRequest is the request passed to [Client.Tokenize].
+type TokenizeRequest struct {
+	// Model is the model name.
+	Model string `json:"model"`
+
+	// Text is the text to tokenize. Special tokens in it, such as those
+	// used by the model's template, are tokenized as such.
+	Text string `json:"text"`
+
+	// KeepAlive controls how long the model will stay loaded in memory following
+	// this request.
+	KeepAlive *Duration `json:"keep_alive,omitempty"`
+}
+
+// TokenizeResponse is the response from [Client.Tokenize].
+type TokenizeResponse struct {
+	Model  string `json:"model"`
+	Tokens []int  `json:"tokens"`
+
+	// Pieces holds the text of each token. A piece can be part of a
+	// multibyte character, in which case it isn't valid UTF-8.
+	Pieces []string `json:"pieces"`
+}
+
+// DetokenizeRequest is the request passed to [Client.Detokenize].
+type DetokenizeRequest struct {
+	// Model is the model name.
+	Model string `json:"model"`
+
+	// Tokens are the token ids to turn back into text.
+	Tokens []int `json:"tokens"`
+
+	// KeepAlive controls how long the model will stay loaded in memory following
+	// this request.
+	KeepAlive *Duration `json:"keep_alive,omitempty"`
+}
+
+// DetokenizeResponse is the response from [Client.Detokenize].
+type DetokenizeResponse struct {
+	Model string `json:"model"`
+	Text  string `json:"text"`
+}
+
+// RerankRequest is the request passed to [Client.Rerank].
+type RerankRequest struct {
+	// Model is the model name. It must be a reranking model.
+	Model string `json:"model"`
+
+	// Query is the text the documents are ranked against.
+	Query string `json:"query"`
+
+	// Documents are the texts to rank.
+	Documents []string `json:"documents"`
+
+	// TopN limits the response to the most relevant documents. All of them
+	// are returned if it's zero.
+	TopN int `json:"top_n,omitempty"`
+
+	// KeepAlive controls how long the model will stay loaded in memory following
+	// this request.
+	KeepAlive *Duration `json:"keep_alive,omitempty"`
+
+	// Priority is the scheduling class of the request, either "interactive"
+	// or "batch". It defaults to "batch".
+	Priority string `json:"priority,omitempty"`
+
+	// Options lists model-specific options.
+	Options map[string]interface{} `json:"options"`
+}
+
+// RerankResponse is the response from [Client.Rerank].
+type RerankResponse struct {
+	Model string `json:"model"`
+
+	// Results are ordered from the most to the least relevant document.
+	Results []RerankResult `json:"results"`
+}
+
+// RerankResult is the relevance of one document in a [RerankRequest].
+type RerankResult struct {
+	// Index is the position of the document in the request.
+	Index int `json:"index"`
+
+	// RelevanceScore is the model's score for the document. Higher is more
+	// relevant. Scores are only comparable between documents ranked by the
+	// same model.
+	RelevanceScore float32 `json:"relevance_score"`
+}
+
 // CreateRequest is the request passed to [Client.Create].
 type CreateRequest struct {
 	Model     string `json:"model"`
@@ -329,6 +485,7 @@ type ShowResponse struct {
 	Parameters    string         `json:"parameters,omitempty"`
 	Template      string         `json:"template,omitempty"`
 	System        string         `json:"system,omitempty"`
+	Grammar       string         `json:"grammar,omitempty"`
 	Details       ModelDetails   `json:"details,omitempty"`
 	Messages      []Message      `json:"messages,omitempty"`
 	ModelInfo     map[string]any `json:"model_info,omitempty"`
@@ -404,6 +561,14 @@ type ProcessModelResponse struct {
 	Details   ModelDetails `json:"details,omitempty"`
 	ExpiresAt time.Time    `json:"expires_at"`
 	SizeVRAM  int64        `json:"size_vram"`
+
+	// Restarts is the number of times the model's runner has been restarted
+	// after crashing or hanging.
+	Restarts int `json:"restarts,omitempty"`
+
+	// Pinned is true if the model was preloaded at startup and is never
+	// unloaded.
+	Pinned bool `json:"pinned,omitempty"`
 }
 
 type RetrieveModelResponse struct {
@@ -417,6 +582,126 @@ type TokenResponse struct {
 	Token string `json:"token"`
 }
 
+// ConfigResponse is the response from the admin config endpoint, listing the
+// settings that may be changed while the server is running.
+type ConfigResponse struct {
+	Settings map[string]ConfigSetting `json:"settings"`
+}
+
+// ConfigSetting is a single setting in [ConfigResponse].
+type ConfigSetting struct {
+	Value       string `json:"value"`
+	Description string `json:"description"`
+}
+
+// ConfigRequest changes settings by environment variable name, such as
+// OLLAMA_NUM_PARALLEL. Values use the same syntax as the environment.
+type ConfigRequest struct {
+	Settings map[string]string `json:"settings"`
+}
+
+// UnloadRequest is the request passed to the admin unload endpoint. Either
+// Model or All must be set.
+type UnloadRequest struct {
+	Model string `json:"model,omitempty"`
+	All   bool   `json:"all,omitempty"`
+}
+
+// UnloadResponse lists the models that were unloaded.
+type UnloadResponse struct {
+	Models []string `json:"models"`
+}
+
+// BatchRequest is a line of the JSONL file sent to the batch endpoint.
+type BatchRequest struct {
+	// ID identifies the request in the results. It defaults to the line
+	// number, counting from 1.
+	ID string `json:"id,omitempty"`
+
+	// Endpoint is the API the request is for, one of /api/generate,
+	// /api/chat or /api/embed.
+	Endpoint string `json:"endpoint"`
+
+	// Body is the request, as it would be sent to Endpoint.
+	Body json.RawMessage `json:"body"`
+}
+
+// BatchResult is a line of a batch job's results. Results are written as
+// requests finish, so they may be out of order.
+type BatchResult struct {
+	ID string `json:"id"`
+
+	// Line is the line of the request in the batch file, counting from 1.
+	Line int `json:"line"`
+
+	// Response is the endpoint's response, if the request succeeded.
+	Response json.RawMessage `json:"response,omitempty"`
+
+	// Error is the reason the request failed.
+	Error string `json:"error,omitempty"`
+}
+
+// BatchJob describes a batch job and its progress.
+type BatchJob struct {
+	ID string `json:"id"`
+
+	// Status is one of "queued", "running", "completed", "canceled" or
+	// "failed".
+	Status string `json:"status"`
+
+	// Total is the number of requests in the job. Completed and Failed count
+	// the requests that have finished.
+	Total     int `json:"total"`
+	Completed int `json:"completed"`
+	Failed    int `json:"failed"`
+
+	CreatedAt  time.Time  `json:"created_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+
+	// Error is the reason the job failed.
+	Error string `json:"error,omitempty"`
+}
+
+// ListBatchResponse is the response listing batch jobs.
+type ListBatchResponse struct {
+	Jobs []BatchJob `json:"jobs"`
+}
+
+// Session is a conversation stored on the server.
+type Session struct {
+	ID string `json:"id"`
+
+	// Model is the model that last replied in the session, and Digest the
+	// digest of its manifest at the time.
+	Model  string `json:"model"`
+	Digest string `json:"digest"`
+
+	// Messages is the session's history. It's left out when listing
+	// sessions.
+	Messages []Message `json:"messages,omitempty"`
+
+	// Owner is the name of the API key that created the session, if the
+	// server requires API keys. Other keys can't see or use the session.
+	Owner string `json:"owner,omitempty"`
+
+	CreatedAt  time.Time `json:"created_at"`
+	ModifiedAt time.Time `json:"modified_at"`
+
+	// ExpiresAt is when the session will be deleted if it isn't used again.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// ListSessionsResponse is the response listing sessions.
+type ListSessionsResponse struct {
+	Sessions []Session `json:"sessions"`
+}
+
+// ForkSessionRequest is the request passed to [Client.ForkSession].
+type ForkSessionRequest struct {
+	// ID is the ID of the new session. A random ID is used if it's empty.
+	ID string `json:"id,omitempty"`
+}
+
 // GenerateResponse is the response passed into [GenerateResponseFunc].
 type GenerateResponse struct {
 	// Model is the model name that generated the response.
@@ -438,6 +723,9 @@ type GenerateResponse struct {
 	// can be sent in the next request to keep a conversational memory.
 	Context []int `json:"context,omitempty"`
 
+	// Logprobs are the tokens of Response, if requested.
+	Logprobs []Logprob `json:"logprobs,omitempty"`
+
 	Metrics
 }
 
@@ -464,6 +752,10 @@ func (m *Metrics) Summary() {
 		fmt.Fprintf(os.Stderr, "prompt eval count:    %d token(s)\n", m.PromptEvalCount)
 	}
 
+	if m.PromptCacheCount > 0 {
+		fmt.Fprintf(os.Stderr, "prompt cache count:   %d token(s)\n", m.PromptCacheCount)
+	}
+
 	if m.PromptEvalDuration > 0 {
 		fmt.Fprintf(os.Stderr, "prompt eval duration: %s\n", m.PromptEvalDuration)
 		fmt.Fprintf(os.Stderr, "prompt eval rate:     %.2f tokens/s\n", float64(m.PromptEvalCount)/m.PromptEvalDuration.Seconds())
@@ -477,6 +769,10 @@ func (m *Metrics) Summary() {
 		fmt.Fprintf(os.Stderr, "eval duration:        %s\n", m.EvalDuration)
 		fmt.Fprintf(os.Stderr, "eval rate:            %.2f tokens/s\n", float64(m.EvalCount)/m.EvalDuration.Seconds())
 	}
+
+	if m.DraftAcceptanceRate > 0 {
+		fmt.Fprintf(os.Stderr, "draft acceptance:     %.2f%%\n", 100*m.DraftAcceptanceRate)
+	}
 }
 
 func (opts *Options) FromMap(m map[string]interface{}) error {
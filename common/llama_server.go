@@ -1,7 +0,0 @@
-package common
-
-type LlamaServer struct {
-	Address string
-	Port    int
-	// Add any additional fields as necessary
-}
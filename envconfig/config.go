@@ -29,6 +29,8 @@ var ErrInvalidHostPort = errors.New("invalid port specified in OLLAMA_HOST")
 var (
 	// Set via OLLAMA_ORIGINS in the environment
 	AllowOrigins []string
+	// Set via OLLAMA_API_KEYS in the environment
+	APIKeys string
 	// Set via OLLAMA_DEBUG in the environment
 	Debug bool
 	// Experimental flash attention
@@ -44,6 +46,8 @@ var (
 	MaxRunners int
 	// Set via OLLAMA_MAX_QUEUE in the environment
 	MaxQueuedRequests int
+	// Set via OLLAMA_METRICS in the environment
+	Metrics bool
 	// Set via OLLAMA_MODELS in the environment
 	ModelsDir string
 	// Set via OLLAMA_NOHISTORY in the environment
@@ -52,10 +56,18 @@ var (
 	NoPrune bool
 	// Set via OLLAMA_NUM_PARALLEL in the environment
 	NumParallel int
+	// Set via OLLAMA_OTLP_ENDPOINT in the environment
+	OTLPEndpoint string
+	// Set via OLLAMA_PRELOAD in the environment
+	Preload string
 	// Set via OLLAMA_RUNNERS_DIR in the environment
 	RunnersDir string
 	// Set via OLLAMA_SCHED_SPREAD in the environment
 	SchedSpread bool
+	// Set via OLLAMA_SESSION_TTL in the environment
+	SessionTTL time.Duration
+	// Set via OLLAMA_SHUTDOWN_TIMEOUT in the environment
+	ShutdownTimeout time.Duration
 	// Set via OLLAMA_TMPDIR in the environment
 	TmpDir string
 	// Set via OLLAMA_INTEL_GPU in the environment
@@ -81,6 +93,7 @@ type EnvVar struct {
 
 func AsMap() map[string]EnvVar {
 	ret := map[string]EnvVar{
+		"OLLAMA_API_KEYS":          {"OLLAMA_API_KEYS", APIKeys, "Path to a file of API keys required to access the server"},
 		"OLLAMA_DEBUG":             {"OLLAMA_DEBUG", Debug, "Show additional debug information (e.g. OLLAMA_DEBUG=1)"},
 		"OLLAMA_FLASH_ATTENTION":   {"OLLAMA_FLASH_ATTENTION", FlashAttention, "Enabled flash attention"},
 		"OLLAMA_HOST":              {"OLLAMA_HOST", Host, "IP Address for the ollama server (default 127.0.0.1:11434)"},
@@ -88,13 +101,18 @@ func AsMap() map[string]EnvVar {
 		"OLLAMA_LLM_LIBRARY":       {"OLLAMA_LLM_LIBRARY", LLMLibrary, "Set LLM library to bypass autodetection"},
 		"OLLAMA_MAX_LOADED_MODELS": {"OLLAMA_MAX_LOADED_MODELS", MaxRunners, "Maximum number of loaded models per GPU"},
 		"OLLAMA_MAX_QUEUE":         {"OLLAMA_MAX_QUEUE", MaxQueuedRequests, "Maximum number of queued requests"},
+		"OLLAMA_METRICS":           {"OLLAMA_METRICS", Metrics, "Serve Prometheus metrics on /metrics"},
 		"OLLAMA_MODELS":            {"OLLAMA_MODELS", ModelsDir, "The path to the models directory"},
 		"OLLAMA_NOHISTORY":         {"OLLAMA_NOHISTORY", NoHistory, "Do not preserve readline history"},
 		"OLLAMA_NOPRUNE":           {"OLLAMA_NOPRUNE", NoPrune, "Do not prune model blobs on startup"},
 		"OLLAMA_NUM_PARALLEL":      {"OLLAMA_NUM_PARALLEL", NumParallel, "Maximum number of parallel requests"},
 		"OLLAMA_ORIGINS":           {"OLLAMA_ORIGINS", AllowOrigins, "A comma separated list of allowed origins"},
+		"OLLAMA_OTLP_ENDPOINT":     {"OLLAMA_OTLP_ENDPOINT", OTLPEndpoint, "OTLP/HTTP endpoint to export traces to (e.g. http://localhost:4318)"},
+		"OLLAMA_PRELOAD":           {"OLLAMA_PRELOAD", Preload, "Models to load at startup and never unload, as a comma separated list or a JSON file"},
 		"OLLAMA_RUNNERS_DIR":       {"OLLAMA_RUNNERS_DIR", RunnersDir, "Location for runners"},
 		"OLLAMA_SCHED_SPREAD":      {"OLLAMA_SCHED_SPREAD", SchedSpread, "Always schedule model across all GPUs"},
+		"OLLAMA_SESSION_TTL":       {"OLLAMA_SESSION_TTL", SessionTTL, "How long chat sessions are kept after their last use (default \"24h\")"},
+		"OLLAMA_SHUTDOWN_TIMEOUT":  {"OLLAMA_SHUTDOWN_TIMEOUT", ShutdownTimeout, "How long to let requests finish when shutting down (default \"20s\")"},
 		"OLLAMA_TMPDIR":            {"OLLAMA_TMPDIR", TmpDir, "Location for temporary files"},
 	}
 	if runtime.GOOS != "darwin" {
@@ -135,6 +153,8 @@ func init() {
 
 	MaxQueuedRequests = 512
 	KeepAlive = 5 * time.Minute
+	ShutdownTimeout = 20 * time.Second
+	SessionTTL = 24 * time.Hour
 
 	LoadConfig()
 }
@@ -197,6 +217,12 @@ func LoadConfig() {
 
 	TmpDir = clean("OLLAMA_TMPDIR")
 
+	OTLPEndpoint = clean("OLLAMA_OTLP_ENDPOINT")
+
+	APIKeys = clean("OLLAMA_API_KEYS")
+
+	Preload = clean("OLLAMA_PRELOAD")
+
 	LLMLibrary = clean("OLLAMA_LLM_LIBRARY")
 
 	if onp := clean("OLLAMA_NUM_PARALLEL"); onp != "" {
@@ -213,6 +239,15 @@ func LoadConfig() {
 		NoHistory = true
 	}
 
+	if m := clean("OLLAMA_METRICS"); m != "" {
+		d, err := strconv.ParseBool(m)
+		if err == nil {
+			Metrics = d
+		} else {
+			Metrics = true
+		}
+	}
+
 	if spread := clean("OLLAMA_SCHED_SPREAD"); spread != "" {
 		s, err := strconv.ParseBool(spread)
 		if err == nil {
@@ -270,6 +305,24 @@ func LoadConfig() {
 		loadKeepAlive(ka)
 	}
 
+	if ttl := clean("OLLAMA_SESSION_TTL"); ttl != "" {
+		d, err := parseDuration(ttl)
+		if err != nil {
+			log.Printf("invalid setting, ignoring OLLAMA_SESSION_TTL=%s: %v", ttl, err)
+		} else {
+			SessionTTL = d
+		}
+	}
+
+	if st := clean("OLLAMA_SHUTDOWN_TIMEOUT"); st != "" {
+		d, err := parseDuration(st)
+		if err != nil {
+			log.Printf("invalid setting, ignoring OLLAMA_SHUTDOWN_TIMEOUT=%s: %v", st, err)
+		} else {
+			ShutdownTimeout = d
+		}
+	}
+
 	var err error
 	ModelsDir, err = getModelsDir()
 	if err != nil {
@@ -350,22 +403,26 @@ func getOllamaHost() (*OllamaHost, error) {
 }
 
 func loadKeepAlive(ka string) {
-	v, err := strconv.Atoi(ka)
+	if d, err := parseDuration(ka); err == nil {
+		KeepAlive = d
+	}
+}
+
+// parseDuration reads a duration such as "10m", or a number of seconds. A
+// negative value means forever.
+func parseDuration(s string) (time.Duration, error) {
+	d, err := time.ParseDuration(s)
 	if err != nil {
-		d, err := time.ParseDuration(ka)
-		if err == nil {
-			if d < 0 {
-				KeepAlive = time.Duration(math.MaxInt64)
-			} else {
-				KeepAlive = d
-			}
-		}
-	} else {
-		d := time.Duration(v) * time.Second
-		if d < 0 {
-			KeepAlive = time.Duration(math.MaxInt64)
-		} else {
-			KeepAlive = d
+		v, aerr := strconv.Atoi(s)
+		if aerr != nil {
+			return 0, err
 		}
+		d = time.Duration(v) * time.Second
 	}
+
+	if d < 0 {
+		return time.Duration(math.MaxInt64), nil
+	}
+
+	return d, nil
 }
@@ -86,3 +86,23 @@ func TestClientFromEnvironment(t *testing.T) {
 		})
 	}
 }
+
+func TestUpdate(t *testing.T) {
+	keepAlive, numParallel := KeepAlive, NumParallel
+	t.Cleanup(func() { KeepAlive, NumParallel = keepAlive, numParallel })
+
+	require.NoError(t, Update(map[string]string{"OLLAMA_KEEP_ALIVE": "10m", "OLLAMA_NUM_PARALLEL": "2"}))
+	require.Equal(t, 10*time.Minute, KeepAlive)
+	require.Equal(t, 2, NumParallel)
+
+	require.NoError(t, Update(map[string]string{"OLLAMA_KEEP_ALIVE": "-1"}))
+	require.Equal(t, time.Duration(math.MaxInt64), KeepAlive)
+
+	// nothing changes if any setting is rejected
+	require.ErrorContains(t, Update(map[string]string{"OLLAMA_NUM_PARALLEL": "3", "OLLAMA_MAX_LOADED_MODELS": "many"}), "invalid setting")
+	require.Equal(t, 2, NumParallel)
+
+	require.ErrorContains(t, Update(map[string]string{"OLLAMA_NUM_PARALLEL": "-1"}), "negative")
+	require.ErrorContains(t, Update(map[string]string{"OLLAMA_HOST": "0.0.0.0"}), "cannot be changed")
+	require.ErrorContains(t, Update(map[string]string{"OLLAMA_NOPE": "1"}), "unknown setting")
+}
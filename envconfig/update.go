@@ -0,0 +1,72 @@
+package envconfig
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// RuntimeSettings are the settings that may be changed while the server is
+// running. They are read by the scheduler when it loads a model, so changes
+// apply to models loaded afterwards.
+var RuntimeSettings = []string{
+	"OLLAMA_KEEP_ALIVE",
+	"OLLAMA_MAX_LOADED_MODELS",
+	"OLLAMA_NUM_PARALLEL",
+	"OLLAMA_SCHED_SPREAD",
+}
+
+// Update changes runtime settings, using the same syntax as the environment.
+// Nothing is changed if any key is not a runtime setting or any value is
+// invalid.
+func Update(values map[string]string) error {
+	var (
+		keepAlive   = KeepAlive
+		maxRunners  = MaxRunners
+		numParallel = NumParallel
+		schedSpread = SchedSpread
+	)
+
+	for k, v := range values {
+		var err error
+		switch k {
+		case "OLLAMA_KEEP_ALIVE":
+			keepAlive, err = parseDuration(v)
+		case "OLLAMA_MAX_LOADED_MODELS":
+			maxRunners, err = parseCount(v)
+		case "OLLAMA_NUM_PARALLEL":
+			numParallel, err = parseCount(v)
+		case "OLLAMA_SCHED_SPREAD":
+			schedSpread, err = strconv.ParseBool(v)
+		default:
+			if _, ok := AsMap()[k]; ok {
+				return fmt.Errorf("%s cannot be changed while the server is running", k)
+			}
+			return fmt.Errorf("unknown setting %s", k)
+		}
+
+		if err != nil {
+			return fmt.Errorf("invalid setting %s=%s: %w", k, v, err)
+		}
+	}
+
+	KeepAlive = keepAlive
+	MaxRunners = maxRunners
+	NumParallel = numParallel
+	SchedSpread = schedSpread
+	return nil
+}
+
+// parseCount reads a non-negative integer, where zero selects a default
+func parseCount(s string) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, err
+	}
+
+	if n < 0 {
+		return 0, errors.New("must not be negative")
+	}
+
+	return n, nil
+}
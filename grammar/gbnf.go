@@ -0,0 +1,438 @@
+package grammar
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// SyntaxError is a problem with a grammar at a line and column, both
+// counting from 1.
+type SyntaxError struct {
+	Line   int
+	Column int
+	Msg    string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("line %d, column %d: %s", e.Line, e.Column, e.Msg)
+}
+
+type position struct {
+	line, column int
+}
+
+// term is an item in a sequence. Only what's needed to check the grammar
+// is kept: the rules it refers to and whether it can match nothing.
+type term struct {
+	pos      position
+	ref      string
+	group    [][]term
+	nullable bool
+}
+
+type rule struct {
+	pos  position
+	alts [][]term
+}
+
+type gbnfParser struct {
+	src  string
+	off  int
+	line int
+	col  int
+}
+
+// Validate checks a GBNF grammar is one the runner accepts: that it parses,
+// has a root rule, defines every rule it refers to, and has no left
+// recursion, which the runner can't match. Problems are reported as a
+// [SyntaxError].
+func Validate(src string) error {
+	p := gbnfParser{src: src, line: 1, col: 1}
+	rules, order, err := p.parse()
+	if err != nil {
+		return err
+	}
+
+	if _, ok := rules["root"]; !ok {
+		return &SyntaxError{Line: 1, Column: 1, Msg: `grammar has no "root" rule`}
+	}
+
+	for _, name := range order {
+		if err := checkRefs(rules, rules[name].alts); err != nil {
+			return err
+		}
+	}
+
+	return checkLeftRecursion(rules, order)
+}
+
+func (p *gbnfParser) errorf(pos position, format string, args ...any) error {
+	return &SyntaxError{Line: pos.line, Column: pos.column, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *gbnfParser) pos() position {
+	return position{p.line, p.col}
+}
+
+func (p *gbnfParser) peek() rune {
+	if p.off >= len(p.src) {
+		return 0
+	}
+
+	r, _ := utf8.DecodeRuneInString(p.src[p.off:])
+	return r
+}
+
+func (p *gbnfParser) next() rune {
+	r, n := utf8.DecodeRuneInString(p.src[p.off:])
+	p.off += n
+	if r == '\n' {
+		p.line++
+		p.col = 1
+	} else {
+		p.col++
+	}
+
+	return r
+}
+
+func (p *gbnfParser) eof() bool {
+	return p.off >= len(p.src)
+}
+
+// space skips spaces, tabs and comments, and newlines if newlines is set
+func (p *gbnfParser) space(newlines bool) {
+	for !p.eof() {
+		switch r := p.peek(); {
+		case r == ' ' || r == '\t':
+			p.next()
+		case r == '#':
+			for !p.eof() && p.peek() != '\r' && p.peek() != '\n' {
+				p.next()
+			}
+		case newlines && (r == '\r' || r == '\n'):
+			p.next()
+		default:
+			return
+		}
+	}
+}
+
+func isNameChar(r rune) bool {
+	return r == '-' || ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') || ('0' <= r && r <= '9')
+}
+
+func (p *gbnfParser) name() string {
+	start := p.off
+	for !p.eof() && isNameChar(p.peek()) {
+		p.next()
+	}
+
+	return p.src[start:p.off]
+}
+
+func (p *gbnfParser) parse() (map[string]*rule, []string, error) {
+	rules := make(map[string]*rule)
+	var order []string
+
+	p.space(true)
+	for !p.eof() {
+		pos := p.pos()
+		name := p.name()
+		if name == "" {
+			return nil, nil, p.errorf(pos, "expected a rule name, found %q", p.peek())
+		}
+
+		if r, ok := rules[name]; ok {
+			return nil, nil, p.errorf(pos, "rule %q is already defined at line %d", name, r.pos.line)
+		}
+
+		p.space(false)
+		if !strings.HasPrefix(p.src[p.off:], "::=") {
+			return nil, nil, p.errorf(p.pos(), `expected "::=" after rule name %q`, name)
+		}
+
+		for range 3 {
+			p.next()
+		}
+
+		p.space(true)
+		alts, err := p.alternates(false)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		switch p.peek() {
+		case '\r', '\n', 0:
+			if !p.eof() {
+				p.next()
+			}
+		case ')':
+			return nil, nil, p.errorf(p.pos(), `unexpected ")"`)
+		default:
+			return nil, nil, p.errorf(p.pos(), "unexpected %q", p.peek())
+		}
+
+		rules[name] = &rule{pos: pos, alts: alts}
+		order = append(order, name)
+		p.space(true)
+	}
+
+	return rules, order, nil
+}
+
+func (p *gbnfParser) alternates(nested bool) ([][]term, error) {
+	var alts [][]term
+	for {
+		seq, err := p.sequence(nested)
+		if err != nil {
+			return nil, err
+		}
+
+		alts = append(alts, seq)
+		if p.peek() != '|' {
+			return alts, nil
+		}
+
+		p.next()
+		p.space(true)
+	}
+}
+
+func (p *gbnfParser) sequence(nested bool) ([]term, error) {
+	var seq []term
+	for !p.eof() {
+		pos := p.pos()
+		switch r := p.peek(); {
+		case r == '"':
+			p.next()
+			var empty = true
+			for p.peek() != '"' {
+				if p.eof() || p.peek() == '\n' {
+					return nil, p.errorf(pos, "unterminated string literal")
+				}
+
+				if err := p.char(); err != nil {
+					return nil, err
+				}
+				empty = false
+			}
+
+			p.next()
+			seq = append(seq, term{pos: pos, nullable: empty})
+		case r == '[':
+			p.next()
+			if p.peek() == '^' {
+				p.next()
+			}
+
+			for p.peek() != ']' {
+				if p.eof() || p.peek() == '\n' {
+					return nil, p.errorf(pos, "unterminated character class")
+				}
+
+				if err := p.char(); err != nil {
+					return nil, err
+				}
+
+				if p.peek() == '-' && !strings.HasPrefix(p.src[p.off:], "-]") {
+					p.next()
+					if p.eof() {
+						return nil, p.errorf(pos, "unterminated character class")
+					}
+
+					if err := p.char(); err != nil {
+						return nil, err
+					}
+				}
+			}
+
+			p.next()
+			seq = append(seq, term{pos: pos})
+		case isNameChar(r):
+			seq = append(seq, term{pos: pos, ref: p.name()})
+		case r == '(':
+			p.next()
+			p.space(true)
+			group, err := p.alternates(true)
+			if err != nil {
+				return nil, err
+			}
+
+			if p.peek() != ')' {
+				return nil, p.errorf(pos, `unclosed "("`)
+			}
+
+			p.next()
+			seq = append(seq, term{pos: pos, group: group})
+		case r == '*' || r == '+' || r == '?':
+			if len(seq) == 0 {
+				return nil, p.errorf(pos, "%q must follow an item", r)
+			}
+
+			p.next()
+			if r != '+' {
+				seq[len(seq)-1].nullable = true
+			}
+		case r == '{':
+			return nil, p.errorf(pos, "repetition counts aren't supported, repeat the item instead")
+		default:
+			return seq, nil
+		}
+
+		p.space(nested)
+	}
+
+	return seq, nil
+}
+
+// char reads a character of a literal or character class, which may be
+// escaped
+func (p *gbnfParser) char() error {
+	pos := p.pos()
+	if p.next() != '\\' {
+		return nil
+	}
+
+	r := p.next()
+	switch r {
+	case 'x', 'u', 'U':
+		n := map[rune]int{'x': 2, 'u': 4, 'U': 8}[r]
+		for range n {
+			if !strings.ContainsRune("0123456789abcdefABCDEF", p.peek()) {
+				return p.errorf(pos, `"\%c" must be followed by %d hex digits`, r, n)
+			}
+
+			p.next()
+		}
+	case 't', 'r', 'n', '\\', '"', '[', ']':
+	default:
+		return p.errorf(pos, `unknown escape "\%c"`, r)
+	}
+
+	return nil
+}
+
+func checkRefs(rules map[string]*rule, alts [][]term) error {
+	for _, seq := range alts {
+		for _, t := range seq {
+			if t.ref != "" {
+				if _, ok := rules[t.ref]; !ok {
+					return &SyntaxError{Line: t.pos.line, Column: t.pos.column, Msg: fmt.Sprintf("undefined rule %q", t.ref)}
+				}
+			}
+
+			if err := checkRefs(rules, t.group); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// nullable reports whether alts can match an empty string, given which rules
+// are known to
+func nullable(alts [][]term, rules map[string]bool) bool {
+	for _, seq := range alts {
+		if seqNullable(seq, rules) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func seqNullable(seq []term, rules map[string]bool) bool {
+	for _, t := range seq {
+		if !termNullable(t, rules) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func termNullable(t term, rules map[string]bool) bool {
+	switch {
+	case t.nullable:
+		return true
+	case t.ref != "":
+		return rules[t.ref]
+	case t.group != nil:
+		return nullable(t.group, rules)
+	default:
+		return false
+	}
+}
+
+// leftRefs adds the rules alts can start with to refs and reports whether
+// alts can match an empty string. Each group's nullability is worked out as
+// it's visited, so nested groups are only walked once.
+func leftRefs(alts [][]term, nullables map[string]bool, refs map[string]position) bool {
+	var empty bool
+	for _, seq := range alts {
+		seqEmpty := true
+		for _, t := range seq {
+			if t.ref != "" {
+				if _, ok := refs[t.ref]; !ok {
+					refs[t.ref] = t.pos
+				}
+			}
+
+			groupEmpty := t.group != nil && leftRefs(t.group, nullables, refs)
+			if !t.nullable && !nullables[t.ref] && !groupEmpty {
+				seqEmpty = false
+				break
+			}
+		}
+
+		empty = empty || seqEmpty
+	}
+
+	return empty
+}
+
+func checkLeftRecursion(rules map[string]*rule, order []string) error {
+	nullables := make(map[string]bool)
+	for changed := true; changed; {
+		changed = false
+		for name, r := range rules {
+			if !nullables[name] && nullable(r.alts, nullables) {
+				nullables[name] = true
+				changed = true
+			}
+		}
+	}
+
+	edges := make(map[string]map[string]position)
+	for name, r := range rules {
+		edges[name] = make(map[string]position)
+		leftRefs(r.alts, nullables, edges[name])
+	}
+
+	// a rule is left recursive if it can reach itself without consuming
+	// any input
+	for _, name := range order {
+		seen := map[string]bool{}
+		stack := []string{name}
+		for len(stack) > 0 {
+			n := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			for ref := range edges[n] {
+				if ref == name {
+					pos := rules[name].pos
+					return &SyntaxError{Line: pos.line, Column: pos.column, Msg: fmt.Sprintf("rule %q is left recursive", name)}
+				}
+
+				if !seen[ref] {
+					seen[ref] = true
+					stack = append(stack, ref)
+				}
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,98 @@
+package grammar
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	cases := []string{
+		`root ::= "yes" | "no"`,
+		"# a comment\nroot ::= item (\",\" ws item)* # trailing\n\nitem ::= [a-z]+\nws ::= [ \\t\\n]*\n",
+		"root ::= (\n  \"a\" |\n  \"b\"\n)\r\n",
+		"root ::= \"a\" |\n  \"b\" |\n  \"\"",
+		`root ::= [^"\\\x7F\x00-\x1F] "é" "\U0001F600" [\[\]-]`,
+		`root ::= "(" root? ")" | "x"`,
+		"root ::= ws \"x\"\nws ::= \" \"?",
+	}
+
+	for _, tt := range cases {
+		t.Run(tt, func(t *testing.T) {
+			if err := Validate(tt); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+
+	// grammars compiled from schemas must be valid too
+	for _, schema := range []string{
+		`{"type": "object", "properties": {"name": {"type": "string"}, "tags": {"type": "array", "items": {"type": "string"}}}, "additionalProperties": {"type": "number"}}`,
+		`{"$defs": {"node": {"type": "object", "properties": {"children": {"type": "array", "items": {"$ref": "#/$defs/node"}}}}}, "$ref": "#/$defs/node"}`,
+		`{"type": "string", "format": "date-time"}`,
+	} {
+		g, err := FromSchema([]byte(schema))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := Validate(g); err != nil {
+			t.Errorf("%s: %v\n%s", schema, err, g)
+		}
+	}
+}
+
+func TestValidateNested(t *testing.T) {
+	// nested groups are checked in linear time, this took minutes when each
+	// group was walked again by every group around it
+	n := 100000
+	g := "root ::= " + strings.Repeat("(", n) + `"a"` + strings.Repeat(")", n)
+	if err := Validate(g); err != nil {
+		t.Fatal(err)
+	}
+
+	g = "root ::= " + strings.Repeat(`( "" `, n) + "root" + strings.Repeat(")", n)
+	if err := Validate(g); err == nil || err.Error() != `line 1, column 1: rule "root" is left recursive` {
+		t.Fatalf("expected left recursion error, got %v", err)
+	}
+}
+
+func TestValidateErrors(t *testing.T) {
+	cases := []struct {
+		grammar string
+		err     string
+	}{
+		{``, `line 1, column 1: grammar has no "root" rule`},
+		{`answer ::= "yes"`, `line 1, column 1: grammar has no "root" rule`},
+		{`root = "yes"`, `line 1, column 6: expected "::=" after rule name "root"`},
+		{`::= "yes"`, `line 1, column 1: expected a rule name, found ':'`},
+		{"root ::= \"yes\"\n  | \"no\"", `line 2, column 3: expected a rule name, found '|'`},
+		{"root ::= answer\nanswer ::= \"yes", `line 2, column 12: unterminated string literal`},
+		{`root ::= [a-z`, `line 1, column 10: unterminated character class`},
+		{`root ::= ("a" | "b"`, `line 1, column 10: unclosed "("`},
+		{`root ::= "a")`, `line 1, column 13: unexpected ")"`},
+		{`root ::= "a" @`, `line 1, column 14: unexpected '@'`},
+		{`root ::= * "a"`, `line 1, column 10: '*' must follow an item`},
+		{`root ::= "a"{2}`, `line 1, column 13: repetition counts aren't supported, repeat the item instead`},
+		{`root ::= "\q"`, `line 1, column 11: unknown escape "\q"`},
+		{`root ::= "\x4"`, `line 1, column 11: "\x" must be followed by 2 hex digits`},
+		{"root ::= \"a\"\nroot ::= \"b\"", `line 2, column 1: rule "root" is already defined at line 1`},
+		{"root ::= answer\n\nanswer ::= yes | \"no\"", `line 3, column 12: undefined rule "yes"`},
+		{`root ::= root "a" | "b"`, `line 1, column 1: rule "root" is left recursive`},
+		{"root ::= ws list\nlist ::= ws? root \",\" | \"x\"\nws ::= \" \"*", `line 1, column 1: rule "root" is left recursive`},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.grammar, func(t *testing.T) {
+			err := Validate(tt.grammar)
+			var serr *SyntaxError
+			if !errors.As(err, &serr) {
+				t.Fatalf("expected a syntax error, got %v", err)
+			}
+
+			if err.Error() != tt.err {
+				t.Errorf("expected %q, got %q", tt.err, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,643 @@
+// Package grammar builds GBNF grammars, which llama.cpp uses to constrain
+// the tokens a model can generate.
+package grammar
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// ErrUnsupported is returned for JSON schemas using keywords that can't be
+// expressed as a grammar.
+var ErrUnsupported = errors.New("unsupported schema")
+
+// annotations are schema keywords that don't constrain values
+var annotations = []string{
+	"$schema", "$id", "$comment", "$defs", "definitions",
+	"title", "description", "default", "examples",
+	"deprecated", "readOnly", "writeOnly",
+}
+
+// keywords are the schema keywords that are compiled to rules, by the type
+// they apply to. Keywords under "" apply to any type.
+var keywords = map[string][]string{
+	"":       {"type", "enum", "const", "anyOf", "oneOf", "allOf", "$ref"},
+	"string": {"minLength", "maxLength", "format"},
+	"array":  {"items", "minItems", "maxItems", "uniqueItems"},
+	"object": {"properties", "required", "additionalProperties"},
+}
+
+// primitives are the rules shared by every grammar, added as they're used
+var primitives = map[string]struct {
+	rule string
+	deps []string
+}{
+	"ws":      {`([ \t\n] ws)?`, nil},
+	"value":   {`object | array | string | number | ("true" | "false" | "null")`, []string{"object", "array", "string", "number"}},
+	"object":  {`"{" ws ( string ws ":" ws value ws ( "," ws string ws ":" ws value ws )* )? "}"`, []string{"ws", "string", "value"}},
+	"array":   {`"[" ws ( value ws ( "," ws value ws )* )? "]"`, []string{"ws", "value"}},
+	"string":  {`"\"" char* "\""`, []string{"char"}},
+	"char":    {`[^"\\\x7F\x00-\x1F] | "\\" (["\\/bfnrt] | "u" [0-9a-fA-F] [0-9a-fA-F] [0-9a-fA-F] [0-9a-fA-F])`, nil},
+	"number":  {`integer ("." [0-9]+)? ([eE] [-+]? [0-9]+)?`, []string{"integer"}},
+	"integer": {`"-"? ([0-9] | [1-9] [0-9]*)`, nil},
+	"boolean": {`"true" | "false"`, nil},
+	"null":    {`"null"`, nil},
+
+	"date":      {`[0-9] [0-9] [0-9] [0-9] "-" ( "0" [1-9] | "1" [0-2] ) "-" ( "0" [1-9] | [1-2] [0-9] | "3" [0-1] )`, nil},
+	"time":      {`( [01] [0-9] | "2" [0-3] ) ":" [0-5] [0-9] ":" [0-5] [0-9] ( "." [0-9]+ )? ( "Z" | [+-] ( [01] [0-9] | "2" [0-3] ) ":" [0-5] [0-9] )`, nil},
+	"date-time": {`date "T" time`, []string{"date", "time"}},
+	"uuid":      {`hex4 hex4 "-" hex4 "-" hex4 "-" hex4 "-" hex4 hex4 hex4`, []string{"hex4"}},
+	"hex4":      {`[0-9a-fA-F] [0-9a-fA-F] [0-9a-fA-F] [0-9a-fA-F]`, nil},
+}
+
+// stringFormats are the string formats that are enforced. Other formats are
+// annotations.
+var stringFormats = []string{"date", "time", "date-time", "uuid"}
+
+type compiler struct {
+	root  map[string]json.RawMessage
+	names []string
+	rules map[string]string
+	refs  map[string]string
+}
+
+// FromSchema compiles a JSON schema to a grammar for the JSON values that
+// validate against it. Properties are generated in the order the schema
+// lists them, required properties first. oneOf is treated as anyOf.
+//
+// Keywords that can't be compiled, such as pattern or minimum, and item or
+// length counts above 256 return an error wrapping [ErrUnsupported].
+func FromSchema(schema []byte) (string, error) {
+	c := compiler{rules: make(map[string]string), refs: make(map[string]string)}
+	if err := json.Unmarshal(schema, &c.root); err != nil {
+		return "", fmt.Errorf("invalid schema: %w", err)
+	}
+
+	expr, err := c.visit(schema, "#", "root")
+	if err != nil {
+		return "", err
+	}
+
+	// the root rule is the first in the grammar
+	if i := slices.Index(c.names, "root"); i >= 0 {
+		c.names = slices.Delete(c.names, i, i+1)
+	} else {
+		c.rules["root"] = expr
+	}
+
+	var sb strings.Builder
+	for _, name := range append([]string{"root"}, c.names...) {
+		fmt.Fprintf(&sb, "%s ::= %s\n", name, c.rules[name])
+	}
+
+	return sb.String(), nil
+}
+
+func unsupported(path, format string, args ...any) error {
+	return fmt.Errorf("%w: %s at %s", ErrUnsupported, fmt.Sprintf(format, args...), path)
+}
+
+var invalidName = regexp.MustCompile(`[^a-zA-Z0-9-]+`)
+
+// name returns an unused rule name derived from hint
+func (c *compiler) name(hint string) string {
+	name := strings.Trim(invalidName.ReplaceAllString(hint, "-"), "-")
+	if name == "" {
+		name = "rule"
+	}
+
+	unique := name
+	for i := 1; ; i++ {
+		if _, ok := c.rules[unique]; !ok {
+			if _, ok := primitives[unique]; !ok {
+				return unique
+			}
+		}
+		unique = fmt.Sprintf("%s%d", name, i)
+	}
+}
+
+// rule adds a rule with a name derived from hint and returns the name
+func (c *compiler) rule(hint, expr string) string {
+	name := c.name(hint)
+	c.rules[name] = expr
+	c.names = append(c.names, name)
+	return name
+}
+
+// primitive adds a shared rule and the rules it depends on
+func (c *compiler) primitive(name string) string {
+	if _, ok := c.rules[name]; !ok {
+		p := primitives[name]
+		c.rules[name] = p.rule
+		c.names = append(c.names, name)
+		for _, dep := range p.deps {
+			c.primitive(dep)
+		}
+	}
+
+	return name
+}
+
+// visit returns an expression matching the values the schema accepts
+func (c *compiler) visit(raw json.RawMessage, path, hint string) (string, error) {
+	switch string(bytes.TrimSpace(raw)) {
+	case "true", "{}":
+		return c.primitive("value"), nil
+	case "false":
+		return "", unsupported(path, "schema accepts no values")
+	}
+
+	var s map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return "", fmt.Errorf("invalid schema at %s: %w", path, err)
+	}
+
+	types, err := schemaTypes(s, path)
+	if err != nil {
+		return "", err
+	}
+
+	for k := range s {
+		if !slices.Contains(annotations, k) && !slices.Contains(keywords[""], k) &&
+			!slices.ContainsFunc(types, func(t string) bool { return slices.Contains(keywords[t], k) }) {
+			return "", unsupported(path, "keyword %q", k)
+		}
+	}
+
+	if ref, ok := s["$ref"]; ok {
+		if k := constraint(s, "$ref"); k != "" {
+			return "", unsupported(path, "keyword %q alongside $ref", k)
+		}
+
+		var name string
+		if err := json.Unmarshal(ref, &name); err != nil {
+			return "", fmt.Errorf("invalid schema at %s: %w", path+"/$ref", err)
+		}
+
+		return c.ref(name, path)
+	}
+
+	if v, ok := s["const"]; ok {
+		return literalValue(v)
+	}
+
+	if v, ok := s["enum"]; ok {
+		var values []json.RawMessage
+		if err := json.Unmarshal(v, &values); err != nil {
+			return "", fmt.Errorf("invalid schema at %s: %w", path+"/enum", err)
+		} else if len(values) == 0 {
+			return "", unsupported(path, "empty enum")
+		}
+
+		alts := make([]string, len(values))
+		for i, v := range values {
+			if alts[i], err = literalValue(v); err != nil {
+				return "", err
+			}
+		}
+
+		return c.rule(hint, strings.Join(alts, " | ")), nil
+	}
+
+	for _, k := range []string{"anyOf", "oneOf", "allOf"} {
+		if _, ok := s[k]; !ok {
+			continue
+		}
+
+		if other := constraint(s, k); other != "" {
+			return "", unsupported(path, "keyword %q alongside %s", other, k)
+		}
+
+		var schemas []json.RawMessage
+		if err := json.Unmarshal(s[k], &schemas); err != nil {
+			return "", fmt.Errorf("invalid schema at %s: %w", path+"/"+k, err)
+		} else if len(schemas) == 0 {
+			return "", unsupported(path, "empty %s", k)
+		} else if k == "allOf" && len(schemas) > 1 {
+			return "", unsupported(path, "allOf with more than one schema")
+		}
+
+		alts := make([]string, len(schemas))
+		for i, schema := range schemas {
+			if alts[i], err = c.visit(schema, fmt.Sprintf("%s/%s/%d", path, k, i), fmt.Sprintf("%s-%d", hint, i)); err != nil {
+				return "", err
+			}
+		}
+
+		if len(alts) == 1 {
+			return alts[0], nil
+		}
+
+		return c.rule(hint, strings.Join(alts, " | ")), nil
+	}
+
+	if len(types) == 0 {
+		return c.primitive("value"), nil
+	}
+
+	alts := make([]string, len(types))
+	for i, t := range types {
+		// alternatives each need their own rule
+		hint := hint
+		if len(types) > 1 {
+			hint += "-" + t
+		}
+
+		switch t {
+		case "null", "boolean", "integer", "number":
+			alts[i] = c.primitive(t)
+		case "string":
+			alts[i], err = c.string(s, path, hint)
+		case "array":
+			alts[i], err = c.array(s, path, hint)
+		case "object":
+			alts[i], err = c.object(s, path, hint)
+		}
+
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if len(alts) == 1 {
+		return alts[0], nil
+	}
+
+	return c.rule(hint, strings.Join(alts, " | ")), nil
+}
+
+// constraint returns a keyword of s, other than except, that constrains
+// values, or "" if there's none
+func constraint(s map[string]json.RawMessage, except string) string {
+	for k := range s {
+		if k != except && !slices.Contains(annotations, k) {
+			return k
+		}
+	}
+
+	return ""
+}
+
+// schemaTypes returns the types a schema accepts, inferred from its keywords
+// if it doesn't list any
+func schemaTypes(s map[string]json.RawMessage, path string) ([]string, error) {
+	var types []string
+	if t, ok := s["type"]; ok {
+		var one string
+		if err := json.Unmarshal(t, &one); err == nil {
+			types = []string{one}
+		} else if err := json.Unmarshal(t, &types); err != nil {
+			return nil, fmt.Errorf("invalid schema at %s: type must be a string or an array of strings", path)
+		}
+
+		for _, t := range types {
+			if !slices.Contains([]string{"null", "boolean", "integer", "number", "string", "array", "object"}, t) {
+				return nil, fmt.Errorf("invalid schema at %s: unknown type %q", path, t)
+			}
+		}
+
+		return types, nil
+	}
+
+	for _, t := range []string{"string", "array", "object"} {
+		for _, k := range keywords[t] {
+			if _, ok := s[k]; ok {
+				types = append(types, t)
+				break
+			}
+		}
+	}
+
+	return types, nil
+}
+
+// ref returns the rule for a schema in the root schema's $defs or
+// definitions
+func (c *compiler) ref(ref, path string) (string, error) {
+	if name, ok := c.refs[ref]; ok {
+		return name, nil
+	}
+
+	var raw json.RawMessage
+	for _, prefix := range []string{"#/$defs/", "#/definitions/"} {
+		if name, ok := strings.CutPrefix(ref, prefix); ok {
+			var defs map[string]json.RawMessage
+			if err := json.Unmarshal(c.root[strings.Trim(prefix[1:], "/")], &defs); err == nil {
+				raw = defs[name]
+			}
+		}
+	}
+
+	if raw == nil {
+		return "", unsupported(path, "$ref %q, only references to $defs or definitions are supported", ref)
+	}
+
+	// name the rule before visiting the schema so recursive references
+	// resolve to it. Visiting the schema adds the rule if it needs one.
+	name := c.name("def-" + ref[strings.LastIndex(ref, "/")+1:])
+	c.refs[ref] = name
+
+	expr, err := c.visit(raw, ref, name)
+	if err != nil {
+		return "", err
+	}
+
+	if expr != name {
+		c.rules[name] = expr
+		c.names = append(c.names, name)
+	}
+
+	return name, nil
+}
+
+func (c *compiler) string(s map[string]json.RawMessage, path, hint string) (string, error) {
+	var format string
+	if v, ok := s["format"]; ok {
+		if err := json.Unmarshal(v, &format); err != nil {
+			return "", fmt.Errorf("invalid schema at %s: %w", path+"/format", err)
+		}
+	}
+
+	minLength, maxLength, err := bounds(s, path, "minLength", "maxLength")
+	if err != nil {
+		return "", err
+	}
+
+	if slices.Contains(stringFormats, format) {
+		if minLength > 0 || maxLength >= 0 {
+			return "", unsupported(path, "length limits on strings with format %q", format)
+		}
+
+		return c.rule(hint, seq(`"\""`, c.primitive(format), `"\""`)), nil
+	}
+
+	if minLength == 0 && maxLength < 0 {
+		return c.primitive("string"), nil
+	}
+
+	return c.rule(hint, seq(`"\""`, repeat(c.primitive("char"), "", minLength, maxLength), `"\""`)), nil
+}
+
+func (c *compiler) array(s map[string]json.RawMessage, path, hint string) (string, error) {
+	if v, ok := s["uniqueItems"]; ok && string(v) != "false" {
+		return "", unsupported(path, "keyword %q", "uniqueItems")
+	}
+
+	var item string
+	if v, ok := s["items"]; ok {
+		var err error
+		if item, err = c.visit(v, path+"/items", hint+"-item"); err != nil {
+			return "", err
+		}
+	} else {
+		item = c.primitive("value")
+	}
+
+	minItems, maxItems, err := bounds(s, path, "minItems", "maxItems")
+	if err != nil {
+		return "", err
+	}
+
+	ws := c.primitive("ws")
+	return c.rule(hint, seq(`"["`, ws, repeat(item+" "+ws, `"," ws`, minItems, maxItems), `"]"`)), nil
+}
+
+func (c *compiler) object(s map[string]json.RawMessage, path, hint string) (string, error) {
+	names, props, err := properties(s["properties"])
+	if err != nil {
+		return "", fmt.Errorf("invalid schema at %s: %w", path+"/properties", err)
+	}
+
+	var required []string
+	if v, ok := s["required"]; ok {
+		if err := json.Unmarshal(v, &required); err != nil {
+			return "", fmt.Errorf("invalid schema at %s: %w", path+"/required", err)
+		}
+	}
+
+	ws := c.primitive("ws")
+	kv := func(name string) (string, error) {
+		schema, ok := props[name]
+		if !ok {
+			schema = json.RawMessage("true")
+		}
+
+		// property names that aren't valid rule names still get a rule
+		// of their own
+		propHint := hint + "-" + name
+		if invalidName.ReplaceAllString(name, "") == "" {
+			propHint = hint + "-property"
+		}
+
+		value, err := c.visit(schema, path+"/properties/"+name, propHint)
+		if err != nil {
+			return "", err
+		}
+
+		key, err := json.Marshal(name)
+		if err != nil {
+			return "", err
+		}
+
+		return c.rule(propHint+"-kv", seq(literal(string(key)), ws, `":"`, ws, value, ws)), nil
+	}
+
+	var fixed, optional []string
+	for _, name := range required {
+		if slices.Contains(fixed, name) {
+			continue
+		}
+
+		expr, err := kv(name)
+		if err != nil {
+			return "", err
+		}
+
+		fixed = append(fixed, expr)
+	}
+
+	for _, name := range names {
+		if slices.Contains(required, name) {
+			continue
+		}
+
+		expr, err := kv(name)
+		if err != nil {
+			return "", err
+		}
+
+		optional = append(optional, expr)
+	}
+
+	// additional properties are only generated when the schema asks for
+	// them, as leaving them out always validates
+	var extra string
+	if v, ok := s["additionalProperties"]; ok && string(bytes.TrimSpace(v)) != "false" {
+		value, err := c.visit(v, path+"/additionalProperties", hint+"-additional")
+		if err != nil {
+			return "", err
+		}
+
+		extra = c.rule(hint+"-additional-kv", seq(c.primitive("string"), ws, `":"`, ws, value, ws))
+	}
+
+	// properties after the first are each preceded by a comma
+	tail := func(optional []string) string {
+		var sb strings.Builder
+		for _, expr := range optional {
+			fmt.Fprintf(&sb, ` ( "," ws %s )?`, expr)
+		}
+
+		if extra != "" {
+			fmt.Fprintf(&sb, ` ( "," ws %s )*`, extra)
+		}
+
+		return sb.String()
+	}
+
+	var body string
+	switch {
+	case len(fixed) > 0:
+		body = strings.Join(fixed, ` "," ws `) + tail(optional)
+	case len(optional) > 0 || extra != "":
+		var alts []string
+		for i, expr := range optional {
+			alts = append(alts, expr+tail(optional[i+1:]))
+		}
+
+		if extra != "" {
+			alts = append(alts, extra+tail(nil))
+		}
+
+		body = "( " + strings.Join(alts, " | ") + " )?"
+	}
+
+	if body == "" {
+		return c.rule(hint, `"{" ws "}"`), nil
+	}
+
+	return c.rule(hint, `"{" ws `+body+` "}"`), nil
+}
+
+// properties decodes a properties keyword, keeping the order of the names
+func properties(raw json.RawMessage) ([]string, map[string]json.RawMessage, error) {
+	props := make(map[string]json.RawMessage)
+	if raw == nil {
+		return nil, props, nil
+	}
+
+	if err := json.Unmarshal(raw, &props); err != nil {
+		return nil, nil, err
+	}
+
+	d := json.NewDecoder(bytes.NewReader(raw))
+	if _, err := d.Token(); err != nil {
+		return nil, nil, err
+	}
+
+	var names []string
+	for d.More() {
+		t, err := d.Token()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		names = append(names, t.(string))
+
+		var skip json.RawMessage
+		if err := d.Decode(&skip); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return names, props, nil
+}
+
+// maxRepeat is the largest count a schema can give for the items of an array
+// or the characters of a string. Counts are expanded into the grammar one item
+// at a time, so larger ones make grammars too big to use.
+const maxRepeat = 256
+
+// bounds reads a pair of minimum and maximum count keywords. A missing
+// maximum is returned as -1.
+func bounds(s map[string]json.RawMessage, path, minKey, maxKey string) (int, int, error) {
+	minimum, maximum := 0, -1
+	for _, k := range []struct {
+		name string
+		p    *int
+	}{{minKey, &minimum}, {maxKey, &maximum}} {
+		if v, ok := s[k.name]; ok {
+			if err := json.Unmarshal(v, k.p); err != nil || *k.p < 0 {
+				return 0, 0, fmt.Errorf("invalid schema at %s: %s must be a non-negative integer", path, k.name)
+			}
+
+			if *k.p > maxRepeat {
+				return 0, 0, unsupported(path, "%s greater than %d", k.name, maxRepeat)
+			}
+		}
+	}
+
+	if maximum >= 0 && maximum < minimum {
+		return 0, 0, fmt.Errorf("invalid schema at %s: %s is less than %s", path, maxKey, minKey)
+	}
+
+	return minimum, maximum, nil
+}
+
+// repeat returns an expression matching between minimum and maximum of item,
+// separated by sep. A negative maximum is unbounded.
+func repeat(item, sep string, minimum, maximum int) string {
+	if maximum == 0 {
+		return ""
+	}
+
+	next := seq(sep, item)
+	first := max(minimum, 1)
+
+	parts := []string{item}
+	for range first - 1 {
+		parts = append(parts, next)
+	}
+
+	switch {
+	case maximum < 0:
+		parts = append(parts, "( "+next+" )*")
+	case maximum > first:
+		// nest the optional items so each is only allowed after the last
+		n := maximum - first
+		parts = append(parts, strings.Repeat("( "+next+" ", n)+strings.TrimSpace(strings.Repeat(")? ", n)))
+	}
+
+	if minimum == 0 {
+		return "( " + seq(parts...) + " )?"
+	}
+
+	return seq(parts...)
+}
+
+// seq joins the non-empty expressions in exprs into a sequence
+func seq(exprs ...string) string {
+	return strings.Join(slices.DeleteFunc(exprs, func(s string) bool { return s == "" }), " ")
+}
+
+// literalValue returns an expression matching a JSON value exactly
+func literalValue(v json.RawMessage) (string, error) {
+	var b bytes.Buffer
+	if err := json.Compact(&b, v); err != nil {
+		return "", err
+	}
+
+	return literal(b.String()), nil
+}
+
+// literal quotes s as a grammar string literal
+func literal(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "\t", `\t`)
+	return `"` + r.Replace(s) + `"`
+}
@@ -0,0 +1,173 @@
+package grammar
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+const (
+	wsRule     = `ws ::= ([ \t\n] ws)?`
+	stringRule = `string ::= "\"" char* "\""`
+	charRule   = `char ::= [^"\\\x7F\x00-\x1F] | "\\" (["\\/bfnrt] | "u" [0-9a-fA-F] [0-9a-fA-F] [0-9a-fA-F] [0-9a-fA-F])`
+)
+
+func TestFromSchema(t *testing.T) {
+	cases := []struct {
+		name   string
+		schema string
+		expect []string
+	}{
+		{
+			name:   "object",
+			schema: `{"type": "object", "properties": {"name": {"type": "string"}, "age": {"type": "integer"}, "email": {"type": "string"}}, "required": ["email", "name"]}`,
+			expect: []string{
+				`root ::= "{" ws root-email-kv "," ws root-name-kv ( "," ws root-age-kv )? "}"`,
+				wsRule,
+				stringRule,
+				charRule,
+				`root-email-kv ::= "\"email\"" ws ":" ws string ws`,
+				`root-name-kv ::= "\"name\"" ws ":" ws string ws`,
+				`integer ::= "-"? ([0-9] | [1-9] [0-9]*)`,
+				`root-age-kv ::= "\"age\"" ws ":" ws integer ws`,
+			},
+		},
+		{
+			name:   "optional properties",
+			schema: `{"properties": {"a": {"type": "boolean"}, "b": {"type": ["boolean", "null"]}}}`,
+			expect: []string{
+				`root ::= "{" ws ( root-a-kv ( "," ws root-b-kv )? | root-b-kv )? "}"`,
+				wsRule,
+				`boolean ::= "true" | "false"`,
+				`root-a-kv ::= "\"a\"" ws ":" ws boolean ws`,
+				`null ::= "null"`,
+				`root-b ::= boolean | null`,
+				`root-b-kv ::= "\"b\"" ws ":" ws root-b ws`,
+			},
+		},
+		{
+			name:   "additional properties",
+			schema: `{"type": "object", "additionalProperties": {"type": "boolean"}}`,
+			expect: []string{
+				`root ::= "{" ws ( root-additional-kv ( "," ws root-additional-kv )* )? "}"`,
+				wsRule,
+				`boolean ::= "true" | "false"`,
+				stringRule,
+				charRule,
+				`root-additional-kv ::= string ws ":" ws boolean ws`,
+			},
+		},
+		{
+			name:   "array",
+			schema: `{"type": "array", "items": {"enum": ["a", "b\"c", 1, null]}, "minItems": 1, "maxItems": 3}`,
+			expect: []string{
+				`root ::= "[" ws root-item ws ( "," ws root-item ws ( "," ws root-item ws )? )? "]"`,
+				`root-item ::= "\"a\"" | "\"b\\\"c\"" | "1" | "null"`,
+				wsRule,
+			},
+		},
+		{
+			name:   "string length",
+			schema: `{"type": "string", "minLength": 2, "maxLength": 3}`,
+			expect: []string{
+				`root ::= "\"" char char ( char )? "\""`,
+				charRule,
+			},
+		},
+		{
+			name:   "string format",
+			schema: `{"type": "string", "format": "uuid"}`,
+			expect: []string{
+				`root ::= "\"" uuid "\""`,
+				`uuid ::= hex4 hex4 "-" hex4 "-" hex4 "-" hex4 "-" hex4 hex4 hex4`,
+				`hex4 ::= [0-9a-fA-F] [0-9a-fA-F] [0-9a-fA-F] [0-9a-fA-F]`,
+			},
+		},
+		{
+			name:   "recursive ref",
+			schema: `{"$defs": {"list": {"type": "object", "properties": {"next": {"anyOf": [{"$ref": "#/$defs/list"}, {"type": "null"}]}}, "required": ["next"]}}, "$ref": "#/$defs/list"}`,
+			expect: []string{
+				`root ::= def-list`,
+				wsRule,
+				`null ::= "null"`,
+				`def-list-next ::= def-list | null`,
+				`def-list-next-kv ::= "\"next\"" ws ":" ws def-list-next ws`,
+				`def-list ::= "{" ws def-list-next-kv "}"`,
+			},
+		},
+		{
+			name:   "const",
+			schema: `{"const": {"a": [1, 2]}, "title": "constant"}`,
+			expect: []string{
+				`root ::= "{\"a\":[1,2]}"`,
+			},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			g, err := FromSchema([]byte(tt.schema))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(strings.Split(strings.TrimSpace(g), "\n"), tt.expect); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestFromSchemaMaxRepeat(t *testing.T) {
+	g, err := FromSchema([]byte(`{"type": "array", "items": {"type": "string", "maxLength": 256}, "minItems": 256, "maxItems": 256}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(g) > 64<<10 {
+		t.Errorf("expected grammar under 64KiB, got %d bytes", len(g))
+	}
+}
+
+func TestFromSchemaErrors(t *testing.T) {
+	cases := []struct {
+		schema      string
+		unsupported bool
+		err         string
+	}{
+		{`{"type": "string", "pattern": "^a+$"}`, true, `unsupported schema: keyword "pattern" at #`},
+		{`{"properties": {"age": {"type": "integer", "minimum": 0}}}`, true, `unsupported schema: keyword "minimum" at #/properties/age`},
+		{`{"type": "integer", "minLength": 1}`, true, `unsupported schema: keyword "minLength" at #`},
+		{`{"allOf": [{"type": "string"}, {"maxLength": 2}]}`, true, `unsupported schema: allOf with more than one schema at #`},
+		{`{"type": "object", "anyOf": [{"required": ["a"]}]}`, true, `unsupported schema: keyword "type" alongside anyOf at #`},
+		{`{"$ref": "https://example.com/schema.json"}`, true, `unsupported schema: $ref "https://example.com/schema.json", only references to $defs or definitions are supported at #`},
+		{`{"type": "array", "items": false}`, true, `unsupported schema: schema accepts no values at #/items`},
+		{`{"type": "string", "format": "date", "maxLength": 8}`, true, `unsupported schema: length limits on strings with format "date" at #`},
+		{`{"type": "array", "uniqueItems": true}`, true, `unsupported schema: keyword "uniqueItems" at #`},
+		{`{"type": "array", "items": {"type": "integer"}, "maxItems": 1000000}`, true, `unsupported schema: maxItems greater than 256 at #`},
+		{`{"properties": {"name": {"type": "string", "maxLength": 100000}}}`, true, `unsupported schema: maxLength greater than 256 at #/properties/name`},
+		{`{"type": "array", "minItems": 4000000000}`, true, `unsupported schema: minItems greater than 256 at #`},
+		{`{"type": "text"}`, false, `invalid schema at #: unknown type "text"`},
+		{`{"type": "string", "minLength": 3, "maxLength": 2}`, false, `invalid schema at #: maxLength is less than minLength`},
+		{`{"type": ["string", 1]}`, false, `invalid schema at #: type must be a string or an array of strings`},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.schema, func(t *testing.T) {
+			_, err := FromSchema([]byte(tt.schema))
+			if err == nil {
+				t.Fatal("expected error")
+			}
+
+			if errors.Is(err, ErrUnsupported) != tt.unsupported {
+				t.Errorf("expected unsupported %t, got %v", tt.unsupported, err)
+			}
+
+			if err.Error() != tt.err {
+				t.Errorf("expected %q, got %q", tt.err, err)
+			}
+		})
+	}
+}
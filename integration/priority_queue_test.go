@@ -0,0 +1,110 @@
+//go:build integration
+
+package integration
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ollama/ollama/api"
+	"github.com/stretchr/testify/require"
+)
+
+// TestPriorityQueue floods the server with batch embedding requests against
+// the same model as a series of interactive chats and verifies the chats keep
+// starting within a bounded time instead of queueing behind the batch work.
+func TestPriorityQueue(t *testing.T) {
+	startTime := time.Now() // Start time for logging duration
+
+	if os.Getenv("OLLAMA_TEST_EXISTING") != "" {
+		t.Skip("Priority queue test requires spawning a local server so we can limit parallelism")
+		return
+	}
+
+	// A single slot makes every request compete for the same runner
+	os.Setenv("OLLAMA_NUM_PARALLEL", "1")
+
+	// Note: Keep the batch load modest in CPU mode, each embedding holds the only slot
+	threadCount := 16
+	chatCount := 3
+	firstTokenBound := 30 * time.Second
+
+	req := api.GenerateRequest{
+		Model:  "orca-mini",
+		Prompt: "why is the sky blue?",
+		Options: map[string]interface{}{
+			"seed":        42,
+			"temperature": 0.0,
+		},
+	}
+	resp := []string{"sunlight", "scattering", "atmosphere"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer func() {
+		duration := time.Since(startTime)
+		t.Logf("TestPriorityQueue completed in %v", duration) // Log the duration of the test
+	}()
+
+	defer cancel()
+	client, _, cleanup := InitServerConnection(ctx, t)
+	defer cleanup()
+
+	require.NoError(t, PullIfMissing(ctx, client, req.Model))
+
+	// Context for the batch workers so we can shut them down
+	batchCtx, batchCancel := context.WithCancel(ctx)
+	defer batchCancel()
+
+	batchCount := 0
+	counterMu := sync.Mutex{}
+	var batchwg sync.WaitGroup
+	for i := 0; i < threadCount; i++ {
+		batchwg.Add(1)
+		go func(i int) {
+			defer batchwg.Done()
+			// Fresh client for every worker
+			client, _ := GetTestEndpoint()
+			for batchCtx.Err() == nil {
+				_, err := client.Embeddings(batchCtx, &api.EmbeddingRequest{
+					Model:    req.Model,
+					Prompt:   req.Prompt,
+					Options:  req.Options,
+					Priority: "batch",
+				})
+				if errors.Is(err, context.Canceled) {
+					return
+				}
+				require.NoError(t, err, "%d batch request failed", i)
+
+				counterMu.Lock()
+				batchCount++
+				counterMu.Unlock()
+			}
+		}(i)
+	}
+
+	// Let the batch load build a backlog before the interactive requests arrive
+	time.Sleep(2 * time.Second)
+
+	for i := 0; i < chatCount; i++ {
+		slog.Info("starting interactive generate", "id", i)
+		start := time.Now()
+		interactive := req
+		interactive.Priority = "interactive"
+		DoGenerate(ctx, t, client, interactive, resp, firstTokenBound, 10*time.Second)
+		slog.Info("interactive generate completed", "id", i, "duration", time.Since(start))
+	}
+
+	batchCancel()
+	batchwg.Wait()
+
+	counterMu.Lock()
+	defer counterMu.Unlock()
+	slog.Info("batch requests completed", "count", batchCount)
+	require.Greater(t, batchCount, 0, "batch requests should continue to make progress")
+}
@@ -0,0 +1,52 @@
+//go:build integration
+
+package integration
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ollama/ollama/api"
+)
+
+func TestRerank(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	client, _, cleanup := InitServerConnection(ctx, t)
+	defer cleanup()
+
+	req := api.RerankRequest{
+		Model: "bge-reranker-v2-m3",
+		Query: "why is the sky blue?",
+		// more documents than the runner has slots, so some of the runner's
+		// tasks, whose prompts are token arrays rather than strings, have to
+		// wait for a slot
+		Documents: []string{
+			"Grass is green because of chlorophyll.",
+			"The sky is blue because of Rayleigh scattering of sunlight.",
+			"Paris is the capital of France.",
+			"Bananas are a good source of potassium.",
+			"The ocean is salty because of dissolved minerals.",
+			"Mount Everest is the highest mountain on Earth.",
+		},
+	}
+
+	if err := PullIfMissing(ctx, client, req.Model); err != nil {
+		t.Fatalf("failed to pull model %s: %v", req.Model, err)
+	}
+
+	res, err := client.Rerank(ctx, &req)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if len(res.Results) != len(req.Documents) {
+		t.Fatalf("expected %d results, got %d", len(req.Documents), len(res.Results))
+	}
+
+	if res.Results[0].Index != 1 {
+		t.Fatalf("expected document 1 to be the most relevant, got %d", res.Results[0].Index)
+	}
+}
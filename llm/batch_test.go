@@ -0,0 +1,238 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/gpu"
+)
+
+// fakeRunner simulates a runner's decode loop. Each step takes the same time
+// regardless of how many sequences are in the batch, as on a GPU, and
+// generates one token for every active sequence. Like the runner, it decodes
+// up to --parallel sequences at once, and without --cont-batching new
+// sequences are only admitted once the batch has drained.
+type fakeRunner struct {
+	step       time.Duration
+	parallel   int
+	continuous bool
+
+	mu       sync.Mutex
+	wake     chan struct{}
+	pending  []*fakeSequence
+	active   []*fakeSequence
+	maxBatch int
+}
+
+type fakeSequence struct {
+	remaining int
+	tokens    chan string
+}
+
+// newFakeRunner returns a fakeRunner configured by the runner arguments params
+func newFakeRunner(t testing.TB, step time.Duration, params []string) *fakeRunner {
+	r := &fakeRunner{step: step, parallel: 1, continuous: slices.Contains(params, "--cont-batching"), wake: make(chan struct{}, 1)}
+	if i := slices.Index(params, "--parallel"); i >= 0 && i+1 < len(params) {
+		n, err := strconv.Atoi(params[i+1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.parallel = n
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.run(ctx)
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	return r
+}
+
+func (r *fakeRunner) run(ctx context.Context) {
+	for {
+		r.mu.Lock()
+		if r.continuous || len(r.active) == 0 {
+			n := min(len(r.pending), r.parallel-len(r.active))
+			r.active = append(r.active, r.pending[:n]...)
+			r.pending = r.pending[n:]
+		}
+
+		batch := r.active
+		r.maxBatch = max(r.maxBatch, len(batch))
+		r.mu.Unlock()
+
+		if len(batch) == 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-r.wake:
+				continue
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(r.step):
+		}
+
+		// only this loop changes active so batch is still current
+		active := batch[:0]
+		for _, seq := range batch {
+			seq.remaining--
+			seq.tokens <- fmt.Sprintf(" t%d", seq.remaining)
+			if seq.remaining > 0 {
+				active = append(active, seq)
+			} else {
+				close(seq.tokens)
+			}
+		}
+
+		r.mu.Lock()
+		r.active = active
+		r.mu.Unlock()
+	}
+}
+
+func (r *fakeRunner) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.URL.Path {
+	case "/health":
+		healthy(w, req)
+		return
+	case "/tokenize":
+		fmt.Fprint(w, `{"tokens":[1]}`)
+		return
+	case "/completion":
+	default:
+		http.NotFound(w, req)
+		return
+	}
+
+	var c completionRequest
+	if err := json.NewDecoder(req.Body).Decode(&c); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	seq := &fakeSequence{remaining: max(c.NumPredict, 1)}
+	seq.tokens = make(chan string, seq.remaining)
+
+	r.mu.Lock()
+	r.pending = append(r.pending, seq)
+	r.mu.Unlock()
+
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+
+	var n int
+	for token := range seq.tokens {
+		n++
+		fmt.Fprintf(w, "data: {\"content\":%q}\n\n", token)
+	}
+
+	fmt.Fprintf(w, "data: {\"content\":\"\",\"stop\":true,\"stopped_limit\":true,\"timings\":{\"predicted_n\":%d}}\n\n", n)
+}
+
+// newBatchServer returns an llmServer for numParallel sequences talking to a
+// fakeRunner started with the arguments NewLlamaServer would give it
+func newBatchServer(t testing.TB, step time.Duration, numParallel int) (*llmServer, *fakeRunner) {
+	opts := api.DefaultOptions()
+	params := runnerParams("model.gguf", nil, gpu.GpuInfoList{{Library: "cpu"}}, nil, nil, "", -1, &opts, MemoryEstimate{}, 0, numParallel)
+
+	r := newFakeRunner(t, step, params)
+	s := newStubServer(t, r)
+	s.numParallel = numParallel
+	s.sem = semaphore.NewWeighted(int64(numParallel))
+	return s, r
+}
+
+func TestCompletionContinuousBatching(t *testing.T) {
+	s, r := newBatchServer(t, time.Millisecond, 4)
+
+	var g errgroup.Group
+	counts := make([]int, 4)
+	for i := range counts {
+		g.Go(func() error {
+			opts := api.DefaultOptions()
+			opts.NumPredict = 10 * (i + 1)
+			return s.Completion(context.Background(), CompletionRequest{Prompt: "hi", Options: &opts}, func(r CompletionResponse) {
+				if r.Done {
+					counts[i] = r.EvalCount
+				}
+			})
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	// each sequence stops at its own num_predict while sharing batches
+	for i, n := range counts {
+		if n != 10*(i+1) {
+			t.Errorf("sequence %d: expected %d tokens, got %d", i, 10*(i+1), n)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.maxBatch < 2 {
+		t.Errorf("expected sequences to be batched together, max batch %d", r.maxBatch)
+	}
+}
+
+// BenchmarkCompletionBatching measures generation throughput for concurrent
+// requests of different lengths sent through Completion to a fake runner,
+// serving one sequence at a time and several with continuous batching.
+func BenchmarkCompletionBatching(b *testing.B) {
+	for _, numParallel := range []int{1, 4} {
+		b.Run(fmt.Sprintf("parallel=%d", numParallel), func(b *testing.B) {
+			s, _ := newBatchServer(b, 100*time.Microsecond, numParallel)
+
+			var mu sync.Mutex
+			var tokens int
+
+			b.ResetTimer()
+			var g errgroup.Group
+			for i := range b.N {
+				g.Go(func() error {
+					opts := api.DefaultOptions()
+					opts.NumPredict = 8 << (i % 4)
+					return s.Completion(context.Background(), CompletionRequest{Prompt: "hi", Options: &opts}, func(r CompletionResponse) {
+						if r.Done {
+							mu.Lock()
+							tokens += r.EvalCount
+							mu.Unlock()
+						}
+					})
+				})
+			}
+
+			if err := g.Wait(); err != nil {
+				b.Fatal(err)
+			}
+
+			b.ReportMetric(float64(tokens)/b.Elapsed().Seconds(), "tokens/s")
+		})
+	}
+}
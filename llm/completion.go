@@ -1,7 +1,291 @@
 package llm
 
+import (
+	"errors"
+	"math"
+	"time"
+
+	"github.com/ollama/ollama/api"
+)
+
+// ProtocolVersion is the version of the wire protocol spoken between the
+// server and its runner subprocesses. It is sent on every runner request in
+// the ProtocolHeader header, and runners report theirs in /health. It must be
+// bumped, along with the runner's, whenever a field is added, removed or
+// changes meaning.
+const ProtocolVersion = 5
+
+const ProtocolHeader = "X-Ollama-Runner-Protocol"
+
+// ErrProtocolMismatch is returned for runners that report a different
+// ProtocolVersion than the server's, usually because the runner is from
+// another build of Ollama. Such runners aren't used.
+var ErrProtocolMismatch = errors.New("runner protocol version mismatch")
+
+// ImageData is an image attached to a prompt. The prompt refers to it with an
+// [img-ID] tag.
+type ImageData struct {
+	Data []byte `json:"data"`
+	ID   int    `json:"id"`
+}
+
+// CompletionRequest is a single completion handed to a runner.
+type CompletionRequest struct {
+	Prompt string
+	Images []ImageData
+
+	// Format constrains the output. Only "json" is supported.
+	Format string
+
+	// Grammar is a GBNF grammar constraining the output. It takes precedence
+	// over Format.
+	Grammar string
+
+	// Logprobs returns the log probability of each generated token along
+	// with TopLogprobs of the most likely alternatives.
+	Logprobs    bool
+	TopLogprobs int
+
+	Options *api.Options
+}
+
+// CompletionResponse is a chunk of a streamed completion. The final chunk has
+// Done set and carries the timing metrics for the request. Its DoneReason is
+// "stop", "length" or, if the request was cancelled before the runner
+// finished, "cancelled".
 type CompletionResponse struct {
-	// Define the necessary fields for the completion response
-	GeneratedText string `json:"generated_text"`
-	// Add other fields as necessary
+	Content            string
+	DoneReason         string
+	Done               bool
+	PromptEvalCount    int
+	PromptEvalDuration time.Duration
+	EvalCount          int
+	EvalDuration       time.Duration
+
+	// PromptCacheCount is the number of prompt tokens reused from the
+	// runner's cache rather than evaluated. They aren't included in
+	// PromptEvalCount.
+	PromptCacheCount int
+
+	// DraftCount is the number of tokens proposed by the draft model during
+	// speculative decoding and DraftAcceptedCount the number of those the
+	// model accepted.
+	DraftCount         int
+	DraftAcceptedCount int
+
+	// Logprobs are the tokens of Content, if requested
+	Logprobs []api.Logprob
+}
+
+// DraftAcceptanceRate is the fraction of the tokens proposed by the draft
+// model that were accepted, or 0 if there's no draft model
+func (r CompletionResponse) DraftAcceptanceRate() float64 {
+	if r.DraftCount == 0 {
+		return 0
+	}
+
+	return float64(r.DraftAcceptedCount) / float64(r.DraftCount)
+}
+
+// completionRequest is the wire form of CompletionRequest as posted to the
+// runner's /completion endpoint
+type completionRequest struct {
+	Prompt      string      `json:"prompt"`
+	ImageData   []ImageData `json:"image_data,omitempty"`
+	Grammar     string      `json:"grammar,omitempty"`
+	Stream      bool        `json:"stream"`
+	CachePrompt bool        `json:"cache_prompt"`
+
+	NumPredict       int      `json:"n_predict"`
+	NumKeep          int      `json:"n_keep"`
+	MainGPU          int      `json:"main_gpu"`
+	Temperature      float32  `json:"temperature"`
+	TopK             int      `json:"top_k"`
+	TopP             float32  `json:"top_p"`
+	TFSZ             float32  `json:"tfs_z"`
+	TypicalP         float32  `json:"typical_p"`
+	RepeatLastN      int      `json:"repeat_last_n"`
+	RepeatPenalty    float32  `json:"repeat_penalty"`
+	PresencePenalty  float32  `json:"presence_penalty"`
+	FrequencyPenalty float32  `json:"frequency_penalty"`
+	Mirostat         int      `json:"mirostat"`
+	MirostatTau      float32  `json:"mirostat_tau"`
+	MirostatEta      float32  `json:"mirostat_eta"`
+	PenalizeNewline  bool     `json:"penalize_nl"`
+	Seed             int      `json:"seed"`
+	Stop             []string `json:"stop"`
+	NumProbs         int      `json:"n_probs,omitempty"`
+}
+
+func newCompletionRequest(req CompletionRequest) completionRequest {
+	opts := req.Options
+	r := completionRequest{
+		Prompt:      req.Prompt,
+		ImageData:   req.Images,
+		Grammar:     req.Grammar,
+		Stream:      true,
+		CachePrompt: true,
+
+		NumPredict:       opts.NumPredict,
+		NumKeep:          opts.NumKeep,
+		MainGPU:          opts.MainGPU,
+		Temperature:      opts.Temperature,
+		TopK:             opts.TopK,
+		TopP:             opts.TopP,
+		TFSZ:             opts.TFSZ,
+		TypicalP:         opts.TypicalP,
+		RepeatLastN:      opts.RepeatLastN,
+		RepeatPenalty:    opts.RepeatPenalty,
+		PresencePenalty:  opts.PresencePenalty,
+		FrequencyPenalty: opts.FrequencyPenalty,
+		Mirostat:         opts.Mirostat,
+		MirostatTau:      opts.MirostatTau,
+		MirostatEta:      opts.MirostatEta,
+		PenalizeNewline:  opts.PenalizeNewline,
+		Seed:             opts.Seed,
+		Stop:             opts.Stop,
+	}
+
+	if r.Grammar == "" && req.Format == "json" {
+		r.Grammar = jsonGrammar
+	}
+
+	// the runner always reports the sampled token's probability when asked
+	// for any
+	if req.Logprobs {
+		r.NumProbs = max(req.TopLogprobs, 1)
+	}
+
+	return r
+}
+
+// completionChunk is a single server-sent event streamed back by the runner
+type completionChunk struct {
+	Content      string `json:"content"`
+	Stop         bool   `json:"stop"`
+	StoppedLimit bool   `json:"stopped_limit"`
+
+	Probs []tokenProb `json:"completion_probabilities"`
+
+	Timings struct {
+		PredictedN     int     `json:"predicted_n"`
+		PredictedMS    float64 `json:"predicted_ms"`
+		PromptN        int     `json:"prompt_n"`
+		PromptMS       float64 `json:"prompt_ms"`
+		PromptCachedN  int     `json:"prompt_cached_n"`
+		DraftN         int     `json:"draft_n"`
+		DraftAcceptedN int     `json:"draft_accepted_n"`
+	} `json:"timings"`
+}
+
+// tokenProb is a generated token with its probability and the most likely
+// tokens the runner considered in its place
+type tokenProb struct {
+	ID    int     `json:"id"`
+	Bytes []int   `json:"bytes"`
+	Prob  float64 `json:"prob"`
+	Probs []struct {
+		ID    int     `json:"id"`
+		Bytes []int   `json:"bytes"`
+		Prob  float64 `json:"prob"`
+	} `json:"probs"`
+}
+
+// minLogprob stands in for the log of a zero probability, which can't be
+// encoded as JSON
+const minLogprob = -9999
+
+// piece converts the raw bytes of a token, as sent by the runner, to a string
+func piece(bts []int) string {
+	b := make([]byte, len(bts))
+	for i, c := range bts {
+		b[i] = byte(c)
+	}
+
+	return string(b)
+}
+
+func tokenLogprob(id int, bts []int, prob float64) api.TokenLogprob {
+	return api.TokenLogprob{
+		Token:   piece(bts),
+		ID:      id,
+		Logprob: max(math.Log(prob), minLogprob),
+		Bytes:   bts,
+	}
+}
+
+// logprobs converts the probabilities of the chunk's tokens, keeping up to
+// top alternatives for each
+func (c completionChunk) logprobs(top int) []api.Logprob {
+	var logprobs []api.Logprob
+	for _, p := range c.Probs {
+		lp := api.Logprob{TokenLogprob: tokenLogprob(p.ID, p.Bytes, p.Prob)}
+		for _, alt := range p.Probs[:min(top, len(p.Probs))] {
+			lp.TopLogprobs = append(lp.TopLogprobs, tokenLogprob(alt.ID, alt.Bytes, alt.Prob))
+		}
+
+		logprobs = append(logprobs, lp)
+	}
+
+	return logprobs
+}
+
+// final converts the last chunk of a stream into a response carrying the
+// request metrics
+func (c completionChunk) final() CompletionResponse {
+	doneReason := "stop"
+	if c.StoppedLimit {
+		doneReason = "length"
+	}
+
+	return CompletionResponse{
+		Done:               true,
+		DoneReason:         doneReason,
+		PromptEvalCount:    c.Timings.PromptN,
+		PromptEvalDuration: parseDurationMs(c.Timings.PromptMS),
+		EvalCount:          c.Timings.PredictedN,
+		EvalDuration:       parseDurationMs(c.Timings.PredictedMS),
+		PromptCacheCount:   c.Timings.PromptCachedN,
+		DraftCount:         c.Timings.DraftN,
+		DraftAcceptedCount: c.Timings.DraftAcceptedN,
+	}
+}
+
+type EmbedRequest struct {
+	Content []string `json:"content"`
+}
+
+type EmbedResponse struct {
+	Embedding [][]float32 `json:"embedding"`
+}
+
+type RerankRequest struct {
+	Query     string   `json:"query"`
+	Documents []string `json:"documents"`
+}
+
+// RerankResponse holds a score for each document, in the order of the
+// request
+type RerankResponse struct {
+	Scores []float32 `json:"scores"`
+}
+
+type TokenizeRequest struct {
+	Content    string `json:"content"`
+	WithPieces bool   `json:"with_pieces,omitempty"`
+}
+
+type TokenizeResponse struct {
+	Tokens []int `json:"tokens"`
+
+	// Pieces holds the bytes of each token when WithPieces is set
+	Pieces [][]int `json:"pieces,omitempty"`
+}
+
+type DetokenizeRequest struct {
+	Tokens []int `json:"tokens"`
+}
+
+type DetokenizeResponse struct {
+	Content string `json:"content"`
 }
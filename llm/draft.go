@@ -0,0 +1,58 @@
+package llm
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/gpu"
+)
+
+// numDraft is the number of tokens the draft model proposes in each step of
+// speculative decoding for the target model to verify
+const numDraft = 5
+
+// EstimateDraftGPULayers estimates the memory needed to load the draft model
+// at path next to a target model on gpus. The draft shares the target's
+// context size and is offloaded as far as it fits, regardless of the number
+// of layers requested for the target. It returns the estimate along with a
+// copy of gpus with that memory set aside, for estimating the target. An
+// empty path returns gpus unchanged.
+func EstimateDraftGPULayers(gpus gpu.GpuInfoList, path string, opts api.Options) (gpu.GpuInfoList, MemoryEstimate, error) {
+	if path == "" {
+		return gpus, MemoryEstimate{}, nil
+	}
+
+	ggml, err := LoadModel(path, 0)
+	if err != nil {
+		return nil, MemoryEstimate{}, fmt.Errorf("draft model: %w", err)
+	}
+
+	opts.NumGPU = -1
+	estimate := EstimateGPULayers(gpus, ggml, nil, opts)
+
+	remaining := slices.Clone(gpus)
+	if len(remaining) > 0 && remaining[0].Library == "cpu" {
+		remaining[0].FreeMemory -= min(remaining[0].FreeMemory, estimate.TotalSize)
+	}
+
+	for i, size := range estimate.GPUSizes {
+		remaining[i].FreeMemory -= min(remaining[i].FreeMemory, size)
+	}
+
+	return remaining, estimate, nil
+}
+
+// fullyLoaded reports whether every layer of the model fits on the GPUs
+func (m MemoryEstimate) fullyLoaded() bool {
+	return m.Layers > 0 && m.Layers >= m.layersModel
+}
+
+// add includes the memory of another model loaded in the same runner
+func (m *MemoryEstimate) add(o MemoryEstimate) {
+	m.VRAMSize += o.VRAMSize
+	m.TotalSize += o.TotalSize
+	for i := range min(len(m.GPUSizes), len(o.GPUSizes)) {
+		m.GPUSizes[i] += o.GPUSizes[i]
+	}
+}
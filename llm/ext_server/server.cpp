@@ -53,6 +53,11 @@
 
 using json = nlohmann::json;
 
+// version of the wire protocol spoken with the ollama server, reported in
+// /health. It must match llm.ProtocolVersion, which the server checks before
+// sending any requests.
+static const int runner_protocol_version = 5;
+
 struct server_params {
     std::string hostname = "127.0.0.1";
     std::vector<std::string> api_keys;
@@ -62,6 +67,7 @@ struct server_params {
     int32_t write_timeout = 600;
     bool slots_endpoint = true;
     bool metrics_endpoint = false;
+    bool vocab_only = false;
     int n_threads_http = -1;
 };
 
@@ -133,6 +139,7 @@ struct server_slot {
 
     int32_t n_prompt_tokens           = 0;
     int32_t n_prompt_tokens_processed = 0;
+    int32_t n_prompt_tokens_cached    = 0; // prompt tokens reused from the kv cache
 
     json prompt;
     std::string generated_text;
@@ -162,6 +169,12 @@ struct server_slot {
     // multimodal
     std::vector<slot_image> images;
 
+    // speculative decoding
+    std::vector<llama_token> cache_tokens_draft; // tokens in the draft model's kv cache
+    int32_t n_draft          = 0;     // tokens proposed by the draft model
+    int32_t n_draft_accepted = 0;     // proposed tokens that were accepted
+    bool    speculate        = false; // draft tokens after this step
+
     // stats
     size_t n_sent_text = 0; // number of sent text character
     size_t n_sent_token_probs = 0;
@@ -177,6 +190,7 @@ struct server_slot {
 
     void reset() {
         n_prompt_tokens        = 0;
+        n_prompt_tokens_cached = 0;
         generated_text         = "";
         truncated              = false;
         stopped_eos            = false;
@@ -188,6 +202,9 @@ struct server_slot {
         n_sent_token_probs     = 0;
         ga_i                   = 0;
         n_past_se              = 0;
+        n_draft                = 0;
+        n_draft_accepted       = 0;
+        speculate              = false;
 
         generated_token_probs.clear();
 
@@ -246,6 +263,7 @@ struct server_slot {
         return json
         {
             {"prompt_n",               n_prompt_tokens_processed},
+            {"prompt_cached_n",        n_prompt_tokens_cached},
             {"prompt_ms",              t_prompt_processing},
             {"prompt_per_token_ms",    t_prompt_processing / n_prompt_tokens_processed},
             {"prompt_per_second",      1e3 / t_prompt_processing * n_prompt_tokens_processed},
@@ -254,6 +272,9 @@ struct server_slot {
             {"predicted_ms",           t_token_generation},
             {"predicted_per_token_ms", t_token_generation / n_decoded},
             {"predicted_per_second",   1e3 / t_token_generation * n_decoded},
+
+            {"draft_n",                n_draft},
+            {"draft_accepted_n",       n_draft_accepted},
         };
     }
 
@@ -337,11 +358,18 @@ struct llama_server_context
 
     clip_ctx *clp_ctx = nullptr;
 
+    // draft model for speculative decoding
+    llama_model   *model_draft = nullptr;
+    llama_context *ctx_draft   = nullptr;
+    llama_batch    batch_draft;
+    llama_batch    batch_spec;
+
     gpt_params params;
 
     llama_batch batch;
 
     bool multimodal         = false;
+    bool vocab_only         = false;
     bool clean_kv_cache     = true;
     bool all_slots_are_idle = false;
     bool add_bos_token      = true;
@@ -383,6 +411,38 @@ struct llama_server_context
             llama_free_model(model);
             model = nullptr;
         }
+        if (ctx_draft)
+        {
+            llama_batch_free(batch_draft);
+            llama_batch_free(batch_spec);
+            llama_free(ctx_draft);
+            ctx_draft = nullptr;
+        }
+        if (model_draft)
+        {
+            llama_free_model(model_draft);
+            model_draft = nullptr;
+        }
+    }
+
+    // load_vocab loads only the model's vocabulary, with no weights or
+    // context, which is enough to tokenize and detokenize
+    bool load_vocab(const gpt_params &params_)
+    {
+        params = params_;
+
+        llama_model_params mparams = llama_model_default_params();
+        mparams.vocab_only = true;
+
+        model = llama_load_model_from_file(params.model.c_str(), mparams);
+        if (model == nullptr)
+        {
+            LOG_ERROR("unable to load model vocabulary", {{"model", params.model}});
+            return false;
+        }
+
+        vocab_only = true;
+        return true;
     }
 
     bool load_model(const gpt_params &params_)
@@ -420,6 +480,32 @@ struct llama_server_context
             }
         }
 
+        if (!params.model_draft.empty())
+        {
+            // the draft shares the context size so it can follow every slot
+            gpt_params params_draft = params;
+            params_draft.model        = params.model_draft;
+            params_draft.n_gpu_layers = params.n_gpu_layers_draft;
+            params_draft.lora_adapter.clear();
+
+            std::tie(model_draft, ctx_draft) = llama_init_from_gpt_params(params_draft);
+            if (model_draft == nullptr)
+            {
+                LOG_ERROR("unable to load draft model", {{"model", params.model_draft}});
+                return false;
+            }
+
+            if (llama_n_vocab(model_draft) != llama_n_vocab(model))
+            {
+                LOG_ERROR("draft model vocabulary does not match the model", {
+                    {"model",         params.model_draft},
+                    {"n_vocab",       llama_n_vocab(model)},
+                    {"n_vocab_draft", llama_n_vocab(model_draft)}
+                });
+                return false;
+            }
+        }
+
         n_ctx = llama_n_ctx(ctx);
 
         add_bos_token = llama_should_add_bos_token(model);
@@ -473,6 +559,12 @@ struct llama_server_context
         }
 
         batch = llama_batch_init(n_ctx, 0, params.n_parallel);
+
+        if (ctx_draft)
+        {
+            batch_draft = llama_batch_init(params.n_batch, 0, 1);
+            batch_spec  = llama_batch_init(params.n_draft + 1, 0, 1);
+        }
     }
 
     std::vector<llama_token> tokenize(const json & json_prompt, bool add_bos) const
@@ -497,12 +589,12 @@ struct llama_server_context
                     std::vector<llama_token> p;
                     if (first)
                     {
-                        p = ::llama_tokenize(ctx, s, add_bos, TMP_FORCE_SPECIAL);
+                        p = ::llama_tokenize(model, s, add_bos, TMP_FORCE_SPECIAL);
                         first = false;
                     }
                     else
                     {
-                        p = ::llama_tokenize(ctx, s, false, TMP_FORCE_SPECIAL);
+                        p = ::llama_tokenize(model, s, false, TMP_FORCE_SPECIAL);
                     }
                     prompt_tokens.insert(prompt_tokens.end(), p.begin(), p.end());
                 }
@@ -519,7 +611,7 @@ struct llama_server_context
         else
         {
             auto s = json_prompt.template get<std::string>();
-            prompt_tokens = ::llama_tokenize(ctx, s, add_bos, TMP_FORCE_SPECIAL);
+            prompt_tokens = ::llama_tokenize(model, s, add_bos, TMP_FORCE_SPECIAL);
         }
 
         return prompt_tokens;
@@ -812,6 +904,14 @@ struct llama_server_context
     void kv_cache_clear() {
         // clear the entire KV cache
         llama_kv_cache_clear(ctx);
+        if (ctx_draft)
+        {
+            llama_kv_cache_clear(ctx_draft);
+            for (server_slot &slot : slots)
+            {
+                slot.cache_tokens_draft.clear();
+            }
+        }
         clean_kv_cache = false;
     }
 
@@ -1160,10 +1260,11 @@ struct llama_server_context
             {"timings",             slot.get_formated_timings()}
         };
 
-        if (slot.sparams.n_probs > 0)
+        // streamed probabilities were already sent with each token
+        if (slot.sparams.n_probs > 0 && !slot.params.stream)
         {
             std::vector<completion_token_output> probs = {};
-            if (!slot.params.stream && slot.stopped_word)
+            if (slot.stopped_word)
             {
                 const std::vector<llama_token> stop_word_toks = llama_tokenize(ctx, slot.stopping_word, false);
                 probs = std::vector<completion_token_output>(slot.generated_token_probs.begin(), slot.generated_token_probs.end() - stop_word_toks.size());
@@ -1206,6 +1307,17 @@ struct llama_server_context
                 }
 
                 const float * embd = llama_get_embeddings_seq(ctx, batch.seq_id[i][0]);
+
+                // rank pooling leaves a single relevance score for the sequence
+                if (llama_pooling_type(ctx) == LLAMA_POOLING_TYPE_RANK)
+                {
+                    res.result_json = json
+                    {
+                        {"score", embd == NULL ? 0.0f : embd[0]},
+                    };
+                    continue;
+                }
+
                 if (embd == NULL) {
                     embd = llama_get_embeddings_ith(ctx, i);
                     if (embd == NULL) {
@@ -1390,8 +1502,10 @@ struct llama_server_context
 
     // Find the slot that has the greatest common prefix
     server_slot *prefix_slot(const json &prompt) {
+        // only string prompts can share a prefix, so tokenized and mixed
+        // prompts such as rerank's take any available slot
         if (!prompt.is_string()) {
-            return nullptr;
+            return get_slot(-1);
         }
 
         std::string prompt_str = prompt.get<std::string>();
@@ -1548,6 +1662,12 @@ struct llama_server_context
     }
 
     bool update_slots() {
+        // nothing to decode without weights
+        if (vocab_only)
+        {
+            return true;
+        }
+
         if (system_need_update)
         {
             LOG_DEBUG("updating system prompt", {});
@@ -1791,6 +1911,13 @@ struct llama_server_context
                         }
                     }
 
+                    if (slot.params.cache_prompt)
+                    {
+                        // only the part of the prompt not already in the cache is evaluated
+                        slot.n_prompt_tokens_cached    = slot.n_past;
+                        slot.n_prompt_tokens_processed = slot.n_prompt_tokens - slot.n_past;
+                    }
+
                     int p0 = (int) system_tokens.size() + slot.n_past;
                     LOG_DEBUG("kv cache rm [p0, end)", {
                         { "slot_id", slot.id },
@@ -1969,6 +2096,16 @@ struct llama_server_context
                     result.probs.push_back({cur_p.data[i].id, cur_p.data[i].p});
                 }
 
+                // the sampled token isn't always among the most likely ones
+                for (size_t i = 0; n_probs > 0 && i < cur_p.size; ++i)
+                {
+                    if (cur_p.data[i].id == id)
+                    {
+                        result.prob = cur_p.data[i].p;
+                        break;
+                    }
+                }
+
                 if (!process_token(result, slot))
                 {
                     slot.release();
@@ -1976,15 +2113,174 @@ struct llama_server_context
                     send_final_response(slot);
                     metrics.on_prediction(slot);
                 }
+                else
+                {
+                    slot.speculate = can_speculate(slot);
+                }
 
                 slot.i_batch = -1;
             }
         }
 
+        // speculate once every slot has sampled from the batch since verifying
+        // the draft tokens overwrites the logits
+        for (auto & slot : slots)
+        {
+            if (!slot.speculate)
+            {
+                continue;
+            }
+
+            slot.speculate = false;
+            if (!speculate(slot))
+            {
+                slot.release();
+                slot.print_timings();
+                send_final_response(slot);
+                metrics.on_prediction(slot);
+            }
+        }
+
         LOG_VERBOSE("slots updated", {});
         return true;
     }
 
+    bool can_speculate(const server_slot &slot) const
+    {
+        return ctx_draft != nullptr &&
+               slot.ga_n == 1 &&
+               slot.images.empty() &&
+               slot.sparams.n_probs == 0 &&
+               system_tokens.empty() &&
+               slot.n_past + params.n_draft + 1 < slot.n_ctx;
+    }
+
+    // speculate has the draft model propose the tokens following the slot's
+    // last sampled token and verifies them with the model in a single batch.
+    // The model samples after each proposed token in turn and the proposal is
+    // accepted for as long as it matches, so the output is the same as it
+    // would be without a draft model. Returns false once the slot is done.
+    bool speculate(server_slot &slot)
+    {
+        const int32_t n_past = slot.n_past;
+
+        // bring the draft model's cache up to date with the model's, which
+        // holds every token but the last one sampled
+        const std::vector<llama_token> evaluated(slot.cache_tokens.begin(), slot.cache_tokens.begin() + n_past);
+        const size_t n_common = common_part(slot.cache_tokens_draft, evaluated);
+        llama_kv_cache_seq_rm(ctx_draft, slot.id, n_common, -1);
+        slot.cache_tokens_draft.resize(n_common);
+
+        for (size_t i = n_common; i < evaluated.size(); i += params.n_batch)
+        {
+            const size_t n_tokens = std::min(evaluated.size() - i, (size_t) params.n_batch);
+
+            llama_batch_clear(batch_draft);
+            for (size_t j = i; j < i + n_tokens; j++)
+            {
+                llama_batch_add(batch_draft, evaluated[j], j, { slot.id }, false);
+            }
+
+            if (llama_decode(ctx_draft, batch_draft) != 0)
+            {
+                LOG_WARNING("failed to evaluate the prompt with the draft model", {{"slot_id", slot.id}});
+                llama_kv_cache_seq_rm(ctx_draft, slot.id, -1, -1);
+                slot.cache_tokens_draft.clear();
+                return true;
+            }
+
+            slot.cache_tokens_draft.insert(slot.cache_tokens_draft.end(), evaluated.begin() + i, evaluated.begin() + i + n_tokens);
+        }
+
+        // greedily draft the most likely tokens
+        const int32_t n_vocab = llama_n_vocab(model_draft);
+
+        std::vector<llama_token> draft;
+        llama_token cur = slot.sampled;
+        for (int32_t i = 0; i < params.n_draft; i++)
+        {
+            llama_batch_clear(batch_draft);
+            llama_batch_add(batch_draft, cur, n_past + i, { slot.id }, true);
+            if (llama_decode(ctx_draft, batch_draft) != 0)
+            {
+                break;
+            }
+
+            slot.cache_tokens_draft.push_back(cur);
+
+            const float *logits = llama_get_logits_ith(ctx_draft, 0);
+            cur = std::max_element(logits, logits + n_vocab) - logits;
+            draft.push_back(cur);
+
+            if (llama_token_is_eog(model_draft, cur))
+            {
+                break;
+            }
+        }
+
+        if (draft.empty())
+        {
+            return true;
+        }
+
+        // verify the last sampled token and the draft together
+        llama_batch_clear(batch_spec);
+        llama_batch_add(batch_spec, slot.sampled, system_tokens.size() + n_past, { slot.id }, true);
+        for (size_t i = 0; i < draft.size(); i++)
+        {
+            llama_batch_add(batch_spec, draft[i], system_tokens.size() + n_past + 1 + i, { slot.id }, true);
+        }
+
+        if (llama_decode(ctx, batch_spec) != 0)
+        {
+            LOG_WARNING("failed to verify draft tokens", {{"slot_id", slot.id}});
+            llama_kv_cache_seq_rm(ctx, slot.id, n_past, -1);
+            return true;
+        }
+
+        slot.n_draft += draft.size();
+
+        int32_t n_accepted = 0;
+        bool has_next_token = true;
+        for (size_t i = 0; i <= draft.size(); i++)
+        {
+            completion_token_output result;
+            result.tok = llama_sampling_sample(slot.ctx_sampling, ctx, NULL, i);
+            llama_sampling_accept(slot.ctx_sampling, ctx, result.tok, true);
+            slot.n_decoded += 1;
+
+            has_next_token = process_token(result, slot);
+
+            // the first token that differs from the draft isn't in the kv
+            // cache yet and is evaluated in the next step like any other
+            if (i == draft.size() || result.tok != draft[i])
+            {
+                break;
+            }
+
+            n_accepted++;
+            if (!has_next_token)
+            {
+                break;
+            }
+        }
+
+        slot.n_draft_accepted += n_accepted;
+
+        // drop the rejected part of the draft from the cache
+        slot.n_past = n_past + 1 + n_accepted;
+        llama_kv_cache_seq_rm(ctx, slot.id, system_tokens.size() + slot.n_past, -1);
+
+        LOG_VERBOSE("speculative step", {
+            {"slot_id",    slot.id},
+            {"task_id",    slot.task_id},
+            {"n_draft",    draft.size()},
+            {"n_accepted", n_accepted}
+        });
+
+        return has_next_token;
+    }
+
     json model_meta() {
         return json{
                 {"vocab_type", llama_vocab_type(model)},
@@ -2017,7 +2313,7 @@ static void server_print_usage(const char *argv0, const gpt_params &params,
     printf("  --yarn-attn-factor N      YaRN: scale sqrt(t) or attention magnitude (default: 1.0)\n");
     printf("  --yarn-beta-slow N        YaRN: high correction dim or alpha (default: %.1f)\n", params.yarn_beta_slow);
     printf("  --yarn-beta-fast N        YaRN: low correction dim or beta (default: %.1f)\n", params.yarn_beta_fast);
-    printf("  --pooling {none,mean,cls}\n");
+    printf("  --pooling {none,mean,cls,rank}\n");
     printf("                        pooling type for embeddings, use model default if unspecified\n");
     printf("  -b N, --batch-size N      batch size for prompt processing (default: %d)\n", params.n_batch);
     printf("  --memory-f32              use f32 instead of f16 for memory key+value (default: disabled)\n");
@@ -2060,6 +2356,7 @@ static void server_print_usage(const char *argv0, const gpt_params &params,
     printf("  --api-key-file FNAME      path to file containing api keys delimited by new lines. If set, requests must include one of the keys for access.\n");
     printf("  -to N, --timeout N        server read/write timeout in seconds (default: %d)\n", sparams.read_timeout);
     printf("  --embedding               enable embedding vector output (default: %s)\n", params.embedding ? "enabled" : "disabled");
+    printf("  --vocab-only              only load the vocabulary, for tokenizing and detokenizing (default: %s)\n", sparams.vocab_only ? "enabled" : "disabled");
     printf("  -np N, --parallel N       number of slots for process requests (default: %d)\n", params.n_parallel);
     printf("  -cb, --cont-batching      enable continuous batching (a.k.a dynamic batching) (default: disabled)\n");
     printf("  -fa, --flash-attn         enable Flash Attention (default: %s)\n", params.flash_attn ? "enabled" : "disabled");
@@ -2070,6 +2367,11 @@ static void server_print_usage(const char *argv0, const gpt_params &params,
     printf("  -ctv TYPE, --cache-type-v TYPE\n");
     printf("                            KV cache data type for V (default: f16)\n");
     printf("  --mmproj MMPROJ_FILE      path to a multimodal projector file for LLaVA.\n");
+    printf("  -md FNAME, --model-draft FNAME\n");
+    printf("                            draft model for speculative decoding\n");
+    printf("  --draft N                 number of tokens to draft for speculative decoding (default: %d)\n", params.n_draft);
+    printf("  -ngld N, --n-gpu-layers-draft N\n");
+    printf("                            number of layers of the draft model to store in VRAM\n");
     printf("  --log-format              log output format: json or text (default: json)\n");
     printf("  --log-disable             disables logging to a file.\n");
     printf("  --slots-endpoint-disable  disables slots monitoring endpoint.\n");
@@ -2269,6 +2571,7 @@ static void server_params_parse(int argc, char **argv, server_params &sparams, g
             /**/ if (value == "none") { params.pooling_type = LLAMA_POOLING_TYPE_NONE; }
             else if (value == "mean") { params.pooling_type = LLAMA_POOLING_TYPE_MEAN; }
             else if (value == "cls")  { params.pooling_type = LLAMA_POOLING_TYPE_CLS; }
+            else if (value == "rank") { params.pooling_type = LLAMA_POOLING_TYPE_RANK; }
             else { invalid_param = true; break; }
         }
         else if (arg == "--threads" || arg == "-t")
@@ -2476,6 +2779,10 @@ static void server_params_parse(int argc, char **argv, server_params &sparams, g
         {
             params.embedding = true;
         }
+        else if (arg == "--vocab-only")
+        {
+            sparams.vocab_only = true;
+        }
         else if (arg == "-cb" || arg == "--cont-batching")
         {
             params.cont_batching = true;
@@ -2517,6 +2824,39 @@ static void server_params_parse(int argc, char **argv, server_params &sparams, g
             }
             params.mmproj = argv[i];
         }
+        else if (arg == "-md" || arg == "--model-draft")
+        {
+            if (++i >= argc)
+            {
+                invalid_param = true;
+                break;
+            }
+            params.model_draft = argv[i];
+        }
+        else if (arg == "--draft")
+        {
+            if (++i >= argc)
+            {
+                invalid_param = true;
+                break;
+            }
+            params.n_draft = std::stoi(argv[i]);
+        }
+        else if (arg == "-ngld" || arg == "--n-gpu-layers-draft")
+        {
+            if (++i >= argc)
+            {
+                invalid_param = true;
+                break;
+            }
+            if (llama_supports_gpu_offload()) {
+                params.n_gpu_layers_draft = std::stoi(argv[i]);
+            } else {
+                LOG_WARNING("Not compiled with GPU offload support, --n-gpu-layers-draft option will be ignored. "
+                        "See main README.md for information on enabling GPU BLAS support",
+                        {{"n_gpu_layers_draft", params.n_gpu_layers_draft}});
+            }
+        }
         else if (arg == "--log-format")
         {
             if (++i >= argc)
@@ -2793,6 +3133,13 @@ int main(int argc, char **argv) {
         server_state current_state = state.load();
         switch(current_state) {
             case SERVER_STATE_READY: {
+                // there are no slots without a context
+                if (llama.vocab_only) {
+                    res.set_content(json{{"status", "ok"}, {"protocol", runner_protocol_version}}.dump(), "application/json");
+                    res.status = 200; // HTTP OK
+                    break;
+                }
+
                 // request slots data using task queue
                 task_server task;
                 task.id   = llama.queue_tasks.get_new_id();
@@ -2811,6 +3158,7 @@ int main(int argc, char **argv) {
 
                 json health = {
                         {"status",           "ok"},
+                        {"protocol",         runner_protocol_version},
                         {"slots_idle",       n_idle_slots},
                         {"slots_processing", n_processing_slots}};
                 res.status = 200; // HTTP OK
@@ -2829,12 +3177,12 @@ int main(int argc, char **argv) {
             }
             case SERVER_STATE_LOADING_MODEL:
                 char buf[128];
-                snprintf(&buf[0], 128, R"({"status": "loading model", "progress": %0.2f})", llama.modelProgress);
+                snprintf(&buf[0], 128, R"({"status": "loading model", "protocol": %d, "progress": %0.2f})", runner_protocol_version, llama.modelProgress);
                 res.set_content(buf, "application/json");
                 res.status = 503; // HTTP Service Unavailable
                 break;
             case SERVER_STATE_ERROR:
-                res.set_content(R"({"status": "error", "error": "Model failed to load"})", "application/json");
+                res.set_content(json{{"status", "error"}, {"protocol", runner_protocol_version}, {"error", "Model failed to load"}}.dump(), "application/json");
                 res.status = 500; // HTTP Internal Server Error
                 break;
         }
@@ -3028,7 +3376,16 @@ int main(int argc, char **argv) {
     params.progress_callback = update_load_progress;
     params.progress_callback_user_data = (void*)&llama;
 
-    if (!llama.load_model(params))
+    if (sparams.vocab_only)
+    {
+        if (!llama.load_vocab(params))
+        {
+            state.store(SERVER_STATE_ERROR);
+            return 1;
+        }
+        state.store(SERVER_STATE_READY);
+        LOG_INFO("model vocabulary loaded", {});
+    } else if (!llama.load_model(params))
     {
         state.store(SERVER_STATE_ERROR);
         return 1;
@@ -3079,6 +3436,11 @@ int main(int argc, char **argv) {
                 if (!validate_api_key(req, res)) {
                     return;
                 }
+                if (llama.vocab_only) {
+                    res.status = 501;
+                    res.set_content("model was loaded without weights", "text/plain; charset=utf-8");
+                    return;
+                }
                 json data = json::parse(req.body);
                 const int task_id = llama.queue_tasks.get_new_id();
                 llama.queue_results.add_waiting_task_id(task_id);
@@ -3159,7 +3521,17 @@ int main(int argc, char **argv) {
                 {
                     tokens = llama.tokenize(body["content"], false);
                 }
-                const json data = format_tokenizer_response(tokens);
+                json data = format_tokenizer_response(tokens);
+                if (json_value(body, "with_pieces", false))
+                {
+                    // pieces may split multibyte characters so send their bytes
+                    json pieces = json::array();
+                    for (const llama_token &token : tokens)
+                    {
+                        pieces.push_back(token_to_bytes(llama.model, token));
+                    }
+                    data["pieces"] = pieces;
+                }
                 return res.set_content(data.dump(), "application/json; charset=utf-8");
             });
 
@@ -3171,7 +3543,7 @@ int main(int argc, char **argv) {
                 if (body.count("tokens") != 0)
                 {
                     const std::vector<llama_token> tokens = body["tokens"];
-                    content = tokens_to_str(llama.ctx, tokens.cbegin(), tokens.cend());
+                    content = tokens_to_str(llama.model, tokens.cbegin(), tokens.cend());
                 }
 
                 const json data = format_detokenized_response(content);
@@ -3181,6 +3553,11 @@ int main(int argc, char **argv) {
     svr.Post("/embedding", [&llama](const httplib::Request &req, httplib::Response &res)
             {
                 res.set_header("Access-Control-Allow-Origin", req.get_header_value("Origin"));
+                if (llama.vocab_only) {
+                    res.status = 501;
+                    res.set_content("model was loaded without weights", "text/plain; charset=utf-8");
+                    return;
+                }
                 const json body = json::parse(req.body);
                 json prompt;
                 if (body.count("content") != 0)
@@ -3221,6 +3598,62 @@ int main(int argc, char **argv) {
                 }
             });
 
+    svr.Post("/rerank", [&llama](const httplib::Request &req, httplib::Response &res)
+            {
+                res.set_header("Access-Control-Allow-Origin", req.get_header_value("Origin"));
+                if (llama.vocab_only) {
+                    res.status = 501;
+                    res.set_content("model was loaded without weights", "text/plain; charset=utf-8");
+                    return;
+                }
+                if (llama_pooling_type(llama.ctx) != LLAMA_POOLING_TYPE_RANK) {
+                    res.status = 400;
+                    res.set_content("model does not support reranking", "text/plain; charset=utf-8");
+                    return;
+                }
+                const json body = json::parse(req.body);
+                const std::string query = body.value("query", "");
+                const std::vector<std::string> documents = body.value("documents", std::vector<std::string>{});
+
+                // each document is scored in its own task as
+                // [BOS]query[EOS][SEP]document[EOS], which is how cross-encoders
+                // are trained, and results are collected in document order
+                std::vector<int> task_ids;
+                for (const auto & document : documents)
+                {
+                    const json prompt = json::array({
+                        llama_token_bos(llama.model), query, llama_token_eos(llama.model),
+                        llama_token_sep(llama.model), document, llama_token_eos(llama.model),
+                    });
+
+                    const int id_task = llama.queue_tasks.get_new_id();
+                    llama.queue_results.add_waiting_task_id(id_task);
+                    llama.request_completion(id_task, {{"prompt", prompt}}, true, -1);
+                    task_ids.push_back(id_task);
+                }
+
+                json scores = json::array();
+                json error;
+                for (const int id_task : task_ids)
+                {
+                    task_result result = llama.queue_results.recv(id_task);
+                    llama.queue_results.remove_waiting_task_id(id_task);
+                    if (result.error) {
+                        error = result.result_json;
+                        continue;
+                    }
+
+                    scores.push_back(result.result_json.value("score", 0.0f));
+                }
+
+                if (!error.is_null()) {
+                    res.status = 500;
+                    return res.set_content(error.dump(), "application/json; charset=utf-8");
+                }
+
+                return res.set_content(json{{"scores", scores}}.dump(), "application/json; charset=utf-8");
+            });
+
     // GG: if I put the main loop inside a thread, it crashes on the first request when build in Debug!?
     //     "Bus error: 10" - this is on macOS, it does not crash on Linux
     //std::thread t2([&]()
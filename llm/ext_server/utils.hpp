@@ -107,6 +107,7 @@ struct completion_token_output {
 
     std::vector<token_prob> probs;
     llama_token tok;
+    float prob = 0.0f; // probability of tok, set when n_probs > 0
     std::string text_to_send;
 };
 
@@ -604,6 +605,21 @@ static size_t find_partial_stop_string(const std::string &stop,
     return std::string::npos;
 }
 
+// token_to_piece is llama_token_to_piece without a context, for runners that
+// only loaded the vocabulary
+static std::string token_to_piece(const llama_model *model, const llama_token token)
+{
+    std::string piece(8, 0);
+    int32_t n = llama_token_to_piece(model, token, &piece[0], piece.size(), 0, true);
+    if (n < 0)
+    {
+        piece.resize(-n);
+        n = llama_token_to_piece(model, token, &piece[0], piece.size(), 0, true);
+    }
+    piece.resize(n);
+    return piece;
+}
+
 // TODO: reuse llama_detokenize
 template <class Iter>
 static std::string tokens_to_str(llama_context *ctx, Iter begin, Iter end)
@@ -616,6 +632,17 @@ static std::string tokens_to_str(llama_context *ctx, Iter begin, Iter end)
     return ret;
 }
 
+template <class Iter>
+static std::string tokens_to_str(const llama_model *model, Iter begin, Iter end)
+{
+    std::string ret;
+    for (; begin != end; ++begin)
+    {
+        ret += token_to_piece(model, *begin);
+    }
+    return ret;
+}
+
 // format incomplete utf-8 multibyte character for output
 static std::string tokens_to_output_formatted_string(const llama_context *ctx, const llama_token token)
 {
@@ -632,6 +659,19 @@ static std::string tokens_to_output_formatted_string(const llama_context *ctx, c
     return out;
 }
 
+// the raw bytes of a token, which may be part of a multibyte character and
+// so can't always be sent as a json string
+static std::vector<uint8_t> token_to_bytes(const llama_model *model, const llama_token token)
+{
+    const std::string piece = token_to_piece(model, token);
+    return std::vector<uint8_t>(piece.begin(), piece.end());
+}
+
+static std::vector<uint8_t> token_to_bytes(const llama_context *ctx, const llama_token token)
+{
+    return token_to_bytes(llama_get_model(ctx), token);
+}
+
 // convert a vector of completion_token_output to json
 static json probs_vector_to_json(const llama_context *ctx, const std::vector<completion_token_output> &probs)
 {
@@ -644,13 +684,18 @@ static json probs_vector_to_json(const llama_context *ctx, const std::vector<com
             std::string tok_str = tokens_to_output_formatted_string(ctx, p.tok);
             probs_for_token.push_back(json
             {
+                {"id",      p.tok},
                 {"tok_str", tok_str},
+                {"bytes",   token_to_bytes(ctx, p.tok)},
                 {"prob",    p.prob},
             });
         }
         std::string tok_str = tokens_to_output_formatted_string(ctx, prob.tok);
         out.push_back(json{
+            {"id",      prob.tok},
             {"content", tok_str},
+            {"bytes",   token_to_bytes(ctx, prob.tok)},
+            {"prob",    prob.prob},
             {"probs",   probs_for_token},
         });
     }
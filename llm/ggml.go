@@ -107,6 +107,69 @@ func (kv KV) ContextLength() uint64 {
 	return kv.u64(fmt.Sprintf("%s.context_length", kv.Architecture()))
 }
 
+// PoolingTypeRank is the pooling type of reranking models, which score how
+// well a document matches a query instead of embedding text
+const PoolingTypeRank = 4
+
+// PoolingType is how an embedding model pools its token embeddings, as a
+// llama_pooling_type. It's 0 for generative models, which have none.
+func (kv KV) PoolingType() uint64 {
+	return kv.u64(fmt.Sprintf("%s.pooling_type", kv.Architecture()))
+}
+
+// VocabSize is the number of tokens in the model's vocabulary
+func (kv KV) VocabSize() uint64 {
+	switch v := kv["tokenizer.ggml.tokens"].(type) {
+	case *array:
+		return uint64(v.size)
+	case []string:
+		return uint64(len(v))
+	}
+
+	return 0
+}
+
+// Strings returns the string array at key. It's nil if there's no such array
+// or it was too large to decode.
+func (kv KV) Strings(key string) []string {
+	return arrayValues[string](kv, key)
+}
+
+// Floats returns the float32 array at key, like Strings.
+func (kv KV) Floats(key string) []float32 {
+	return arrayValues[float32](kv, key)
+}
+
+// Ints returns the int32 array at key, like Strings.
+func (kv KV) Ints(key string) []int32 {
+	return arrayValues[int32](kv, key)
+}
+
+func arrayValues[T any](kv KV, key string) []T {
+	switch v := kv[key].(type) {
+	case []T:
+		return v
+	case *array:
+		if v.values == nil {
+			return nil
+		}
+
+		values := make([]T, len(v.values))
+		for i, e := range v.values {
+			t, ok := e.(T)
+			if !ok {
+				return nil
+			}
+
+			values[i] = t
+		}
+
+		return values
+	}
+
+	return nil
+}
+
 func (kv KV) ChatTemplate() string {
 	s, _ := kv["tokenizer.chat_template"].(string)
 	return s
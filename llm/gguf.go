@@ -536,6 +536,7 @@ var ggufKVOrder = map[string][]string{
 		"tokenizer.ggml.padding_token_id",
 		"tokenizer.ggml.add_bos_token",
 		"tokenizer.ggml.add_eos_token",
+		"tokenizer.ggml.add_space_prefix",
 		"tokenizer.chat_template",
 		"bert.pooling_type",
 	},
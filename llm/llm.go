@@ -14,45 +14,8 @@ import "C"
 import (
 	"fmt"
 	"unsafe"
-	"github.com/ollama/ollama/common" // Added import for common package
 )
 
-func LoadModel(modelPath string) error {
-	model := C.llama_load_model(C.CString(modelPath))
-	if model == nil {
-		return fmt.Errorf("failed to load model from path: %s", modelPath)
-	}
-
-	fmt.Printf("Loading model from: %s\n", modelPath)
-	return nil
-}
-
-// CompletionResponse represents the response structure for completions.
-type CompletionResponse struct {
-	DoneReason         string  `json:"done_reason"`
-	PromptEvalCount    int     `json:"prompt_eval_count"`
-	PromptEvalDuration float64 `json:"prompt_eval_duration"`
-	EvalCount          int     `json:"eval_count"`
-	EvalDuration       float64 `json:"eval_duration"`
-}
-
-// ImageData represents image-related data.
-type ImageData struct {
-	Width  int    `json:"width"`
-	Height int    `json:"height"`
-	URL    string `json:"url"`
-}
-
-// CompletionRequest represents the request structure for completions.
-type CompletionRequest struct {
-	Prompt     string     `json:"prompt"`
-	MaxTokens  int        `json:"max_tokens"`
-	Temperature float64    `json:"temperature"`
-	TopP       float64    `json:"top_p"`
-	Images     []ImageData `json:"images,omitempty"`
-	Format     string     `json:"format,omitempty"`
-}
-
 func SystemInfo() string {
 	return C.GoString(C.llama_print_system_info())
 }
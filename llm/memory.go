@@ -12,13 +12,24 @@ import (
 )
 
 // This algorithm looks for a complete fit to determine if we need to unload other models
-func PredictServerFit(allGpus gpu.GpuInfoList, ggml *GGML, adapters, projectors []string, opts api.Options) (bool, uint64) {
+// A draft model must fit entirely alongside the model.
+func PredictServerFit(allGpus gpu.GpuInfoList, ggml *GGML, adapters, projectors []string, draft string, opts api.Options) (bool, uint64) {
 	// Split up the GPUs by type and try them
 	var estimatedVRAM uint64
 	for _, gpus := range allGpus.ByLibrary() {
+		gpus, draftEstimate, err := EstimateDraftGPULayers(gpus, draft, opts)
+		if err != nil {
+			slog.Warn("unable to estimate draft model", "error", err)
+			return false, estimatedVRAM
+		}
+
+		if draft != "" && !draftEstimate.fullyLoaded() {
+			continue
+		}
+
 		var layerCount int
 		estimate := EstimateGPULayers(gpus, ggml, projectors, opts)
-		layerCount, estimatedVRAM = estimate.Layers, estimate.VRAMSize
+		layerCount, estimatedVRAM = estimate.Layers, estimate.VRAMSize+draftEstimate.VRAMSize
 		if opts.NumGPU < 0 {
 			if layerCount > 0 && layerCount >= int(ggml.KV().BlockCount()+1) {
 				return true, estimatedVRAM
@@ -1,32 +1,1319 @@
 package llm
 
 import (
-	// "context" // Removed unused import
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/ollama/ollama/api" // Ensure api is imported
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/semaphore"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
+	"github.com/ollama/ollama/format"
+	"github.com/ollama/ollama/gpu"
+)
+
+// startSpan starts a span for a request to the runner
+func startSpan(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.Tracer("github.com/ollama/ollama/llm").Start(ctx, name, opts...)
+}
+
+// endSpan ends span, recording err if it isn't nil
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
+
+type LlamaServer interface {
+	Ping(ctx context.Context) error
+	WaitUntilRunning(ctx context.Context) error
+	Completion(ctx context.Context, req CompletionRequest, fn func(CompletionResponse)) error
+	Embed(ctx context.Context, input []string) ([][]float32, error)
+
+	// Rerank scores each document's relevance to query. The model must have
+	// rank pooling.
+	Rerank(ctx context.Context, query string, documents []string) ([]float32, error)
+	Tokenize(ctx context.Context, content string) ([]int, error)
+
+	// TokenizePieces is like Tokenize but also returns the text of each
+	// token. Pieces can hold part of a multibyte character.
+	TokenizePieces(ctx context.Context, content string) ([]int, []string, error)
+	Detokenize(ctx context.Context, tokens []int) (string, error)
+	Close() error
+	EstimatedVRAM() uint64 // Total VRAM across all GPUs
+	EstimatedTotal() uint64
+	EstimatedVRAMByGPU(gpuID string) uint64
+	Pid() int
+
+	// Stopped returns a channel that is closed once the runner stops, either
+	// because it was closed or because it failed. Err returns the failure, or
+	// nil if the runner is still running or was closed.
+	Stopped() <-chan struct{}
+	Err() error
+}
+
+// llmServer is an instance of the llama.cpp server
+type llmServer struct {
+	port        int
+	cmd         *exec.Cmd
+	done        chan error // Channel to signal when the process exits
+	status      *StatusWriter
+	options     api.Options
+	numParallel int
+
+	estimate     MemoryEstimate
+	totalLayers  uint64
+	gpus         gpu.GpuInfoList // Recorded just before the model loaded, free space will be incorrect
+	loadDuration time.Duration   // Record how long it took the model to load
+	loadProgress float32
+
+	sem *semaphore.Weighted
+
+	closing  atomic.Bool
+	stopped  chan struct{} // closed once the runner stops
+	stopOnce sync.Once
+	err      error // set before stopped is closed if the runner failed
+}
+
+// Health checking of a running runner. A runner that misses
+// maxMissedHealthChecks checks in a row is considered hung and killed.
+var (
+	healthCheckInterval   = 10 * time.Second
+	healthCheckTimeout    = 30 * time.Second
+	maxMissedHealthChecks = 3
 )
 
-// LlamaServer represents the server for handling requests
-type LlamaServer struct {
-	Address string // The address of the server
-	Port    int    // The port on which the server listens
+// LoadModel decodes the GGML model at the given path. See DecodeGGML for the
+// meaning of maxArraySize.
+func LoadModel(model string, maxArraySize int) (*GGML, error) {
+	if _, err := os.Stat(model); err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(model)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ggml, _, err := DecodeGGML(f, maxArraySize)
+	return ggml, err
+}
+
+// NewLlamaServer will run a server for the given GPUs
+// The gpu list must be a single family.
+// If draft is set, it's loaded alongside the model for speculative decoding.
+func NewLlamaServer(gpus gpu.GpuInfoList, model string, ggml *GGML, adapters, projectors []string, draft string, opts api.Options, numParallel int) (LlamaServer, error) {
+	var err error
+	var cpuRunner string
+	var estimate MemoryEstimate
+	var systemTotalMemory uint64
+	var systemFreeMemory uint64
+	var systemSwapFreeMemory uint64
+
+	systemMemInfo, err := gpu.GetCPUMem()
+	if err != nil {
+		slog.Error("failed to lookup system memory", "error", err)
+	} else {
+		systemTotalMemory = systemMemInfo.TotalMemory
+		systemFreeMemory = systemMemInfo.FreeMemory
+		systemSwapFreeMemory = systemMemInfo.FreeSwap
+		slog.Debug("system memory", "total", format.HumanBytes2(systemTotalMemory), "free", format.HumanBytes2(systemFreeMemory), "free_swap", format.HumanBytes2(systemSwapFreeMemory))
+	}
+
+	// A vocab-only runner holds no weights so it always runs on the CPU and
+	// needs next to no memory
+	if opts.VocabOnly {
+		opts.NumGPU = 0
+		adapters, projectors, draft = nil, nil, ""
+	}
+
+	// If the user wants zero GPU layers, reset the gpu list to be CPU/system ram info
+	if opts.NumGPU == 0 {
+		gpus = gpu.GetCPUInfo()
+	}
+
+	if draft != "" && len(projectors) > 0 {
+		slog.Warn("speculative decoding isn't supported for multimodal models, ignoring draft model")
+		draft = ""
+	}
+
+	// set aside room for the draft model before fitting the model itself
+	gpus, draftEstimate, err := EstimateDraftGPULayers(gpus, draft, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(gpus) == 1 && gpus[0].Library == "cpu" {
+		cpuRunner = serverForCpu()
+		if !opts.VocabOnly {
+			estimate = EstimateGPULayers(gpus, ggml, projectors, opts)
+		}
+	} else {
+		estimate = EstimateGPULayers(gpus, ggml, projectors, opts)
+
+		switch {
+		case gpus[0].Library == "metal" && estimate.VRAMSize > systemTotalMemory:
+			// disable partial offloading when model is greater than total system memory as this
+			// can lead to locking up the system
+			opts.NumGPU = 0
+		case gpus[0].Library != "metal" && estimate.Layers == 0:
+			// Don't bother loading into the GPU if no layers can fit
+			cpuRunner = serverForCpu()
+			gpus = gpu.GetCPUInfo()
+		case opts.NumGPU < 0 && estimate.Layers > 0 && gpus[0].Library != "cpu":
+			opts.NumGPU = estimate.Layers
+		}
+	}
+
+	estimate.add(draftEstimate)
+
+	// On linux, over-allocating CPU memory will almost always result in an error
+	if runtime.GOOS == "linux" {
+		systemMemoryRequired := estimate.TotalSize - estimate.VRAMSize
+		available := systemFreeMemory + systemSwapFreeMemory
+		if systemMemoryRequired > available {
+			slog.Warn("model request too large for system", "requested", format.HumanBytes2(systemMemoryRequired), "available", available, "total", format.HumanBytes2(systemTotalMemory), "free", format.HumanBytes2(systemFreeMemory), "swap", format.HumanBytes2(systemSwapFreeMemory))
+			return nil, fmt.Errorf("model requires more system memory (%s) than is available (%s)", format.HumanBytes2(systemMemoryRequired), format.HumanBytes2(available))
+		}
+	}
+
+	estimate.log()
+
+	// Loop through potential servers
+	finalErr := errors.New("no suitable llama servers found")
+
+	if len(adapters) > 1 {
+		return nil, errors.New("ollama supports only one lora adapter, but multiple were provided")
+	}
+
+	availableServers := getAvailableServers()
+	if len(availableServers) == 0 {
+		if runtime.GOOS != "windows" {
+			slog.Warn("llama server binary disappeared, reinitializing payloads")
+			err = Init()
+			if err != nil {
+				slog.Warn("failed to reinitialize payloads", "error", err)
+				return nil, err
+			}
+			availableServers = getAvailableServers()
+		} else {
+			return nil, finalErr
+		}
+	}
+	var servers []string
+	if cpuRunner != "" {
+		servers = []string{cpuRunner}
+	} else {
+		servers = serversForGpu(gpus[0]) // All GPUs in the list are matching Library and Variant
+	}
+	demandLib := envconfig.LLMLibrary
+	if demandLib != "" {
+		serverPath := availableServers[demandLib]
+		if serverPath == "" {
+			slog.Info(fmt.Sprintf("Invalid OLLAMA_LLM_LIBRARY %s - not found", demandLib))
+		} else {
+			slog.Info("user override", "OLLAMA_LLM_LIBRARY", demandLib, "path", serverPath)
+			servers = []string{demandLib}
+			if strings.HasPrefix(demandLib, "cpu") {
+				// Omit the GPU flag to silence the warning
+				opts.NumGPU = -1
+			}
+		}
+	}
+
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no servers found for %v", gpus)
+	}
+
+	draftLayers := -1
+	if cpuRunner == "" {
+		draftLayers = draftEstimate.Layers
+	}
+
+	params := runnerParams(model, ggml, gpus, adapters, projectors, draft, draftLayers, &opts, estimate, systemFreeMemory, numParallel)
+
+	for i := range len(servers) {
+		dir := availableServers[servers[i]]
+		if dir == "" {
+			// Shouldn't happen
+			finalErr = fmt.Errorf("[%d] server %s not listed in available servers %v", i, servers[i], availableServers)
+			slog.Error("server list inconsistent", "error", finalErr)
+			continue
+		}
+
+		if strings.HasPrefix(servers[i], "cpu") {
+			gpus = gpu.GetCPUInfo()
+		}
+
+		// Find an availableServers  port, retry on each iteration in case the failure was a port conflict race
+		port := 0
+		if a, err := net.ResolveTCPAddr("tcp", "localhost:0"); err == nil {
+			var l *net.TCPListener
+			if l, err = net.ListenTCP("tcp", a); err == nil {
+				port = l.Addr().(*net.TCPAddr).Port
+				l.Close()
+			}
+		}
+		if port == 0 {
+			slog.Debug("ResolveTCPAddr failed ", "error", err)
+			port = rand.Intn(65535-49152) + 49152 // get a random port in the ephemeral range
+		}
+		finalParams := append(params, "--port", strconv.Itoa(port))
+
+		pathEnv := "LD_LIBRARY_PATH"
+		if runtime.GOOS == "windows" {
+			pathEnv = "PATH"
+		}
+		// prepend the server directory to LD_LIBRARY_PATH/PATH and the parent dir for common dependencies
+		libraryPaths := []string{dir, filepath.Dir(dir)}
+
+		if libraryPath, ok := os.LookupEnv(pathEnv); ok {
+			// Append our runner directory to the path
+			// This will favor system libraries over our bundled library dependencies
+			libraryPaths = append(libraryPaths, filepath.SplitList(libraryPath)...)
+		}
+
+		// Note: we always put the dependency path first
+		// since this was the exact version we verified for AMD GPUs
+		// and we favor what the user had in their path
+		if gpus[0].DependencyPath != "" {
+			libraryPaths = append([]string{gpus[0].DependencyPath}, libraryPaths...)
+		}
+
+		server := filepath.Join(dir, "ollama_llama_server")
+		if runtime.GOOS == "windows" {
+			server += ".exe"
+		}
+
+		// Detect tmp cleaners wiping out the file
+		_, err := os.Stat(server)
+		if errors.Is(err, os.ErrNotExist) {
+			slog.Warn("llama server disappeared, reinitializing payloads", "path", server, "error", err)
+			err = Init()
+			if err != nil {
+				slog.Warn("failed to reinitialize payloads", "error", err)
+				return nil, err
+			}
+		}
+
+		s := &llmServer{
+			port:        port,
+			cmd:         exec.Command(server, finalParams...),
+			status:      NewStatusWriter(os.Stderr),
+			options:     opts,
+			estimate:    estimate,
+			numParallel: numParallel,
+			sem:         semaphore.NewWeighted(int64(numParallel)),
+			totalLayers: ggml.KV().BlockCount() + 1,
+			gpus:        gpus,
+			done:        make(chan error, 1),
+			stopped:     make(chan struct{}),
+		}
+
+		s.cmd.Env = os.Environ()
+		s.cmd.Stdout = os.Stdout
+		s.cmd.Stderr = s.status
+		s.cmd.SysProcAttr = LlamaServerSysProcAttr
+
+		envWorkarounds := [][2]string{}
+		for _, gpu := range gpus {
+			envWorkarounds = append(envWorkarounds, gpu.EnvWorkarounds...)
+		}
+		visibleDevicesEnv, visibleDevicesEnvVal := gpus.GetVisibleDevicesEnv()
+		pathEnvVal := strings.Join(libraryPaths, string(filepath.ListSeparator))
+
+		// Update or add the path and visible devices variable with our adjusted version
+		pathNeeded := true
+		devicesNeeded := visibleDevicesEnv != ""
+		for i := range s.cmd.Env {
+			cmp := strings.SplitN(s.cmd.Env[i], "=", 2)
+			if strings.EqualFold(cmp[0], pathEnv) {
+				s.cmd.Env[i] = pathEnv + "=" + pathEnvVal
+				pathNeeded = false
+			} else if devicesNeeded && strings.EqualFold(cmp[0], visibleDevicesEnv) {
+				s.cmd.Env[i] = visibleDevicesEnv + "=" + visibleDevicesEnvVal
+				devicesNeeded = false
+			} else if len(envWorkarounds) != 0 {
+				for _, kv := range envWorkarounds {
+					if strings.EqualFold(cmp[0], kv[0]) {
+						s.cmd.Env[i] = kv[0] + "=" + kv[1]
+					}
+				}
+			}
+		}
+		if pathNeeded {
+			s.cmd.Env = append(s.cmd.Env, pathEnv+"="+pathEnvVal)
+		}
+		if devicesNeeded {
+			s.cmd.Env = append(s.cmd.Env, visibleDevicesEnv+"="+visibleDevicesEnvVal)
+		}
+
+		slog.Info("starting llama server", "cmd", s.cmd.String())
+		if envconfig.Debug {
+			filteredEnv := []string{}
+			for _, ev := range s.cmd.Env {
+				if strings.HasPrefix(ev, "CUDA_") ||
+					strings.HasPrefix(ev, "ROCR_") ||
+					strings.HasPrefix(ev, "ROCM_") ||
+					strings.HasPrefix(ev, "HIP_") ||
+					strings.HasPrefix(ev, "GPU_") ||
+					strings.HasPrefix(ev, "HSA_") ||
+					strings.HasPrefix(ev, "GGML_") ||
+					strings.HasPrefix(ev, "PATH=") ||
+					strings.HasPrefix(ev, "LD_LIBRARY_PATH=") {
+					filteredEnv = append(filteredEnv, ev)
+				}
+			}
+			// Log at debug as the environment is inherited and might contain sensitive information
+			slog.Debug("subprocess", "environment", filteredEnv)
+		}
+
+		if err = s.cmd.Start(); err != nil {
+			// Detect permission denied and augment the message about noexec
+			if errors.Is(err, os.ErrPermission) {
+				finalErr = fmt.Errorf("unable to start server %w.  %s may have noexec set.  Set OLLAMA_TMPDIR for server to a writable executable directory", err, dir)
+				continue
+			}
+			finalErr = s.status.loadError(fmt.Errorf("error starting the external llama server: %w", err))
+			continue
+		}
+
+		// reap subprocess when it exits
+		go func() {
+			err := s.cmd.Wait()
+			if s.closing.Load() {
+				s.stop(nil)
+			} else {
+				s.stop(s.status.runnerError(fmt.Errorf("llama runner process exited unexpectedly: %w", err)))
+			}
+			s.done <- err
+		}()
+
+		return s, nil
+	}
+
+	slog.Error("unable to load any llama server", "error", finalErr)
+	return nil, finalErr
+}
+
+// runnerParams returns the command line arguments, apart from the port, for a
+// runner serving model with opts on gpus. draftLayers is the number of layers
+// of the draft model to offload, or -1 when running on the CPU. The mmap
+// setting in opts is updated for partial offloads on Metal.
+func runnerParams(model string, ggml *GGML, gpus gpu.GpuInfoList, adapters, projectors []string, draft string, draftLayers int, opts *api.Options, estimate MemoryEstimate, systemFreeMemory uint64, numParallel int) []string {
+	params := []string{
+		"--model", model,
+		"--ctx-size", strconv.Itoa(opts.NumCtx),
+		"--batch-size", strconv.Itoa(opts.NumBatch),
+		"--embedding",
+	}
+
+	params = append(params, "--log-disable")
+
+	if opts.VocabOnly {
+		params = append(params, "--vocab-only")
+	}
+
+	if opts.NumGPU >= 0 {
+		params = append(params, "--n-gpu-layers", strconv.Itoa(opts.NumGPU))
+	}
+
+	if envconfig.Debug {
+		params = append(params, "--verbose")
+	}
+
+	if opts.MainGPU > 0 {
+		params = append(params, "--main-gpu", strconv.Itoa(opts.MainGPU))
+	}
+
+	if len(adapters) > 0 {
+		// applying multiple adapters is not supported by the llama.cpp server yet
+		params = append(params, "--lora", adapters[0])
+	}
+
+	if len(projectors) > 0 {
+		// applying multiple projectors is not supported by the llama.cpp server yet
+		params = append(params, "--mmproj", projectors[0])
+	}
+
+	if draft != "" {
+		params = append(params, "--model-draft", draft, "--draft", strconv.Itoa(numDraft))
+		if draftLayers >= 0 {
+			params = append(params, "--n-gpu-layers-draft", strconv.Itoa(draftLayers))
+		}
+	}
+
+	if opts.NumThread > 0 {
+		params = append(params, "--threads", strconv.Itoa(opts.NumThread))
+	}
+
+	if !opts.F16KV {
+		params = append(params, "--memory-f32")
+	}
+
+	flashAttnEnabled := envconfig.FlashAttention
+
+	for _, g := range gpus {
+		// only cuda (compute capability 7+) and metal support flash attention
+		if g.Library != "metal" && (g.Library != "cuda" || g.DriverMajor < 7) {
+			flashAttnEnabled = false
+		}
+
+		// mmap has issues with partial offloading on metal
+		if g.Library == "metal" &&
+			uint64(opts.NumGPU) > 0 &&
+			uint64(opts.NumGPU) < ggml.KV().BlockCount()+1 {
+			opts.UseMMap = new(bool)
+			*opts.UseMMap = false
+		}
+	}
+
+	if flashAttnEnabled {
+		params = append(params, "--flash-attn")
+	}
+
+	// Windows CUDA should not use mmap for best performance
+	// Linux  with a model larger than free space, mmap leads to thrashing
+	// For CPU loads we want the memory to be allocated, not FS cache
+	if (runtime.GOOS == "windows" && gpus[0].Library == "cuda" && opts.UseMMap == nil) ||
+		(runtime.GOOS == "linux" && systemFreeMemory < estimate.TotalSize && opts.UseMMap == nil) ||
+		(gpus[0].Library == "cpu" && opts.UseMMap == nil) ||
+		(opts.UseMMap != nil && !*opts.UseMMap) {
+		params = append(params, "--no-mmap")
+	}
+
+	if opts.UseMLock {
+		params = append(params, "--mlock")
+	}
+
+	if opts.UseNUMA {
+		params = append(params, "--numa")
+	}
+
+	params = append(params, "--parallel", strconv.Itoa(numParallel))
+
+	// decode all active sequences together in one batch per step and admit
+	// new ones between steps rather than waiting for the batch to drain
+	if numParallel > 1 {
+		params = append(params, "--cont-batching")
+	}
+
+	if estimate.TensorSplit != "" {
+		params = append(params, "--tensor-split", estimate.TensorSplit)
+	}
+
+	return params
+}
+
+type ServerStatus int
+
+const ( // iota is reset to 0
+	ServerStatusReady ServerStatus = iota
+	ServerStatusNoSlotsAvailable
+	ServerStatusLoadingModel
+	ServerStatusNotResponding
+	ServerStatusError
+)
+
+func (s ServerStatus) ToString() string {
+	switch s {
+	case ServerStatusReady:
+		return "llm server ready"
+	case ServerStatusNoSlotsAvailable:
+		return "llm busy - no slots available"
+	case ServerStatusLoadingModel:
+		return "llm server loading model"
+	case ServerStatusNotResponding:
+		return "llm server not responding"
+	default:
+		return "llm server error"
+	}
+}
+
+type ServerStatusResp struct {
+	Status          string  `json:"status"`
+	Protocol        int     `json:"protocol"`
+	SlotsIdle       int     `json:"slots_idle"`
+	SlotsProcessing int     `json:"slots_processing"`
+	Error           string  `json:"error"`
+	Progress        float32 `json:"progress"`
+}
+
+// exited reports a LoadError if the runner process is no longer running
+func (s *llmServer) exited() error {
+	if s.cmd == nil || s.cmd.ProcessState == nil {
+		return nil
+	}
+
+	if s.cmd.ProcessState.ExitCode() == -1 {
+		// Most likely a signal killed it, log some more details to try to help troubleshoot
+		slog.Warn("llama runner process no longer running", "sys", s.cmd.ProcessState.Sys(), "string", s.cmd.ProcessState.String())
+	}
+
+	return s.status.loadError(fmt.Errorf("llama runner process no longer running: %d", s.cmd.ProcessState.ExitCode()))
+}
+
+func (s *llmServer) url(path string) string {
+	return fmt.Sprintf("http://127.0.0.1:%d%s", s.port, path)
+}
+
+func (s *llmServer) getServerStatus(ctx context.Context) (ServerStatus, error) {
+	// Fail fast if its exited
+	if err := s.exited(); err != nil {
+		return ServerStatusError, err
+	}
+
+	if err := s.Err(); err != nil {
+		return ServerStatusError, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url("/health"), nil)
+	if err != nil {
+		return ServerStatusError, fmt.Errorf("error creating GET request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(ProtocolHeader, strconv.Itoa(ProtocolVersion))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return ServerStatusNotResponding, errors.New("server not responding")
+		}
+		return ServerStatusError, fmt.Errorf("health resp: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return ServerStatusError, fmt.Errorf("read health request: %w", err)
+	}
+
+	var status ServerStatusResp
+	if err := json.Unmarshal(body, &status); err != nil {
+		return ServerStatusError, fmt.Errorf("health unmarshal encode response: %w", err)
+	}
+
+	// runners from before the version was reported have none
+	if status.Protocol != ProtocolVersion {
+		return ServerStatusError, fmt.Errorf("%w: runner speaks version %d, server expects %d", ErrProtocolMismatch, status.Protocol, ProtocolVersion)
+	}
+
+	switch status.Status {
+	case "ok":
+		return ServerStatusReady, nil
+	case "no slot available":
+		return ServerStatusNoSlotsAvailable, nil
+	case "loading model":
+		s.loadProgress = status.Progress
+		return ServerStatusLoadingModel, nil
+	default:
+		return ServerStatusError, fmt.Errorf("server error: %+v", status)
+	}
+}
+
+// getServerStatusRetry will retry if ServerStatusNoSlotsAvailable is received
+func (s *llmServer) getServerStatusRetry(ctx context.Context) (ServerStatus, error) {
+	var retries int
+	for {
+		status, err := s.getServerStatus(ctx)
+		if err != nil {
+			return status, err
+		}
+
+		if status == ServerStatusNoSlotsAvailable {
+			if retries >= 10 {
+				return status, fmt.Errorf("no slots available after %d retries", retries)
+			}
+
+			time.Sleep(5 * time.Millisecond)
+			retries++
+			continue
+		}
+
+		return status, nil
+	}
+}
+
+func (s *llmServer) Ping(ctx context.Context) error {
+	_, err := s.getServerStatus(ctx)
+	if err != nil {
+		slog.Debug("server unhealthy", "error", err)
+		return err
+	}
+	return nil
+}
+
+func (s *llmServer) WaitUntilRunning(ctx context.Context) error {
+	start := time.Now()
+	stallDuration := 5 * time.Minute            // If no progress happens
+	finalLoadDuration := 5 * time.Minute        // After we hit 100%, give the runner more time to come online
+	stallTimer := time.Now().Add(stallDuration) // give up if we stall
+
+	slog.Info("waiting for llama runner to start responding")
+	var lastStatus ServerStatus = -1
+	fullyLoaded := false
+
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Warn("client connection closed before server finished loading, aborting load")
+			return fmt.Errorf("timed out waiting for llama runner to start: %w", ctx.Err())
+		case err := <-s.done:
+			if s.status != nil && strings.Contains(s.status.LastErrMsg, "unknown model") {
+				return fmt.Errorf("this model is not supported by your version of Ollama. You may need to upgrade")
+			}
+			return s.status.loadError(fmt.Errorf("llama runner process has terminated: %v", err))
+		default:
+		}
+		if time.Now().After(stallTimer) {
+			// timeout
+			return s.status.loadError(fmt.Errorf("timed out waiting for llama runner to start - progress %0.2f", s.loadProgress))
+		}
+		if err := s.exited(); err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+		defer cancel()
+		priorProgress := s.loadProgress
+		status, err := s.getServerStatus(ctx)
+		if errors.Is(err, ErrProtocolMismatch) {
+			return s.status.loadError(err)
+		}
+		if lastStatus != status && status != ServerStatusReady {
+			// Only log on status changes
+			slog.Info("waiting for server to become available", "status", status.ToString())
+		}
+		switch status {
+		case ServerStatusReady:
+			s.loadDuration = time.Since(start)
+			slog.Info(fmt.Sprintf("llama runner started in %0.2f seconds", s.loadDuration.Seconds()))
+			go s.supervise(healthCheckInterval)
+			return nil
+		default:
+			lastStatus = status
+			// Reset the timer as long as we're making forward progress on the load
+			if priorProgress != s.loadProgress {
+				slog.Debug(fmt.Sprintf("model load progress %0.2f", s.loadProgress))
+				stallTimer = time.Now().Add(stallDuration)
+			} else if !fullyLoaded && int(s.loadProgress*100.0) >= 100 {
+				slog.Debug("model load completed, waiting for server to become available", "status", status.ToString())
+				stallTimer = time.Now().Add(finalLoadDuration)
+				fullyLoaded = true
+			}
+			time.Sleep(time.Millisecond * 250)
+			continue
+		}
+	}
+}
+
+// supervise health checks the runner once it's running. A runner that stops
+// responding is killed and marked failed so requests in flight return an
+// error instead of hanging. Exits are picked up by the process reaper.
+func (s *llmServer) supervise(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var missed int
+	for {
+		select {
+		case <-s.stopped:
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+		_, err := s.getServerStatus(ctx)
+		cancel()
+		if err == nil {
+			missed = 0
+			continue
+		}
+
+		missed++
+		slog.Warn("llama runner health check failed", "pid", s.Pid(), "missed", missed, "error", err)
+		if missed >= maxMissedHealthChecks {
+			s.stop(s.status.runnerError(fmt.Errorf("llama runner stopped responding after %d health checks: %w", missed, err)))
+			if s.cmd != nil && s.cmd.Process != nil {
+				if err := s.cmd.Process.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
+					slog.Warn("failed to kill unresponsive llama runner", "error", err)
+				}
+			}
+			return
+		}
+	}
+}
+
+// stop marks the runner as stopped, recording err as the reason if it failed
+func (s *llmServer) stop(err error) {
+	s.stopOnce.Do(func() {
+		s.err = err
+		close(s.stopped)
+	})
+}
+
+func (s *llmServer) Stopped() <-chan struct{} {
+	return s.stopped
 }
 
-// NewLlamaServer creates a new LlamaServer instance
-func NewLlamaServer(address string, port int) *LlamaServer {
-	return &LlamaServer{
-		Address: address,
-		Port:    port,
+func (s *llmServer) Err() error {
+	select {
+	case <-s.stopped:
+		return s.err
+	default:
+		return nil
 	}
 }
 
-// Completion handles completion requests
-func (s *LlamaServer) Completion(req api.CompletionRequest) (api.CompletionResponse, error) {
-	// Implementation for handling completion requests
-	return api.CompletionResponse{
-		Content: "This is a placeholder response.",
-		Done:    true,
-	}, nil
+// requestContext returns a context for a request to the runner which is
+// canceled if the runner fails while the request is in flight
+func (s *llmServer) requestContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	go func() {
+		select {
+		case <-s.stopped:
+			cancel(s.Err())
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, func() { cancel(nil) }
+}
+
+// runnerError replaces err with the runner failure if the runner failed
+func (s *llmServer) runnerError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if rerr := s.Err(); rerr != nil {
+		return rerr
+	}
+
+	return err
+}
+
+const jsonGrammar = `
+root   ::= object
+value  ::= object | array | string | number | ("true" | "false" | "null") ws
+
+object ::=
+  "{" ws (
+            string ":" ws value
+    ("," ws string ":" ws value)*
+  )? "}" ws
+
+array  ::=
+  "[" ws (
+            value
+    ("," ws value)*
+  )? "]" ws
+
+string ::=
+  "\"" (
+    [^"\\\x7F\x00-\x1F] |
+    "\\" (["\\/bfnrt] | "u" [0-9a-fA-F] [0-9a-fA-F] [0-9a-fA-F] [0-9a-fA-F]) # escapes
+  )* "\"" ws
+
+number ::= ("-"? ([0-9] | [1-9] [0-9]*)) ("." [0-9]+)? ([eE] [-+]? [0-9]+)? ws
+
+# Optional space: by convention, applied in this grammar after literal chars when allowed
+ws ::= ([ \t\n] ws)?
+`
+
+const maxBufferSize = 512 * format.KiloByte
+
+func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn func(CompletionResponse)) (err error) {
+	ctx, span := startSpan(ctx, "runner.completion", trace.WithAttributes(attribute.Int("images", len(req.Images))))
+	defer func() { endSpan(span, err) }()
+
+	ctx, cancel := s.requestContext(ctx)
+	defer cancel()
+
+	return s.runnerError(s.completion(ctx, req, fn))
 }
 
-// Other methods for LlamaServer can be added here
+func (s *llmServer) completion(ctx context.Context, req CompletionRequest, fn func(CompletionResponse)) error {
+	if err := s.sem.Acquire(ctx, 1); err != nil {
+		slog.Error("Failed to acquire semaphore", "error", err)
+		return err
+	}
+	defer s.sem.Release(1)
+
+	// put an upper limit on num_predict to avoid the model running on forever
+	if req.Options.NumPredict < 0 || req.Options.NumPredict > 10*s.options.NumCtx {
+		req.Options.NumPredict = 10 * s.options.NumCtx
+	}
+
+	request := newCompletionRequest(req)
+
+	// Make sure the server is ready
+	status, err := s.getServerStatusRetry(ctx)
+	if err != nil {
+		return err
+	} else if status != ServerStatusReady {
+		return fmt.Errorf("unexpected server status: %s", status.ToString())
+	}
+
+	if request.Grammar == jsonGrammar {
+		if !strings.Contains(strings.ToLower(req.Prompt), "json") {
+			slog.Warn("Prompt does not specify that the LLM should response in JSON, but JSON format is expected. For best results specify that JSON is expected in the system prompt.")
+		}
+	}
+
+	// Handling JSON marshaling with special characters unescaped.
+	buffer := &bytes.Buffer{}
+	enc := json.NewEncoder(buffer)
+	enc.SetEscapeHTML(false)
+
+	if err := enc.Encode(request); err != nil {
+		return fmt.Errorf("failed to marshal data: %v", err)
+	}
+
+	serverReq, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url("/completion"), buffer)
+	if err != nil {
+		return fmt.Errorf("error creating POST request: %v", err)
+	}
+	serverReq.Header.Set("Content-Type", "application/json")
+	serverReq.Header.Set(ProtocolHeader, strconv.Itoa(ProtocolVersion))
+
+	res, err := http.DefaultClient.Do(serverReq)
+	if err != nil {
+		return fmt.Errorf("POST predict: %v", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 400 {
+		bodyBytes, err := io.ReadAll(res.Body)
+		if err != nil {
+			return fmt.Errorf("failed reading llm error response: %w", err)
+		}
+		slog.Error("llm predict error", "body", bodyBytes)
+		return fmt.Errorf("%s", bodyBytes)
+	}
+
+	scanner := bufio.NewScanner(res.Body)
+	buf := make([]byte, 0, maxBufferSize)
+	scanner.Buffer(buf, maxBufferSize)
+
+	// keep track of the last token generated, this is used to abort if the model starts looping
+	var lastToken string
+	var tokenRepeat int
+
+	// number of tokens generated so far, reported if the request is cancelled
+	var evalCount int
+	evalStart := time.Now()
+
+	for scanner.Scan() {
+		select {
+		case <-ctx.Done():
+			return s.cancelled(ctx, evalCount, time.Since(evalStart), fn)
+		default:
+			line := scanner.Bytes()
+			if len(line) == 0 {
+				continue
+			}
+
+			evt, ok := bytes.CutPrefix(line, []byte("data: "))
+			if !ok {
+				return fmt.Errorf("error parsing llm response stream: %s", line)
+			}
+
+			var c completionChunk
+			if err := json.Unmarshal(evt, &c); err != nil {
+				return fmt.Errorf("error unmarshalling llm prediction response: %v", err)
+			}
+
+			switch {
+			case strings.TrimSpace(c.Content) == lastToken:
+				tokenRepeat++
+			default:
+				lastToken = strings.TrimSpace(c.Content)
+				tokenRepeat = 0
+			}
+
+			// 30 picked as an arbitrary max token repeat limit, modify as needed
+			if tokenRepeat > 30 {
+				slog.Debug("prediction aborted, token repeat limit reached")
+				return ctx.Err()
+			}
+
+			if c.Content != "" {
+				evalCount++
+				resp := CompletionResponse{Content: c.Content}
+				if req.Logprobs {
+					resp.Logprobs = c.logprobs(req.TopLogprobs)
+				}
+
+				fn(resp)
+			}
+
+			if c.Stop {
+				fn(c.final())
+				return nil
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		if ctx.Err() != nil {
+			return s.cancelled(ctx, evalCount, time.Since(evalStart), fn)
+		}
+
+		if strings.Contains(err.Error(), "unexpected EOF") {
+			err := s.status.runnerError(errors.New("an unknown error was encountered while running the model"))
+			s.stop(err)
+			s.Close()
+			return err
+		}
+
+		return fmt.Errorf("error reading llm response: %v", err)
+	}
+
+	return nil
+}
+
+// cancelled finishes a completion whose context was cancelled part way
+// through. Canceling the request to the runner closes the connection, which
+// aborts the slot so it's free for the next request. If the client went away
+// fn receives a final response with a done reason of "cancelled", otherwise
+// the cause of the cancellation, such as the runner failing, is returned.
+func (s *llmServer) cancelled(ctx context.Context, evalCount int, evalDuration time.Duration, fn func(CompletionResponse)) error {
+	if cause := context.Cause(ctx); !errors.Is(cause, context.Canceled) {
+		return cause
+	}
+
+	slog.Info("completion cancelled", "done_reason", "cancelled", "eval_count", evalCount, "eval_duration", evalDuration)
+	fn(CompletionResponse{
+		Done:         true,
+		DoneReason:   "cancelled",
+		EvalCount:    evalCount,
+		EvalDuration: evalDuration,
+	})
+
+	return nil
+}
+
+func (s *llmServer) Embed(ctx context.Context, input []string) ([][]float32, error) {
+	ctx, cancel := s.requestContext(ctx)
+	defer cancel()
+
+	embedding, err := s.embed(ctx, input)
+	return embedding, s.runnerError(err)
+}
+
+func (s *llmServer) embed(ctx context.Context, input []string) ([][]float32, error) {
+	if err := s.sem.Acquire(ctx, 1); err != nil {
+		slog.Error("Failed to acquire semaphore", "error", err)
+		return nil, err
+	}
+	defer s.sem.Release(1)
+
+	// Make sure the server is ready
+	status, err := s.getServerStatusRetry(ctx)
+	if err != nil {
+		return nil, err
+	} else if status != ServerStatusReady {
+		return nil, fmt.Errorf("unexpected server status: %s", status.ToString())
+	}
+
+	data, err := json.Marshal(EmbedRequest{Content: input})
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling embed data: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url("/embedding"), bytes.NewBuffer(data))
+	if err != nil {
+		return nil, fmt.Errorf("error creating embed request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(ProtocolHeader, strconv.Itoa(ProtocolVersion))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("do embedding request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading embed response: %w", err)
+	}
+
+	if resp.StatusCode >= 400 {
+		slog.Error("llm embedding error", "body", body)
+		return nil, fmt.Errorf("%s", body)
+	}
+
+	var e EmbedResponse
+	if err := json.Unmarshal(body, &e); err != nil {
+		return nil, fmt.Errorf("unmarshal tokenize response: %w", err)
+	}
+
+	return e.Embedding, nil
+}
+
+func (s *llmServer) Rerank(ctx context.Context, query string, documents []string) ([]float32, error) {
+	ctx, cancel := s.requestContext(ctx)
+	defer cancel()
+
+	scores, err := s.rerank(ctx, query, documents)
+	return scores, s.runnerError(err)
+}
+
+func (s *llmServer) rerank(ctx context.Context, query string, documents []string) ([]float32, error) {
+	if err := s.sem.Acquire(ctx, 1); err != nil {
+		slog.Error("Failed to acquire semaphore", "error", err)
+		return nil, err
+	}
+	defer s.sem.Release(1)
+
+	status, err := s.getServerStatusRetry(ctx)
+	if err != nil {
+		return nil, err
+	} else if status != ServerStatusReady {
+		return nil, fmt.Errorf("unexpected server status: %s", status.ToString())
+	}
+
+	data, err := json.Marshal(RerankRequest{Query: query, Documents: documents})
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling rerank data: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url("/rerank"), bytes.NewBuffer(data))
+	if err != nil {
+		return nil, fmt.Errorf("error creating rerank request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(ProtocolHeader, strconv.Itoa(ProtocolVersion))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("do rerank request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading rerank response: %w", err)
+	}
+
+	if resp.StatusCode >= 400 {
+		slog.Error("llm rerank error", "body", body)
+		return nil, fmt.Errorf("%s", body)
+	}
+
+	var r RerankResponse
+	if err := json.Unmarshal(body, &r); err != nil {
+		return nil, fmt.Errorf("unmarshal rerank response: %w", err)
+	}
+
+	if len(r.Scores) != len(documents) {
+		return nil, fmt.Errorf("expected %d rerank scores, got %d", len(documents), len(r.Scores))
+	}
+
+	return r.Scores, nil
+}
+
+func (s *llmServer) Tokenize(ctx context.Context, content string) ([]int, error) {
+	encoded, err := s.tokenize(ctx, TokenizeRequest{Content: content})
+	if err != nil {
+		return nil, err
+	}
+
+	return encoded.Tokens, nil
+}
+
+func (s *llmServer) TokenizePieces(ctx context.Context, content string) ([]int, []string, error) {
+	encoded, err := s.tokenize(ctx, TokenizeRequest{Content: content, WithPieces: true})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(encoded.Pieces) != len(encoded.Tokens) {
+		return nil, nil, fmt.Errorf("runner returned %d pieces for %d tokens", len(encoded.Pieces), len(encoded.Tokens))
+	}
+
+	pieces := make([]string, len(encoded.Pieces))
+	for i, bts := range encoded.Pieces {
+		pieces[i] = piece(bts)
+	}
+
+	return encoded.Tokens, pieces, nil
+}
+
+func (s *llmServer) tokenize(ctx context.Context, r TokenizeRequest) (_ *TokenizeResponse, err error) {
+	ctx, span := startSpan(ctx, "tokenize", trace.WithAttributes(attribute.Int("length", len(r.Content))))
+	defer func() { endSpan(span, err) }()
+
+	// Make sure the server is ready
+	status, err := s.getServerStatus(ctx)
+	if err != nil {
+		return nil, err
+	} else if status != ServerStatusReady && status != ServerStatusNoSlotsAvailable {
+		return nil, fmt.Errorf("unexpected server status: %s", status.ToString())
+	}
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		return nil, fmt.Errorf("marshaling encode data: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url("/tokenize"), bytes.NewBuffer(data))
+	if err != nil {
+		return nil, fmt.Errorf("encode request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(ProtocolHeader, strconv.Itoa(ProtocolVersion))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("do encode request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read encode request: %w", err)
+	}
+
+	if resp.StatusCode >= 400 {
+		slog.Error("llm encode error", "body", body)
+		return nil, fmt.Errorf("%s", body)
+	}
+
+	var encoded TokenizeResponse
+	if err := json.Unmarshal(body, &encoded); err != nil {
+		return nil, fmt.Errorf("unmarshal encode response: %w", err)
+	}
+
+	return &encoded, nil
+}
+
+func (s *llmServer) Detokenize(ctx context.Context, tokens []int) (_ string, err error) {
+	ctx, span := startSpan(ctx, "detokenize", trace.WithAttributes(attribute.Int("tokens", len(tokens))))
+	defer func() { endSpan(span, err) }()
+
+	// Make sure the server is ready
+	status, err := s.getServerStatus(ctx)
+	if err != nil {
+		return "", err
+	} else if status != ServerStatusReady && status != ServerStatusNoSlotsAvailable {
+		return "", fmt.Errorf("unexpected server status: %s", status.ToString())
+	}
+
+	data, err := json.Marshal(DetokenizeRequest{Tokens: tokens})
+	if err != nil {
+		return "", fmt.Errorf("marshaling decode data: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url("/detokenize"), bytes.NewBuffer(data))
+	if err != nil {
+		return "", fmt.Errorf("decode request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(ProtocolHeader, strconv.Itoa(ProtocolVersion))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("do decode request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("read decode request: %w", err)
+	}
+
+	if resp.StatusCode >= 400 {
+		slog.Error("llm decode error", "body", body)
+		return "", fmt.Errorf("%s", body)
+	}
+
+	var decoded DetokenizeResponse
+	if err := json.Unmarshal(body, &decoded); err != nil {
+		return "", fmt.Errorf("unmarshal encode response: %w", err)
+	}
+
+	return decoded.Content, nil
+}
+
+func (s *llmServer) Close() error {
+	s.closing.Store(true)
+	if s.cmd == nil {
+		s.stop(nil)
+		return nil
+	}
+
+	slog.Debug("stopping llama server")
+	if err := s.cmd.Process.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		return err
+	}
+	// if ProcessState is already populated, Wait already completed, no need to wait again
+	if s.cmd.ProcessState == nil {
+		slog.Debug("waiting for llama server to exit")
+		<-s.done
+	}
+
+	slog.Debug("llama server stopped")
+	return nil
+}
+
+func (s *llmServer) EstimatedVRAM() uint64 {
+	return s.estimate.VRAMSize
+}
+
+func (s *llmServer) EstimatedTotal() uint64 {
+	return s.estimate.TotalSize
+}
+
+func (s *llmServer) EstimatedVRAMByGPU(gpuID string) uint64 {
+	for i, gpu := range s.gpus {
+		if gpu.ID == gpuID && i < len(s.estimate.GPUSizes) {
+			return s.estimate.GPUSizes[i]
+		}
+	}
+	return 0
+}
+
+// Pid returns the process ID of the runner, or -1 if it isn't running
+func (s *llmServer) Pid() int {
+	if s.cmd != nil && s.cmd.Process != nil {
+		return s.cmd.Process.Pid
+	}
+	return -1
+}
+
+func parseDurationMs(ms float64) time.Duration {
+	dur, err := time.ParseDuration(fmt.Sprintf("%fms", ms))
+	if err != nil {
+		panic(err)
+	}
+
+	return dur
+}
@@ -0,0 +1,667 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"golang.org/x/sync/semaphore"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/gpu"
+)
+
+// newStubServer returns an llmServer talking to handler in place of a runner
+// subprocess
+func newStubServer(t testing.TB, handler http.Handler) *llmServer {
+	t.Helper()
+
+	ts := httptest.NewServer(handler)
+	t.Cleanup(ts.Close)
+
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	port, err := strconv.Atoi(u.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := api.DefaultOptions()
+	return &llmServer{
+		port:        port,
+		status:      NewStatusWriter(os.Stderr),
+		options:     opts,
+		numParallel: 1,
+		sem:         semaphore.NewWeighted(1),
+		done:        make(chan error, 1),
+		stopped:     make(chan struct{}),
+	}
+}
+
+func healthy(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintf(w, `{"status":"ok","protocol":%d,"slots_idle":1,"slots_processing":0}`, ProtocolVersion)
+}
+
+func TestCompletion(t *testing.T) {
+	var got map[string]any
+	var version string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", healthy)
+	mux.HandleFunc("/completion", func(w http.ResponseWriter, r *http.Request) {
+		version = r.Header.Get(ProtocolHeader)
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Error(err)
+		}
+
+		fmt.Fprintln(w, `data: {"content":"Hello"}`)
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, `data: {"content":" world"}`)
+		fmt.Fprintln(w, `data: {"content":"","stop":true,"stopped_limit":true,"timings":{"predicted_n":2,"predicted_ms":20,"prompt_n":3,"prompt_ms":10,"draft_n":4,"draft_accepted_n":1}}`)
+	})
+
+	s := newStubServer(t, mux)
+
+	opts := api.DefaultOptions()
+	var resps []CompletionResponse
+	err := s.Completion(context.Background(), CompletionRequest{Prompt: "hi", Format: "json", Options: &opts}, func(r CompletionResponse) {
+		resps = append(resps, r)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if version != strconv.Itoa(ProtocolVersion) {
+		t.Errorf("expected protocol version %d, got %q", ProtocolVersion, version)
+	}
+
+	if got["prompt"] != "hi" {
+		t.Errorf("expected prompt %q, got %v", "hi", got["prompt"])
+	}
+
+	if got["grammar"] != jsonGrammar {
+		t.Errorf("expected json grammar, got %v", got["grammar"])
+	}
+
+	if _, ok := got["image_data"]; ok {
+		t.Errorf("expected no image_data, got %v", got["image_data"])
+	}
+
+	if len(resps) != 3 {
+		t.Fatalf("expected 3 responses, got %d", len(resps))
+	}
+
+	if resps[0].Content != "Hello" || resps[1].Content != " world" {
+		t.Errorf("unexpected content %q %q", resps[0].Content, resps[1].Content)
+	}
+
+	final := resps[2]
+	if !final.Done || final.DoneReason != "length" {
+		t.Errorf("expected done with reason length, got %+v", final)
+	}
+
+	if final.PromptEvalCount != 3 || final.PromptEvalDuration != 10*time.Millisecond {
+		t.Errorf("unexpected prompt metrics %+v", final)
+	}
+
+	if final.EvalCount != 2 || final.EvalDuration != 20*time.Millisecond {
+		t.Errorf("unexpected eval metrics %+v", final)
+	}
+
+	if rate := final.DraftAcceptanceRate(); rate != 0.25 {
+		t.Errorf("expected draft acceptance rate 0.25, got %v", rate)
+	}
+}
+
+func TestCompletionRunnerError(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", healthy)
+	mux.HandleFunc("/completion", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "slot unavailable", http.StatusInternalServerError)
+	})
+
+	s := newStubServer(t, mux)
+
+	opts := api.DefaultOptions()
+	err := s.Completion(context.Background(), CompletionRequest{Prompt: "hi", Options: &opts}, func(CompletionResponse) {
+		t.Error("unexpected response")
+	})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestEmbedTokenize(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", healthy)
+	mux.HandleFunc("/embedding", func(w http.ResponseWriter, r *http.Request) {
+		var req EmbedRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+
+		var resp EmbedResponse
+		for range req.Content {
+			resp.Embedding = append(resp.Embedding, []float32{0.1, 0.2})
+		}
+		json.NewEncoder(w).Encode(resp)
+	})
+	mux.HandleFunc("/tokenize", func(w http.ResponseWriter, r *http.Request) {
+		var req TokenizeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+
+		if req.WithPieces {
+			// the last piece is the first half of "é"
+			fmt.Fprint(w, `{"tokens":[1,2,3],"pieces":[[97],[32,98],[195]]}`)
+			return
+		}
+		fmt.Fprint(w, `{"tokens":[1,2,3]}`)
+	})
+	mux.HandleFunc("/detokenize", func(w http.ResponseWriter, r *http.Request) {
+		var req DetokenizeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		fmt.Fprintf(w, `{"content":"%d tokens"}`, len(req.Tokens))
+	})
+
+	s := newStubServer(t, mux)
+	ctx := context.Background()
+
+	embeddings, err := s.Embed(ctx, []string{"a", "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(embeddings) != 2 {
+		t.Errorf("expected 2 embeddings, got %d", len(embeddings))
+	}
+
+	tokens, err := s.Tokenize(ctx, "a b c")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tokens) != 3 {
+		t.Errorf("expected 3 tokens, got %d", len(tokens))
+	}
+
+	_, pieces, err := s.TokenizePieces(ctx, "a b\xc3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff([]string{"a", " b", "\xc3"}, pieces); diff != "" {
+		t.Errorf("pieces mismatch (-want +got):\n%s", diff)
+	}
+
+	content, err := s.Detokenize(ctx, tokens)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if content != "3 tokens" {
+		t.Errorf("expected %q, got %q", "3 tokens", content)
+	}
+}
+
+func TestWaitUntilRunning(t *testing.T) {
+	var calls int
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, `{"status":"loading model","protocol":%d,"progress":%0.2f}`, ProtocolVersion, float32(calls)/3)
+			return
+		}
+
+		healthy(w, r)
+	})
+
+	s := newStubServer(t, mux)
+	if err := s.WaitUntilRunning(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if calls != 3 {
+		t.Errorf("expected 3 health checks, got %d", calls)
+	}
+}
+
+func TestWaitUntilRunningExited(t *testing.T) {
+	s := newStubServer(t, http.NotFoundHandler())
+	s.status.LastErrMsg = "error loading model: bad magic"
+	s.done <- errors.New("exit status 1")
+
+	err := s.WaitUntilRunning(context.Background())
+
+	var loadErr *LoadError
+	if !errors.As(err, &loadErr) {
+		t.Fatalf("expected LoadError, got %v", err)
+	}
+
+	if loadErr.Msg != "error loading model: bad magic" {
+		t.Errorf("unexpected message %q", loadErr.Msg)
+	}
+}
+
+func TestWaitUntilRunningProtocolMismatch(t *testing.T) {
+	for name, body := range map[string]string{
+		"other version": fmt.Sprintf(`{"status":"ok","protocol":%d,"slots_idle":1}`, ProtocolVersion+1),
+		"no version":    `{"status":"ok","slots_idle":1}`,
+		"while loading": fmt.Sprintf(`{"status":"loading model","protocol":%d,"progress":0.5}`, ProtocolVersion-1),
+	} {
+		t.Run(name, func(t *testing.T) {
+			s := newStubServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, body)
+			}))
+
+			err := s.WaitUntilRunning(context.Background())
+			if !errors.Is(err, ErrProtocolMismatch) {
+				t.Fatalf("expected ErrProtocolMismatch, got %v", err)
+			}
+
+			if _, err := s.getServerStatus(context.Background()); !errors.Is(err, ErrProtocolMismatch) {
+				t.Errorf("expected ErrProtocolMismatch from the status, got %v", err)
+			}
+		})
+	}
+}
+
+func TestPingExited(t *testing.T) {
+	s := newStubServer(t, http.HandlerFunc(healthy))
+	s.cmd = exec.Command(os.Args[0], "-test.run=^$")
+	if err := s.cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	var loadErr *LoadError
+	if err := s.Ping(context.Background()); !errors.As(err, &loadErr) {
+		t.Fatalf("expected LoadError, got %v", err)
+	}
+
+	if s.Pid() <= 0 {
+		t.Errorf("expected pid, got %d", s.Pid())
+	}
+}
+
+func TestCompletionGrammar(t *testing.T) {
+	var got completionRequest
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", healthy)
+	mux.HandleFunc("/completion", func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Error(err)
+		}
+
+		fmt.Fprintln(w, `data: {"content":"","stop":true}`)
+	})
+
+	s := newStubServer(t, mux)
+
+	opts := api.DefaultOptions()
+	req := CompletionRequest{
+		Prompt:  "hi",
+		Format:  "json",
+		Grammar: `root ::= "yes" | "no"`,
+		Images:  []ImageData{{ID: 0, Data: []byte("image")}},
+		Options: &opts,
+	}
+
+	if err := s.Completion(context.Background(), req, func(CompletionResponse) {}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got.Grammar != req.Grammar {
+		t.Errorf("expected grammar %q, got %q", req.Grammar, got.Grammar)
+	}
+
+	if len(got.ImageData) != 1 || string(got.ImageData[0].Data) != "image" {
+		t.Errorf("unexpected image data %+v", got.ImageData)
+	}
+}
+
+func TestCompletionLogprobs(t *testing.T) {
+	var got completionRequest
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", healthy)
+	mux.HandleFunc("/completion", func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Error(err)
+		}
+
+		// "é" is split across two tokens
+		fmt.Fprintln(w, `data: {"content":"Hi","completion_probabilities":[{"id":1,"content":"Hi","bytes":[72,105],"prob":0.5,"probs":[{"id":1,"tok_str":"Hi","bytes":[72,105],"prob":0.5},{"id":2,"tok_str":"Hey","bytes":[72,101,121],"prob":0.25}]}]}`)
+		fmt.Fprintln(w, `data: {"content":"é","completion_probabilities":[{"id":3,"content":"byte: \\xc3","bytes":[195],"prob":1,"probs":[]},{"id":4,"content":"byte: \\xa9","bytes":[169],"prob":0,"probs":[]}]}`)
+		fmt.Fprintln(w, `data: {"content":"","stop":true}`)
+	})
+
+	s := newStubServer(t, mux)
+
+	opts := api.DefaultOptions()
+	var resps []CompletionResponse
+	req := CompletionRequest{Prompt: "hi", Logprobs: true, TopLogprobs: 1, Options: &opts}
+	if err := s.Completion(context.Background(), req, func(r CompletionResponse) {
+		resps = append(resps, r)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got.NumProbs != 1 {
+		t.Errorf("expected n_probs 1, got %d", got.NumProbs)
+	}
+
+	if len(resps) != 3 {
+		t.Fatalf("expected 3 responses, got %d", len(resps))
+	}
+
+	hi := api.TokenLogprob{Token: "Hi", ID: 1, Logprob: math.Log(0.5), Bytes: []int{72, 105}}
+	expect := []api.Logprob{{TokenLogprob: hi, TopLogprobs: []api.TokenLogprob{hi}}}
+	if diff := cmp.Diff(resps[0].Logprobs, expect); diff != "" {
+		t.Errorf("mismatch (-got +want):\n%s", diff)
+	}
+
+	expect = []api.Logprob{
+		{TokenLogprob: api.TokenLogprob{Token: "\xc3", ID: 3, Logprob: 0, Bytes: []int{195}}},
+		{TokenLogprob: api.TokenLogprob{Token: "\xa9", ID: 4, Logprob: minLogprob, Bytes: []int{169}}},
+	}
+	if diff := cmp.Diff(resps[1].Logprobs, expect); diff != "" {
+		t.Errorf("mismatch (-got +want):\n%s", diff)
+	}
+
+	if resps[2].Logprobs != nil {
+		t.Errorf("expected no logprobs in the final response, got %v", resps[2].Logprobs)
+	}
+
+	// logprobs aren't sent unless requested
+	got = completionRequest{}
+	if err := s.Completion(context.Background(), CompletionRequest{Prompt: "hi", Options: &opts}, func(r CompletionResponse) {
+		if r.Logprobs != nil {
+			t.Errorf("expected no logprobs, got %v", r.Logprobs)
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got.NumProbs != 0 {
+		t.Errorf("expected n_probs 0, got %d", got.NumProbs)
+	}
+}
+
+func TestCompletionCancel(t *testing.T) {
+	aborted := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", healthy)
+	mux.HandleFunc("/completion", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `data: {"content":"Hello"}`)
+		w.(http.Flusher).Flush()
+
+		// keep generating until the connection is dropped
+		select {
+		case <-r.Context().Done():
+			close(aborted)
+		case <-time.After(5 * time.Second):
+			fmt.Fprintln(w, `data: {"content":"","stop":true}`)
+		}
+	})
+
+	s := newStubServer(t, mux)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	opts := api.DefaultOptions()
+	var resps []CompletionResponse
+	err := s.Completion(ctx, CompletionRequest{Prompt: "hi", Options: &opts}, func(r CompletionResponse) {
+		resps = append(resps, r)
+		if r.Content != "" {
+			cancel()
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-aborted:
+	case <-time.After(2 * time.Second):
+		t.Fatal("runner request was not aborted")
+	}
+
+	if len(resps) != 2 {
+		t.Fatalf("expected 2 responses, got %d", len(resps))
+	}
+
+	final := resps[1]
+	if !final.Done || final.DoneReason != "cancelled" || final.EvalCount != 1 {
+		t.Errorf("expected done with reason cancelled, got %+v", final)
+	}
+
+	if !s.sem.TryAcquire(1) {
+		t.Error("expected slot to be released")
+	}
+}
+
+func TestCompletionPromptCache(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", healthy)
+	mux.HandleFunc("/tokenize", func(w http.ResponseWriter, r *http.Request) {
+		t.Error("completions leave picking a slot to the runner, so don't tokenize")
+	})
+	mux.HandleFunc("/completion", func(w http.ResponseWriter, r *http.Request) {
+		var req completionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+
+		if !req.CachePrompt {
+			t.Error("expected the prompt to be cached")
+		}
+
+		fmt.Fprint(w, "data: {\"content\":\"\",\"stop\":true,\"timings\":{\"prompt_n\":1,\"prompt_cached_n\":4}}\n")
+	})
+
+	s := newStubServer(t, mux)
+
+	opts := api.DefaultOptions()
+	var final CompletionResponse
+	if err := s.Completion(context.Background(), CompletionRequest{Prompt: "abcde", Options: &opts}, func(r CompletionResponse) {
+		final = r
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if final.PromptEvalCount != 1 || final.PromptCacheCount != 4 {
+		t.Errorf("unexpected prompt metrics %+v", final)
+	}
+}
+
+func TestSuperviseHung(t *testing.T) {
+	interval, timeout := healthCheckInterval, healthCheckTimeout
+	healthCheckInterval, healthCheckTimeout = time.Millisecond, 10*time.Millisecond
+	t.Cleanup(func() { healthCheckInterval, healthCheckTimeout = interval, timeout })
+
+	hung := make(chan struct{})
+	t.Cleanup(func() { close(hung) })
+
+	var responding atomic.Bool
+	responding.Store(true)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		if !responding.Load() {
+			select {
+			case <-hung:
+			case <-r.Context().Done():
+			}
+			return
+		}
+
+		healthy(w, r)
+	})
+	mux.HandleFunc("/completion", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `data: {"content":"Hello"}`)
+		w.(http.Flusher).Flush()
+		responding.Store(false)
+		select {
+		case <-hung:
+		case <-r.Context().Done():
+		}
+	})
+
+	s := newStubServer(t, mux)
+	go s.supervise(healthCheckInterval)
+
+	opts := api.DefaultOptions()
+	err := s.Completion(context.Background(), CompletionRequest{Prompt: "hi", Options: &opts}, func(CompletionResponse) {})
+
+	var runnerErr *RunnerError
+	if !errors.As(err, &runnerErr) {
+		t.Fatalf("expected RunnerError, got %v", err)
+	}
+
+	select {
+	case <-s.Stopped():
+	default:
+		t.Fatal("expected runner to be stopped")
+	}
+
+	if !errors.Is(s.Err(), runnerErr.Err) {
+		t.Errorf("expected runner error %v, got %v", runnerErr, s.Err())
+	}
+
+	if err := s.Ping(context.Background()); !errors.As(err, &runnerErr) {
+		t.Errorf("expected ping to report RunnerError, got %v", err)
+	}
+}
+
+func TestCloseStopped(t *testing.T) {
+	s := newStubServer(t, http.HandlerFunc(healthy))
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-s.Stopped():
+	default:
+		t.Fatal("expected runner to be stopped")
+	}
+
+	if err := s.Err(); err != nil {
+		t.Errorf("expected no error after close, got %v", err)
+	}
+}
+
+func TestCompletionTrace(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(tp)
+	t.Cleanup(func() { otel.SetTracerProvider(prev) })
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", healthy)
+	mux.HandleFunc("/tokenize", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"tokens":[1,2,3]}`)
+	})
+	mux.HandleFunc("/completion", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `data: {"content":"","stop":true}`)
+	})
+
+	s := newStubServer(t, mux)
+
+	ctx, parent := otel.Tracer("test").Start(context.Background(), "request")
+	opts := api.DefaultOptions()
+	if err := s.Completion(ctx, CompletionRequest{Prompt: "hi", Options: &opts}, func(CompletionResponse) {}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Tokenize(ctx, "hi"); err != nil {
+		t.Fatal(err)
+	}
+	parent.End()
+
+	spans := make(map[string]tracetest.SpanStub)
+	for _, span := range exporter.GetSpans() {
+		spans[span.Name] = span
+	}
+
+	completion, ok := spans["runner.completion"]
+	if !ok || completion.Parent.SpanID() != parent.SpanContext().SpanID() {
+		t.Fatalf("expected runner.completion span under the request, got %v", spans)
+	}
+
+	if tokenize, ok := spans["tokenize"]; !ok || tokenize.Parent.SpanID() != parent.SpanContext().SpanID() {
+		t.Errorf("expected tokenize span under the request, got %v", spans)
+	}
+}
+
+func TestRunnerParams(t *testing.T) {
+	cpu := gpu.GpuInfoList{{Library: "cpu"}}
+
+	// want maps the flags expected to their value, or "" for flags without one
+	cases := []struct {
+		name        string
+		numParallel int
+		draft       string
+		draftLayers int
+		vocabOnly   bool
+		want        map[string]string
+		notWant     []string
+	}{
+		{"single", 1, "", -1, false, map[string]string{"--parallel": "1"}, []string{"--cont-batching", "--vocab-only"}},
+		{"parallel", 4, "", -1, false, map[string]string{"--parallel": "4", "--cont-batching": ""}, nil},
+		{"vocab only", 1, "", -1, true, map[string]string{"--vocab-only": ""}, nil},
+		{"draft on cpu", 1, "draft.gguf", -1, false, map[string]string{"--model-draft": "draft.gguf"}, []string{"--n-gpu-layers-draft"}},
+		{"draft on gpu", 1, "draft.gguf", 3, false, map[string]string{"--model-draft": "draft.gguf", "--n-gpu-layers-draft": "3"}, nil},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := api.DefaultOptions()
+			opts.VocabOnly = tt.vocabOnly
+
+			params := runnerParams("model.gguf", nil, cpu, nil, nil, tt.draft, tt.draftLayers, &opts, MemoryEstimate{}, 0, tt.numParallel)
+			if !slices.Equal(params[:2], []string{"--model", "model.gguf"}) {
+				t.Errorf("expected the model first, got %v", params)
+			}
+
+			for flag, value := range tt.want {
+				i := slices.Index(params, flag)
+				switch {
+				case i < 0:
+					t.Errorf("expected %s in %v", flag, params)
+				case value != "" && (i+1 >= len(params) || params[i+1] != value):
+					t.Errorf("expected %s %s in %v", flag, value, params)
+				}
+			}
+
+			for _, flag := range tt.notWant {
+				if slices.Contains(params, flag) {
+					t.Errorf("unexpected %s in %v", flag, params)
+				}
+			}
+		})
+	}
+}
@@ -2,13 +2,22 @@ package llm
 
 import (
 	"bytes"
+	"fmt"
 	"os"
+	"strings"
+	"sync"
 )
 
+// maxStatusErrs is the number of recent runner error lines kept for reporting
+const maxStatusErrs = 5
+
 // StatusWriter is a writer that captures error messages from the llama runner process
 type StatusWriter struct {
 	LastErrMsg string
 	out        *os.File
+
+	mu   sync.Mutex
+	errs []string // most recent error lines, oldest first
 }
 
 func NewStatusWriter(out *os.File) *StatusWriter {
@@ -37,7 +46,84 @@ func (w *StatusWriter) Write(b []byte) (int, error) {
 	}
 	if errMsg != "" {
 		w.LastErrMsg = errMsg
+
+		w.mu.Lock()
+		w.errs = append(w.errs, errMsg)
+		if len(w.errs) > maxStatusErrs {
+			w.errs = w.errs[len(w.errs)-maxStatusErrs:]
+		}
+		w.mu.Unlock()
 	}
 
 	return w.out.Write(b)
 }
+
+// Errors returns the most recent error lines reported by the runner, oldest
+// first
+func (w *StatusWriter) Errors() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]string(nil), w.errs...)
+}
+
+// LoadError is returned when the llama runner process fails to start, exits
+// or stops responding while loading a model. Msg holds the last error the
+// runner reported on stderr, if any.
+type LoadError struct {
+	Msg string
+	Err error
+}
+
+func (e *LoadError) Error() string {
+	if e.Msg == "" {
+		return e.Err.Error()
+	}
+
+	return fmt.Sprintf("%v: %s", e.Err, e.Msg)
+}
+
+func (e *LoadError) Unwrap() error {
+	return e.Err
+}
+
+// loadError wraps err in a LoadError carrying the last error message captured
+// from the runner
+func (w *StatusWriter) loadError(err error) error {
+	var msg string
+	if w != nil {
+		msg = w.LastErrMsg
+	}
+
+	return &LoadError{Msg: msg, Err: err}
+}
+
+// RunnerError is returned to requests in flight when a runner that finished
+// loading exits unexpectedly or stops responding to health checks. Msg holds
+// the most recent errors the runner reported on stderr, if any.
+type RunnerError struct {
+	Msg string
+	Err error
+}
+
+func (e *RunnerError) Error() string {
+	if e.Msg == "" {
+		return e.Err.Error()
+	}
+
+	return fmt.Sprintf("%v: %s", e.Err, e.Msg)
+}
+
+func (e *RunnerError) Unwrap() error {
+	return e.Err
+}
+
+// runnerError wraps err in a RunnerError carrying the recent error messages
+// captured from the runner
+func (w *StatusWriter) runnerError(err error) error {
+	var msg string
+	if w != nil {
+		msg = strings.Join(w.Errors(), "; ")
+	}
+
+	return &RunnerError{Msg: msg, Err: err}
+}
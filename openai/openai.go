@@ -36,15 +36,32 @@ type Message struct {
 }
 
 type Choice struct {
-	Index        int     `json:"index"`
-	Message      Message `json:"message"`
-	FinishReason *string `json:"finish_reason"`
+	Index        int       `json:"index"`
+	Message      Message   `json:"message"`
+	Logprobs     *Logprobs `json:"logprobs"`
+	FinishReason *string   `json:"finish_reason"`
 }
 
 type ChunkChoice struct {
-	Index        int     `json:"index"`
-	Delta        Message `json:"delta"`
-	FinishReason *string `json:"finish_reason"`
+	Index        int       `json:"index"`
+	Delta        Message   `json:"delta"`
+	Logprobs     *Logprobs `json:"logprobs"`
+	FinishReason *string   `json:"finish_reason"`
+}
+
+type TokenLogprob struct {
+	Token   string  `json:"token"`
+	Logprob float64 `json:"logprob"`
+	Bytes   []int   `json:"bytes"`
+}
+
+type ContentLogprob struct {
+	TokenLogprob
+	TopLogprobs []TokenLogprob `json:"top_logprobs"`
+}
+
+type Logprobs struct {
+	Content []ContentLogprob `json:"content"`
 }
 
 type CompleteChunkChoice struct {
@@ -60,7 +77,14 @@ type Usage struct {
 }
 
 type ResponseFormat struct {
-	Type string `json:"type"`
+	Type       string      `json:"type"`
+	JsonSchema *JsonSchema `json:"json_schema,omitempty"`
+}
+
+type JsonSchema struct {
+	Name   string          `json:"name"`
+	Schema json.RawMessage `json:"schema"`
+	Strict *bool           `json:"strict,omitempty"`
 }
 
 type EmbedRequest struct {
@@ -81,6 +105,8 @@ type ChatCompletionRequest struct {
 	TopP             *float64        `json:"top_p"`
 	ResponseFormat   *ResponseFormat `json:"response_format"`
 	Tools            []api.Tool      `json:"tools"`
+	Logprobs         bool            `json:"logprobs"`
+	TopLogprobs      int             `json:"top_logprobs"`
 }
 
 type ChatCompletion struct {
@@ -215,8 +241,9 @@ func toChatCompletion(id string, r api.ChatResponse) ChatCompletion {
 		Model:             r.Model,
 		SystemFingerprint: "fp_ollama",
 		Choices: []Choice{{
-			Index:   0,
-			Message: Message{Role: r.Message.Role, Content: r.Message.Content, ToolCalls: toolCalls},
+			Index:    0,
+			Message:  Message{Role: r.Message.Role, Content: r.Message.Content, ToolCalls: toolCalls},
+			Logprobs: toLogprobs(r.Logprobs),
 			FinishReason: func(reason string) *string {
 				if len(reason) > 0 {
 					return &reason
@@ -225,13 +252,40 @@ func toChatCompletion(id string, r api.ChatResponse) ChatCompletion {
 			}(r.DoneReason),
 		}},
 		Usage: Usage{
-			PromptTokens:     r.PromptEvalCount,
+			PromptTokens:     r.PromptEvalCount + r.PromptCacheCount,
 			CompletionTokens: r.EvalCount,
-			TotalTokens:      r.PromptEvalCount + r.EvalCount,
+			TotalTokens:      r.PromptEvalCount + r.PromptCacheCount + r.EvalCount,
 		},
 	}
 }
 
+func toTokenLogprob(lp api.TokenLogprob) TokenLogprob {
+	bts := lp.Bytes
+	if bts == nil {
+		bts = []int{}
+	}
+
+	return TokenLogprob{Token: lp.Token, Logprob: lp.Logprob, Bytes: bts}
+}
+
+// toLogprobs converts the logprobs of a response, which are nil unless the
+// request asked for them
+func toLogprobs(logprobs []api.Logprob) *Logprobs {
+	if logprobs == nil {
+		return nil
+	}
+
+	content := make([]ContentLogprob, len(logprobs))
+	for i, lp := range logprobs {
+		content[i] = ContentLogprob{TokenLogprob: toTokenLogprob(lp.TokenLogprob), TopLogprobs: []TokenLogprob{}}
+		for _, top := range lp.TopLogprobs {
+			content[i].TopLogprobs = append(content[i].TopLogprobs, toTokenLogprob(top))
+		}
+	}
+
+	return &Logprobs{Content: content}
+}
+
 func toChunk(id string, r api.ChatResponse) ChatCompletionChunk {
 	return ChatCompletionChunk{
 		Id:                id,
@@ -240,8 +294,9 @@ func toChunk(id string, r api.ChatResponse) ChatCompletionChunk {
 		Model:             r.Model,
 		SystemFingerprint: "fp_ollama",
 		Choices: []ChunkChoice{{
-			Index: 0,
-			Delta: Message{Role: "assistant", Content: r.Message.Content},
+			Index:    0,
+			Delta:    Message{Role: "assistant", Content: r.Message.Content},
+			Logprobs: toLogprobs(r.Logprobs),
 			FinishReason: func(reason string) *string {
 				if len(reason) > 0 {
 					return &reason
@@ -270,9 +325,9 @@ func toCompletion(id string, r api.GenerateResponse) Completion {
 			}(r.DoneReason),
 		}},
 		Usage: Usage{
-			PromptTokens:     r.PromptEvalCount,
+			PromptTokens:     r.PromptEvalCount + r.PromptCacheCount,
 			CompletionTokens: r.EvalCount,
-			TotalTokens:      r.PromptEvalCount + r.EvalCount,
+			TotalTokens:      r.PromptEvalCount + r.PromptCacheCount + r.EvalCount,
 		},
 	}
 }
@@ -460,18 +515,29 @@ func fromChatRequest(r ChatCompletionRequest) (*api.ChatRequest, error) {
 		options["top_p"] = 1.0
 	}
 
-	var format string
-	if r.ResponseFormat != nil && r.ResponseFormat.Type == "json_object" {
-		format = "json"
+	var format json.RawMessage
+	if r.ResponseFormat != nil {
+		switch r.ResponseFormat.Type {
+		case "json_object":
+			format = json.RawMessage(`"json"`)
+		case "json_schema":
+			if r.ResponseFormat.JsonSchema == nil || len(r.ResponseFormat.JsonSchema.Schema) == 0 {
+				return nil, fmt.Errorf("response_format json_schema requires a schema")
+			}
+
+			format = r.ResponseFormat.JsonSchema.Schema
+		}
 	}
 
 	return &api.ChatRequest{
-		Model:    r.Model,
-		Messages: messages,
-		Format:   format,
-		Options:  options,
-		Stream:   &r.Stream,
-		Tools:    r.Tools,
+		Model:       r.Model,
+		Messages:    messages,
+		Format:      format,
+		Options:     options,
+		Stream:      &r.Stream,
+		Tools:       r.Tools,
+		Logprobs:    r.Logprobs,
+		TopLogprobs: r.TopLogprobs,
 	}, nil
 }
 
@@ -151,6 +151,70 @@ func TestChatMiddleware(t *testing.T) {
 				}
 			},
 		},
+		{
+			Name: "chat handler with json schema",
+			Setup: func(t *testing.T, req *http.Request) {
+				body := ChatCompletionRequest{
+					Model:    "test-model",
+					Messages: []Message{{Role: "user", Content: "Hello"}},
+					ResponseFormat: &ResponseFormat{
+						Type:       "json_schema",
+						JsonSchema: &JsonSchema{Name: "greeting", Schema: json.RawMessage(`{"type":"object","properties":{"greeting":{"type":"string"}}}`)},
+					},
+				}
+				prepareRequest(req, body)
+			},
+			Expected: func(t *testing.T, req *api.ChatRequest, resp *httptest.ResponseRecorder) {
+				if resp.Code != http.StatusOK {
+					t.Fatalf("expected 200, got %d", resp.Code)
+				}
+
+				if string(req.Format) != `{"type":"object","properties":{"greeting":{"type":"string"}}}` {
+					t.Fatalf("expected schema format, got %s", req.Format)
+				}
+			},
+		},
+		{
+			Name: "chat handler with json schema missing schema",
+			Setup: func(t *testing.T, req *http.Request) {
+				body := ChatCompletionRequest{
+					Model:          "test-model",
+					Messages:       []Message{{Role: "user", Content: "Hello"}},
+					ResponseFormat: &ResponseFormat{Type: "json_schema"},
+				}
+				prepareRequest(req, body)
+			},
+			Expected: func(t *testing.T, req *api.ChatRequest, resp *httptest.ResponseRecorder) {
+				if resp.Code != http.StatusBadRequest {
+					t.Fatalf("expected 400, got %d", resp.Code)
+				}
+
+				if !strings.Contains(resp.Body.String(), "response_format json_schema requires a schema") {
+					t.Fatalf("error was not forwarded")
+				}
+			},
+		},
+		{
+			Name: "chat handler with logprobs",
+			Setup: func(t *testing.T, req *http.Request) {
+				body := ChatCompletionRequest{
+					Model:       "test-model",
+					Messages:    []Message{{Role: "user", Content: "Hello"}},
+					Logprobs:    true,
+					TopLogprobs: 2,
+				}
+				prepareRequest(req, body)
+			},
+			Expected: func(t *testing.T, req *api.ChatRequest, resp *httptest.ResponseRecorder) {
+				if resp.Code != http.StatusOK {
+					t.Fatalf("expected 200, got %d", resp.Code)
+				}
+
+				if !req.Logprobs || req.TopLogprobs != 2 {
+					t.Fatalf("expected logprobs with 2 alternatives, got %t and %d", req.Logprobs, req.TopLogprobs)
+				}
+			},
+		},
 		{
 			Name: "chat handler error forwarding",
 			Setup: func(t *testing.T, req *http.Request) {
@@ -471,6 +535,68 @@ func TestMiddlewareResponses(t *testing.T) {
 		},
 	}
 
+	chatEndpoint := func(c *gin.Context) {
+		c.JSON(http.StatusOK, api.ChatResponse{
+			Model:   "test-model",
+			Message: api.Message{Role: "assistant", Content: "Hi"},
+			Logprobs: []api.Logprob{{
+				TokenLogprob: api.TokenLogprob{Token: "Hi", ID: 1, Logprob: -0.5, Bytes: []int{72, 105}},
+				TopLogprobs:  []api.TokenLogprob{{Token: "Hi", ID: 1, Logprob: -0.5, Bytes: []int{72, 105}}},
+			}},
+		})
+	}
+
+	expectLogprobs := &Logprobs{Content: []ContentLogprob{{
+		TokenLogprob: TokenLogprob{Token: "Hi", Logprob: -0.5, Bytes: []int{72, 105}},
+		TopLogprobs:  []TokenLogprob{{Token: "Hi", Logprob: -0.5, Bytes: []int{72, 105}}},
+	}}}
+
+	testCases = append(testCases,
+		testCase{
+			Name:     "chat handler with logprobs",
+			Method:   http.MethodPost,
+			Path:     "/api/chat",
+			TestPath: "/api/chat",
+			Handler:  ChatMiddleware,
+			Endpoint: chatEndpoint,
+			Setup: func(t *testing.T, req *http.Request) {
+				prepareRequest(req, ChatCompletionRequest{Model: "test-model", Messages: []Message{{Role: "user", Content: "Hello"}}, Logprobs: true, TopLogprobs: 1})
+			},
+			Expected: func(t *testing.T, resp *httptest.ResponseRecorder) {
+				var chatResp ChatCompletion
+				if err := json.NewDecoder(resp.Body).Decode(&chatResp); err != nil {
+					t.Fatal(err)
+				}
+
+				assert.Equal(t, expectLogprobs, chatResp.Choices[0].Logprobs)
+			},
+		},
+		testCase{
+			Name:     "chat handler with streamed logprobs",
+			Method:   http.MethodPost,
+			Path:     "/api/chat",
+			TestPath: "/api/chat",
+			Handler:  ChatMiddleware,
+			Endpoint: chatEndpoint,
+			Setup: func(t *testing.T, req *http.Request) {
+				prepareRequest(req, ChatCompletionRequest{Model: "test-model", Messages: []Message{{Role: "user", Content: "Hello"}}, Logprobs: true, Stream: true})
+			},
+			Expected: func(t *testing.T, resp *httptest.ResponseRecorder) {
+				data, ok := strings.CutPrefix(strings.TrimSpace(resp.Body.String()), "data: ")
+				if !ok {
+					t.Fatalf("expected an event, got %s", resp.Body.String())
+				}
+
+				var chunk ChatCompletionChunk
+				if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+					t.Fatal(err)
+				}
+
+				assert.Equal(t, expectLogprobs, chunk.Choices[0].Logprobs)
+			},
+		},
+	)
+
 	gin.SetMode(gin.TestMode)
 	router := gin.New()
 
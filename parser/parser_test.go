@@ -19,6 +19,8 @@ func TestParseFileFile(t *testing.T) {
 	input := `
 FROM model1
 ADAPTER adapter1
+DRAFT draft1
+GRAMMAR """root ::= ("yes" | "no")"""
 LICENSE MIT
 PARAMETER param1 value1
 PARAMETER param2 value2
@@ -39,6 +41,8 @@ TEMPLATE """{{ if .System }}<|start_header_id|>system<|end_header_id|>
 	expectedCommands := []Command{
 		{Name: "model", Args: "model1"},
 		{Name: "adapter", Args: "adapter1"},
+		{Name: "draft", Args: "draft1"},
+		{Name: "grammar", Args: `root ::= ("yes" | "no")`},
 		{Name: "license", Args: "MIT"},
 		{Name: "param1", Args: "value1"},
 		{Name: "param2", Args: "value2"},
@@ -519,6 +523,7 @@ func TestParseFileFormatParseFile(t *testing.T) {
 		`
 FROM foo
 ADAPTER adapter1
+DRAFT draft1
 LICENSE MIT
 PARAMETER param1 value1
 PARAMETER param2 value2
@@ -0,0 +1,223 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
+)
+
+// runtimeConfig returns the current value of each runtime setting
+func runtimeConfig() api.ConfigResponse {
+	env, vals := envconfig.AsMap(), envconfig.Values()
+	resp := api.ConfigResponse{Settings: make(map[string]api.ConfigSetting)}
+	for _, k := range envconfig.RuntimeSettings {
+		resp.Settings[k] = api.ConfigSetting{Value: vals[k], Description: env[k].Description}
+	}
+
+	return resp
+}
+
+func (s *Server) ConfigHandler(c *gin.Context) {
+	var resp api.ConfigResponse
+	if err := s.sched.configure(c.Request.Context(), func() { resp = runtimeConfig() }); err != nil {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+func (s *Server) UpdateConfigHandler(c *gin.Context) {
+	var req api.ConfigRequest
+	err := c.ShouldBindJSON(&req)
+	switch {
+	case errors.Is(err, io.EOF):
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	case err != nil:
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var resp api.ConfigResponse
+	if err := s.sched.configure(c.Request.Context(), func() {
+		if err = envconfig.Update(req.Settings); err == nil {
+			resp = runtimeConfig()
+		}
+	}); err != nil {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+func (s *Server) UnloadHandler(c *gin.Context) {
+	var req api.UnloadRequest
+	err := c.ShouldBindJSON(&req)
+	switch {
+	case errors.Is(err, io.EOF):
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	case err != nil:
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	switch {
+	case req.All:
+		c.JSON(http.StatusOK, api.UnloadResponse{Models: s.sched.expireAllRunners()})
+	case req.Model != "":
+		if !s.unloadModel(c, req.Model) {
+			return
+		}
+
+		c.JSON(http.StatusOK, api.UnloadResponse{Models: []string{req.Model}})
+	default:
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "model or all is required"})
+	}
+}
+
+// DrainHandler stops the server accepting new requests and returns once
+// those in flight have finished
+func (s *Server) DrainHandler(c *gin.Context) {
+	if err := s.drain.wait(c.Request.Context()); err != nil {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+// ResumeHandler accepts requests again after a drain
+func (s *Server) ResumeHandler(c *gin.Context) {
+	s.drain.resume()
+	c.Status(http.StatusOK)
+}
+
+// drainer counts in-flight requests so the server can stop taking work and
+// wait for what it has to finish. The zero value accepts requests.
+type drainer struct {
+	mu       sync.Mutex
+	draining bool
+	inflight int
+	idle     chan struct{} // closed when inflight drops to zero
+	resumed  chan struct{} // closed when a drain ends
+}
+
+var errDraining = errors.New("server is draining")
+
+// middleware rejects requests while draining, except those to the admin API
+func (d *drainer) middleware(c *gin.Context) {
+	if strings.HasPrefix(c.Request.URL.Path, "/api/admin/") {
+		c.Next()
+		return
+	}
+
+	d.mu.Lock()
+	if d.draining {
+		d.mu.Unlock()
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": errDraining.Error()})
+		return
+	}
+	d.inflight++
+	d.mu.Unlock()
+
+	defer d.done()
+	c.Next()
+}
+
+// batchMiddleware holds the requests of batch jobs while draining until the
+// drain ends, and counts them in flight like other requests
+func (d *drainer) batchMiddleware(c *gin.Context) {
+	if err := d.acquire(c.Request.Context()); err != nil {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+
+	defer d.done()
+	c.Next()
+}
+
+// acquire counts a request in flight, first waiting for a drain to end. It
+// fails if ctx is done while waiting.
+func (d *drainer) acquire(ctx context.Context) error {
+	for {
+		d.mu.Lock()
+		if !d.draining {
+			d.inflight++
+			d.mu.Unlock()
+			return nil
+		}
+
+		if d.resumed == nil {
+			d.resumed = make(chan struct{})
+		}
+		resumed := d.resumed
+		d.mu.Unlock()
+
+		select {
+		case <-resumed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (d *drainer) done() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.inflight--
+	if d.inflight == 0 && d.idle != nil {
+		close(d.idle)
+		d.idle = nil
+	}
+}
+
+// wait stops new requests being accepted and blocks until there are none in
+// flight or ctx is done
+func (d *drainer) wait(ctx context.Context) error {
+	d.mu.Lock()
+	d.draining = true
+	if d.inflight == 0 {
+		d.mu.Unlock()
+		return nil
+	}
+
+	if d.idle == nil {
+		d.idle = make(chan struct{})
+	}
+	idle := d.idle
+	d.mu.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (d *drainer) resume() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.draining = false
+	if d.resumed != nil {
+		close(d.resumed)
+		d.resumed = nil
+	}
+}
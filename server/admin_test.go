@@ -0,0 +1,197 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
+)
+
+func TestAdminConfig(t *testing.T) {
+	keepAlive, numParallel := envconfig.KeepAlive, envconfig.NumParallel
+	t.Cleanup(func() { envconfig.KeepAlive, envconfig.NumParallel = keepAlive, numParallel })
+	envconfig.KeepAlive, envconfig.NumParallel = 5*time.Minute, 0
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := &Server{sched: InitScheduler()}
+	s.sched.Run(ctx)
+	router := s.GenerateRoutes()
+
+	do := func(method, body string) (int, api.ConfigResponse) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, "/api/admin/config", strings.NewReader(body)))
+
+		var resp api.ConfigResponse
+		if w.Code == http.StatusOK {
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		}
+		return w.Code, resp
+	}
+
+	code, resp := do(http.MethodGet, "")
+	require.Equal(t, http.StatusOK, code)
+	require.Len(t, resp.Settings, len(envconfig.RuntimeSettings))
+	require.Equal(t, "5m0s", resp.Settings["OLLAMA_KEEP_ALIVE"].Value)
+	require.NotEmpty(t, resp.Settings["OLLAMA_KEEP_ALIVE"].Description)
+
+	code, resp = do(http.MethodPatch, `{"settings":{"OLLAMA_KEEP_ALIVE":"1h","OLLAMA_NUM_PARALLEL":"2"}}`)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "1h0m0s", resp.Settings["OLLAMA_KEEP_ALIVE"].Value)
+	require.Equal(t, "2", resp.Settings["OLLAMA_NUM_PARALLEL"].Value)
+
+	code, _ = do(http.MethodPatch, `{"settings":{"OLLAMA_HOST":"0.0.0.0"}}`)
+	require.Equal(t, http.StatusBadRequest, code)
+
+	code, _ = do(http.MethodPatch, `{"settings":{"OLLAMA_NUM_PARALLEL":"two"}}`)
+	require.Equal(t, http.StatusBadRequest, code)
+
+	code, resp = do(http.MethodGet, "")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "2", resp.Settings["OLLAMA_NUM_PARALLEL"].Value)
+}
+
+func TestAdminUnload(t *testing.T) {
+	s := &Server{sched: InitScheduler()}
+	for _, name := range []string{"b:latest", "a:latest"} {
+		s.sched.loaded[name] = &runnerRef{model: &Model{ShortName: name}, refCount: 1, sessionDuration: time.Minute}
+	}
+
+	router := s.GenerateRoutes()
+	unload := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/admin/unload", strings.NewReader(body)))
+		return w
+	}
+
+	require.Equal(t, http.StatusBadRequest, unload(`{}`).Code)
+
+	w := unload(`{"all":true}`)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var resp api.UnloadResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	require.Equal(t, []string{"a:latest", "b:latest"}, resp.Models)
+
+	for _, runner := range s.sched.loaded {
+		// runners in use are unloaded once their requests finish
+		require.Zero(t, runner.sessionDuration)
+		require.Empty(t, s.sched.expiredCh)
+	}
+}
+
+func TestDrainer(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	var d drainer
+	release := make(chan struct{})
+	started := make(chan struct{})
+
+	r := gin.New()
+	r.Use(d.middleware)
+	r.GET("/api/slow", func(c *gin.Context) {
+		close(started)
+		<-release
+		c.Status(http.StatusOK)
+	})
+	r.GET("/api/fast", func(c *gin.Context) { c.Status(http.StatusOK) })
+	r.GET("/api/admin/config", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	get := func(path string) int {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w.Code
+	}
+
+	slow := make(chan int, 1)
+	go func() { slow <- get("/api/slow") }()
+	<-started
+
+	drained := make(chan error, 1)
+	go func() { drained <- d.wait(context.Background()) }()
+
+	require.Eventually(t, func() bool { return get("/api/fast") == http.StatusServiceUnavailable }, time.Second, 10*time.Millisecond)
+	require.Equal(t, http.StatusOK, get("/api/admin/config"))
+
+	select {
+	case <-drained:
+		t.Fatal("drain returned with a request in flight")
+	default:
+	}
+
+	close(release)
+	require.NoError(t, <-drained)
+	require.Equal(t, http.StatusOK, <-slow)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.NoError(t, d.wait(ctx), "an idle server drains immediately")
+
+	d.resume()
+	require.Equal(t, http.StatusOK, get("/api/fast"))
+}
+
+func TestDrainBatch(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	j, err := loadBatchJobs(t.TempDir())
+	require.NoError(t, err)
+
+	s := &Server{batch: j}
+	release := make(chan struct{})
+	started := make(chan struct{}, batchWorkers)
+
+	r := gin.New()
+	r.Use(s.drain.batchMiddleware)
+	r.POST("/api/generate", func(c *gin.Context) {
+		started <- struct{}{}
+		<-release
+		c.JSON(http.StatusOK, gin.H{})
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go j.run(ctx, r, nil)
+
+	job, err := j.submit(strings.NewReader(`{"endpoint":"/api/generate","body":{"model":"llama3"}}`), nil)
+	require.NoError(t, err)
+	<-started
+
+	// batch requests in flight hold up the drain
+	drained := make(chan error, 1)
+	go func() { drained <- s.drain.wait(context.Background()) }()
+
+	select {
+	case <-drained:
+		t.Fatal("drain returned with a batch request in flight")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	close(release)
+	require.NoError(t, <-drained)
+	waitForBatch(t, j, job.ID, batchCompleted)
+
+	// jobs submitted while draining wait for the drain to end
+	job, err = j.submit(strings.NewReader(`{"endpoint":"/api/generate","body":{"model":"llama3"}}`), nil)
+	require.NoError(t, err)
+
+	select {
+	case <-started:
+		t.Fatal("batch request ran while draining")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	s.drain.resume()
+	<-started
+	waitForBatch(t, j, job.ID, batchCompleted)
+}
@@ -0,0 +1,332 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/types/model"
+)
+
+// Scopes group the routes an API key may call. Routes in scopeOpen, such as
+// listing models, may be called by every key.
+const (
+	scopeOpen      = "open"
+	scopeInference = "inference"
+	scopeManage    = "manage"
+	scopeAdmin     = "admin"
+	scopeAll       = "*"
+)
+
+// routeScopes holds the scope of every route. Keys limited to some scopes
+// can't call routes missing from it.
+var routeScopes = map[string]string{
+	"/api/tags":              scopeOpen,
+	"/api/version":           scopeOpen,
+	"/api/show":              scopeOpen,
+	"/api/ps":                scopeOpen,
+	"/v1/models":             scopeOpen,
+	"/v1/models/:model":      scopeOpen,
+	"/api/generate":          scopeInference,
+	"/api/chat":              scopeInference,
+	"/api/embed":             scopeInference,
+	"/api/embeddings":        scopeInference,
+	"/api/tokenize":          scopeInference,
+	"/api/detokenize":        scopeInference,
+	"/api/rerank":            scopeInference,
+	"/v1/chat/completions":   scopeInference,
+	"/v1/completions":        scopeInference,
+	"/v1/embeddings":         scopeInference,
+	"/api/batch":             scopeInference,
+	"/api/batch/:id":         scopeInference,
+	"/api/batch/:id/cancel":  scopeInference,
+	"/api/batch/:id/results": scopeInference,
+	"/api/sessions":          scopeInference,
+	"/api/sessions/:id":      scopeInference,
+	"/api/sessions/:id/fork": scopeInference,
+	"/api/pull":              scopeManage,
+	"/api/push":              scopeManage,
+	"/api/create":            scopeManage,
+	"/api/copy":              scopeManage,
+	"/api/delete":            scopeManage,
+	"/api/blobs/:digest":     scopeManage,
+	"/api/admin/config":      scopeAdmin,
+	"/api/admin/unload":      scopeAdmin,
+	"/api/admin/drain":       scopeAdmin,
+	"/metrics":               scopeAdmin,
+}
+
+// apiKey is an entry in the file named by OLLAMA_API_KEYS
+type apiKey struct {
+	Key string `json:"key"`
+
+	// Name identifies the key in logs and owns the batch jobs and sessions
+	// created with it, so it must be unique.
+	Name string `json:"name"`
+
+	// Scopes lists the groups of routes the key may call. An empty list
+	// allows every route.
+	Scopes []string `json:"scopes"`
+
+	// Models lists glob patterns, matched with path.Match, for the models
+	// the key may use. An empty list allows every model.
+	Models []string `json:"models"`
+
+	// RequestsPerMinute and TokensPerDay limit the key's usage. Zero means
+	// unlimited.
+	RequestsPerMinute int `json:"requests_per_minute"`
+	TokensPerDay      int `json:"tokens_per_day"`
+
+	mu          sync.Mutex
+	windowStart time.Time
+	requests    int
+	day         time.Time
+	tokens      int
+}
+
+type apiKeys struct {
+	keys map[string]*apiKey
+}
+
+func loadAPIKeys(p string) (*apiKeys, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var file struct {
+		Keys []*apiKey `json:"keys"`
+	}
+
+	if err := json.NewDecoder(f).Decode(&file); err != nil {
+		return nil, fmt.Errorf("api keys: %w", err)
+	}
+
+	keys := apiKeys{keys: make(map[string]*apiKey)}
+	for i, k := range file.Keys {
+		if k.Key == "" {
+			return nil, fmt.Errorf("api keys: key %d is empty", i)
+		}
+
+		if k.Name == "" {
+			return nil, fmt.Errorf("api keys: key %d has no name", i)
+		}
+
+		if keys.named(k.Name) != nil {
+			return nil, fmt.Errorf("api keys: name %q is used by more than one key", k.Name)
+		}
+
+		for _, pattern := range k.Models {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("api keys: %q: bad model pattern %q", k.Name, pattern)
+			}
+		}
+
+		keys.keys[k.Key] = k
+	}
+
+	return &keys, nil
+}
+
+// named returns the key called name, or nil if there isn't one
+func (keys *apiKeys) named(name string) *apiKey {
+	for _, k := range keys.keys {
+		if k.Name == name {
+			return k
+		}
+	}
+
+	return nil
+}
+
+// allowsScope reports whether the key may call routes in scope. An empty
+// scope is a route missing from routeScopes, which only keys without scope
+// limits may call.
+func (k *apiKey) allowsScope(scope string) bool {
+	return scope == scopeOpen || len(k.Scopes) == 0 || slices.Contains(k.Scopes, scopeAll) || (scope != "" && slices.Contains(k.Scopes, scope))
+}
+
+// allowsModel reports whether name matches one of the key's model patterns,
+// either in its shortest form, such as llama3:latest, or fully qualified
+func (k *apiKey) allowsModel(name string) bool {
+	if len(k.Models) == 0 {
+		return true
+	}
+
+	n := model.ParseName(name)
+	for _, pattern := range k.Models {
+		for _, s := range []string{name, n.DisplayShortest(), n.String()} {
+			if ok, _ := path.Match(pattern, s); ok {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+var (
+	errRequestQuota = errors.New("request quota exceeded, please try again later")
+	errTokenQuota   = errors.New("daily token quota exceeded")
+)
+
+// take counts a request against the key's quotas, returning an error and how
+// long until it may retry if a quota is used up
+func (k *apiKey) take(now time.Time) (time.Duration, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	day := now.UTC().Truncate(24 * time.Hour)
+	if !k.day.Equal(day) {
+		k.day, k.tokens = day, 0
+	}
+
+	if k.TokensPerDay > 0 && k.tokens >= k.TokensPerDay {
+		return k.day.Add(24 * time.Hour).Sub(now), errTokenQuota
+	}
+
+	if now.Sub(k.windowStart) >= time.Minute {
+		k.windowStart, k.requests = now, 0
+	}
+
+	if k.RequestsPerMinute > 0 && k.requests >= k.RequestsPerMinute {
+		return k.windowStart.Add(time.Minute).Sub(now), errRequestQuota
+	}
+
+	k.requests++
+	return 0, nil
+}
+
+// wait counts a request against the key's quotas like take, but waits for
+// the request quota instead of failing. It fails if the daily token quota is
+// used up.
+func (k *apiKey) wait(ctx context.Context) error {
+	for {
+		retry, err := k.take(time.Now())
+		if !errors.Is(err, errRequestQuota) {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(retry):
+		}
+	}
+}
+
+func (k *apiKey) addTokens(n int) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.tokens += n
+}
+
+type apiKeyContextKey struct{}
+
+// contextKey returns the API key a request was made with, or nil if API keys
+// aren't required
+func contextKey(ctx context.Context) *apiKey {
+	k, _ := ctx.Value(apiKeyContextKey{}).(*apiKey)
+	return k
+}
+
+// recordTokens counts the tokens used by a completion against the quota of
+// the API key the request was made with, if any
+func recordTokens(ctx context.Context, m api.Metrics) {
+	if k := contextKey(ctx); k != nil {
+		k.addTokens(m.PromptEvalCount + m.EvalCount)
+	}
+}
+
+// streamedBodies are the routes whose bodies are too large to buffer: blob
+// uploads, and batch uploads, which check the model of each request as they
+// read it
+var streamedBodies = []string{"/api/blobs/:digest", "/api/batch"}
+
+// requestModels returns the models named in a request, reading them from the
+// body without consuming it
+func requestModels(c *gin.Context) ([]string, error) {
+	names := []string{c.Param("model")}
+
+	if c.Request.Body != nil && !slices.Contains(streamedBodies, c.FullPath()) {
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			return nil, err
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		var r struct {
+			Model       string `json:"model"`
+			Name        string `json:"name"`
+			Source      string `json:"source"`
+			Destination string `json:"destination"`
+		}
+
+		// malformed bodies are left for the handler to reject
+		if json.Unmarshal(body, &r) == nil {
+			names = append(names, r.Model, r.Name, r.Source, r.Destination)
+		}
+	}
+
+	return slices.DeleteFunc(names, func(s string) bool { return s == "" }), nil
+}
+
+// middleware requires requests to carry a known API key as a bearer token,
+// checks the route and models are allowed for the key, and enforces its
+// quotas. Only the root path, used for health checks, is open to all.
+func (keys *apiKeys) middleware(c *gin.Context) {
+	if c.Request.URL.Path == "/" {
+		c.Next()
+		return
+	}
+
+	token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	k := keys.keys[token]
+	if !ok || k == nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "a valid API key is required"})
+		return
+	}
+
+	// requests that match no route are left to fail with a 404
+	if scope := routeScopes[c.FullPath()]; c.FullPath() != "" && !k.allowsScope(scope) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("API key is not allowed to call %s", c.FullPath())})
+		return
+	}
+
+	names, err := requestModels(c)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	for _, name := range names {
+		if !k.allowsModel(name) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("API key is not allowed to use model %q", name)})
+			return
+		}
+	}
+
+	if retry, err := k.take(time.Now()); err != nil {
+		c.Header("Retry-After", strconv.Itoa(int(retry.Seconds()+1)))
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), apiKeyContextKey{}, k))
+	c.Next()
+}
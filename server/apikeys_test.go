@@ -0,0 +1,203 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
+)
+
+func writeAPIKeys(t *testing.T, keys string) string {
+	t.Helper()
+
+	p := filepath.Join(t.TempDir(), "keys.json")
+	require.NoError(t, os.WriteFile(p, []byte(keys), 0o600))
+	return p
+}
+
+func TestLoadAPIKeys(t *testing.T) {
+	keys, err := loadAPIKeys(writeAPIKeys(t, `{"keys":[{"key":"a","name":"ci","scopes":["inference"],"models":["llama3*"],"requests_per_minute":10}]}`))
+	require.NoError(t, err)
+	require.Equal(t, "ci", keys.keys["a"].Name)
+	require.Equal(t, 10, keys.keys["a"].RequestsPerMinute)
+
+	_, err = loadAPIKeys(writeAPIKeys(t, `{"keys":[{"name":"empty"}]}`))
+	require.ErrorContains(t, err, "empty")
+
+	_, err = loadAPIKeys(writeAPIKeys(t, `{"keys":[{"key":"a"}]}`))
+	require.ErrorContains(t, err, "no name")
+
+	_, err = loadAPIKeys(writeAPIKeys(t, `{"keys":[{"key":"a","name":"ci"},{"key":"b","name":"ci"}]}`))
+	require.ErrorContains(t, err, "more than one key")
+
+	_, err = loadAPIKeys(writeAPIKeys(t, `{"keys":[{"key":"a","name":"ci","models":["[a-"]}]}`))
+	require.ErrorContains(t, err, "bad model pattern")
+}
+
+func TestAPIKeyAllowsModel(t *testing.T) {
+	k := apiKey{Models: []string{"llama3*", "myorg/*"}}
+
+	for name, expect := range map[string]bool{
+		"llama3":                               true,
+		"llama3:70b":                           true,
+		"registry.ollama.ai/library/llama3:8b": true,
+		"myorg/custom:latest":                  true,
+		"mistral":                              false,
+		"otherorg/custom":                      false,
+	} {
+		require.Equal(t, expect, k.allowsModel(name), name)
+	}
+}
+
+func TestAPIKeysMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	keys, err := loadAPIKeys(writeAPIKeys(t, `{"keys":[
+		{"key":"chat","name":"chat","scopes":["inference"],"models":["llama3*"],"requests_per_minute":3},
+		{"key":"admin","name":"admin","scopes":["*"]},
+		{"key":"embed","name":"embed","scopes":["inference"]}
+	]}`))
+	require.NoError(t, err)
+
+	r := gin.New()
+	r.Use(keys.middleware)
+	echo := func(c *gin.Context) {
+		body, _ := io.ReadAll(c.Request.Body)
+		c.String(http.StatusOK, string(body))
+	}
+	r.POST("/api/chat", echo)
+	// batch uploads reach the handler unread
+	var upload *strings.Reader
+	r.POST("/api/batch", func(c *gin.Context) {
+		require.Equal(t, upload.Size(), int64(upload.Len()))
+		c.Status(http.StatusOK)
+	})
+	r.POST("/api/pull", echo)
+	r.GET("/api/tags", echo)
+	r.GET("/api/unscoped", echo)
+	r.GET("/", echo)
+
+	do := func(method, path, key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	cases := []struct {
+		name, method, path, key, body string
+		code                          int
+	}{
+		{"health check", http.MethodGet, "/", "", "", http.StatusOK},
+		{"missing key", http.MethodGet, "/api/tags", "", "", http.StatusUnauthorized},
+		{"unknown key", http.MethodGet, "/api/tags", "nope", "", http.StatusUnauthorized},
+		{"open route", http.MethodGet, "/api/tags", "embed", "", http.StatusOK},
+		{"unscoped route", http.MethodGet, "/api/unscoped", "embed", "", http.StatusForbidden},
+		{"unscoped route all scopes", http.MethodGet, "/api/unscoped", "admin", "", http.StatusOK},
+		{"unknown route", http.MethodGet, "/api/missing", "embed", "", http.StatusNotFound},
+		{"scope denied", http.MethodPost, "/api/pull", "chat", `{"model":"llama3"}`, http.StatusForbidden},
+		{"scope allowed", http.MethodPost, "/api/pull", "admin", `{"model":"mistral"}`, http.StatusOK},
+		{"model denied", http.MethodPost, "/api/chat", "chat", `{"model":"mistral"}`, http.StatusForbidden},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			w := do(tt.method, tt.path, tt.key, tt.body)
+			require.Equal(t, tt.code, w.Code, w.Body.String())
+		})
+	}
+
+	t.Run("body preserved", func(t *testing.T) {
+		w := do(http.MethodPost, "/api/chat", "chat", `{"model":"llama3:8b"}`)
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, `{"model":"llama3:8b"}`, w.Body.String())
+	})
+
+	t.Run("batch upload not buffered", func(t *testing.T) {
+		upload = strings.NewReader(`{"endpoint":"/api/chat","body":{"model":"mistral"}}`)
+		req := httptest.NewRequest(http.MethodPost, "/api/batch", upload)
+		req.Header.Set("Authorization", "Bearer embed")
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	})
+
+	t.Run("requests per minute", func(t *testing.T) {
+		// the chat key has used 1 of its 3 requests
+		for range 2 {
+			require.Equal(t, http.StatusOK, do(http.MethodPost, "/api/chat", "chat", `{"model":"llama3"}`).Code)
+		}
+
+		w := do(http.MethodPost, "/api/chat", "chat", `{"model":"llama3"}`)
+		require.Equal(t, http.StatusTooManyRequests, w.Code)
+		require.NotEmpty(t, w.Header().Get("Retry-After"))
+
+		var serr api.StatusError
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &serr))
+		require.Equal(t, errRequestQuota.Error(), serr.ErrorMessage)
+	})
+}
+
+// Routes missing from routeScopes are denied to keys with limited scopes,
+// so every route needs one
+func TestRouteScopes(t *testing.T) {
+	metricsEnabled := envconfig.Metrics
+	envconfig.Metrics = true
+	t.Cleanup(func() { envconfig.Metrics = metricsEnabled })
+
+	s := &Server{sched: InitScheduler()}
+	for _, route := range s.GenerateRoutes().(*gin.Engine).Routes() {
+		if route.Path == "/" {
+			continue
+		}
+
+		if _, ok := routeScopes[route.Path]; !ok {
+			t.Errorf("%s %s has no scope", route.Method, route.Path)
+		}
+	}
+}
+
+func TestAPIKeyQuotas(t *testing.T) {
+	k := &apiKey{RequestsPerMinute: 2, TokensPerDay: 100}
+	now := time.Date(2024, 7, 1, 12, 0, 0, 0, time.UTC)
+
+	for range 2 {
+		_, err := k.take(now)
+		require.NoError(t, err)
+	}
+
+	retry, err := k.take(now.Add(30 * time.Second))
+	require.ErrorIs(t, err, errRequestQuota)
+	require.Equal(t, 30*time.Second, retry)
+
+	// a new window starts after a minute
+	_, err = k.take(now.Add(time.Minute))
+	require.NoError(t, err)
+
+	ctx := context.WithValue(context.Background(), apiKeyContextKey{}, k)
+	recordTokens(ctx, api.Metrics{PromptEvalCount: 60, EvalCount: 40})
+
+	_, err = k.take(now.Add(2 * time.Minute))
+	require.ErrorIs(t, err, errTokenQuota)
+
+	// the token quota resets at midnight UTC
+	_, err = k.take(now.Add(24 * time.Hour))
+	require.NoError(t, err)
+}
@@ -0,0 +1,772 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
+)
+
+// Batch jobs run the requests in a JSONL file in the background at batch
+// priority, one job at a time in the order they were submitted. Each job is a
+// directory under the models directory holding its requests, its results and
+// its status, so a job interrupted by a restart resumes where it left off.
+
+const (
+	batchQueued    = "queued"
+	batchRunning   = "running"
+	batchCompleted = "completed"
+	batchCanceled  = "canceled"
+	batchFailed    = "failed"
+)
+
+// batchEndpoints are the APIs batch requests may call
+var batchEndpoints = []string{"/api/generate", "/api/chat", "/api/embed"}
+
+// batchWorkers is how many of a job's requests are in flight at once
+var batchWorkers = 4
+
+var (
+	errBadBatch         = errors.New("bad batch")
+	errBatchNotFound    = errors.New("batch job not found")
+	errBatchModelDenied = errors.New("API key is not allowed to use model")
+)
+
+// GetBatchPath returns the directory batch jobs are stored in, creating it if
+// needed
+func GetBatchPath() (string, error) {
+	dir := filepath.Join(envconfig.ModelsDir, "batch")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+
+	return dir, nil
+}
+
+type batchJob struct {
+	dir string
+
+	// owner is the name of the API key the job was submitted with. It is
+	// empty if API keys weren't required.
+	owner string
+
+	mu        sync.Mutex
+	job       api.BatchJob
+	cancel    context.CancelFunc // set while the job is running
+	lastSaved time.Time
+}
+
+type batchJobs struct {
+	dir string
+
+	mu   sync.Mutex
+	jobs map[string]*batchJob
+	wake chan struct{} // signaled when a job is queued
+}
+
+// loadBatchJobs reads the jobs stored in dir. Jobs that were running when the
+// server stopped are queued to run again.
+func loadBatchJobs(dir string) (*batchJobs, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	j := &batchJobs{dir: dir, jobs: make(map[string]*batchJob), wake: make(chan struct{}, 1)}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+
+		job := &batchJob{dir: filepath.Join(dir, e.Name())}
+		if err := job.load(); err != nil {
+			slog.Warn("skipping batch job", "id", e.Name(), "error", err)
+			continue
+		}
+
+		if job.job.Status == batchRunning {
+			job.job.Status = batchQueued
+		}
+
+		j.jobs[job.job.ID] = job
+	}
+
+	return j, nil
+}
+
+// batchJobFile is the job.json of a job
+type batchJobFile struct {
+	api.BatchJob
+	Owner string `json:"owner,omitempty"`
+}
+
+func (b *batchJob) load() error {
+	f, err := os.Open(filepath.Join(b.dir, "job.json"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var file batchJobFile
+	if err := json.NewDecoder(f).Decode(&file); err != nil {
+		return err
+	}
+
+	b.job, b.owner = file.BatchJob, file.Owner
+	return nil
+}
+
+// save writes the job's status. mu must be held.
+func (b *batchJob) save() error {
+	bts, err := json.Marshal(batchJobFile{b.job, b.owner})
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(b.dir, "job.json.tmp")
+	if err := os.WriteFile(tmp, bts, 0o644); err != nil {
+		return err
+	}
+
+	b.lastSaved = time.Now()
+	return os.Rename(tmp, filepath.Join(b.dir, "job.json"))
+}
+
+// ownedBy reports whether the job may be seen and canceled with k, which is
+// nil if API keys aren't required
+func (b *batchJob) ownedBy(k *apiKey) bool {
+	return k == nil || b.owner == k.Name
+}
+
+func (b *batchJob) snapshot() api.BatchJob {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.job
+}
+
+func newBatchID() (string, error) {
+	bts := make([]byte, 12)
+	if _, err := rand.Read(bts); err != nil {
+		return "", err
+	}
+
+	return "batch-" + hex.EncodeToString(bts), nil
+}
+
+// submit stores the requests read from r as a new queued job owned by k,
+// which is nil if API keys aren't required
+func (j *batchJobs) submit(r io.Reader, k *apiKey) (api.BatchJob, error) {
+	id, err := newBatchID()
+	if err != nil {
+		return api.BatchJob{}, err
+	}
+
+	allowModel := func(string) bool { return true }
+	job := &batchJob{dir: filepath.Join(j.dir, id)}
+	if k != nil {
+		allowModel, job.owner = k.allowsModel, k.Name
+	}
+
+	if err := os.MkdirAll(job.dir, 0o755); err != nil {
+		return api.BatchJob{}, err
+	}
+
+	total, err := writeBatchRequests(r, filepath.Join(job.dir, "requests.jsonl"), allowModel)
+	if err == nil {
+		// create the results file so it can be downloaded before the job runs
+		err = os.WriteFile(filepath.Join(job.dir, "results.jsonl"), nil, 0o644)
+	}
+
+	if err == nil {
+		job.job = api.BatchJob{ID: id, Status: batchQueued, Total: total, CreatedAt: time.Now().UTC()}
+		err = job.save()
+	}
+
+	if err != nil {
+		os.RemoveAll(job.dir)
+		return api.BatchJob{}, err
+	}
+
+	queued := job.job
+
+	j.mu.Lock()
+	j.jobs[id] = job
+	j.mu.Unlock()
+
+	select {
+	case j.wake <- struct{}{}:
+	default:
+	}
+
+	return queued, nil
+}
+
+// writeBatchRequests checks each request read from r and writes it to p,
+// returning the number of requests
+func writeBatchRequests(r io.Reader, p string, allowModel func(string) bool) (int, error) {
+	f, err := os.Create(p)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	br := bufio.NewReader(r)
+
+	var n int
+	for {
+		line, err := br.ReadBytes('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return 0, err
+		}
+
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			n++
+			req, berr := parseBatchRequest(line, n, allowModel)
+			if berr != nil {
+				return 0, berr
+			}
+
+			bts, merr := json.Marshal(req)
+			if merr != nil {
+				return 0, merr
+			}
+
+			w.Write(bts)
+			w.WriteByte('\n')
+		}
+
+		if errors.Is(err, io.EOF) {
+			break
+		}
+	}
+
+	if n == 0 {
+		return 0, fmt.Errorf("%w: no requests", errBadBatch)
+	}
+
+	if err := w.Flush(); err != nil {
+		return 0, err
+	}
+
+	return n, f.Close()
+}
+
+func parseBatchRequest(line []byte, n int, allowModel func(string) bool) (api.BatchRequest, error) {
+	var req api.BatchRequest
+	if err := json.Unmarshal(line, &req); err != nil {
+		return req, fmt.Errorf("%w: line %d: %w", errBadBatch, n, err)
+	}
+
+	if !slices.Contains(batchEndpoints, req.Endpoint) {
+		return req, fmt.Errorf("%w: line %d: endpoint must be one of %v", errBadBatch, n, batchEndpoints)
+	}
+
+	var body struct {
+		Model string `json:"model"`
+	}
+
+	if err := json.Unmarshal(req.Body, &body); err != nil {
+		return req, fmt.Errorf("%w: line %d: body: %w", errBadBatch, n, err)
+	}
+
+	if body.Model == "" {
+		return req, fmt.Errorf("%w: line %d: model %w", errBadBatch, n, errRequired)
+	}
+
+	if !allowModel(body.Model) {
+		return req, fmt.Errorf("%w: line %d: %w %q", errBadBatch, n, errBatchModelDenied, body.Model)
+	}
+
+	if req.ID == "" {
+		req.ID = strconv.Itoa(n)
+	}
+
+	return req, nil
+}
+
+func (j *batchJobs) get(id string) (*batchJob, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	job, ok := j.jobs[id]
+	return job, ok
+}
+
+// list returns the jobs owned by k
+func (j *batchJobs) list(k *apiKey) []api.BatchJob {
+	j.mu.Lock()
+	jobs := make([]api.BatchJob, 0, len(j.jobs))
+	for _, job := range j.jobs {
+		if job.ownedBy(k) {
+			jobs = append(jobs, job.snapshot())
+		}
+	}
+	j.mu.Unlock()
+
+	slices.SortFunc(jobs, func(a, b api.BatchJob) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	return jobs
+}
+
+// cancel stops a queued or running job. Results of the requests that already
+// finished are kept.
+func (j *batchJobs) cancel(id string) (api.BatchJob, error) {
+	job, ok := j.get(id)
+	if !ok {
+		return api.BatchJob{}, errBatchNotFound
+	}
+
+	job.mu.Lock()
+	defer job.mu.Unlock()
+
+	if job.job.Status == batchQueued || job.job.Status == batchRunning {
+		now := time.Now().UTC()
+		job.job.Status, job.job.FinishedAt = batchCanceled, &now
+		if job.cancel != nil {
+			job.cancel()
+		}
+
+		if err := job.save(); err != nil {
+			return api.BatchJob{}, err
+		}
+	}
+
+	return job.job, nil
+}
+
+// next returns the oldest queued job, if there is one
+func (j *batchJobs) next() *batchJob {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var next *batchJob
+	for _, job := range j.jobs {
+		job.mu.Lock()
+		queued, created := job.job.Status == batchQueued, job.job.CreatedAt
+		job.mu.Unlock()
+
+		if queued && (next == nil || created.Before(next.job.CreatedAt)) {
+			next = job
+		}
+	}
+
+	return next
+}
+
+// run runs queued jobs until ctx is done, sending their requests to h. A job
+// interrupted by ctx is left to resume the next time the server starts. keys
+// are the API keys jobs are run with, or nil if they aren't required.
+func (j *batchJobs) run(ctx context.Context, h http.Handler, keys *apiKeys) {
+	for {
+		job := j.next()
+		if job == nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-j.wake:
+			}
+			continue
+		}
+
+		job.run(ctx, h, keys)
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// run sends the job's requests to h with its owner's API key in their
+// context, so they count against the key's quotas
+func (b *batchJob) run(ctx context.Context, h http.Handler, keys *apiKeys) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	b.mu.Lock()
+	if b.job.Status != batchQueued {
+		b.mu.Unlock()
+		return
+	}
+
+	b.job.Status, b.cancel = batchRunning, cancel
+	if err := b.save(); err != nil {
+		slog.Warn("failed to save batch job", "id", b.job.ID, "error", err)
+	}
+	b.mu.Unlock()
+
+	slog.Info("running batch job", "id", b.job.ID)
+
+	var err error
+	if keys != nil {
+		if k := keys.named(b.owner); k != nil {
+			err = b.process(context.WithValue(ctx, apiKeyContextKey{}, k), h)
+		} else {
+			err = fmt.Errorf("API key %q no longer exists", b.owner)
+		}
+	} else {
+		err = b.process(ctx, h)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.cancel = nil
+
+	switch {
+	case b.job.Status == batchCanceled:
+		slog.Info("batch job canceled", "id", b.job.ID)
+		return
+	case ctx.Err() != nil:
+		// the server is stopping; the job stays running and is resumed at
+		// the next start
+	case err != nil:
+		slog.Error("batch job failed", "id", b.job.ID, "error", err)
+		b.job.Status, b.job.Error = batchFailed, err.Error()
+	default:
+		slog.Info("batch job completed", "id", b.job.ID, "completed", b.job.Completed, "failed", b.job.Failed)
+		b.job.Status = batchCompleted
+	}
+
+	if b.job.Status != batchRunning {
+		now := time.Now().UTC()
+		b.job.FinishedAt = &now
+	}
+
+	if err := b.save(); err != nil {
+		slog.Warn("failed to save batch job", "id", b.job.ID, "error", err)
+	}
+}
+
+// process sends the job's requests that don't have results yet to h
+func (b *batchJob) process(ctx context.Context, h http.Handler) error {
+	done, err := b.scanResults()
+	if err != nil {
+		return err
+	}
+
+	results, err := os.OpenFile(filepath.Join(b.dir, "results.jsonl"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	defer results.Close()
+
+	requests, err := os.Open(filepath.Join(b.dir, "requests.jsonl"))
+	if err != nil {
+		return err
+	}
+	defer requests.Close()
+
+	type batchLine struct {
+		api.BatchRequest
+		n int
+	}
+
+	g, ctx := errgroup.WithContext(ctx)
+	lines := make(chan batchLine)
+
+	g.Go(func() error {
+		defer close(lines)
+
+		br := bufio.NewReader(requests)
+		for n := 1; ; n++ {
+			bts, err := br.ReadBytes('\n')
+			if errors.Is(err, io.EOF) {
+				return nil
+			} else if err != nil {
+				return err
+			}
+
+			if done[n] {
+				continue
+			}
+
+			var req api.BatchRequest
+			if err := json.Unmarshal(bts, &req); err != nil {
+				return fmt.Errorf("line %d: %w", n, err)
+			}
+
+			select {
+			case lines <- batchLine{req, n}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	})
+
+	for range batchWorkers {
+		g.Go(func() error {
+			for l := range lines {
+				result := serveBatchRequest(ctx, h, l.BatchRequest, l.n)
+				if ctx.Err() != nil {
+					// interrupted requests are run again if the job resumes
+					return ctx.Err()
+				}
+
+				if err := b.record(results, result); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+	}
+
+	return g.Wait()
+}
+
+// scanResults counts the results already written, returning the lines of
+// the requests they are for. A result only partly written when the server
+// stopped is discarded.
+func (b *batchJob) scanResults() (map[int]bool, error) {
+	f, err := os.OpenFile(filepath.Join(b.dir, "results.jsonl"), os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	done := make(map[int]bool)
+	var completed, failed int
+	var offset int64
+
+	br := bufio.NewReader(f)
+	for {
+		bts, err := br.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		var result api.BatchResult
+		if err := json.Unmarshal(bts, &result); err != nil {
+			break
+		}
+
+		done[result.Line] = true
+		if result.Error != "" {
+			failed++
+		} else {
+			completed++
+		}
+		offset += int64(len(bts))
+	}
+
+	if err := f.Truncate(offset); err != nil {
+		return nil, err
+	}
+
+	b.mu.Lock()
+	b.job.Completed, b.job.Failed = completed, failed
+	b.mu.Unlock()
+	return done, nil
+}
+
+// record appends a result and counts it in the job's progress, which is
+// saved at most once a second
+func (b *batchJob) record(w io.Writer, result api.BatchResult) error {
+	bts, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, err := w.Write(append(bts, '\n')); err != nil {
+		return err
+	}
+
+	if result.Error != "" {
+		b.job.Failed++
+	} else {
+		b.job.Completed++
+	}
+
+	if time.Since(b.lastSaved) > time.Second {
+		return b.save()
+	}
+
+	return nil
+}
+
+// serveBatchRequest sends req to h at batch priority without streaming,
+// returning its response or error as a result. A request made with an API key
+// waits for the key's request quota and fails if its token quota is used up.
+func serveBatchRequest(ctx context.Context, h http.Handler, req api.BatchRequest, n int) api.BatchResult {
+	result := api.BatchResult{ID: req.ID, Line: n}
+
+	if k := contextKey(ctx); k != nil {
+		if err := k.wait(ctx); err != nil {
+			result.Error = err.Error()
+			return result
+		}
+	}
+
+	var body map[string]any
+	if err := json.Unmarshal(req.Body, &body); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	body["stream"] = false
+	body["priority"] = priorityBatch.String()
+
+	bts, err := json.Marshal(body)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	// the scheduler releases a runner when the request's context is done, so
+	// each request needs its own context rather than the job's
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, req.Endpoint, bytes.NewReader(bts))
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	r.Header.Set("Content-Type", "application/json")
+
+	w := batchResponse{header: make(http.Header)}
+	h.ServeHTTP(&w, r)
+
+	if w.code == http.StatusOK {
+		result.Response = w.body.Bytes()
+		return result
+	}
+
+	var serr api.StatusError
+	if err := json.Unmarshal(w.body.Bytes(), &serr); err != nil || serr.ErrorMessage == "" {
+		serr.ErrorMessage = http.StatusText(w.code)
+	}
+
+	result.Error = serr.ErrorMessage
+	return result
+}
+
+// batchResponse buffers the response to a batch request
+type batchResponse struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (w *batchResponse) Header() http.Header {
+	return w.header
+}
+
+func (w *batchResponse) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+}
+
+func (w *batchResponse) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(b)
+}
+
+func (s *Server) CreateBatchHandler(c *gin.Context) {
+	job, err := s.batch.submit(c.Request.Body, contextKey(c.Request.Context()))
+	switch {
+	case errors.Is(err, errBatchModelDenied):
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, errBadBatch):
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, job)
+}
+
+func (s *Server) ListBatchHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, api.ListBatchResponse{Jobs: s.batch.list(contextKey(c.Request.Context()))})
+}
+
+// requestBatch returns the job named in the path of c, if it is owned by the
+// request's API key
+func (s *Server) requestBatch(c *gin.Context) (*batchJob, bool) {
+	job, ok := s.batch.get(c.Param("id"))
+	if !ok || !job.ownedBy(contextKey(c.Request.Context())) {
+		return nil, false
+	}
+
+	return job, true
+}
+
+func (s *Server) GetBatchHandler(c *gin.Context) {
+	job, ok := s.requestBatch(c)
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": errBatchNotFound.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, job.snapshot())
+}
+
+func (s *Server) CancelBatchHandler(c *gin.Context) {
+	if _, ok := s.requestBatch(c); !ok {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": errBatchNotFound.Error()})
+		return
+	}
+
+	job, err := s.batch.cancel(c.Param("id"))
+	switch {
+	case errors.Is(err, errBatchNotFound):
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, job)
+}
+
+// BatchResultsHandler sends the results of a job as JSONL. A job that hasn't
+// finished sends the results so far.
+func (s *Server) BatchResultsHandler(c *gin.Context) {
+	job, ok := s.requestBatch(c)
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": errBatchNotFound.Error()})
+		return
+	}
+
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", job.job.ID+".jsonl"))
+	c.File(filepath.Join(job.dir, "results.jsonl"))
+}
+
+// batchRoutes serves the requests of batch jobs, which skip the middleware
+// of the public routes. While the server drains, jobs pause before their next
+// request.
+func (s *Server) batchRoutes() http.Handler {
+	r := gin.New()
+	r.Use(s.drain.batchMiddleware)
+	r.POST("/api/generate", s.GenerateHandler)
+	r.POST("/api/chat", s.ChatHandler)
+	r.POST("/api/embed", s.EmbedHandler)
+	return r
+}
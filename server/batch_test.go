@@ -0,0 +1,450 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
+	"github.com/ollama/ollama/gpu"
+	"github.com/ollama/ollama/llm"
+)
+
+// echoBatchHandler responds to batch requests with their body, or an error for
+// the model "bad"
+func echoBatchHandler(t *testing.T, served *[]string) http.Handler {
+	var mu sync.Mutex
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		require.Equal(t, false, body["stream"])
+		require.Equal(t, "batch", body["priority"])
+
+		mu.Lock()
+		*served = append(*served, body["prompt"].(string))
+		mu.Unlock()
+
+		if body["model"] == "bad" {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(gin.H{"error": `model "bad" not found`})
+			return
+		}
+
+		json.NewEncoder(w).Encode(body)
+	})
+}
+
+func readBatchResults(t *testing.T, p string) []api.BatchResult {
+	t.Helper()
+
+	f, err := os.Open(p)
+	require.NoError(t, err)
+	defer f.Close()
+
+	var results []api.BatchResult
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var result api.BatchResult
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &result))
+		results = append(results, result)
+	}
+	require.NoError(t, scanner.Err())
+
+	sort.Slice(results, func(i, j int) bool { return results[i].Line < results[j].Line })
+	return results
+}
+
+func waitForBatch(t *testing.T, j *batchJobs, id, status string) api.BatchJob {
+	t.Helper()
+
+	var job api.BatchJob
+	require.Eventually(t, func() bool {
+		b, ok := j.get(id)
+		require.True(t, ok)
+		job = b.snapshot()
+		return job.Status == status
+	}, 5*time.Second, 10*time.Millisecond)
+	return job
+}
+
+func TestBatchSubmit(t *testing.T) {
+	j, err := loadBatchJobs(t.TempDir())
+	require.NoError(t, err)
+
+	cases := map[string]string{
+		"empty":    "\n\n",
+		"json":     `{"endpoint":`,
+		"endpoint": `{"endpoint":"/api/pull","body":{"model":"llama3"}}`,
+		"model":    `{"endpoint":"/api/chat","body":{}}`,
+	}
+
+	for name, body := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, err := j.submit(strings.NewReader(body), nil)
+			require.ErrorIs(t, err, errBadBatch)
+		})
+	}
+
+	_, err = j.submit(strings.NewReader(`{"endpoint":"/api/chat","body":{"model":"mistral"}}`), &apiKey{Name: "ci", Models: []string{"llama3"}})
+	require.ErrorIs(t, err, errBatchModelDenied)
+
+	// rejected jobs leave nothing behind
+	entries, err := os.ReadDir(j.dir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+	require.Empty(t, j.list(nil))
+
+	job, err := j.submit(strings.NewReader(`{"endpoint":"/api/generate","body":{"model":"llama3"}}
+
+{"id":"second","endpoint":"/api/embed","body":{"model":"llama3"}}
+`), nil)
+	require.NoError(t, err)
+	require.Equal(t, batchQueued, job.Status)
+	require.Equal(t, 2, job.Total)
+}
+
+func TestBatchRun(t *testing.T) {
+	j, err := loadBatchJobs(t.TempDir())
+	require.NoError(t, err)
+
+	var served []string
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go j.run(ctx, echoBatchHandler(t, &served), nil)
+
+	job, err := j.submit(strings.NewReader(`{"id":"a","endpoint":"/api/generate","body":{"model":"llama3","prompt":"1"}}
+{"endpoint":"/api/generate","body":{"model":"bad","prompt":"2"}}
+{"endpoint":"/api/chat","body":{"model":"llama3","prompt":"3","stream":true}}
+`), nil)
+	require.NoError(t, err)
+
+	job = waitForBatch(t, j, job.ID, batchCompleted)
+	require.Equal(t, 2, job.Completed)
+	require.Equal(t, 1, job.Failed)
+	require.NotNil(t, job.FinishedAt)
+
+	results := readBatchResults(t, filepath.Join(j.dir, job.ID, "results.jsonl"))
+	require.Len(t, results, 3)
+	require.Equal(t, "a", results[0].ID)
+	require.JSONEq(t, `{"model":"llama3","prompt":"1","stream":false,"priority":"batch"}`, string(results[0].Response))
+	require.Equal(t, "2", results[1].ID)
+	require.Equal(t, `model "bad" not found`, results[1].Error)
+	require.Equal(t, 3, results[2].Line)
+
+	// jobs are reloaded from disk
+	reloaded, err := loadBatchJobs(j.dir)
+	require.NoError(t, err)
+	require.Equal(t, []api.BatchJob{job}, reloaded.list(nil))
+}
+
+func TestBatchResume(t *testing.T) {
+	j, err := loadBatchJobs(t.TempDir())
+	require.NoError(t, err)
+
+	job, err := j.submit(strings.NewReader(`{"endpoint":"/api/generate","body":{"model":"llama3","prompt":"1"}}
+{"endpoint":"/api/generate","body":{"model":"llama3","prompt":"2"}}
+{"endpoint":"/api/generate","body":{"model":"llama3","prompt":"3"}}
+`), nil)
+	require.NoError(t, err)
+
+	// simulate a server that stopped after finishing the second request and
+	// while writing the result of the first
+	b, _ := j.get(job.ID)
+	b.mu.Lock()
+	b.job.Status = batchRunning
+	require.NoError(t, b.save())
+	b.mu.Unlock()
+
+	results := filepath.Join(j.dir, job.ID, "results.jsonl")
+	require.NoError(t, os.WriteFile(results, []byte(`{"id":"2","line":2,"response":{}}
+{"id":"1","li`), 0o644))
+
+	j, err = loadBatchJobs(j.dir)
+	require.NoError(t, err)
+	b, _ = j.get(job.ID)
+	require.Equal(t, batchQueued, b.snapshot().Status)
+
+	var served []string
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go j.run(ctx, echoBatchHandler(t, &served), nil)
+
+	job = waitForBatch(t, j, job.ID, batchCompleted)
+	require.Equal(t, 3, job.Completed)
+
+	sort.Strings(served)
+	require.Equal(t, []string{"1", "3"}, served)
+	require.Len(t, readBatchResults(t, results), 3)
+}
+
+func TestBatchCancel(t *testing.T) {
+	j, err := loadBatchJobs(t.TempDir())
+	require.NoError(t, err)
+
+	started := make(chan struct{}, batchWorkers)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-r.Context().Done()
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go j.run(ctx, h, nil)
+
+	job, err := j.submit(strings.NewReader(`{"endpoint":"/api/generate","body":{"model":"llama3"}}`), nil)
+	require.NoError(t, err)
+	<-started
+
+	job, err = j.cancel(job.ID)
+	require.NoError(t, err)
+	require.Equal(t, batchCanceled, job.Status)
+
+	// the runner moves on to the next job
+	next, err := j.submit(strings.NewReader(`{"endpoint":"/api/generate","body":{"model":"llama3"}}`), nil)
+	require.NoError(t, err)
+	<-started
+	waitForBatch(t, j, next.ID, batchRunning)
+
+	_, err = j.cancel("missing")
+	require.ErrorIs(t, err, errBatchNotFound)
+}
+
+func TestBatchRoutes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	j, err := loadBatchJobs(t.TempDir())
+	require.NoError(t, err)
+
+	s := &Server{sched: InitScheduler(), batch: j}
+	router := s.GenerateRoutes()
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+
+	w := do(http.MethodPost, "/api/batch", `{"endpoint":"/api/generate","body":{"model":"llama3"}}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var job api.BatchJob
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&job))
+
+	require.Equal(t, http.StatusBadRequest, do(http.MethodPost, "/api/batch", `{}`).Code)
+	require.Equal(t, http.StatusNotFound, do(http.MethodGet, "/api/batch/missing", "").Code)
+
+	w = do(http.MethodGet, "/api/batch", "")
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var list api.ListBatchResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&list))
+	require.Equal(t, []api.BatchJob{job}, list.Jobs)
+
+	w = do(http.MethodGet, "/api/batch/"+job.ID+"/results", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "application/x-ndjson", w.Header().Get("Content-Type"))
+	require.Empty(t, w.Body.String())
+
+	w = do(http.MethodPost, "/api/batch/"+job.ID+"/cancel", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&job))
+	require.Equal(t, batchCanceled, job.Status)
+}
+
+func TestBatchOwner(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	keys, err := loadAPIKeys(writeAPIKeys(t, `{"keys":[{"key":"a","name":"alice"},{"key":"b","name":"bob"}]}`))
+	require.NoError(t, err)
+
+	j, err := loadBatchJobs(t.TempDir())
+	require.NoError(t, err)
+
+	s := &Server{sched: InitScheduler(), batch: j, keys: keys}
+	router := s.GenerateRoutes()
+
+	do := func(method, path, key, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+key)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	w := do(http.MethodPost, "/api/batch", "a", `{"endpoint":"/api/generate","body":{"model":"llama3"}}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var job api.BatchJob
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&job))
+
+	var list api.ListBatchResponse
+	w = do(http.MethodGet, "/api/batch", "b", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&list))
+	require.Empty(t, list.Jobs)
+
+	for _, path := range []string{"/api/batch/" + job.ID, "/api/batch/" + job.ID + "/results"} {
+		require.Equal(t, http.StatusNotFound, do(http.MethodGet, path, "b", "").Code, path)
+		require.Equal(t, http.StatusOK, do(http.MethodGet, path, "a", "").Code, path)
+	}
+
+	require.Equal(t, http.StatusNotFound, do(http.MethodPost, "/api/batch/"+job.ID+"/cancel", "b", "").Code)
+	b, _ := j.get(job.ID)
+	require.Equal(t, batchQueued, b.snapshot().Status)
+
+	w = do(http.MethodGet, "/api/batch", "a", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&list))
+	require.Equal(t, []api.BatchJob{job}, list.Jobs)
+
+	// the owner is kept when jobs are reloaded
+	j, err = loadBatchJobs(j.dir)
+	require.NoError(t, err)
+	require.Len(t, j.list(keys.named("alice")), 1)
+	require.Empty(t, j.list(keys.named("bob")))
+}
+
+func TestBatchRunKey(t *testing.T) {
+	keys, err := loadAPIKeys(writeAPIKeys(t, `{"keys":[{"key":"a","name":"alice","tokens_per_day":10}]}`))
+	require.NoError(t, err)
+	alice := keys.named("alice")
+
+	j, err := loadBatchJobs(t.TempDir())
+	require.NoError(t, err)
+
+	// each request uses 6 tokens, so the second uses up the key's quota
+	var mu sync.Mutex
+	var served []string
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		k := contextKey(r.Context())
+		require.NotNil(t, k)
+		served = append(served, k.Name)
+		recordTokens(r.Context(), api.Metrics{PromptEvalCount: 2, EvalCount: 4})
+		json.NewEncoder(w).Encode(gin.H{})
+	})
+
+	workers := batchWorkers
+	batchWorkers = 1
+	t.Cleanup(func() { batchWorkers = workers })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go j.run(ctx, h, keys)
+
+	job, err := j.submit(strings.NewReader(`{"endpoint":"/api/generate","body":{"model":"llama3"}}
+{"endpoint":"/api/generate","body":{"model":"llama3"}}
+{"endpoint":"/api/generate","body":{"model":"llama3"}}
+`), alice)
+	require.NoError(t, err)
+
+	job = waitForBatch(t, j, job.ID, batchCompleted)
+	require.Equal(t, 2, job.Completed)
+	require.Equal(t, 1, job.Failed)
+	require.Equal(t, []string{"alice", "alice"}, served)
+
+	results := readBatchResults(t, filepath.Join(j.dir, job.ID, "results.jsonl"))
+	require.Equal(t, errTokenQuota.Error(), results[2].Error)
+
+	// a job whose key was removed fails
+	job, err = j.submit(strings.NewReader(`{"endpoint":"/api/generate","body":{"model":"llama3"}}`), &apiKey{Name: "removed"})
+	require.NoError(t, err)
+
+	job = waitForBatch(t, j, job.ID, batchFailed)
+	require.Equal(t, `API key "removed" no longer exists`, job.Error)
+}
+
+// completingLlm finishes every completion immediately
+type completingLlm struct {
+	*mockLlm
+}
+
+func (completingLlm) Completion(_ context.Context, _ llm.CompletionRequest, fn func(llm.CompletionResponse)) error {
+	fn(llm.CompletionResponse{Content: "ok", Done: true, DoneReason: "stop"})
+	return nil
+}
+
+func TestBatchScheduler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	envconfig.LoadConfig()
+
+	numParallel, maxRunners := envconfig.NumParallel, envconfig.MaxRunners
+	t.Cleanup(func() { envconfig.NumParallel, envconfig.MaxRunners = numParallel, maxRunners })
+	envconfig.NumParallel, envconfig.MaxRunners = 1, 1
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	j, err := loadBatchJobs(t.TempDir())
+	require.NoError(t, err)
+
+	s := &Server{sched: InitScheduler(), batch: j}
+	s.sched.getGpuFn = s.sched.getCpuFn
+	s.sched.newServerFn = func(gpu.GpuInfoList, string, *llm.GGML, []string, []string, string, api.Options, int) (llm.LlamaServer, error) {
+		return completingLlm{&mockLlm{done: make(chan struct{})}}, nil
+	}
+	s.sched.Run(ctx)
+
+	w := createRequest(t, s.CreateModelHandler, api.CreateRequest{
+		Model: "test",
+		Modelfile: fmt.Sprintf("FROM %s\nTEMPLATE {{ .Prompt }}", createBinFile(t, llm.KV{
+			"general.architecture":      "llama",
+			"tokenizer.ggml.tokens":     []string{""},
+			"tokenizer.ggml.scores":     []float32{0},
+			"tokenizer.ggml.token_type": []int32{0},
+		}, []llm.Tensor{
+			{Name: "token_embd.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+		})),
+		Stream: &stream,
+	})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	go j.run(ctx, s.batchRoutes(), nil)
+
+	// more requests than the runner has slots, so each must release its slot
+	// for the next to be scheduled
+	var lines strings.Builder
+	for i := range 6 {
+		fmt.Fprintf(&lines, `{"endpoint":"/api/generate","body":{"model":"test","prompt":"%d"}}`+"\n", i)
+	}
+
+	job, err := j.submit(strings.NewReader(lines.String()), nil)
+	require.NoError(t, err)
+
+	job = waitForBatch(t, j, job.ID, batchCompleted)
+	require.Equal(t, 6, job.Completed)
+	require.Zero(t, job.Failed)
+
+	var runners []*runnerRef
+	s.sched.loadedMu.Lock()
+	for _, runner := range s.sched.loaded {
+		runners = append(runners, runner)
+	}
+	s.sched.loadedMu.Unlock()
+
+	require.Len(t, runners, 1)
+	require.Eventually(t, func() bool {
+		runners[0].refMu.Lock()
+		defer runners[0].refMu.Unlock()
+		return runners[0].refCount == 0
+	}, time.Second, 10*time.Millisecond)
+}
@@ -20,6 +20,8 @@ import (
 	"syscall"
 	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/sync/errgroup"
 
 	"github.com/ollama/ollama/api"
@@ -33,6 +35,36 @@ var errPartStalled = errors.New("part stalled")
 
 var blobDownloadManager sync.Map
 
+// downloadCtx is the parent of every blob download, which outlives the pull
+// that started it while other pulls wait on it. It is canceled at shutdown.
+var downloadCtx, cancelDownloads = context.WithCancel(context.Background())
+
+// stopDownloads cancels blob downloads and waits for them to record their
+// progress in their -partial-N files, so the next pull resumes them
+func stopDownloads(ctx context.Context) error {
+	cancelDownloads()
+
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		running := false
+		blobDownloadManager.Range(func(any, any) bool {
+			running = true
+			return false
+		})
+
+		if !running {
+			return nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
 type blobDownload struct {
 	Name   string
 	Digest string
@@ -67,6 +99,34 @@ const (
 	maxDownloadPartSize int64 = 1000 * format.MegaByte
 )
 
+// MarshalJSON records the part's progress in its -partial-N file
+func (p *blobDownloadPart) MarshalJSON() ([]byte, error) {
+	return json.Marshal(blobDownloadPartJSON{
+		N:         p.N,
+		Offset:    p.Offset,
+		Size:      p.Size,
+		Completed: p.Completed.Load(),
+	})
+}
+
+func (p *blobDownloadPart) UnmarshalJSON(b []byte) error {
+	var v blobDownloadPartJSON
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+
+	p.N, p.Offset, p.Size = v.N, v.Offset, v.Size
+	p.Completed.Store(v.Completed)
+	return nil
+}
+
+type blobDownloadPartJSON struct {
+	N         int
+	Offset    int64
+	Size      int64
+	Completed int64
+}
+
 func (p *blobDownloadPart) Name() string {
 	return strings.Join([]string{
 		p.blobDownload.Name, "partial", strconv.Itoa(p.N),
@@ -84,6 +144,7 @@ func (p *blobDownloadPart) StopsAt() int64 {
 func (p *blobDownloadPart) Write(b []byte) (n int, err error) {
 	n = len(b)
 	p.blobDownload.Completed.Add(int64(n))
+	metrics.pullBytes.Add(float64(n))
 	p.lastUpdatedMu.Lock()
 	p.lastUpdated = time.Now()
 	p.lastUpdatedMu.Unlock()
@@ -289,7 +350,15 @@ func (b *blobDownload) run(ctx context.Context, requestURL *url.URL, opts *regis
 	return nil
 }
 
-func (b *blobDownload) downloadChunk(ctx context.Context, requestURL *url.URL, w io.Writer, part *blobDownloadPart) error {
+func (b *blobDownload) downloadChunk(ctx context.Context, requestURL *url.URL, w io.Writer, part *blobDownloadPart) (err error) {
+	ctx, span := startSpan(ctx, "downloadChunk", trace.WithAttributes(
+		attribute.String("digest", b.Digest),
+		attribute.Int("part", part.N),
+		attribute.Int64("offset", part.StartsAt()),
+		attribute.Int64("size", part.StopsAt()-part.StartsAt()),
+	))
+	defer func() { endSpan(span, err) }()
+
 	g, ctx := errgroup.WithContext(ctx)
 	g.Go(func() error {
 		req, err := http.NewRequestWithContext(ctx, http.MethodGet, requestURL.String(), nil)
@@ -459,7 +528,7 @@ func downloadBlob(ctx context.Context, opts downloadOpts) (cacheHit bool, _ erro
 		}
 
 		//nolint:contextcheck
-		go download.Run(context.Background(), requestURL, opts.regOpts)
+		go download.Run(downloadCtx, requestURL, opts.regOpts)
 	}
 
 	return false, download.Wait(ctx, opts.fn)
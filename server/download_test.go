@@ -0,0 +1,103 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
+)
+
+func TestStopDownloads(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	envconfig.LoadConfig()
+	t.Cleanup(func() { downloadCtx, cancelDownloads = context.WithCancel(context.Background()) })
+
+	const total, sent = 4096, 1024
+	digest := "sha256:" + strings.Repeat("a", 64)
+
+	var direct, resumed string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/direct" && r.Header.Get("Range") == "bytes=0-4095":
+			// send part of the blob then stall until the download is canceled
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(make([]byte, sent))
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+		case r.URL.Path == "/direct":
+			resumed = r.Header.Get("Range")
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(make([]byte, total-sent))
+		case r.Method == http.MethodHead:
+			w.Header().Set("Content-Length", strconv.Itoa(total))
+		default:
+			// redirect to another host name, as the registry does to its blob storage
+			http.Redirect(w, r, direct, http.StatusTemporaryRedirect)
+		}
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+	direct = "http://localhost:" + u.Port() + "/direct"
+
+	opts := downloadOpts{
+		mp:      ModelPath{ProtocolScheme: "http", Registry: u.Host, Namespace: "library", Repository: "test", Tag: "latest"},
+		digest:  digest,
+		regOpts: &registryOptions{Insecure: true},
+		fn:      func(api.ProgressResponse) {},
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := downloadBlob(context.Background(), opts)
+		errCh <- err
+	}()
+
+	require.Eventually(t, func() bool {
+		v, ok := blobDownloadManager.Load(digest)
+		return ok && v.(*blobDownload).Completed.Load() == sent
+	}, 5*time.Second, 10*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, stopDownloads(ctx))
+	require.ErrorIs(t, <-errCh, context.Canceled)
+
+	blob, err := GetBlobsPath(digest)
+	require.NoError(t, err)
+
+	// the partial file records how much was downloaded
+	f, err := os.Open(blob + "-partial-0")
+	require.NoError(t, err)
+	defer f.Close()
+
+	var part struct {
+		Size      int64
+		Completed int64
+	}
+	require.NoError(t, json.NewDecoder(f).Decode(&part))
+	require.EqualValues(t, total, part.Size)
+	require.EqualValues(t, sent, part.Completed)
+
+	// the next pull picks up where the last left off
+	downloadCtx, cancelDownloads = context.WithCancel(context.Background())
+	_, err = downloadBlob(context.Background(), opts)
+	require.NoError(t, err)
+	require.Equal(t, "bytes=1024-4095", resumed)
+
+	fi, err := os.Stat(blob)
+	require.NoError(t, err)
+	require.EqualValues(t, total, fi.Size())
+}
@@ -26,6 +26,7 @@ import (
 	"github.com/ollama/ollama/auth"
 	"github.com/ollama/ollama/envconfig"
 	"github.com/ollama/ollama/format"
+	"github.com/ollama/ollama/grammar"
 	"github.com/ollama/ollama/llm"
 	"github.com/ollama/ollama/parser"
 	"github.com/ollama/ollama/template"
@@ -39,6 +40,7 @@ var (
 	errCapabilityCompletion = errors.New("completion")
 	errCapabilityTools      = errors.New("tools")
 	errCapabilityInsert     = errors.New("insert")
+	errCapabilityRerank     = errors.New("rerank")
 )
 
 type Capability string
@@ -47,6 +49,7 @@ const (
 	CapabilityCompletion = Capability("completion")
 	CapabilityTools      = Capability("tools")
 	CapabilityInsert     = Capability("insert")
+	CapabilityRerank     = Capability("rerank")
 )
 
 type registryOptions struct {
@@ -66,7 +69,9 @@ type Model struct {
 	ParentModel    string
 	AdapterPaths   []string
 	ProjectorPaths []string
+	DraftPath      string
 	System         string
+	Grammar        string
 	License        []string
 	Digest         string
 	Options        map[string]interface{}
@@ -78,26 +83,48 @@ type Model struct {
 // CheckCapabilities checks if the model has the specified capabilities returning an error describing
 // any missing or unknown capabilities
 func (m *Model) CheckCapabilities(caps ...Capability) error {
+	// TODO(mxyng): decode the GGML into model to avoid doing this multiple times
+	var kv llm.KV
+	decode := func() bool {
+		if kv != nil {
+			return true
+		}
+
+		f, err := os.Open(m.ModelPath)
+		if err != nil {
+			slog.Error("couldn't open model file", "error", err)
+			return false
+		}
+		defer f.Close()
+
+		ggml, _, err := llm.DecodeGGML(f, 0)
+		if err != nil {
+			slog.Error("couldn't decode ggml", "error", err)
+			return false
+		}
+
+		kv = ggml.KV()
+		return true
+	}
+
 	var errs []error
 	for _, cap := range caps {
 		switch cap {
 		case CapabilityCompletion:
-			f, err := os.Open(m.ModelPath)
-			if err != nil {
-				slog.Error("couldn't open model file", "error", err)
+			if !decode() {
 				continue
 			}
-			defer f.Close()
 
-			// TODO(mxyng): decode the GGML into model to avoid doing this multiple times
-			ggml, _, err := llm.DecodeGGML(f, 0)
-			if err != nil {
-				slog.Error("couldn't decode ggml", "error", err)
+			if _, ok := kv[fmt.Sprintf("%s.pooling_type", kv.Architecture())]; ok {
+				errs = append(errs, errCapabilityCompletion)
+			}
+		case CapabilityRerank:
+			if !decode() {
 				continue
 			}
 
-			if _, ok := ggml.KV()[fmt.Sprintf("%s.pooling_type", ggml.KV().Architecture())]; ok {
-				errs = append(errs, errCapabilityCompletion)
+			if kv.PoolingType() != llm.PoolingTypeRank {
+				errs = append(errs, errCapabilityRerank)
 			}
 		case CapabilityTools:
 			if !slices.Contains(m.Template.Vars(), "tools") {
@@ -143,6 +170,13 @@ func (m *Model) String() string {
 		})
 	}
 
+	if m.DraftPath != "" {
+		modelfile.Commands = append(modelfile.Commands, parser.Command{
+			Name: "draft",
+			Args: m.DraftPath,
+		})
+	}
+
 	if m.Template != nil {
 		modelfile.Commands = append(modelfile.Commands, parser.Command{
 			Name: "template",
@@ -157,6 +191,13 @@ func (m *Model) String() string {
 		})
 	}
 
+	if m.Grammar != "" {
+		modelfile.Commands = append(modelfile.Commands, parser.Command{
+			Name: "grammar",
+			Args: m.Grammar,
+		})
+	}
+
 	for k, v := range m.Options {
 		switch v := v.(type) {
 		case []any:
@@ -288,6 +329,8 @@ func GetModel(name string) (*Model, error) {
 			model.AdapterPaths = append(model.AdapterPaths, filename)
 		case "application/vnd.ollama.image.projector":
 			model.ProjectorPaths = append(model.ProjectorPaths, filename)
+		case "application/vnd.ollama.image.draft":
+			model.DraftPath = filename
 		case "application/vnd.ollama.image.prompt",
 			"application/vnd.ollama.image.template":
 			bts, err := os.ReadFile(filename)
@@ -306,6 +349,13 @@ func GetModel(name string) (*Model, error) {
 			}
 
 			model.System = string(bts)
+		case "application/vnd.ollama.image.grammar":
+			bts, err := os.ReadFile(filename)
+			if err != nil {
+				return nil, err
+			}
+
+			model.Grammar = string(bts)
 		case "application/vnd.ollama.image.params":
 			params, err := os.Open(filename)
 			if err != nil {
@@ -381,7 +431,7 @@ func CreateModel(ctx context.Context, name model.Name, modelFileDir, quantizatio
 		mediatype := fmt.Sprintf("application/vnd.ollama.image.%s", c.Name)
 
 		switch c.Name {
-		case "model", "adapter":
+		case "model", "adapter", "draft":
 			var baseLayers []*layerGGML
 			if name := model.ParseName(c.Args); name.IsValid() {
 				baseLayers, err = parseFromModel(ctx, name, fn)
@@ -433,6 +483,22 @@ func CreateModel(ctx context.Context, name model.Name, modelFileDir, quantizatio
 			}
 
 			for _, baseLayer := range baseLayers {
+				if c.Name == "draft" {
+					// only the weights of the draft model are kept, the
+					// rest of its layers don't apply to this model
+					if baseLayer.MediaType != "application/vnd.ollama.image.model" {
+						continue
+					}
+
+					draft := *baseLayer.Layer
+					draft.MediaType = mediatype
+					layers = slices.DeleteFunc(layers, func(layer *Layer) bool {
+						return layer.MediaType == mediatype
+					})
+					layers = append(layers, &draft)
+					continue
+				}
+
 				if quantization != "" &&
 					baseLayer.MediaType == "application/vnd.ollama.image.model" &&
 					baseLayer.GGML != nil &&
@@ -460,8 +526,7 @@ func CreateModel(ctx context.Context, name model.Name, modelFileDir, quantizatio
 						defer temp.Close()
 						defer os.Remove(temp.Name())
 
-if err := llm.Quantize(blob, temp.Name()); err != nil {
-
+						if err := llm.Quantize(blob, temp.Name(), want); err != nil {
 							return err
 						}
 
@@ -494,11 +559,16 @@ if err := llm.Quantize(blob, temp.Name()); err != nil {
 
 				layers = append(layers, baseLayer.Layer)
 			}
-		case "license", "template", "system":
-			if c.Name == "template" {
+		case "license", "template", "system", "grammar":
+			switch c.Name {
+			case "template":
 				if _, err := template.Parse(c.Args); err != nil {
 					return fmt.Errorf("%w: %s", errBadTemplate, err)
 				}
+			case "grammar":
+				if err := grammar.Validate(c.Args); err != nil {
+					return fmt.Errorf("%w: %s", errBadGrammar, err)
+				}
 			}
 
 			if c.Name != "license" {
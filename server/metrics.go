@@ -0,0 +1,153 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/ollama/ollama/api"
+)
+
+// serverMetrics are the metrics exported on /metrics when OLLAMA_METRICS is
+// set. Queue and runner gauges are read from the scheduler on each scrape by
+// schedulerCollector.
+type serverMetrics struct {
+	registry *prometheus.Registry
+
+	loadDuration  *prometheus.HistogramVec
+	completions   *prometheus.CounterVec
+	promptTokens  *prometheus.CounterVec
+	evalTokens    *prometheus.CounterVec
+	tokensPerSec  *prometheus.HistogramVec
+	pullBytes     prometheus.Counter
+	pushBytes     prometheus.Counter
+	requestErrors *prometheus.CounterVec
+}
+
+func newServerMetrics() *serverMetrics {
+	m := serverMetrics{
+		registry: prometheus.NewRegistry(),
+		loadDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "ollama_model_load_duration_seconds",
+			Help:    "Time taken to load a model into a runner.",
+			Buckets: []float64{0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+		}, []string{"model"}),
+		completions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ollama_completions_total",
+			Help: "Completions finished, by why they stopped. Completions the client cancelled have a done_reason of cancelled.",
+		}, []string{"model", "done_reason"}),
+		promptTokens: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ollama_prompt_tokens_total",
+			Help: "Prompt tokens evaluated.",
+		}, []string{"model"}),
+		evalTokens: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ollama_eval_tokens_total",
+			Help: "Tokens generated.",
+		}, []string{"model"}),
+		tokensPerSec: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "ollama_eval_tokens_per_second",
+			Help:    "Generation speed of completed requests.",
+			Buckets: []float64{1, 5, 10, 25, 50, 100, 250, 500, 1000},
+		}, []string{"model"}),
+		pullBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "ollama_pull_bytes_total",
+			Help: "Bytes downloaded pulling models.",
+		}),
+		pushBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "ollama_push_bytes_total",
+			Help: "Bytes uploaded pushing models.",
+		}),
+		requestErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ollama_request_errors_total",
+			Help: "Requests that failed, by status code.",
+		}, []string{"code"}),
+	}
+
+	m.registry.MustRegister(
+		m.loadDuration,
+		m.completions,
+		m.promptTokens,
+		m.evalTokens,
+		m.tokensPerSec,
+		m.pullBytes,
+		m.pushBytes,
+		m.requestErrors,
+	)
+
+	return &m
+}
+
+var metrics = newServerMetrics()
+
+// recordCompletion records how a completion finished, its token counts and
+// its speed
+func (m *serverMetrics) recordCompletion(model, doneReason string, r api.Metrics) {
+	m.completions.WithLabelValues(model, doneReason).Inc()
+	m.promptTokens.WithLabelValues(model).Add(float64(r.PromptEvalCount))
+	m.evalTokens.WithLabelValues(model).Add(float64(r.EvalCount))
+	if r.EvalCount > 0 && r.EvalDuration > 0 {
+		m.tokensPerSec.WithLabelValues(model).Observe(float64(r.EvalCount) / r.EvalDuration.Seconds())
+	}
+}
+
+func (m *serverMetrics) recordLoad(model string, d time.Duration) {
+	m.loadDuration.WithLabelValues(model).Observe(d.Seconds())
+}
+
+var (
+	queueDepthDesc    = prometheus.NewDesc("ollama_queue_depth", "Requests waiting for a runner.", []string{"model"}, nil)
+	loadedRunnersDesc = prometheus.NewDesc("ollama_loaded_runners", "Runners currently loaded.", nil, nil)
+	runnerVRAMDesc    = prometheus.NewDesc("ollama_runner_vram_bytes", "VRAM used by a loaded runner.", []string{"model"}, nil)
+)
+
+// schedulerCollector reports the scheduler's current state as gauges
+type schedulerCollector struct {
+	sched *Scheduler
+}
+
+func (c schedulerCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- queueDepthDesc
+	ch <- loadedRunnersDesc
+	ch <- runnerVRAMDesc
+}
+
+func (c schedulerCollector) Collect(ch chan<- prometheus.Metric) {
+	for model, n := range c.sched.queue.depths() {
+		ch <- prometheus.MustNewConstMetric(queueDepthDesc, prometheus.GaugeValue, float64(n), model)
+	}
+
+	c.sched.loadedMu.Lock()
+	defer c.sched.loadedMu.Unlock()
+
+	var loaded int
+	for _, runner := range c.sched.loaded {
+		if runner.model == nil {
+			continue
+		}
+
+		loaded++
+		ch <- prometheus.MustNewConstMetric(runnerVRAMDesc, prometheus.GaugeValue, float64(runner.estimatedVRAM), runner.model.ShortName)
+	}
+
+	ch <- prometheus.MustNewConstMetric(loadedRunnersDesc, prometheus.GaugeValue, float64(loaded))
+}
+
+// metricsMiddleware counts requests that fail with an error status
+func metricsMiddleware(c *gin.Context) {
+	c.Next()
+
+	if code := c.Writer.Status(); code >= http.StatusBadRequest {
+		metrics.requestErrors.WithLabelValues(strconv.Itoa(code)).Inc()
+	}
+}
+
+func (s *Server) MetricsHandler(c *gin.Context) {
+	sched := prometheus.NewRegistry()
+	sched.MustRegister(schedulerCollector{s.sched})
+
+	promhttp.HandlerFor(prometheus.Gatherers{metrics.registry, sched}, promhttp.HandlerOpts{}).ServeHTTP(c.Writer, c.Request)
+}
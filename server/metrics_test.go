@@ -0,0 +1,70 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	metricsEnabled := envconfig.Metrics
+	envconfig.Metrics = true
+	t.Cleanup(func() { envconfig.Metrics = metricsEnabled })
+
+	sched := InitScheduler()
+	sched.loaded["model"] = &runnerRef{model: &Model{ShortName: "loaded:latest"}, estimatedVRAM: 1024}
+	sched.queue.push(&LlmRequest{ctx: context.Background(), model: &Model{ShortName: "queued:latest"}})
+
+	metrics.recordCompletion("loaded:latest", "stop", api.Metrics{PromptEvalCount: 3, EvalCount: 10, EvalDuration: time.Second})
+	metrics.recordCompletion("loaded:latest", "cancelled", api.Metrics{PromptEvalCount: 3, EvalCount: 2, EvalDuration: time.Second})
+	metrics.recordLoad("loaded:latest", time.Second)
+
+	s := &Server{sched: sched}
+	router := s.GenerateRoutes()
+
+	// an unknown route is counted as an error
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/missing", nil))
+	require.Equal(t, http.StatusNotFound, w.Code)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Contains(t, w.Header().Get("Content-Type"), "text/plain")
+
+	body, err := io.ReadAll(w.Body)
+	require.NoError(t, err)
+
+	for _, line := range []string{
+		`ollama_queue_depth{model="queued:latest"} 1`,
+		`ollama_loaded_runners 1`,
+		`ollama_runner_vram_bytes{model="loaded:latest"} 1024`,
+		`ollama_eval_tokens_per_second_bucket{model="loaded:latest",le="10"}`,
+		`ollama_request_errors_total{code="404"}`,
+		`ollama_completions_total{done_reason="stop",model="loaded:latest"} 1`,
+		`ollama_completions_total{done_reason="cancelled",model="loaded:latest"} 1`,
+		`# TYPE ollama_pull_bytes_total counter`,
+		`# TYPE ollama_model_load_duration_seconds histogram`,
+	} {
+		require.Contains(t, string(body), line)
+	}
+}
+
+func TestMetricsDisabled(t *testing.T) {
+	metricsEnabled := envconfig.Metrics
+	envconfig.Metrics = false
+	t.Cleanup(func() { envconfig.Metrics = metricsEnabled })
+
+	s := &Server{sched: InitScheduler()}
+	w := httptest.NewRecorder()
+	s.GenerateRoutes().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
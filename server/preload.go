@@ -0,0 +1,94 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// preloadModel is a model listed in OLLAMA_PRELOAD
+type preloadModel struct {
+	Model   string         `json:"model"`
+	Options map[string]any `json:"options"`
+}
+
+// parsePreload reads OLLAMA_PRELOAD, which is either a comma separated list
+// of model names or the path to a JSON file listing models and the options
+// to load them with
+func parsePreload(s string) ([]preloadModel, error) {
+	if !strings.HasSuffix(s, ".json") {
+		var models []preloadModel
+		for _, name := range strings.Split(s, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				models = append(models, preloadModel{Model: name})
+			}
+		}
+
+		return models, nil
+	}
+
+	f, err := os.Open(s)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var file struct {
+		Models []preloadModel `json:"models"`
+	}
+
+	if err := json.NewDecoder(f).Decode(&file); err != nil {
+		return nil, fmt.Errorf("preload: %w", err)
+	}
+
+	for i, m := range file.Models {
+		if m.Model == "" {
+			return nil, fmt.Errorf("preload: model %d has no name", i)
+		}
+	}
+
+	return file.Models, nil
+}
+
+// preload loads and pins each model in turn. Models that fail to load are
+// logged and skipped.
+func (s *Server) preload(ctx context.Context, models []preloadModel) {
+	for _, p := range models {
+		if err := s.preloadModel(ctx, p); err != nil {
+			slog.Error("failed to preload model", "model", p.Model, "error", err)
+			continue
+		}
+
+		slog.Info("preloaded model", "model", p.Model)
+	}
+}
+
+func (s *Server) preloadModel(ctx context.Context, p preloadModel) error {
+	m, err := GetModel(p.Model)
+	if err != nil {
+		return err
+	}
+
+	opts, err := modelOptions(m, p.Options)
+	if err != nil {
+		return err
+	}
+
+	s.sched.pin(m.ModelPath)
+
+	// canceling ctx releases the runner, which stays loaded as it's pinned
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	runnerCh, errCh := s.sched.GetRunner(ctx, m, opts, nil)
+	select {
+	case <-runnerCh:
+		return nil
+	case err := <-errCh:
+		s.sched.unpin(m.ModelPath)
+		return err
+	}
+}
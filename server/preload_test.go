@@ -0,0 +1,76 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
+	"github.com/ollama/ollama/gpu"
+	"github.com/ollama/ollama/llm"
+)
+
+func TestParsePreload(t *testing.T) {
+	models, err := parsePreload("llama3, mistral:7b,")
+	require.NoError(t, err)
+	require.Equal(t, []preloadModel{{Model: "llama3"}, {Model: "mistral:7b"}}, models)
+
+	p := filepath.Join(t.TempDir(), "preload.json")
+	require.NoError(t, os.WriteFile(p, []byte(`{"models":[{"model":"llama3","options":{"num_ctx":8192}}]}`), 0o600))
+	models, err = parsePreload(p)
+	require.NoError(t, err)
+	require.Equal(t, []preloadModel{{Model: "llama3", Options: map[string]any{"num_ctx": float64(8192)}}}, models)
+
+	require.NoError(t, os.WriteFile(p, []byte(`{"models":[{"options":{}}]}`), 0o600))
+	_, err = parsePreload(p)
+	require.ErrorContains(t, err, "no name")
+
+	_, err = parsePreload(filepath.Join(t.TempDir(), "missing.json"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestPreload(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	envconfig.LoadConfig()
+
+	loaded := make(chan api.Options, 1)
+	s := Server{sched: InitScheduler()}
+	s.sched.getGpuFn = getCpuFn
+	s.sched.getCpuFn = getCpuFn
+	s.sched.loadFn = func(req *LlmRequest, _ *llm.GGML, _ gpu.GpuInfoList, _ int) {
+		loaded <- req.opts
+		req.successCh <- &runnerRef{llama: &mockRunner{}}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.sched.Run(ctx)
+
+	w := createRequest(t, s.CreateModelHandler, api.CreateRequest{
+		Model:     "test",
+		Modelfile: fmt.Sprintf("FROM %s", createBinFile(t, nil, nil)),
+		Stream:    &stream,
+	})
+	require.Equal(t, 200, w.Code)
+
+	// models that fail to load are skipped
+	s.preload(ctx, []preloadModel{
+		{Model: "missing"},
+		{Model: "test", Options: map[string]any{"num_batch": float64(128)}},
+	})
+
+	require.Equal(t, 128, (<-loaded).NumBatch)
+
+	m, err := GetModel("test")
+	require.NoError(t, err)
+	require.True(t, s.sched.pinned[m.ModelPath])
+	require.Len(t, s.sched.pinned, 1)
+}
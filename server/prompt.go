@@ -5,6 +5,9 @@ import (
 	"context"
 	"log/slog"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
 	"github.com/ollama/ollama/api"
 	"github.com/ollama/ollama/llm"
 	"github.com/ollama/ollama/template"
@@ -15,7 +18,10 @@ type tokenizeFunc func(context.Context, string) ([]int, error)
 // chatPrompt accepts a list of messages and returns the prompt and images that should be used for the next chat turn.
 // chatPrompt truncates any messages that exceed the context window of the model, making sure to always include 1) the
 // latest message and 2) system messages
-func chatPrompt(ctx context.Context, m *Model, tokenize tokenizeFunc, opts *api.Options, msgs []api.Message, tools []api.Tool) (prompt string, images []llm.ImageData, _ error) {
+func chatPrompt(ctx context.Context, m *Model, tokenize tokenizeFunc, opts *api.Options, msgs []api.Message, tools []api.Tool) (prompt string, images []llm.ImageData, err error) {
+	ctx, span := startSpan(ctx, "chatPrompt", trace.WithAttributes(modelAttr(m), attribute.Int("messages", len(msgs))))
+	defer func() { endSpan(span, err) }()
+
 	var system []api.Message
 	// always include the last message
 	n := len(msgs) - 1
@@ -62,15 +68,13 @@ func chatPrompt(ctx context.Context, m *Model, tokenize tokenizeFunc, opts *api.
 	}
 
 	for _, m := range msgs[n:] {
-	for _, i := range m.Images {
-		imageData := llm.ImageData{
-			Width:  i.Width,
-			Height: i.Height,
-			URL:    i.URL,
+		for _, i := range m.Images {
+			images = append(images, llm.ImageData{
+				ID:   len(images),
+				Data: i,
+			})
 		}
+	}
 
-			images = append(images, llm.ImageData{
-				Width:  i.Width,
-				Height: i.Height,
-				URL:    i.URL,
+	return b.String(), images, nil
 }
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// priority is the scheduling class of a request
+type priority int
+
+const (
+	priorityInteractive priority = iota
+	priorityBatch
+)
+
+func (p priority) String() string {
+	switch p {
+	case priorityInteractive:
+		return "interactive"
+	case priorityBatch:
+		return "batch"
+	default:
+		return "unknown"
+	}
+}
+
+// priorityWeights is the relative share of runner slots each class receives
+// while both have requests waiting
+var priorityWeights = map[priority]float64{
+	priorityInteractive: 8,
+	priorityBatch:       1,
+}
+
+var errBadPriority = errors.New(`priority must be "interactive" or "batch"`)
+
+// parsePriority parses a request's priority, returning def if it's empty
+func parsePriority(s string, def priority) (priority, error) {
+	switch s {
+	case "":
+		return def, nil
+	case "interactive":
+		return priorityInteractive, nil
+	case "batch":
+		return priorityBatch, nil
+	default:
+		return def, errBadPriority
+	}
+}
+
+type schedInfoKey struct{}
+
+// schedInfo is how the scheduler queues a request
+type schedInfo struct {
+	priority priority
+	client   string
+}
+
+// schedContext returns the request context annotated with the priority and
+// client the scheduler queues the request under
+func schedContext(c *gin.Context, p priority) context.Context {
+	return context.WithValue(c.Request.Context(), schedInfoKey{}, schedInfo{
+		priority: p,
+		client:   clientKey(c),
+	})
+}
+
+// clientKey identifies the client a request is fairly queued under: its API
+// key if it sent one, otherwise its address
+func clientKey(c *gin.Context) string {
+	if token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); ok && token != "" {
+		return "key:" + token
+	}
+
+	return "ip:" + c.ClientIP()
+}
+
+// fairQueue orders pending requests using weighted fair queuing. Every model,
+// client and priority combination is a separate flow. Each request is tagged
+// with a virtual finish time that advances more slowly for heavier weighted
+// flows and the request with the earliest tag is served first, so one busy
+// flow can't starve the others and interactive requests overtake batch ones.
+// The zero value is an empty queue.
+type fairQueue struct {
+	mu      sync.Mutex
+	vtime   float64
+	flows   map[flowKey]float64 // finish tag of the last request queued per flow
+	pending []queuedRequest
+}
+
+type flowKey struct {
+	model    string
+	client   string
+	priority priority
+}
+
+type queuedRequest struct {
+	*LlmRequest
+	start, finish float64
+}
+
+func (q *fairQueue) push(req *LlmRequest) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.flows == nil {
+		q.flows = make(map[flowKey]float64)
+	}
+
+	key := flowKey{req.model.ModelPath, req.client, req.priority}
+	start := max(q.vtime, q.flows[key])
+	finish := start + 1/priorityWeights[req.priority]
+	q.flows[key] = finish
+
+	q.pending = append(q.pending, queuedRequest{LlmRequest: req, start: start, finish: finish})
+}
+
+// pop removes and returns the request with the earliest finish tag for which
+// ready returns true, or nil if there isn't one. Ties go to the request queued
+// first.
+func (q *fairQueue) pop(ready func(*LlmRequest) bool) *LlmRequest {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	next := -1
+	for i, r := range q.pending {
+		if (next < 0 || r.finish < q.pending[next].finish) && ready(r.LlmRequest) {
+			next = i
+		}
+	}
+
+	if next < 0 {
+		return nil
+	}
+
+	r := q.pending[next]
+	q.pending = append(q.pending[:next], q.pending[next+1:]...)
+	q.vtime = max(q.vtime, r.start)
+
+	// flows that have fallen behind virtual time no longer affect tagging
+	for key, finish := range q.flows {
+		if finish <= q.vtime {
+			delete(q.flows, key)
+		}
+	}
+
+	return r.LlmRequest
+}
+
+func (q *fairQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending)
+}
+
+// depths returns the number of pending requests for each model
+func (q *fairQueue) depths() map[string]int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	depths := make(map[string]int)
+	for _, r := range q.pending {
+		depths[r.model.ShortName]++
+	}
+
+	return depths
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePriority(t *testing.T) {
+	cases := []struct {
+		value  string
+		def    priority
+		expect priority
+		err    error
+	}{
+		{"", priorityInteractive, priorityInteractive, nil},
+		{"", priorityBatch, priorityBatch, nil},
+		{"interactive", priorityBatch, priorityInteractive, nil},
+		{"batch", priorityInteractive, priorityBatch, nil},
+		{"urgent", priorityInteractive, priorityInteractive, errBadPriority},
+	}
+
+	for _, tt := range cases {
+		p, err := parsePriority(tt.value, tt.def)
+		require.ErrorIs(t, err, tt.err, tt.value)
+		require.Equal(t, tt.expect, p, tt.value)
+	}
+}
+
+func TestSchedContext(t *testing.T) {
+	c, _ := gin.CreateTestContext(nil)
+	c.Request = &http.Request{Header: http.Header{}, RemoteAddr: "10.0.0.1:1234"}
+
+	info := schedContext(c, priorityBatch).Value(schedInfoKey{}).(schedInfo)
+	require.Equal(t, priorityBatch, info.priority)
+	require.Equal(t, "ip:10.0.0.1", info.client)
+
+	c.Request.Header.Set("Authorization", "Bearer secret")
+	info = schedContext(c, priorityInteractive).Value(schedInfoKey{}).(schedInfo)
+	require.Equal(t, priorityInteractive, info.priority)
+	require.Equal(t, "key:secret", info.client)
+}
+
+func newQueuedRequest(model, client string, p priority) *LlmRequest {
+	return &LlmRequest{
+		ctx:      context.Background(),
+		model:    &Model{ModelPath: model},
+		client:   client,
+		priority: p,
+	}
+}
+
+func popAll(q *fairQueue) (reqs []*LlmRequest) {
+	for {
+		req := q.pop(func(*LlmRequest) bool { return true })
+		if req == nil {
+			return reqs
+		}
+		reqs = append(reqs, req)
+	}
+}
+
+func TestFairQueueInteractiveOvertakesBatch(t *testing.T) {
+	var q fairQueue
+	var batch []*LlmRequest
+	for range 10 {
+		req := newQueuedRequest("model", "bulk", priorityBatch)
+		batch = append(batch, req)
+		q.push(req)
+	}
+
+	interactive := newQueuedRequest("model", "chat", priorityInteractive)
+	q.push(interactive)
+	require.Equal(t, 11, q.len())
+
+	order := popAll(&q)
+	require.Len(t, order, 11)
+	require.Same(t, interactive, order[0])
+	for i, req := range batch {
+		require.Same(t, req, order[i+1], "batch requests stay in order")
+	}
+}
+
+func TestFairQueueClients(t *testing.T) {
+	var q fairQueue
+	for range 4 {
+		q.push(newQueuedRequest("model", "a", priorityBatch))
+	}
+	for range 2 {
+		q.push(newQueuedRequest("model", "b", priorityBatch))
+	}
+
+	var clients []string
+	for _, req := range popAll(&q) {
+		clients = append(clients, req.client)
+	}
+
+	// b's requests are interleaved with a's rather than queued behind them
+	require.Equal(t, []string{"a", "b", "a", "b", "a", "a"}, clients)
+}
+
+func TestFairQueueWeights(t *testing.T) {
+	var q fairQueue
+	for range 20 {
+		q.push(newQueuedRequest("model", "bulk", priorityBatch))
+		q.push(newQueuedRequest("model", "chat", priorityInteractive))
+	}
+
+	// interactive requests get priorityWeights times the share of batch
+	var interactive int
+	for _, req := range popAll(&q)[:18] {
+		if req.priority == priorityInteractive {
+			interactive++
+		}
+	}
+
+	require.Equal(t, 16, interactive)
+}
+
+func TestFairQueueReady(t *testing.T) {
+	var q fairQueue
+	busy := newQueuedRequest("busy", "a", priorityInteractive)
+	idle := newQueuedRequest("idle", "a", priorityBatch)
+	q.push(busy)
+	q.push(idle)
+
+	ready := func(req *LlmRequest) bool { return req.model.ModelPath != "busy" }
+	require.Same(t, idle, q.pop(ready))
+	require.Nil(t, q.pop(ready))
+	require.Equal(t, 1, q.len())
+
+	require.Same(t, busy, q.pop(func(*LlmRequest) bool { return true }))
+}
@@ -1,27 +1,1930 @@
 package server
 
 import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
 	"net"
 	"net/http"
+	"net/netip"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gin-contrib/cors"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
+	"github.com/ollama/ollama/gpu"
+	"github.com/ollama/ollama/grammar"
+	"github.com/ollama/ollama/llm"
+	"github.com/ollama/ollama/openai"
+	"github.com/ollama/ollama/parser"
+	"github.com/ollama/ollama/template"
+	"github.com/ollama/ollama/types/errtypes"
+	"github.com/ollama/ollama/types/model"
+	"github.com/ollama/ollama/version"
 )
 
-// Server struct definition
+var mode string = gin.DebugMode
+
 type Server struct {
-	addr net.Addr // Correctly defined addr field
+	addr  net.Addr
+	sched *Scheduler
+	keys  *apiKeys // nil unless OLLAMA_API_KEYS is set
+	drain drainer
+	batch *batchJobs
+}
+
+func init() {
+	switch mode {
+	case gin.DebugMode:
+	case gin.ReleaseMode:
+	case gin.TestMode:
+	default:
+		mode = gin.DebugMode
+	}
+
+	gin.SetMode(mode)
+}
+
+var (
+	errRequired    = errors.New("is required")
+	errBadTemplate = errors.New("template error")
+	errBadGrammar  = errors.New("grammar error")
+)
+
+func modelOptions(model *Model, requestOpts map[string]interface{}) (api.Options, error) {
+	opts := api.DefaultOptions()
+	if err := opts.FromMap(model.Options); err != nil {
+		return api.Options{}, err
+	}
+
+	if err := opts.FromMap(requestOpts); err != nil {
+		return api.Options{}, err
+	}
+
+	return opts, nil
+}
+
+// scheduleRunner schedules a runner after validating inputs such as capabilities and model options.
+// It returns the allocated runner, model instance, and consolidated options if successful and error otherwise.
+func (s *Server) scheduleRunner(ctx context.Context, name string, caps []Capability, requestOpts map[string]any, keepAlive *api.Duration) (llm.LlamaServer, *Model, *api.Options, error) {
+	if name == "" {
+		return nil, nil, nil, fmt.Errorf("model %w", errRequired)
+	}
+
+	model, err := GetModel(name)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if err := model.CheckCapabilities(caps...); err != nil {
+		return nil, nil, nil, fmt.Errorf("%s %w", name, err)
+	}
+
+	opts, err := modelOptions(model, requestOpts)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	ctx, span := startSpan(ctx, "scheduler.wait", trace.WithAttributes(modelAttr(model)))
+	runnerCh, errCh := s.sched.GetRunner(ctx, model, opts, keepAlive)
+	var runner *runnerRef
+	select {
+	case runner = <-runnerCh:
+		endSpan(span, nil)
+	case err = <-errCh:
+		endSpan(span, err)
+		return nil, nil, nil, err
+	}
+
+	return runner.llama, model, &opts, nil
+}
+
+func (s *Server) GenerateHandler(c *gin.Context) {
+	var req api.GenerateRequest
+	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	format, gbnf, err := parseFormat(req.Format, req.Grammar)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if err := checkLogprobs(req.Logprobs, req.TopLogprobs); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if req.Raw && (req.Template != "" || req.System != "" || len(req.Context) > 0) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "raw mode does not support template, system, or context"})
+		return
+	}
+
+	prio, err := parsePriority(req.Priority, priorityInteractive)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// expire the runner
+	if req.Prompt == "" && req.KeepAlive != nil && int(req.KeepAlive.Seconds()) == 0 {
+		if s.unloadModel(c, req.Model) {
+			c.JSON(http.StatusOK, api.GenerateResponse{
+				Model:      req.Model,
+				CreatedAt:  time.Now().UTC(),
+				Done:       true,
+				DoneReason: "unload",
+			})
+		}
+		return
+	}
+
+	caps := []Capability{CapabilityCompletion}
+	if req.Suffix != "" {
+		caps = append(caps, CapabilityInsert)
+	}
+
+	checkpointStart := time.Now()
+	r, m, opts, err := s.scheduleRunner(schedContext(c, prio), req.Model, caps, req.Options, req.KeepAlive)
+	if errors.Is(err, errCapabilityCompletion) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%q does not support generate", req.Model)})
+		return
+	} else if err != nil {
+		handleScheduleError(c, req.Model, err)
+		return
+	}
+
+	checkpointLoaded := time.Now()
+
+	// an empty request loads the model
+	if req.Prompt == "" {
+		c.JSON(http.StatusOK, api.GenerateResponse{
+			Model:      req.Model,
+			CreatedAt:  time.Now().UTC(),
+			Done:       true,
+			DoneReason: "load",
+		})
+		return
+	}
+
+	images := make([]llm.ImageData, len(req.Images))
+	for i := range req.Images {
+		images[i] = llm.ImageData{ID: i, Data: req.Images[i]}
+	}
+
+	prompt := req.Prompt
+	if !req.Raw {
+		tmpl := m.Template
+		if req.Template != "" {
+			tmpl, err = template.Parse(req.Template)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+		}
+
+		var b bytes.Buffer
+		if req.Context != nil {
+			s, err := r.Detokenize(c.Request.Context(), req.Context)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+
+			b.WriteString(s)
+		}
+
+		var values template.Values
+		if req.Suffix != "" {
+			values.Prompt = prompt
+			values.Suffix = req.Suffix
+		} else {
+			var msgs []api.Message
+			if req.System != "" {
+				msgs = append(msgs, api.Message{Role: "system", Content: req.System})
+			} else if m.System != "" {
+				msgs = append(msgs, api.Message{Role: "system", Content: m.System})
+			}
+
+			for _, i := range images {
+				msgs = append(msgs, api.Message{Role: "user", Content: fmt.Sprintf("[img-%d]", i.ID)})
+			}
+
+			values.Messages = append(msgs, api.Message{Role: "user", Content: req.Prompt})
+		}
+
+		if err := tmpl.Execute(&b, values); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		prompt = b.String()
+	}
+
+	slog.Debug("generate request", "prompt", prompt, "images", images)
+
+	ctx := c.Request.Context()
+	ch := make(chan any)
+	go func() {
+		var sb strings.Builder
+		defer close(ch)
+		if err := r.Completion(ctx, llm.CompletionRequest{
+			Prompt:      prompt,
+			Images:      images,
+			Format:      format,
+			Grammar:     cmp.Or(gbnf, modelGrammar(m, format)),
+			Logprobs:    req.Logprobs,
+			TopLogprobs: req.TopLogprobs,
+			Options:     opts,
+		}, func(cr llm.CompletionResponse) {
+			res := api.GenerateResponse{
+				Model:      req.Model,
+				CreatedAt:  time.Now().UTC(),
+				Response:   cr.Content,
+				Done:       cr.Done,
+				DoneReason: cr.DoneReason,
+				Logprobs:   cr.Logprobs,
+				Metrics: api.Metrics{
+					PromptEvalCount:     cr.PromptEvalCount,
+					PromptEvalDuration:  cr.PromptEvalDuration,
+					EvalCount:           cr.EvalCount,
+					EvalDuration:        cr.EvalDuration,
+					PromptCacheCount:    cr.PromptCacheCount,
+					DraftAcceptanceRate: cr.DraftAcceptanceRate(),
+				},
+			}
+
+			sb.WriteString(cr.Content)
+
+			if cr.Done {
+				res.TotalDuration = time.Since(checkpointStart)
+				res.LoadDuration = checkpointLoaded.Sub(checkpointStart)
+				metrics.recordCompletion(m.ShortName, cr.DoneReason, res.Metrics)
+				recordTokens(ctx, res.Metrics)
+
+				if !req.Raw && cr.DoneReason != "cancelled" {
+					tokens, err := r.Tokenize(ctx, prompt+sb.String())
+					if err != nil {
+						send(ctx, ch, gin.H{"error": err.Error()})
+						return
+					}
+					res.Context = append(req.Context, tokens...)
+				}
+			}
+
+			send(ctx, ch, res)
+		}); err != nil {
+			send(ctx, ch, gin.H{"error": err.Error()})
+		}
+	}()
+
+	if req.Stream != nil && !*req.Stream {
+		var r api.GenerateResponse
+		var sb strings.Builder
+		var logprobs []api.Logprob
+		for rr := range ch {
+			switch t := rr.(type) {
+			case api.GenerateResponse:
+				sb.WriteString(t.Response)
+				logprobs = append(logprobs, t.Logprobs...)
+				r = t
+			case gin.H:
+				msg, ok := t["error"].(string)
+				if !ok {
+					msg = "unexpected error format in response"
+				}
+
+				c.JSON(http.StatusInternalServerError, gin.H{"error": msg})
+				return
+			default:
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "unexpected response"})
+				return
+			}
+		}
+
+		r.Response = sb.String()
+		r.Logprobs = logprobs
+		c.JSON(http.StatusOK, r)
+		return
+	}
+
+	streamResponse(c, ch)
+}
+
+// unloadModel expires the named model's runner. It writes an error response
+// and returns false if the model can't be resolved.
+func (s *Server) unloadModel(c *gin.Context, name string) bool {
+	m, err := GetModel(name)
+	if err != nil {
+		switch {
+		case os.IsNotExist(err):
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model %q not found, try pulling it first", name)})
+		case err.Error() == errtypes.InvalidModelNameErrMsg:
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return false
+	}
+
+	s.sched.expireRunner(m)
+	return true
+}
+
+func (s *Server) EmbedHandler(c *gin.Context) {
+	var req api.EmbedRequest
+	err := c.ShouldBindJSON(&req)
+	switch {
+	case errors.Is(err, io.EOF):
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	case err != nil:
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	prio, err := parsePriority(req.Priority, priorityBatch)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var input []string
+	switch i := req.Input.(type) {
+	case string:
+		if len(i) > 0 {
+			input = append(input, i)
+		}
+	case []any:
+		for _, v := range i {
+			s, ok := v.(string)
+			if !ok {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid input type"})
+				return
+			}
+			input = append(input, s)
+		}
+	default:
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid input type"})
+		return
+	}
+
+	if len(input) == 0 {
+		c.JSON(http.StatusOK, api.EmbedResponse{Model: req.Model, Embeddings: [][]float32{}})
+		return
+	}
+
+	truncate := true
+	if req.Truncate != nil && !*req.Truncate {
+		truncate = false
+	}
+
+	r, m, opts, err := s.scheduleRunner(schedContext(c, prio), req.Model, []Capability{}, req.Options, req.KeepAlive)
+	if err != nil {
+		handleScheduleError(c, req.Model, err)
+		return
+	}
+
+	kvData, err := getKVData(m.ModelPath, false)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	for i, s := range input {
+		tokens, err := r.Tokenize(c.Request.Context(), s)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		ctxLen := min(opts.NumCtx, int(kvData.ContextLength()))
+		if len(tokens) > ctxLen {
+			if !truncate {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "input length exceeds maximum context length"})
+				return
+			}
+
+			tokens = tokens[:ctxLen]
+			s, err = r.Detokenize(c.Request.Context(), tokens)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+		}
+
+		input[i] = s
+	}
+
+	embeddings, err := r.Embed(c.Request.Context(), input)
+	if err != nil {
+		slog.Error("embedding generation failed", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate embedding"})
+		return
+	}
+
+	for i, e := range embeddings {
+		embeddings[i] = normalize(e)
+	}
+
+	c.JSON(http.StatusOK, api.EmbedResponse{
+		Model:      req.Model,
+		Embeddings: embeddings,
+	})
+}
+
+func normalize(vec []float32) []float32 {
+	var sum float32
+	for _, v := range vec {
+		sum += v * v
+	}
+
+	norm := float32(0.0)
+	if sum > 0 {
+		norm = float32(1.0 / math.Sqrt(float64(sum)))
+	}
+
+	for i := range vec {
+		vec[i] *= norm
+	}
+	return vec
+}
+
+func (s *Server) EmbeddingsHandler(c *gin.Context) {
+	var req api.EmbeddingRequest
+	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	prio, err := parsePriority(req.Priority, priorityBatch)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// an empty request loads the model
+	if req.Prompt == "" {
+		c.JSON(http.StatusOK, api.EmbeddingResponse{Embedding: []float64{}})
+		return
+	}
+
+	r, _, _, err := s.scheduleRunner(schedContext(c, prio), req.Model, []Capability{}, req.Options, req.KeepAlive)
+	if err != nil {
+		handleScheduleError(c, req.Model, err)
+		return
+	}
+
+	embeddings, err := r.Embed(c.Request.Context(), []string{req.Prompt})
+	if err != nil {
+		slog.Info(fmt.Sprintf("embedding generation failed: %v", err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate embedding"})
+		return
+	}
+
+	embedding := make([]float64, len(embeddings[0]))
+	for i, v := range embeddings[0] {
+		embedding[i] = float64(v)
+	}
+
+	c.JSON(http.StatusOK, api.EmbeddingResponse{Embedding: embedding})
+}
+
+// vocabOnly are the options for runners that only tokenize. A runner already
+// loaded for the model is used instead if there is one. Models whose
+// vocabulary the tokenizer package supports are tokenized without a runner.
+var vocabOnly = map[string]any{"vocab_only": true}
+
+func (s *Server) TokenizeHandler(c *gin.Context) {
+	var req api.TokenizeRequest
+	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.Text == "" {
+		c.JSON(http.StatusOK, api.TokenizeResponse{Model: req.Model, Tokens: []int{}, Pieces: []string{}})
+		return
+	}
+
+	if tok, ok := goTokenizer(req.Model); ok {
+		tokens, pieces, err := tokenizePieces(tok, req.Text)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, api.TokenizeResponse{Model: req.Model, Tokens: tokens, Pieces: pieces})
+		return
+	}
+
+	r, _, _, err := s.scheduleRunner(schedContext(c, priorityInteractive), req.Model, []Capability{}, vocabOnly, req.KeepAlive)
+	if err != nil {
+		handleScheduleError(c, req.Model, err)
+		return
+	}
+
+	tokens, pieces, err := r.TokenizePieces(c.Request.Context(), req.Text)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, api.TokenizeResponse{Model: req.Model, Tokens: tokens, Pieces: pieces})
+}
+
+func (s *Server) DetokenizeHandler(c *gin.Context) {
+	var req api.DetokenizeRequest
+	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if len(req.Tokens) == 0 {
+		c.JSON(http.StatusOK, api.DetokenizeResponse{Model: req.Model})
+		return
+	}
+
+	if tok, ok := goTokenizer(req.Model); ok {
+		// the tokenizer only fails on tokens it doesn't have
+		text, err := tok.Decode(req.Tokens)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, api.DetokenizeResponse{Model: req.Model, Text: text})
+		return
+	}
+
+	r, m, _, err := s.scheduleRunner(schedContext(c, priorityInteractive), req.Model, []Capability{}, vocabOnly, req.KeepAlive)
+	if err != nil {
+		handleScheduleError(c, req.Model, err)
+		return
+	}
+
+	kvData, err := getKVData(m.ModelPath, false)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// the runner fails on tokens it doesn't have, which is the client's mistake
+	for _, t := range req.Tokens {
+		if t < 0 || uint64(t) >= kvData.VocabSize() {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("token %d is out of range for the model's vocabulary", t)})
+			return
+		}
+	}
+
+	text, err := r.Detokenize(c.Request.Context(), req.Tokens)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, api.DetokenizeResponse{Model: req.Model, Text: text})
+}
+
+func (s *Server) RerankHandler(c *gin.Context) {
+	var req api.RerankRequest
+	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	prio, err := parsePriority(req.Priority, priorityBatch)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.TopN < 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "top_n must not be negative"})
+		return
+	}
+
+	r, _, _, err := s.scheduleRunner(schedContext(c, prio), req.Model, []Capability{CapabilityRerank}, req.Options, req.KeepAlive)
+	if errors.Is(err, errCapabilityRerank) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%q does not support rerank", req.Model)})
+		return
+	} else if err != nil {
+		handleScheduleError(c, req.Model, err)
+		return
+	}
+
+	// no documents loads the model
+	if len(req.Documents) == 0 {
+		c.JSON(http.StatusOK, api.RerankResponse{Model: req.Model, Results: []api.RerankResult{}})
+		return
+	}
+
+	scores, err := r.Rerank(c.Request.Context(), req.Query, req.Documents)
+	if err != nil {
+		slog.Info(fmt.Sprintf("rerank failed: %v", err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to rerank documents"})
+		return
+	}
+
+	results := make([]api.RerankResult, len(scores))
+	for i, score := range scores {
+		results[i] = api.RerankResult{Index: i, RelevanceScore: score}
+	}
+
+	slices.SortStableFunc(results, func(a, b api.RerankResult) int {
+		return cmp.Compare(b.RelevanceScore, a.RelevanceScore)
+	})
+
+	if req.TopN > 0 && req.TopN < len(results) {
+		results = results[:req.TopN]
+	}
+
+	c.JSON(http.StatusOK, api.RerankResponse{Model: req.Model, Results: results})
+}
+
+func (s *Server) PullModelHandler(c *gin.Context) {
+	var req api.PullRequest
+	err := c.ShouldBindJSON(&req)
+	switch {
+	case errors.Is(err, io.EOF):
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	case err != nil:
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	name := model.ParseName(cmp.Or(req.Model, req.Name))
+	if !name.IsValid() {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": errtypes.InvalidModelNameErrMsg})
+		return
+	}
+
+	if err := checkNameExists(name); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ch := make(chan any)
+	go func() {
+		defer close(ch)
+		fn := func(r api.ProgressResponse) {
+			ch <- r
+		}
+
+		regOpts := &registryOptions{
+			Insecure: req.Insecure,
+		}
+
+		ctx, cancel := context.WithCancel(c.Request.Context())
+		defer cancel()
+
+		if err := PullModel(ctx, name.DisplayShortest(), regOpts, fn); err != nil {
+			ch <- gin.H{"error": err.Error()}
+		}
+	}()
+
+	if req.Stream != nil && !*req.Stream {
+		waitForStream(c, ch)
+		return
+	}
+
+	streamResponse(c, ch)
+}
+
+func (s *Server) PushModelHandler(c *gin.Context) {
+	var req api.PushRequest
+	err := c.ShouldBindJSON(&req)
+	switch {
+	case errors.Is(err, io.EOF):
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	case err != nil:
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var model string
+	if req.Model != "" {
+		model = req.Model
+	} else if req.Name != "" {
+		model = req.Name
+	} else {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "model is required"})
+		return
+	}
+
+	ch := make(chan any)
+	go func() {
+		defer close(ch)
+		fn := func(r api.ProgressResponse) {
+			ch <- r
+		}
+
+		regOpts := &registryOptions{
+			Insecure: req.Insecure,
+		}
+
+		ctx, cancel := context.WithCancel(c.Request.Context())
+		defer cancel()
+
+		if err := PushModel(ctx, model, regOpts, fn); err != nil {
+			ch <- gin.H{"error": err.Error()}
+		}
+	}()
+
+	if req.Stream != nil && !*req.Stream {
+		waitForStream(c, ch)
+		return
+	}
+
+	streamResponse(c, ch)
+}
+
+func checkNameExists(name model.Name) error {
+	names, err := Manifests()
+	if err != nil {
+		return err
+	}
+
+	for n := range names {
+		if strings.EqualFold(n.Filepath(), name.Filepath()) && n != name {
+			return fmt.Errorf("a model with that name already exists")
+		}
+	}
+
+	return nil
+}
+
+func (s *Server) CreateModelHandler(c *gin.Context) {
+	var r api.CreateRequest
+	if err := c.ShouldBindJSON(&r); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	name := model.ParseName(cmp.Or(r.Model, r.Name))
+	if !name.IsValid() {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": errtypes.InvalidModelNameErrMsg})
+		return
+	}
+
+	if err := checkNameExists(name); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if r.Path == "" && r.Modelfile == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "path or modelfile are required"})
+		return
+	}
+
+	var sr io.Reader = strings.NewReader(r.Modelfile)
+	if r.Path != "" && r.Modelfile == "" {
+		f, err := os.Open(r.Path)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("error reading modelfile: %s", err)})
+			return
+		}
+		defer f.Close()
+
+		sr = f
+	}
+
+	f, err := parser.ParseFile(sr)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ch := make(chan any)
+	go func() {
+		defer close(ch)
+		fn := func(resp api.ProgressResponse) {
+			ch <- resp
+		}
+
+		ctx, cancel := context.WithCancel(c.Request.Context())
+		defer cancel()
+
+		quantization := cmp.Or(r.Quantize, r.Quantization)
+		if err := CreateModel(ctx, name, filepath.Dir(r.Path), strings.ToUpper(quantization), f, fn); errors.Is(err, errBadTemplate) || errors.Is(err, errBadGrammar) {
+			ch <- gin.H{"error": err.Error(), "status": http.StatusBadRequest}
+		} else if err != nil {
+			ch <- gin.H{"error": err.Error()}
+		}
+	}()
+
+	if r.Stream != nil && !*r.Stream {
+		waitForStream(c, ch)
+		return
+	}
+
+	streamResponse(c, ch)
+}
+
+func (s *Server) DeleteModelHandler(c *gin.Context) {
+	var r api.DeleteRequest
+	if err := c.ShouldBindJSON(&r); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	n := model.ParseName(cmp.Or(r.Model, r.Name))
+	if !n.IsValid() {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("name %q is invalid", cmp.Or(r.Model, r.Name))})
+		return
+	}
+
+	m, err := ParseNamedManifest(n)
+	if errors.Is(err, os.ErrNotExist) {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", cmp.Or(r.Model, r.Name))})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := m.Remove(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := m.RemoveLayers(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+}
+
+func (s *Server) ShowModelHandler(c *gin.Context) {
+	var req api.ShowRequest
+	err := c.ShouldBindJSON(&req)
+	switch {
+	case errors.Is(err, io.EOF):
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	case err != nil:
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.Model != "" {
+		// noop
+	} else if req.Name != "" {
+		req.Model = req.Name
+	} else {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "model is required"})
+		return
+	}
+
+	resp, err := GetModelInfo(req)
+	if err != nil {
+		switch {
+		case os.IsNotExist(err):
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Model)})
+		case err.Error() == errtypes.InvalidModelNameErrMsg:
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+func GetModelInfo(req api.ShowRequest) (*api.ShowResponse, error) {
+	m, err := GetModel(req.Model)
+	if err != nil {
+		return nil, err
+	}
+
+	modelDetails := api.ModelDetails{
+		ParentModel:       m.ParentModel,
+		Format:            m.Config.ModelFormat,
+		Family:            m.Config.ModelFamily,
+		Families:          m.Config.ModelFamilies,
+		ParameterSize:     m.Config.ModelType,
+		QuantizationLevel: m.Config.FileType,
+	}
+
+	if req.System != "" {
+		m.System = req.System
+	}
+
+	msgs := make([]api.Message, len(m.Messages))
+	for i, msg := range m.Messages {
+		msgs[i] = api.Message{Role: msg.Role, Content: msg.Content}
+	}
+
+	n := model.ParseName(req.Model)
+	if !n.IsValid() {
+		return nil, errors.New(errtypes.InvalidModelNameErrMsg)
+	}
+
+	manifest, err := ParseNamedManifest(n)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &api.ShowResponse{
+		License:    strings.Join(m.License, "\n"),
+		System:     m.System,
+		Template:   m.Template.String(),
+		Grammar:    m.Grammar,
+		Details:    modelDetails,
+		Messages:   msgs,
+		ModifiedAt: manifest.fi.ModTime(),
+	}
+
+	var params []string
+	cs := 30
+	for k, v := range m.Options {
+		switch val := v.(type) {
+		case []interface{}:
+			for _, nv := range val {
+				params = append(params, fmt.Sprintf("%-*s %#v", cs, k, nv))
+			}
+		default:
+			params = append(params, fmt.Sprintf("%-*s %#v", cs, k, v))
+		}
+	}
+	resp.Parameters = strings.Join(params, "\n")
+
+	for k, v := range req.Options {
+		if _, ok := req.Options[k]; ok {
+			m.Options[k] = v
+		}
+	}
+
+	var sb strings.Builder
+	fmt.Fprintln(&sb, "# Modelfile generated by \"ollama show\"")
+	fmt.Fprintln(&sb, "# To build a new Modelfile based on this, replace FROM with:")
+	fmt.Fprintf(&sb, "# FROM %s\n\n", m.ShortName)
+	fmt.Fprint(&sb, m.String())
+	resp.Modelfile = sb.String()
+
+	kvData, err := getKVData(m.ModelPath, req.Verbose)
+	if err != nil {
+		return nil, err
+	}
+	delete(kvData, "general.name")
+	delete(kvData, "tokenizer.chat_template")
+	resp.ModelInfo = kvData
+
+	if len(m.ProjectorPaths) > 0 {
+		projectorData, err := getKVData(m.ProjectorPaths[0], req.Verbose)
+		if err != nil {
+			return nil, err
+		}
+		resp.ProjectorInfo = projectorData
+	}
+
+	return resp, nil
+}
+
+func getKVData(digest string, verbose bool) (llm.KV, error) {
+	maxArraySize := 0
+	if verbose {
+		maxArraySize = -1
+	}
+
+	f, err := os.Open(digest)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ggml, _, err := llm.DecodeGGML(f, maxArraySize)
+	if err != nil {
+		return nil, err
+	}
+
+	kv := ggml.KV()
+
+	if !verbose {
+		for k := range kv {
+			if t, ok := kv[k].([]any); len(t) > 5 && ok {
+				kv[k] = []any{}
+			}
+		}
+	}
+
+	return kv, nil
+}
+
+func (s *Server) ListModelsHandler(c *gin.Context) {
+	ms, err := Manifests()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	models := []api.ListModelResponse{}
+	for n, m := range ms {
+		f, err := m.Config.Open()
+		if err != nil {
+			slog.Warn("bad manifest filepath", "name", n, "error", err)
+			continue
+		}
+		defer f.Close()
+
+		var cf ConfigV2
+		if err := json.NewDecoder(f).Decode(&cf); err != nil {
+			slog.Warn("bad manifest config", "name", n, "error", err)
+			continue
+		}
+
+		// tag should never be masked
+		models = append(models, api.ListModelResponse{
+			Model:      n.DisplayShortest(),
+			Name:       n.DisplayShortest(),
+			Size:       m.Size(),
+			Digest:     m.digest,
+			ModifiedAt: m.fi.ModTime(),
+			Details: api.ModelDetails{
+				Format:            cf.ModelFormat,
+				Family:            cf.ModelFamily,
+				Families:          cf.ModelFamilies,
+				ParameterSize:     cf.ModelType,
+				QuantizationLevel: cf.FileType,
+			},
+		})
+	}
+
+	slices.SortStableFunc(models, func(i, j api.ListModelResponse) int {
+		// most recently modified first
+		return cmp.Compare(j.ModifiedAt.Unix(), i.ModifiedAt.Unix())
+	})
+
+	c.JSON(http.StatusOK, api.ListResponse{Models: models})
+}
+
+func (s *Server) CopyModelHandler(c *gin.Context) {
+	var r api.CopyRequest
+	if err := c.ShouldBindJSON(&r); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	src := model.ParseName(r.Source)
+	if !src.IsValid() {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("source %q is invalid", r.Source)})
+		return
+	}
+
+	dst := model.ParseName(r.Destination)
+	if !dst.IsValid() {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("destination %q is invalid", r.Destination)})
+		return
+	}
+
+	if err := checkNameExists(dst); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := CopyModel(src, dst); errors.Is(err, os.ErrNotExist) {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model %q not found", r.Source)})
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
 }
 
-// CreateModelHandler handles the creation of a model
-func (s *Server) CreateModelHandler(w http.ResponseWriter, r *http.Request) {
-	// Logic to create a model
-	w.WriteHeader(http.StatusCreated)
-	w.Write([]byte("Model created successfully"))
+func (s *Server) HeadBlobHandler(c *gin.Context) {
+	path, err := GetBlobsPath(c.Param("digest"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("blob %q not found", c.Param("digest"))})
+		return
+	}
+
+	c.Status(http.StatusOK)
 }
 
-// DeleteModelHandler handles the deletion of a model
-func (s *Server) DeleteModelHandler(w http.ResponseWriter, r *http.Request) {
-	// Logic to delete a model
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("Model deleted successfully"))
+func (s *Server) CreateBlobHandler(c *gin.Context) {
+	if ib, ok := intermediateBlobs[c.Param("digest")]; ok {
+		p, err := GetBlobsPath(ib)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		if _, err := os.Stat(p); errors.Is(err, os.ErrNotExist) {
+			slog.Info("evicting intermediate blob which no longer exists", "digest", ib)
+			delete(intermediateBlobs, c.Param("digest"))
+		} else if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		} else {
+			c.Status(http.StatusOK)
+			return
+		}
+	}
+
+	path, err := GetBlobsPath(c.Param("digest"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	_, err = os.Stat(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		// noop
+	case err != nil:
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	default:
+		c.Status(http.StatusOK)
+		return
+	}
+
+	layer, err := NewLayer(c.Request.Body, "")
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if layer.Digest != c.Param("digest") {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("digest mismatch, expected %q, got %q", c.Param("digest"), layer.Digest)})
+		return
+	}
+
+	c.Status(http.StatusCreated)
 }
 
-// Other existing methods and struct definitions...
+func isLocalIP(ip netip.Addr) bool {
+	if interfaces, err := net.Interfaces(); err == nil {
+		for _, iface := range interfaces {
+			addrs, err := iface.Addrs()
+			if err != nil {
+				continue
+			}
+
+			for _, a := range addrs {
+				if parsed, _, err := net.ParseCIDR(a.String()); err == nil {
+					if parsed.String() == ip.String() {
+						return true
+					}
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+func allowedHost(host string) bool {
+	if host == "" || host == "localhost" {
+		return true
+	}
+
+	if hostname, err := os.Hostname(); err == nil && host == hostname {
+		return true
+	}
+
+	tlds := []string{
+		"localhost",
+		"local",
+		"internal",
+	}
+
+	// check if the host is a local TLD
+	for _, tld := range tlds {
+		if strings.HasSuffix(host, "."+tld) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func allowedHostsMiddleware(addr net.Addr) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if addr == nil {
+			c.Next()
+			return
+		}
+
+		if addr, err := netip.ParseAddrPort(addr.String()); err == nil && !addr.Addr().IsLoopback() {
+			c.Next()
+			return
+		}
+
+		host, _, err := net.SplitHostPort(c.Request.Host)
+		if err != nil {
+			host = c.Request.Host
+		}
+
+		if addr, err := netip.ParseAddr(host); err == nil {
+			if addr.IsLoopback() || addr.IsPrivate() || addr.IsUnspecified() || isLocalIP(addr) {
+				c.Next()
+				return
+			}
+		}
+
+		if allowedHost(host) {
+			if c.Request.Method == http.MethodOptions {
+				c.AbortWithStatus(http.StatusNoContent)
+				return
+			}
+
+			c.Next()
+			return
+		}
+
+		c.AbortWithStatus(http.StatusForbidden)
+	}
+}
+
+func (s *Server) GenerateRoutes() http.Handler {
+	config := cors.DefaultConfig()
+	config.AllowWildcard = true
+	config.AllowBrowserExtensions = true
+	config.AllowHeaders = []string{"Authorization", "Content-Type", "User-Agent", "Accept", "X-Requested-With"}
+	openAIProperties := []string{"lang", "package-version", "os", "arch", "runtime", "runtime-version", "async"}
+	for _, prop := range openAIProperties {
+		config.AllowHeaders = append(config.AllowHeaders, "x-stainless-"+prop)
+	}
+	config.AllowOrigins = envconfig.AllowOrigins
+
+	r := gin.Default()
+	r.Use(
+		tracingMiddleware,
+		cors.New(config),
+		allowedHostsMiddleware(s.addr),
+	)
+
+	if envconfig.Metrics {
+		r.Use(metricsMiddleware)
+	}
+
+	if s.keys != nil {
+		r.Use(s.keys.middleware)
+	}
+
+	r.Use(s.drain.middleware)
+
+	r.POST("/api/pull", s.PullModelHandler)
+	r.POST("/api/generate", s.GenerateHandler)
+	r.POST("/api/chat", s.ChatHandler)
+	r.POST("/api/embed", s.EmbedHandler)
+	r.POST("/api/embeddings", s.EmbeddingsHandler)
+	r.POST("/api/tokenize", s.TokenizeHandler)
+	r.POST("/api/detokenize", s.DetokenizeHandler)
+	r.POST("/api/rerank", s.RerankHandler)
+	r.POST("/api/create", s.CreateModelHandler)
+	r.POST("/api/push", s.PushModelHandler)
+	r.POST("/api/copy", s.CopyModelHandler)
+	r.DELETE("/api/delete", s.DeleteModelHandler)
+	r.POST("/api/show", s.ShowModelHandler)
+	r.POST("/api/blobs/:digest", s.CreateBlobHandler)
+	r.HEAD("/api/blobs/:digest", s.HeadBlobHandler)
+	r.GET("/api/ps", s.ProcessHandler)
+
+	r.POST("/api/batch", s.CreateBatchHandler)
+	r.GET("/api/batch", s.ListBatchHandler)
+	r.GET("/api/batch/:id", s.GetBatchHandler)
+	r.POST("/api/batch/:id/cancel", s.CancelBatchHandler)
+	r.GET("/api/batch/:id/results", s.BatchResultsHandler)
+	r.GET("/api/sessions", s.ListSessionsHandler)
+	r.GET("/api/sessions/:id", s.SessionHandler)
+	r.POST("/api/sessions/:id/fork", s.ForkSessionHandler)
+	r.DELETE("/api/sessions/:id", s.DeleteSessionHandler)
+
+	r.GET("/api/admin/config", s.ConfigHandler)
+	r.PATCH("/api/admin/config", s.UpdateConfigHandler)
+	r.POST("/api/admin/unload", s.UnloadHandler)
+	r.POST("/api/admin/drain", s.DrainHandler)
+	r.DELETE("/api/admin/drain", s.ResumeHandler)
+
+	if envconfig.Metrics {
+		r.GET("/metrics", s.MetricsHandler)
+	}
+
+	// Compatibility endpoints
+	r.POST("/v1/chat/completions", openai.ChatMiddleware(), s.ChatHandler)
+	r.POST("/v1/completions", openai.CompletionsMiddleware(), s.GenerateHandler)
+	r.POST("/v1/embeddings", openai.EmbeddingsMiddleware(), s.EmbedHandler)
+	r.GET("/v1/models", openai.ListMiddleware(), s.ListModelsHandler)
+	r.GET("/v1/models/:model", openai.RetrieveMiddleware(), s.ShowModelHandler)
+
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		r.Handle(method, "/", func(c *gin.Context) {
+			c.String(http.StatusOK, "Ollama is running")
+		})
+
+		r.Handle(method, "/api/tags", s.ListModelsHandler)
+		r.Handle(method, "/api/version", func(c *gin.Context) {
+			c.JSON(http.StatusOK, gin.H{"version": version.Version})
+		})
+	}
+
+	return r
+}
+
+func Serve(ln net.Listener) error {
+	level := slog.LevelInfo
+	if envconfig.Debug {
+		level = slog.LevelDebug
+	}
+
+	slog.Info("server config", "env", envconfig.Values())
+	handler := slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+		Level:     level,
+		AddSource: true,
+		ReplaceAttr: func(_ []string, attr slog.Attr) slog.Attr {
+			if attr.Key == slog.SourceKey {
+				source := attr.Value.Any().(*slog.Source)
+				source.File = filepath.Base(source.File)
+			}
+
+			return attr
+		},
+	})
+
+	slog.SetDefault(slog.New(handler))
+
+	blobsDir, err := GetBlobsPath("")
+	if err != nil {
+		return err
+	}
+	if err := fixBlobs(blobsDir); err != nil {
+		return err
+	}
+
+	if !envconfig.NoPrune {
+		// clean up unused layers and manifests
+		if err := PruneLayers(); err != nil {
+			return err
+		}
+
+		manifestsPath, err := GetManifestPath()
+		if err != nil {
+			return err
+		}
+
+		if err := PruneDirectory(manifestsPath); err != nil {
+			return err
+		}
+	}
+
+	var keys *apiKeys
+	if envconfig.APIKeys != "" {
+		keys, err = loadAPIKeys(envconfig.APIKeys)
+		if err != nil {
+			return err
+		}
+		slog.Info("API key authentication enabled", "keys", len(keys.keys))
+	}
+
+	batchDir, err := GetBatchPath()
+	if err != nil {
+		return err
+	}
+
+	batch, err := loadBatchJobs(batchDir)
+	if err != nil {
+		return err
+	}
+
+	var preloads []preloadModel
+	if envconfig.Preload != "" {
+		preloads, err = parsePreload(envconfig.Preload)
+		if err != nil {
+			return err
+		}
+	}
+
+	ctx, done := context.WithCancel(context.Background())
+
+	shutdownTracing := func(context.Context) error { return nil }
+	if envconfig.OTLPEndpoint != "" {
+		shutdownTracing, err = initTracing(ctx, envconfig.OTLPEndpoint)
+		if err != nil {
+			done()
+			return err
+		}
+		slog.Info("exporting traces", "endpoint", envconfig.OTLPEndpoint)
+	}
+
+	schedCtx, schedDone := context.WithCancel(ctx)
+	sched := InitScheduler()
+	s := &Server{addr: ln.Addr(), sched: sched, keys: keys, batch: batch}
+
+	http.Handle("/", s.GenerateRoutes())
+
+	slog.Info(fmt.Sprintf("Listening on %s (version %s)", ln.Addr(), version.Version))
+	srvr := &http.Server{
+		// Use http.DefaultServeMux so we get net/http/pprof for
+		// free.
+		Handler: nil,
+	}
+
+	// listen for a ctrl+c and stop any loaded llm
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		slog.Info("shutting down", "timeout", envconfig.ShutdownTimeout)
+
+		shutdownCtx, cancel := context.WithTimeout(ctx, envconfig.ShutdownTimeout)
+		defer cancel()
+
+		// pulls can't be expected to finish in time, so stop their downloads
+		// straight away leaving them to resume on the next pull
+		go func() {
+			if err := stopDownloads(shutdownCtx); err != nil {
+				slog.Warn("failed to stop downloads", "error", err)
+			}
+		}()
+
+		// stop accepting connections and let in-flight requests, including
+		// streaming responses, finish
+		if err := srvr.Shutdown(shutdownCtx); err != nil {
+			slog.Warn("requests still in flight at shutdown timeout", "error", err)
+			srvr.Close()
+		}
+
+		schedDone()
+		sched.unloadAllRunners()
+		gpu.Cleanup()
+		if err := shutdownTracing(ctx); err != nil {
+			slog.Warn("failed to flush traces", "error", err)
+		}
+		done()
+	}()
+
+	if err := llm.Init(); err != nil {
+		return fmt.Errorf("unable to initialize llm library %w", err)
+	}
+
+	s.sched.Run(schedCtx)
+	go s.preload(schedCtx, preloads)
+	go s.batch.run(schedCtx, s.batchRoutes(), s.keys)
+
+	err = srvr.Serve(ln)
+	// If server is closed from the signal handler, wait for the ctx to be done
+	// otherwise error out quickly
+	if !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	<-ctx.Done()
+	return nil
+}
+
+func waitForStream(c *gin.Context, ch chan interface{}) {
+	c.Header("Content-Type", "application/json")
+	for resp := range ch {
+		switch r := resp.(type) {
+		case api.ProgressResponse:
+			if r.Status == "success" {
+				c.JSON(http.StatusOK, r)
+				return
+			}
+		case gin.H:
+			status, ok := r["status"].(int)
+			if !ok {
+				status = http.StatusInternalServerError
+			}
+			if errorMsg, ok := r["error"].(string); ok {
+				c.JSON(status, gin.H{"error": errorMsg})
+				return
+			} else {
+				c.JSON(status, gin.H{"error": "unexpected error format in progress response"})
+				return
+			}
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "unexpected progress response"})
+			return
+		}
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "unexpected end of progress response"})
+}
+
+// send sends v on ch unless ctx is done first. Completion callbacks use it so
+// they don't block forever, holding the runner's slot, once the handler has
+// stopped reading because the client went away.
+func send(ctx context.Context, ch chan any, v any) {
+	select {
+	case ch <- v:
+	case <-ctx.Done():
+	}
+}
+
+func streamResponse(c *gin.Context, ch chan any) {
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Stream(func(w io.Writer) bool {
+		val, ok := <-ch
+		if !ok {
+			return false
+		}
+
+		bts, err := json.Marshal(val)
+		if err != nil {
+			slog.Info(fmt.Sprintf("streamResponse: json.Marshal failed with %s", err))
+			return false
+		}
+
+		// Delineate chunks with new-line delimiter
+		bts = append(bts, '\n')
+		if _, err := w.Write(bts); err != nil {
+			slog.Info(fmt.Sprintf("streamResponse: w.Write failed with %s", err))
+			return false
+		}
+
+		return true
+	})
+}
+
+func (s *Server) ProcessHandler(c *gin.Context) {
+	models := []api.ProcessModelResponse{}
+
+	s.sched.loadedMu.Lock()
+	for _, v := range s.sched.loaded {
+		model := v.model
+		if model == nil {
+			continue
+		}
+
+		modelDetails := api.ModelDetails{
+			Format:            model.Config.ModelFormat,
+			Family:            model.Config.ModelFamily,
+			Families:          model.Config.ModelFamilies,
+			ParameterSize:     model.Config.ModelType,
+			QuantizationLevel: model.Config.FileType,
+		}
+
+		mr := api.ProcessModelResponse{
+			Model:     model.ShortName,
+			Name:      model.ShortName,
+			Size:      int64(v.estimatedTotal),
+			SizeVRAM:  int64(v.estimatedVRAM),
+			Digest:    model.Digest,
+			Details:   modelDetails,
+			ExpiresAt: v.expiresAt,
+			Restarts:  v.restarts,
+			Pinned:    v.pinned,
+		}
+		// The scheduler waits to set expiresAt, so if a model is loading it's
+		// possible that it will be set to the unix epoch. For those cases, just
+		// calculate the time w/ the sessionDuration instead.
+		var epoch time.Time
+		if v.expiresAt == epoch {
+			mr.ExpiresAt = time.Now().Add(v.sessionDuration)
+		}
+
+		models = append(models, mr)
+	}
+	s.sched.loadedMu.Unlock()
+
+	slices.SortStableFunc(models, func(i, j api.ProcessModelResponse) int {
+		// longest duration remaining listed first
+		return cmp.Compare(j.ExpiresAt.Unix(), i.ExpiresAt.Unix())
+	})
+
+	c.JSON(http.StatusOK, api.ProcessResponse{Models: models})
+}
+
+func (s *Server) ChatHandler(c *gin.Context) {
+	var req api.ChatRequest
+	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	format, gbnf, err := parseFormat(req.Format, req.Grammar)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if err := checkLogprobs(req.Logprobs, req.TopLogprobs); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	prio, err := parsePriority(req.Priority, priorityInteractive)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// expire the runner
+	if len(req.Messages) == 0 && req.KeepAlive != nil && int(req.KeepAlive.Seconds()) == 0 {
+		if s.unloadModel(c, req.Model) {
+			c.JSON(http.StatusOK, api.ChatResponse{
+				Model:      req.Model,
+				CreatedAt:  time.Now().UTC(),
+				Message:    api.Message{Role: "assistant"},
+				Done:       true,
+				DoneReason: "unload",
+			})
+		}
+		return
+	}
+
+	var sess *api.Session
+	if req.Session != "" {
+		sess, err = loadSession(req.Session, contextKey(c.Request.Context()))
+		if errors.Is(err, errBadSessionID) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		} else if errors.Is(err, errSessionExists) {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("session %q belongs to another API key", req.Session)})
+			return
+		} else if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		if req.Model == "" {
+			req.Model = sess.Model
+			if k := contextKey(c.Request.Context()); k != nil && !k.allowsModel(req.Model) {
+				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("API key is not allowed to use model %q", req.Model)})
+				return
+			}
+		}
+	}
+
+	caps := []Capability{CapabilityCompletion}
+	if len(req.Tools) > 0 {
+		caps = append(caps, CapabilityTools)
+	}
+
+	checkpointStart := time.Now()
+	r, m, opts, err := s.scheduleRunner(schedContext(c, prio), req.Model, caps, req.Options, req.KeepAlive)
+	if errors.Is(err, errCapabilityCompletion) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%q does not support chat", req.Model)})
+		return
+	} else if err != nil {
+		handleScheduleError(c, req.Model, err)
+		return
+	}
+
+	checkpointLoaded := time.Now()
+
+	if len(req.Messages) == 0 {
+		c.JSON(http.StatusOK, api.ChatResponse{
+			Model:      req.Model,
+			CreatedAt:  time.Now().UTC(),
+			Message:    api.Message{Role: "assistant"},
+			Done:       true,
+			DoneReason: "load",
+		})
+		return
+	}
+
+	var msgs []api.Message
+	for _, msg := range m.Messages {
+		msgs = append(msgs, api.Message{Role: msg.Role, Content: msg.Content})
+	}
+
+	if sess != nil {
+		msgs = append(msgs, sess.Messages...)
+	}
+
+	msgs = append(msgs, req.Messages...)
+	if msgs[0].Role != "system" && m.System != "" {
+		msgs = append([]api.Message{{Role: "system", Content: m.System}}, msgs...)
+	}
+
+	prompt, images, err := chatPrompt(c.Request.Context(), m, modelTokenize(m, r.Tokenize), opts, msgs, req.Tools)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	slog.Debug("chat request", "images", len(images), "prompt", prompt)
+
+	ctx := c.Request.Context()
+	ch := make(chan any)
+	go func() {
+		defer close(ch)
+		var content strings.Builder
+		if err := r.Completion(ctx, llm.CompletionRequest{
+			Prompt:      prompt,
+			Images:      images,
+			Format:      format,
+			Grammar:     cmp.Or(gbnf, modelGrammar(m, format)),
+			Logprobs:    req.Logprobs,
+			TopLogprobs: req.TopLogprobs,
+			Options:     opts,
+		}, func(cr llm.CompletionResponse) {
+			content.WriteString(cr.Content)
+			res := api.ChatResponse{
+				Model:      req.Model,
+				CreatedAt:  time.Now().UTC(),
+				Message:    api.Message{Role: "assistant", Content: cr.Content},
+				Done:       cr.Done,
+				DoneReason: cr.DoneReason,
+				Logprobs:   cr.Logprobs,
+				Metrics: api.Metrics{
+					PromptEvalCount:     cr.PromptEvalCount,
+					PromptEvalDuration:  cr.PromptEvalDuration,
+					EvalCount:           cr.EvalCount,
+					EvalDuration:        cr.EvalDuration,
+					PromptCacheCount:    cr.PromptCacheCount,
+					DraftAcceptanceRate: cr.DraftAcceptanceRate(),
+				},
+			}
+
+			if cr.Done {
+				res.TotalDuration = time.Since(checkpointStart)
+				res.LoadDuration = checkpointLoaded.Sub(checkpointStart)
+				metrics.recordCompletion(m.ShortName, cr.DoneReason, res.Metrics)
+				recordTokens(ctx, res.Metrics)
+
+				// save the turn before replying so the client's next turn sees
+				// it. A cancelled turn is dropped rather than saving a partial
+				// reply.
+				if sess != nil && cr.DoneReason != "cancelled" {
+					reply := api.Message{Role: "assistant", Content: content.String()}
+					if len(req.Tools) > 0 {
+						if toolCalls, ok := m.parseToolCalls(reply.Content); ok {
+							reply.ToolCalls = toolCalls
+							reply.Content = ""
+						}
+					}
+
+					if err := appendSession(sess.ID, contextKey(ctx), m, append(req.Messages, reply)...); err != nil {
+						slog.Error("failed to save session", "session", sess.ID, "error", err)
+					}
+				}
+			}
+
+			send(ctx, ch, res)
+		}); err != nil {
+			send(ctx, ch, gin.H{"error": err.Error()})
+		}
+	}()
+
+	if req.Stream != nil && !*req.Stream {
+		var resp api.ChatResponse
+		var sb strings.Builder
+		var logprobs []api.Logprob
+		for rr := range ch {
+			switch t := rr.(type) {
+			case api.ChatResponse:
+				sb.WriteString(t.Message.Content)
+				logprobs = append(logprobs, t.Logprobs...)
+				resp = t
+			case gin.H:
+				msg, ok := t["error"].(string)
+				if !ok {
+					msg = "unexpected error format in response"
+				}
+
+				c.JSON(http.StatusInternalServerError, gin.H{"error": msg})
+				return
+			default:
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "unexpected response"})
+				return
+			}
+		}
+
+		resp.Message.Content = sb.String()
+		resp.Logprobs = logprobs
+		if len(req.Tools) > 0 {
+			if toolCalls, ok := m.parseToolCalls(sb.String()); ok {
+				resp.Message.ToolCalls = toolCalls
+				resp.Message.Content = ""
+			}
+		}
+
+		c.JSON(http.StatusOK, resp)
+		return
+	}
+
+	streamResponse(c, ch)
+}
+
+// maxTopLogprobs is the most alternatives that can be returned for each token
+const maxTopLogprobs = 20
+
+func checkLogprobs(logprobs bool, top int) error {
+	switch {
+	case top < 0 || top > maxTopLogprobs:
+		return fmt.Errorf("top_logprobs must be between 0 and %d", maxTopLogprobs)
+	case top > 0 && !logprobs:
+		return errors.New("top_logprobs requires logprobs")
+	}
+
+	return nil
+}
+
+var (
+	errBadFormat         = errors.New(`format must be empty, "json" or a JSON schema`)
+	errFormatWithGrammar = errors.New("format and grammar can't be used together")
+)
+
+// maxGrammarSize is the largest grammar a request can give
+const maxGrammarSize = 64 << 10
+
+// parseFormat reads the format and grammar of a generate or chat request. It
+// returns the format to pass to the runner and the grammar to constrain
+// sampling with, either the request's own grammar or the one a JSON schema
+// compiles to.
+func parseFormat(raw json.RawMessage, gbnf string) (string, string, error) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || bytes.Equal(raw, []byte("null")) || bytes.Equal(raw, []byte(`""`)) {
+		if len(gbnf) > maxGrammarSize {
+			return "", "", fmt.Errorf("grammar is larger than %d bytes", maxGrammarSize)
+		} else if gbnf != "" {
+			if err := grammar.Validate(gbnf); err != nil {
+				return "", "", fmt.Errorf("invalid grammar: %w", err)
+			}
+		}
+
+		return "", gbnf, nil
+	} else if gbnf != "" {
+		return "", "", errFormatWithGrammar
+	}
+
+	switch raw[0] {
+	case '"':
+		var format string
+		if err := json.Unmarshal(raw, &format); err != nil || (format != "" && format != "json") {
+			return "", "", errBadFormat
+		}
+
+		return format, "", nil
+	case '{':
+		gbnf, err := grammar.FromSchema(raw)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid format: %w", err)
+		}
+
+		return "", gbnf, nil
+	default:
+		return "", "", errBadFormat
+	}
+}
+
+// modelGrammar returns the model's default grammar, unless the request asked
+// for a format of its own
+func modelGrammar(m *Model, format string) string {
+	if format != "" {
+		return ""
+	}
+
+	return m.Grammar
+}
+
+func handleScheduleError(c *gin.Context, name string, err error) {
+	switch {
+	case errors.Is(err, errCapabilities), errors.Is(err, errRequired):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, context.Canceled):
+		c.JSON(499, gin.H{"error": "request canceled"})
+	case errors.Is(err, ErrMaxQueue):
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+	case errors.Is(err, os.ErrNotExist):
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model %q not found, try pulling it first", name)})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
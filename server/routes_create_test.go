@@ -11,6 +11,7 @@ import (
 	"os"
 	"path/filepath"
 	"slices"
+	"strings"
 	"testing"
 
 	"github.com/gin-gonic/gin"
@@ -529,6 +530,75 @@ func TestCreateTemplateSystem(t *testing.T) {
 	})
 }
 
+func TestCreateGrammar(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	p := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", p)
+	envconfig.LoadConfig()
+	var s Server
+
+	w := createRequest(t, s.CreateModelHandler, api.CreateRequest{
+		Name:      "test",
+		Modelfile: fmt.Sprintf("FROM %s\nGRAMMAR root ::= \"yes\"\nGRAMMAR \"\"\"root ::= answer\nanswer ::= \"yes\" | \"no\"\"\"\"", createBinFile(t, nil, nil)),
+		Stream:    &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d: %s", w.Code, w.Body.String())
+	}
+
+	m, err := GetModel("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := "root ::= answer\nanswer ::= \"yes\" | \"no\""
+	if m.Grammar != expect {
+		t.Errorf("expected grammar %q, actual %q", expect, m.Grammar)
+	}
+
+	if !strings.Contains(m.String(), "GRAMMAR \"\"\""+expect+"\"\"\"") {
+		t.Errorf("expected modelfile to contain grammar, actual %s", m.String())
+	}
+
+	// models created from the model keep its grammar
+	w = createRequest(t, s.CreateModelHandler, api.CreateRequest{
+		Name:      "test2",
+		Modelfile: "FROM test",
+		Stream:    &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d", w.Code)
+	}
+
+	m, err = GetModel("test2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.Grammar != expect {
+		t.Errorf("expected grammar %q, actual %q", expect, m.Grammar)
+	}
+
+	t.Run("invalid grammar", func(t *testing.T) {
+		w := createRequest(t, s.CreateModelHandler, api.CreateRequest{
+			Name:      "test",
+			Modelfile: fmt.Sprintf("FROM %s\nGRAMMAR \"\"\"root ::= answer\nanswr ::= \"yes\"\"\"\"", createBinFile(t, nil, nil)),
+			Stream:    &stream,
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("expected status code 400, actual %d", w.Code)
+		}
+
+		if !strings.Contains(w.Body.String(), `line 1, column 10: undefined rule \"answer\"`) {
+			t.Errorf("expected error with position, actual %s", w.Body.String())
+		}
+	})
+}
+
 func TestCreateLicenses(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 
@@ -623,3 +693,79 @@ func TestCreateDetectTemplate(t *testing.T) {
 		})
 	})
 }
+
+func TestCreateDraft(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	p := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", p)
+	envconfig.LoadConfig()
+	var s Server
+
+	w := createRequest(t, s.CreateModelHandler, api.CreateRequest{
+		Name:      "draft",
+		Modelfile: fmt.Sprintf("FROM %s\nTEMPLATE \"draft {{ .Prompt }}\"", createBinFile(t, llm.KV{"general.name": "draft"}, nil)),
+		Stream:    &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d", w.Code)
+	}
+
+	w = createRequest(t, s.CreateModelHandler, api.CreateRequest{
+		Name:      "test",
+		Modelfile: fmt.Sprintf("FROM %s\nDRAFT draft", createBinFile(t, nil, nil)),
+		Stream:    &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d", w.Code)
+	}
+
+	draft, err := GetModel("draft")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := GetModel("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.DraftPath == "" || m.DraftPath != draft.ModelPath {
+		t.Errorf("expected draft %q, actual %q", draft.ModelPath, m.DraftPath)
+	}
+
+	if m.ModelPath == draft.ModelPath {
+		t.Error("expected model to differ from draft")
+	}
+
+	// only the draft's weights are used
+	if m.Template.String() == "draft {{ .Prompt }}" {
+		t.Error("expected draft template to be ignored")
+	}
+
+	if !strings.Contains(m.String(), "DRAFT "+draft.ModelPath) {
+		t.Errorf("expected modelfile to contain draft, actual %s", m.String())
+	}
+
+	// models created from the model keep its draft
+	w = createRequest(t, s.CreateModelHandler, api.CreateRequest{
+		Name:      "test2",
+		Modelfile: "FROM test",
+		Stream:    &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d", w.Code)
+	}
+
+	m, err = GetModel("test2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.DraftPath != draft.ModelPath {
+		t.Errorf("expected draft %q, actual %q", draft.ModelPath, m.DraftPath)
+	}
+}
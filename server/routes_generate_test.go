@@ -4,13 +4,14 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"slices"
 	"strings"
 	"testing"
 	"time"
-	"runtime" // Added import for runtime
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/go-cmp/cmp"
@@ -42,8 +43,35 @@ func (mockRunner) Tokenize(_ context.Context, s string) (tokens []int, err error
 	return
 }
 
-func newMockServer(mock *mockRunner) func(gpu.GpuInfoList, string, *llm.GGML, []string, []string, api.Options, int) (llm.LlamaServer, error) {
-	return func(gpus gpu.GpuInfoList, model string, ggml *llm.GGML, projectors, system []string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
+func (mockRunner) TokenizePieces(_ context.Context, s string) (tokens []int, pieces []string, err error) {
+	for _, field := range strings.Fields(s) {
+		tokens = append(tokens, len(tokens))
+		pieces = append(pieces, field)
+	}
+
+	return
+}
+
+func (mockRunner) Detokenize(_ context.Context, tokens []int) (string, error) {
+	return fmt.Sprintf("%d tokens", len(tokens)), nil
+}
+
+// Rerank scores documents by the number of words they share with the query
+func (mockRunner) Rerank(_ context.Context, query string, documents []string) ([]float32, error) {
+	scores := make([]float32, len(documents))
+	for i, document := range documents {
+		for _, word := range strings.Fields(document) {
+			if slices.Contains(strings.Fields(query), word) {
+				scores[i]++
+			}
+		}
+	}
+
+	return scores, nil
+}
+
+func newMockServer(mock *mockRunner) func(gpu.GpuInfoList, string, *llm.GGML, []string, []string, string, api.Options, int) (llm.LlamaServer, error) {
+	return func(gpus gpu.GpuInfoList, model string, ggml *llm.GGML, projectors, system []string, draft string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
 		return mock, nil
 	}
 }
@@ -344,6 +372,142 @@ func TestGenerateChat(t *testing.T) {
 
 		checkChatResponse(t, w.Body, "test-system", "Abra kadabra!")
 	})
+
+	t.Run("messages with session", func(t *testing.T) {
+		t.Cleanup(func() { deleteSession("magic", nil) })
+
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model:    "test",
+			Session:  "magic",
+			Messages: []api.Message{{Role: "user", Content: "Hello!"}},
+			Stream:   &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Errorf("expected status 200, got %d", w.Code)
+		}
+
+		if diff := cmp.Diff(mock.CompletionRequest.Prompt, "User: Hello! "); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+
+		checkChatResponse(t, w.Body, "test", "Abra kadabra!")
+
+		// the session's history and model are used for the next turn
+		w = createRequest(t, s.ChatHandler, api.ChatRequest{
+			Session:  "magic",
+			Messages: []api.Message{{Role: "user", Content: "Again!"}},
+			Stream:   &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Errorf("expected status 200, got %d", w.Code)
+		}
+
+		if diff := cmp.Diff(mock.CompletionRequest.Prompt, "User: Hello! Assistant: Abra kadabra! User: Again! "); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+
+		checkChatResponse(t, w.Body, "test:latest", "Abra kadabra!")
+
+		sess, err := loadSession("magic", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff(sess.Messages, []api.Message{
+			{Role: "user", Content: "Hello!"},
+			{Role: "assistant", Content: "Abra kadabra!"},
+			{Role: "user", Content: "Again!"},
+			{Role: "assistant", Content: "Abra kadabra!"},
+		}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("cancelled session turn", func(t *testing.T) {
+		t.Cleanup(func() { deleteSession("cancelled", nil) })
+
+		mock.CompletionResponse.DoneReason = "cancelled"
+		t.Cleanup(func() { mock.CompletionResponse.DoneReason = "stop" })
+
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model:    "test",
+			Session:  "cancelled",
+			Messages: []api.Message{{Role: "user", Content: "Hello!"}},
+			Stream:   &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Errorf("expected status 200, got %d", w.Code)
+		}
+
+		// the partial reply isn't saved, so the session isn't created
+		if _, err := readSession("cancelled"); !errors.Is(err, errSessionNotFound) {
+			t.Errorf("expected no session, got %v", err)
+		}
+	})
+
+	t.Run("messages with grammar", func(t *testing.T) {
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model: "test",
+			Messages: []api.Message{
+				{Role: "user", Content: "Hello!"},
+			},
+			Grammar: `root ::= "Hi!"`,
+			Stream:  &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Errorf("expected status 200, got %d", w.Code)
+		}
+
+		if diff := cmp.Diff(mock.CompletionRequest.Grammar, `root ::= "Hi!"`); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+
+		checkChatResponse(t, w.Body, "test", "Abra kadabra!")
+	})
+
+	t.Run("messages with logprobs", func(t *testing.T) {
+		logprobs := []api.Logprob{{TokenLogprob: api.TokenLogprob{Token: "Abra", ID: 1, Logprob: -0.5}}}
+		mock.CompletionResponse.Logprobs = logprobs
+		t.Cleanup(func() { mock.CompletionResponse.Logprobs = nil })
+
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model: "test",
+			Messages: []api.Message{
+				{Role: "user", Content: "Hello!"},
+			},
+			Logprobs: true,
+			Stream:   &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Errorf("expected status 200, got %d", w.Code)
+		}
+
+		var actual api.ChatResponse
+		if err := json.NewDecoder(w.Body).Decode(&actual); err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff(actual.Logprobs, logprobs); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("invalid session", func(t *testing.T) {
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model:    "test",
+			Session:  "../magic",
+			Messages: []api.Message{{Role: "user", Content: "Hello!"}},
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+	})
 }
 
 func TestGenerate(t *testing.T) {
@@ -421,7 +585,7 @@ func TestGenerate(t *testing.T) {
 	}
 
 	t.Run("missing body", func(t *testing.T) {
-		w := createRequest(t, s.ChatHandler, nil)
+		w := createRequest(t, s.GenerateHandler, nil)
 		if w.Code != http.StatusBadRequest {
 			t.Errorf("expected status 400, got %d", w.Code)
 		}
@@ -432,7 +596,7 @@ func TestGenerate(t *testing.T) {
 	})
 
 	t.Run("missing model", func(t *testing.T) {
-		w := createRequest(t, s.ChatHandler, api.ChatRequest{})
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{})
 		if w.Code != http.StatusBadRequest {
 			t.Errorf("expected status 400, got %d", w.Code)
 		}
@@ -442,7 +606,7 @@ func TestGenerate(t *testing.T) {
 		}
 	})
 
-	t.Run("missing capabilities chat", func(t *testing.T) {
+	t.Run("missing capabilities generate", func(t *testing.T) {
 		w := createRequest(t, s.CreateModelHandler, api.CreateRequest{
 			Model: "bert",
 			Modelfile: fmt.Sprintf("FROM %s", createBinFile(t, llm.KV{
@@ -456,7 +620,7 @@ func TestGenerate(t *testing.T) {
 			t.Fatalf("expected status 200, got %d", w.Code)
 		}
 
-		w = createRequest(t, s.ChatHandler, api.ChatRequest{
+		w = createRequest(t, s.GenerateHandler, api.GenerateRequest{
 			Model: "bert",
 		})
 
@@ -464,13 +628,29 @@ func TestGenerate(t *testing.T) {
 			t.Errorf("expected status 400, got %d", w.Code)
 		}
 
-		if diff := cmp.Diff(w.Body.String(), `{"error":"\"bert\" does not support chat"}`); diff != "" {
+		if diff := cmp.Diff(w.Body.String(), `{"error":"\"bert\" does not support generate"}`); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("missing capabilities suffix", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "test",
+			Prompt: "def add(",
+			Suffix: "    return c",
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+
+		if diff := cmp.Diff(w.Body.String(), `{"error":"test does not support insert"}`); diff != "" {
 			t.Errorf("mismatch (-got +want):\n%s", diff)
 		}
 	})
 
 	t.Run("load model", func(t *testing.T) {
-		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
 			Model: "test",
 		})
 
@@ -478,7 +658,7 @@ func TestGenerate(t *testing.T) {
 			t.Errorf("expected status 200, got %d", w.Code)
 		}
 
-		var actual api.ChatResponse
+		var actual api.GenerateResponse
 		if err := json.NewDecoder(w.Body).Decode(&actual); err != nil {
 			t.Fatal(err)
 		}
@@ -496,10 +676,10 @@ func TestGenerate(t *testing.T) {
 		}
 	})
 
-	checkChatResponse := func(t *testing.T, body io.Reader, model, content string) {
+	checkGenerateResponse := func(t *testing.T, body io.Reader, model, content string) {
 		t.Helper()
 
-		var actual api.ChatResponse
+		var actual api.GenerateResponse
 		if err := json.NewDecoder(body).Decode(&actual); err != nil {
 			t.Fatal(err)
 		}
@@ -516,11 +696,12 @@ func TestGenerate(t *testing.T) {
 			t.Errorf("expected done reason stop, got %s", actual.DoneReason)
 		}
 
-		if diff := cmp.Diff(actual.Message, api.Message{
-			Role:    "assistant",
-			Content: content,
-		}); diff != "" {
-			t.Errorf("mismatch (-got +want):\n%s", diff)
+		if actual.Response != content {
+			t.Errorf("expected response %s, got %s", content, actual.Response)
+		}
+
+		if actual.Context == nil {
+			t.Errorf("expected context not nil")
 		}
 
 		if actual.PromptEvalCount == 0 {
@@ -549,12 +730,10 @@ func TestGenerate(t *testing.T) {
 	}
 
 	mock.CompletionResponse.Content = "Hi!"
-	t.Run("messages", func(t *testing.T) {
-		w := createRequest(t, s.ChatHandler, api.ChatRequest{
-			Model: "test",
-			Messages: []api.Message{
-				{Role: "user", Content: "Hello!"},
-			},
+	t.Run("prompt", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "test",
+			Prompt: "Hello!",
 			Stream: &stream,
 		})
 
@@ -566,7 +745,7 @@ func TestGenerate(t *testing.T) {
 			t.Errorf("mismatch (-got +want):\n%s", diff)
 		}
 
-		checkChatResponse(t, w.Body, "test", "Hi!")
+		checkGenerateResponse(t, w.Body, "test", "Hi!")
 	})
 
 	w = createRequest(t, s.CreateModelHandler, api.CreateRequest{
@@ -578,12 +757,10 @@ func TestGenerate(t *testing.T) {
 		t.Fatalf("expected status 200, got %d", w.Code)
 	}
 
-	t.Run("messages with model system", func(t *testing.T) {
-		w := createRequest(t, s.ChatHandler, api.ChatRequest{
-			Model: "test-system",
-			Messages: []api.Message{
-				{Role: "user", Content: "Hello!"},
-			},
+	t.Run("prompt with model system", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "test-system",
+			Prompt: "Hello!",
 			Stream: &stream,
 		})
 
@@ -595,17 +772,15 @@ func TestGenerate(t *testing.T) {
 			t.Errorf("mismatch (-got +want):\n%s", diff)
 		}
 
-		checkChatResponse(t, w.Body, "test-system", "Hi!")
+		checkGenerateResponse(t, w.Body, "test-system", "Hi!")
 	})
 
 	mock.CompletionResponse.Content = "Abra kadabra!"
-	t.Run("messages with system", func(t *testing.T) {
-		w := createRequest(t, s.ChatHandler, api.ChatRequest{
-			Model: "test-system",
-			Messages: []api.Message{
-				{Role: "system", Content: "You can perform magic tricks."},
-				{Role: "user", Content: "Hello!"},
-			},
+	t.Run("prompt with system", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "test-system",
+			Prompt: "Hello!",
+			System: "You can perform magic tricks.",
 			Stream: &stream,
 		})
 
@@ -617,18 +792,17 @@ func TestGenerate(t *testing.T) {
 			t.Errorf("mismatch (-got +want):\n%s", diff)
 		}
 
-		checkChatResponse(t, w.Body, "test-system", "Abra kadabra!")
+		checkGenerateResponse(t, w.Body, "test-system", "Abra kadabra!")
 	})
 
-	t.Run("messages with interleaved system", func(t *testing.T) {
-		w := createRequest(t, s.ChatHandler, api.ChatRequest{
-			Model: "test-system",
-			Messages: []api.Message{
-				{Role: "user", Content: "Hello!"},
-				{Role: "assistant", Content: "I can help you with that."},
-				{Role: "system", Content: "You can perform magic tricks."},
-				{Role: "user", Content: "Help me write tests."},
-			},
+	t.Run("prompt with template", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "test-system",
+			Prompt: "Help me write tests.",
+			System: "You can perform magic tricks.",
+			Template: `{{- if .System }}{{ .System }} {{ end }}
+{{- if .Prompt }}### USER {{ .Prompt }} {{ end }}
+{{- if .Response }}### ASSISTANT {{ .Response }} {{ end }}`,
 			Stream: &stream,
 		})
 
@@ -636,232 +810,229 @@ func TestGenerate(t *testing.T) {
 			t.Errorf("expected status 200, got %d", w.Code)
 		}
 
-		if diff := cmp.Diff(mock.CompletionRequest.Prompt, "System: You are a helpful assistant. User: Hello! Assistant: I can help you with that. System: You can perform magic tricks. User: Help me write tests. "); diff != "" {
+		if diff := cmp.Diff(mock.CompletionRequest.Prompt, "You can perform magic tricks. ### USER Help me write tests. "); diff != "" {
 			t.Errorf("mismatch (-got +want):\n%s", diff)
 		}
 
-		checkChatResponse(t, w.Body, "test-system", "Abra kadabra!")
+		checkGenerateResponse(t, w.Body, "test-system", "Abra kadabra!")
 	})
-}
-
-func TestGenerate(t *testing.T) {
-	gin.SetMode(gin.TestMode)
 
-	mock := mockRunner{
-		CompletionResponse: llm.CompletionResponse{
-			Done:               true,
-			DoneReason:         "stop",
-			PromptEvalCount:    1,
-			PromptEvalDuration: 1,
-			EvalCount:          1,
-			EvalDuration:       1,
-		},
-	}
-
-	s := Server{
-		sched: &Scheduler{
-			pendingReqCh:  make(chan *LlmRequest, 1),
-			finishedReqCh: make(chan *LlmRequest, 1),
-			expiredCh:     make(chan *runnerRef, 1),
-			unloadedCh:    make(chan any, 1),
-			loaded:        make(map[string]*runnerRef),
-			newServerFn:   newMockServer(&mock),
-			getGpuFn:      gpu.GetGPUInfo,
-			getCpuFn:      gpu.GetCPUInfo,
-			reschedDelay:  250 * time.Millisecond,
-			loadFn: func(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuInfoList, numParallel int) {
-				// add small delay to simulate loading
-				time.Sleep(time.Millisecond)
-				req.successCh <- &runnerRef{
-					llama: &mock,
-				}
-			},
-		},
-	}
-
-	go s.sched.Run(context.TODO())
-
-	w := createRequest(t, s.CreateModelHandler, api.CreateRequest{
-		Model: "test",
-		Modelfile: fmt.Sprintf(`FROM %s
-		TEMPLATE """
-{{- if .System }}System: {{ .System }} {{ end }}
-{{- if .Prompt }}User: {{ .Prompt }} {{ end }}
-{{- if .Response }}Assistant: {{ .Response }} {{ end }}"""
-`, createBinFile(t, llm.KV{
-			"general.architecture":          "llama",
-			"llama.block_count":             uint32(1),
-			"llama.context_length":          uint32(8192),
-			"llama.embedding_length":        uint32(4096),
-			"llama.attention.head_count":    uint32(32),
-			"llama.attention.head_count_kv": uint32(8),
-			"tokenizer.ggml.tokens":         []string{""},
-			"tokenizer.ggml.scores":         []float32{0},
-			"tokenizer.ggml.token_type":     []int32{0},
-		}, []llm.Tensor{
-			{Name: "token_embd.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
-			{Name: "blk.0.attn_norm.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
-			{Name: "blk.0.ffn_down.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
-			{Name: "blk.0.ffn_gate.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
-			{Name: "blk.0.ffn_up.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
-			{Name: "blk.0.ffn_norm.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
-			{Name: "blk.0.attn_k.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
-			{Name: "blk.0.attn_output.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
-			{Name: "blk.0.attn_q.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
-			{Name: "blk.0.attn_v.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
-			{Name: "output.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
-		})),
-		Stream: &stream,
-	})
-
-	if w.Code != http.StatusOK {
-		t.Fatalf("expected status 200, got %d", w.Code)
-	}
-
-	t.Run("missing body", func(t *testing.T) {
-		w := createRequest(t, s.ChatHandler, nil)
-		if w.Code != http.StatusBadRequest {
-			t.Errorf("expected status 400, got %d", w.Code)
-		}
-
-		if diff := cmp.Diff(w.Body.String(), `{"error":"model is required"}`); diff != "" {
-			t.Errorf("mismatch (-got +want):\n%s", diff)
-		}
-	})
+	t.Run("raw", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "test-system",
+			Prompt: "Help me write tests.",
+			Raw:    true,
+			Stream: &stream,
+		})
 
-	t.Run("missing model", func(t *testing.T) {
-		w := createRequest(t, s.ChatHandler, api.ChatRequest{})
-		if w.Code != http.StatusBadRequest {
-			t.Errorf("expected status 400, got %d", w.Code)
+		if w.Code != http.StatusOK {
+			t.Errorf("expected status 200, got %d", w.Code)
 		}
 
-		if diff := cmp.Diff(w.Body.String(), `{"error":"model is required"}`); diff != "" {
+		if diff := cmp.Diff(mock.CompletionRequest.Prompt, "Help me write tests."); diff != "" {
 			t.Errorf("mismatch (-got +want):\n%s", diff)
 		}
 	})
 
-	t.Run("missing capabilities chat", func(t *testing.T) {
-		w := createRequest(t, s.CreateModelHandler, api.CreateRequest{
-			Model: "bert",
-			Modelfile: fmt.Sprintf("FROM %s", createBinFile(t, llm.KV{
-				"general.architecture": "bert",
-				"bert.pooling_type":    uint32(0),
-			}, []llm.Tensor{})),
+	t.Run("json format", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "test",
+			Prompt: "Respond in JSON.",
+			Format: json.RawMessage(`"json"`),
 			Stream: &stream,
 		})
 
 		if w.Code != http.StatusOK {
-			t.Fatalf("expected status 200, got %d", w.Code)
-		}
-
-		w = createRequest(t, s.ChatHandler, api.ChatRequest{
-			Model: "bert",
-		})
-
-		if w.Code != http.StatusBadRequest {
-			t.Errorf("expected status 400, got %d", w.Code)
+			t.Errorf("expected status 200, got %d", w.Code)
 		}
 
-		if diff := cmp.Diff(w.Body.String(), `{"error":"\"bert\" does not support chat"}`); diff != "" {
-			t.Errorf("mismatch (-got +want):\n%s", diff)
+		if mock.CompletionRequest.Format != "json" {
+			t.Errorf("expected format json, got %q", mock.CompletionRequest.Format)
 		}
 	})
 
-	t.Run("load model", func(t *testing.T) {
-		w := createRequest(t, s.ChatHandler, api.ChatRequest{
-			Model: "test",
+	t.Run("json schema format", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "test",
+			Prompt: "Respond in JSON.",
+			Format: json.RawMessage(`{"type": "boolean"}`),
+			Stream: &stream,
 		})
 
 		if w.Code != http.StatusOK {
 			t.Errorf("expected status 200, got %d", w.Code)
 		}
 
-		var actual api.ChatResponse
-		if err := json.NewDecoder(w.Body).Decode(&actual); err != nil {
-			t.Fatal(err)
-		}
-
-		if actual.Model != "test" {
-			t.Errorf("expected model test, got %s", actual.Model)
-		}
-
-		if !actual.Done {
-			t.Errorf("expected done true, got false")
+		if diff := cmp.Diff(mock.CompletionRequest.Grammar, "root ::= boolean\nboolean ::= \"true\" | \"false\"\n"); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
 		}
+	})
 
-		if actual.DoneReason != "load" {
-			t.Errorf("expected done reason load, got %s", actual.DoneReason)
+	t.Run("invalid format", func(t *testing.T) {
+		for format, expect := range map[string]string{
+			`"yaml"`:                                `{"error":"format must be empty, \"json\" or a JSON schema"}`,
+			`{"type": "string", "pattern": "^a+$"}`: `{"error":"invalid format: unsupported schema: keyword \"pattern\" at #"}`,
+		} {
+			w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+				Model:  "test",
+				Prompt: "Respond in JSON.",
+				Format: json.RawMessage(format),
+			})
+
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("expected status 400, got %d", w.Code)
+			}
+
+			if diff := cmp.Diff(w.Body.String(), expect); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
 		}
 	})
 
-	checkChatResponse := func(t *testing.T, body io.Reader, model, content string) {
-		t.Helper()
-
-		var actual api.ChatResponse
-		if err := json.NewDecoder(body).Decode(&actual); err != nil {
-			t.Fatal(err)
-		}
+	w = createRequest(t, s.CreateModelHandler, api.CreateRequest{
+		Model:     "test-grammar",
+		Modelfile: "FROM test\nGRAMMAR root ::= \"yes\" | \"no\"",
+	})
 
-		if actual.Model != model {
-			t.Errorf("expected model test, got %s", actual.Model)
-		}
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
 
-		if !actual.Done {
-			t.Errorf("expected done false, got true")
-		}
+	t.Run("model grammar", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "test-grammar",
+			Prompt: "Yes or no?",
+			Stream: &stream,
+		})
 
-		if actual.DoneReason != "stop" {
-			t.Errorf("expected done reason stop, got %s", actual.DoneReason)
+		if w.Code != http.StatusOK {
+			t.Errorf("expected status 200, got %d", w.Code)
 		}
 
-		if diff := cmp.Diff(actual.Message, api.Message{
-			Role:    "assistant",
-			Content: content,
-		}); diff != "" {
+		if diff := cmp.Diff(mock.CompletionRequest.Grammar, `root ::= "yes" | "no"`); diff != "" {
 			t.Errorf("mismatch (-got +want):\n%s", diff)
 		}
+	})
 
-		if actual.PromptEvalCount == 0 {
-			t.Errorf("expected prompt eval count > 0, got 0")
-		}
+	t.Run("grammar", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:   "test-grammar",
+			Prompt:  "Yes or no?",
+			Grammar: `root ::= "maybe"`,
+			Stream:  &stream,
+		})
 
-		if actual.PromptEvalDuration == 0 {
-			t.Errorf("expected prompt eval duration > 0, got 0")
+		if w.Code != http.StatusOK {
+			t.Errorf("expected status 200, got %d", w.Code)
 		}
 
-		if actual.EvalCount == 0 {
-			t.Errorf("expected eval count > 0, got 0")
+		if diff := cmp.Diff(mock.CompletionRequest.Grammar, `root ::= "maybe"`); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
 		}
+	})
 
-		if actual.EvalDuration == 0 {
-			t.Errorf("expected eval duration > 0, got 0")
+	t.Run("model grammar with json format", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "test-grammar",
+			Prompt: "Respond in JSON.",
+			Format: json.RawMessage(`"json"`),
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Errorf("expected status 200, got %d", w.Code)
 		}
 
-		if actual.LoadDuration == 0 {
-			t.Errorf("expected load duration > 0, got 0")
+		if mock.CompletionRequest.Format != "json" || mock.CompletionRequest.Grammar != "" {
+			t.Errorf("expected json format without grammar, got %q and %q", mock.CompletionRequest.Format, mock.CompletionRequest.Grammar)
 		}
+	})
 
-		if actual.TotalDuration == 0 {
-			t.Errorf("expected total duration > 0, got 0")
+	t.Run("invalid grammar", func(t *testing.T) {
+		for _, tt := range []struct {
+			grammar string
+			format  json.RawMessage
+			expect  string
+		}{
+			{"root ::= \"yes\" |\n  \"no", nil, `{"error":"invalid grammar: line 2, column 3: unterminated string literal"}`},
+			{`root ::= "yes"`, json.RawMessage(`"json"`), `{"error":"format and grammar can't be used together"}`},
+			{`root ::= "` + strings.Repeat("y", maxGrammarSize) + `"`, nil, `{"error":"grammar is larger than 65536 bytes"}`},
+		} {
+			w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+				Model:   "test",
+				Prompt:  "Yes or no?",
+				Grammar: tt.grammar,
+				Format:  tt.format,
+			})
+
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("expected status 400, got %d", w.Code)
+			}
+
+			if diff := cmp.Diff(w.Body.String(), tt.expect); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
 		}
-	}
+	})
 
-	mock.CompletionResponse.Content = "Hi!"
-	t.Run("messages", func(t *testing.T) {
-		w := createRequest(t, s.ChatHandler, api.ChatRequest{
-			Model: "test",
-			Messages: []api.Message{
-				{Role: "user", Content: "Hello!"},
-			},
-			Stream: &stream,
+	t.Run("logprobs", func(t *testing.T) {
+		logprobs := []api.Logprob{{
+			TokenLogprob: api.TokenLogprob{Token: "Abra", ID: 1, Logprob: -0.5, Bytes: []int{65, 98, 114, 97}},
+			TopLogprobs:  []api.TokenLogprob{{Token: "Abra", ID: 1, Logprob: -0.5, Bytes: []int{65, 98, 114, 97}}},
+		}}
+
+		mock.CompletionResponse.Logprobs = logprobs
+		t.Cleanup(func() { mock.CompletionResponse.Logprobs = nil })
+
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:       "test",
+			Prompt:      "Hello!",
+			Logprobs:    true,
+			TopLogprobs: 1,
+			Stream:      &stream,
 		})
 
 		if w.Code != http.StatusOK {
 			t.Errorf("expected status 200, got %d", w.Code)
 		}
 
-		if diff := cmp.Diff(mock.CompletionRequest.Prompt, "User: Hello! "); diff != "" {
+		if !mock.CompletionRequest.Logprobs || mock.CompletionRequest.TopLogprobs != 1 {
+			t.Errorf("expected logprobs with 1 alternative, got %t and %d", mock.CompletionRequest.Logprobs, mock.CompletionRequest.TopLogprobs)
+		}
+
+		var actual api.GenerateResponse
+		if err := json.NewDecoder(w.Body).Decode(&actual); err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff(actual.Logprobs, logprobs); diff != "" {
 			t.Errorf("mismatch (-got +want):\n%s", diff)
 		}
+	})
 
-		checkChatResponse(t,
+	t.Run("invalid logprobs", func(t *testing.T) {
+		for _, tt := range []struct {
+			logprobs bool
+			top      int
+			expect   string
+		}{
+			{true, 21, `{"error":"top_logprobs must be between 0 and 20"}`},
+			{false, 5, `{"error":"top_logprobs requires logprobs"}`},
+		} {
+			w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+				Model:       "test",
+				Prompt:      "Hello!",
+				Logprobs:    tt.logprobs,
+				TopLogprobs: tt.top,
+			})
+
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("expected status 400, got %d", w.Code)
+			}
+
+			if diff := cmp.Diff(w.Body.String(), tt.expect); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+		}
+	})
+}
@@ -1,11 +1,59 @@
 package server
 
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/gpu"
+	"github.com/ollama/ollama/llm"
+)
+
 type runnerRef struct {
-	llama          interface{} // Replace with the actual type
-	sessionDuration int
-	numParallel    int
-	refCount       int
-	gpus           []string // Adjust type as necessary
-	loading        bool
-	model          *Model // Replace with the actual type
+	refMu    sync.Mutex
+	refCount uint // prevent unloading if > 0
+
+	llama          llm.LlamaServer
+	loading        bool            // True only during initial load, then false forever
+	gpus           gpu.GpuInfoList // Recorded at time of provisioning
+	estimatedVRAM  uint64
+	estimatedTotal uint64
+
+	sessionDuration time.Duration
+	expireTimer     *time.Timer
+	expiresAt       time.Time
+
+	stale    bool // the runner failed and must not be handed out again
+	pinned   bool // the runner is never unloaded to make room or when idle
+	restarts int  // times the model's runner was restarted after failing
+
+	model       *Model
+	modelPath   string
+	numParallel int
+	*api.Options
+}
+
+// vocabOnly reports whether the runner only tokenizes. It holds no weights, so
+// it doesn't count toward OLLAMA_MAX_LOADED_MODELS and unloading it makes no
+// room for other models.
+func (runner *runnerRef) vocabOnly() bool {
+	return runner.Options != nil && runner.Options.VocabOnly
+}
+
+// The refMu must already be held when calling unload
+func (runner *runnerRef) unload() {
+	if runner.expireTimer != nil {
+		runner.expireTimer.Stop()
+		runner.expireTimer = nil
+	}
+	if runner.llama != nil {
+		if err := runner.llama.Close(); err != nil {
+			slog.Warn("error closing runner", "model", runner.modelPath, "error", err)
+		}
+	}
+	runner.model = nil
+	runner.llama = nil
+	runner.Options = nil
+	runner.gpus = nil
 }
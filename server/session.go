@@ -0,0 +1,368 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
+)
+
+// Sessions store chat histories on the server so clients only send new
+// messages. Each session is a JSON file under the models directory. Sessions
+// not used for OLLAMA_SESSION_TTL are deleted. When the server requires API
+// keys, a session belongs to the key that created it and other keys are told
+// it doesn't exist.
+
+var (
+	errBadSessionID    = errors.New("session IDs must be 1-128 letters, digits, '_', '-' or '.', starting with a letter or digit")
+	errSessionNotFound = errors.New("session not found")
+	errSessionExists   = errors.New("session already exists")
+)
+
+var sessionIDRe = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]{0,127}$`)
+
+// sessionsMu serializes reading and writing session files
+var sessionsMu sync.Mutex
+
+// GetSessionsPath returns the directory sessions are stored in, creating it
+// if needed
+func GetSessionsPath() (string, error) {
+	dir := filepath.Join(envconfig.ModelsDir, "sessions")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+
+	return dir, nil
+}
+
+func sessionPath(id string) (string, error) {
+	if !sessionIDRe.MatchString(id) {
+		return "", errBadSessionID
+	}
+
+	dir, err := GetSessionsPath()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, id+".json"), nil
+}
+
+func sessionExpired(s *api.Session) bool {
+	return time.Since(s.ModifiedAt) > envconfig.SessionTTL
+}
+
+// sessionOwnedBy reports whether s may be used with k, which is nil if API
+// keys aren't required
+func sessionOwnedBy(s *api.Session, k *apiKey) bool {
+	return k == nil || s.Owner == k.Name
+}
+
+// readOwnedSession reads a session like readSession, treating sessions owned
+// by other keys as not found. sessionsMu must be held.
+func readOwnedSession(id string, k *apiKey) (*api.Session, error) {
+	s, err := readSession(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if !sessionOwnedBy(s, k) {
+		return nil, errSessionNotFound
+	}
+
+	return s, nil
+}
+
+// readSession reads a session, deleting it if it has expired. sessionsMu
+// must be held.
+func readSession(id string) (*api.Session, error) {
+	p, err := sessionPath(id)
+	if err != nil {
+		return nil, err
+	}
+
+	bts, err := os.ReadFile(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errSessionNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	var s api.Session
+	if err := json.Unmarshal(bts, &s); err != nil {
+		return nil, fmt.Errorf("session %s: %w", id, err)
+	}
+
+	if sessionExpired(&s) {
+		if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+
+		return nil, errSessionNotFound
+	}
+
+	return &s, nil
+}
+
+// writeSession replaces the session's file. sessionsMu must be held.
+func writeSession(s *api.Session) error {
+	p, err := sessionPath(s.ID)
+	if err != nil {
+		return err
+	}
+
+	s.ExpiresAt = nil
+	bts, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(p+".tmp", bts, 0o644); err != nil {
+		return err
+	}
+
+	return os.Rename(p+".tmp", p)
+}
+
+// withExpiry sets when s will expire, unless sessions are kept forever
+func withExpiry(s *api.Session) *api.Session {
+	if envconfig.SessionTTL < math.MaxInt64 {
+		expires := s.ModifiedAt.Add(envconfig.SessionTTL)
+		s.ExpiresAt = &expires
+	}
+
+	return s
+}
+
+// loadSession returns the session with the given ID, or an empty session if
+// there's no such session. It fails with errSessionExists if the session
+// belongs to a key other than k.
+func loadSession(id string, k *apiKey) (*api.Session, error) {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+
+	s, err := readSession(id)
+	if errors.Is(err, errSessionNotFound) {
+		return &api.Session{ID: id}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if !sessionOwnedBy(s, k) {
+		return nil, errSessionExists
+	}
+
+	return s, nil
+}
+
+// appendSession adds msgs to the end of a session's history, creating the
+// session for k if needed, and records m as the session's model. The session
+// is read again so turns that ran at the same time are all kept.
+func appendSession(id string, k *apiKey, m *Model, msgs ...api.Message) error {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+
+	now := time.Now().UTC()
+	s, err := readSession(id)
+	if errors.Is(err, errSessionNotFound) {
+		s = &api.Session{ID: id, CreatedAt: now}
+		if k != nil {
+			s.Owner = k.Name
+		}
+	} else if err != nil {
+		return err
+	} else if !sessionOwnedBy(s, k) {
+		return errSessionExists
+	}
+
+	if s.Digest != "" && s.Digest != m.Digest {
+		slog.Debug("session model changed", "session", id, "model", m.ShortName, "from", s.Digest, "to", m.Digest)
+	}
+
+	s.Model = m.ShortName
+	s.Digest = m.Digest
+	s.Messages = append(s.Messages, msgs...)
+	s.ModifiedAt = now
+	return writeSession(s)
+}
+
+// listSessions returns the sessions of k that haven't expired, without their
+// messages, most recently used first. Expired sessions are deleted.
+func listSessions(k *apiKey) ([]api.Session, error) {
+	dir, err := GetSessionsPath()
+	if err != nil {
+		return nil, err
+	}
+
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := []api.Session{}
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok || e.IsDir() {
+			continue
+		}
+
+		s, err := readSession(id)
+		if errors.Is(err, errSessionNotFound) {
+			continue
+		} else if err != nil {
+			slog.Warn("skipping session", "id", id, "error", err)
+			continue
+		}
+
+		if !sessionOwnedBy(s, k) {
+			continue
+		}
+
+		s.Messages = nil
+		sessions = append(sessions, *withExpiry(s))
+	}
+
+	slices.SortFunc(sessions, func(a, b api.Session) int { return b.ModifiedAt.Compare(a.ModifiedAt) })
+	return sessions, nil
+}
+
+func newSessionID() (string, error) {
+	bts := make([]byte, 12)
+	if _, err := rand.Read(bts); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(bts), nil
+}
+
+// forkSession copies the session id to a new session of k named to, or a
+// random name if to is empty
+func forkSession(id, to string, k *apiKey) (*api.Session, error) {
+	if to == "" {
+		var err error
+		if to, err = newSessionID(); err != nil {
+			return nil, err
+		}
+	}
+
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+
+	s, err := readOwnedSession(id, k)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := readSession(to); err == nil {
+		return nil, errSessionExists
+	} else if !errors.Is(err, errSessionNotFound) {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	s.ID = to
+	s.CreatedAt = now
+	s.ModifiedAt = now
+	if err := writeSession(s); err != nil {
+		return nil, err
+	}
+
+	return withExpiry(s), nil
+}
+
+func deleteSession(id string, k *apiKey) error {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+
+	if _, err := readOwnedSession(id, k); err != nil {
+		return err
+	}
+
+	p, err := sessionPath(id)
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(p)
+}
+
+func handleSessionError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errBadSessionID):
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, errSessionNotFound):
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("session %q not found", c.Param("id"))})
+	case errors.Is(err, errSessionExists):
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+func (s *Server) ListSessionsHandler(c *gin.Context) {
+	sessions, err := listSessions(contextKey(c.Request.Context()))
+	if err != nil {
+		handleSessionError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, api.ListSessionsResponse{Sessions: sessions})
+}
+
+func (s *Server) SessionHandler(c *gin.Context) {
+	sessionsMu.Lock()
+	sess, err := readOwnedSession(c.Param("id"), contextKey(c.Request.Context()))
+	sessionsMu.Unlock()
+	if err != nil {
+		handleSessionError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, withExpiry(sess))
+}
+
+func (s *Server) ForkSessionHandler(c *gin.Context) {
+	// the body is optional
+	var req api.ForkSessionRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	sess, err := forkSession(c.Param("id"), req.ID, contextKey(c.Request.Context()))
+	if err != nil {
+		handleSessionError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, sess)
+}
+
+func (s *Server) DeleteSessionHandler(c *gin.Context) {
+	if err := deleteSession(c.Param("id"), contextKey(c.Request.Context())); err != nil {
+		handleSessionError(c, err)
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
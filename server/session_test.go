@@ -0,0 +1,193 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
+)
+
+func TestSessionStore(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	envconfig.LoadConfig()
+
+	m := &Model{ShortName: "llama3:latest", Digest: "sha256:1"}
+	hello := api.Message{Role: "user", Content: "Hello!"}
+	hi := api.Message{Role: "assistant", Content: "Hi!"}
+
+	sess, err := loadSession("chat", nil)
+	require.NoError(t, err)
+	require.Equal(t, &api.Session{ID: "chat"}, sess)
+
+	require.NoError(t, appendSession("chat", nil, m, hello, hi))
+
+	// an updated model takes over the session
+	updated := &Model{ShortName: "llama3:latest", Digest: "sha256:2"}
+	require.NoError(t, appendSession("chat", nil, updated, hello, hi))
+
+	sess, err = loadSession("chat", nil)
+	require.NoError(t, err)
+	require.Equal(t, "llama3:latest", sess.Model)
+	require.Equal(t, "sha256:2", sess.Digest)
+	require.Equal(t, []api.Message{hello, hi, hello, hi}, sess.Messages)
+
+	fork, err := forkSession("chat", "", nil)
+	require.NoError(t, err)
+	require.NotEqual(t, "chat", fork.ID)
+	require.Equal(t, sess.Messages, fork.Messages)
+	require.NotNil(t, fork.ExpiresAt)
+
+	_, err = forkSession("chat", fork.ID, nil)
+	require.ErrorIs(t, err, errSessionExists)
+
+	_, err = forkSession("missing", "", nil)
+	require.ErrorIs(t, err, errSessionNotFound)
+
+	_, err = loadSession("../chat", nil)
+	require.ErrorIs(t, err, errBadSessionID)
+
+	sessions, err := listSessions(nil)
+	require.NoError(t, err)
+	require.Len(t, sessions, 2)
+	require.Equal(t, fork.ID, sessions[0].ID)
+	require.Nil(t, sessions[0].Messages)
+
+	require.NoError(t, deleteSession(fork.ID, nil))
+	require.ErrorIs(t, deleteSession(fork.ID, nil), errSessionNotFound)
+
+	t.Run("expired", func(t *testing.T) {
+		t.Setenv("OLLAMA_SESSION_TTL", "1ms")
+		envconfig.LoadConfig()
+		time.Sleep(2 * time.Millisecond)
+
+		sessions, err := listSessions(nil)
+		require.NoError(t, err)
+		require.Empty(t, sessions)
+
+		p, err := sessionPath("chat")
+		require.NoError(t, err)
+		_, err = os.Stat(p)
+		require.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("forever", func(t *testing.T) {
+		t.Setenv("OLLAMA_SESSION_TTL", "-1")
+		envconfig.LoadConfig()
+
+		require.NoError(t, appendSession("chat", nil, m, hello))
+		sessions, err := listSessions(nil)
+		require.NoError(t, err)
+		require.Len(t, sessions, 1)
+		require.Nil(t, sessions[0].ExpiresAt)
+	})
+}
+
+func TestSessionRoutes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	envconfig.LoadConfig()
+
+	require.NoError(t, appendSession("chat", nil, &Model{ShortName: "llama3:latest", Digest: "sha256:1"}, api.Message{Role: "user", Content: "Hello!"}))
+
+	s := &Server{sched: InitScheduler()}
+	router := s.GenerateRoutes()
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+
+	w := do(http.MethodGet, "/api/sessions/chat", "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var sess api.Session
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&sess))
+	require.Equal(t, "chat", sess.ID)
+	require.Len(t, sess.Messages, 1)
+
+	require.Equal(t, http.StatusNotFound, do(http.MethodGet, "/api/sessions/missing", "").Code)
+
+	w = do(http.MethodPost, "/api/sessions/chat/fork", `{"id": "other"}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.Equal(t, http.StatusConflict, do(http.MethodPost, "/api/sessions/chat/fork", `{"id": "other"}`).Code)
+	require.Equal(t, http.StatusBadRequest, do(http.MethodPost, "/api/sessions/chat/fork", `{"id": ".hidden"}`).Code)
+	require.Equal(t, http.StatusOK, do(http.MethodPost, "/api/sessions/chat/fork", "").Code)
+
+	w = do(http.MethodGet, "/api/sessions", "")
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var list api.ListSessionsResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&list))
+	require.Len(t, list.Sessions, 3)
+
+	require.Equal(t, http.StatusOK, do(http.MethodDelete, "/api/sessions/other", "").Code)
+	require.Equal(t, http.StatusNotFound, do(http.MethodDelete, "/api/sessions/other", "").Code)
+}
+
+func TestSessionOwner(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	envconfig.LoadConfig()
+
+	keys, err := loadAPIKeys(writeAPIKeys(t, `{"keys":[{"key":"a","name":"alice"},{"key":"b","name":"bob"}]}`))
+	require.NoError(t, err)
+
+	m := &Model{ShortName: "llama3:latest", Digest: "sha256:1"}
+	hello := api.Message{Role: "user", Content: "Hello!"}
+	require.NoError(t, appendSession("chat", keys.named("alice"), m, hello))
+	require.ErrorIs(t, appendSession("chat", keys.named("bob"), m, hello), errSessionExists)
+
+	_, err = loadSession("chat", keys.named("bob"))
+	require.ErrorIs(t, err, errSessionExists)
+
+	sess, err := loadSession("chat", keys.named("alice"))
+	require.NoError(t, err)
+	require.Equal(t, "alice", sess.Owner)
+	require.Equal(t, []api.Message{hello}, sess.Messages)
+
+	s := &Server{sched: InitScheduler(), keys: keys}
+	router := s.GenerateRoutes()
+
+	do := func(method, path, key, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+key)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	var list api.ListSessionsResponse
+	w := do(http.MethodGet, "/api/sessions", "b", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&list))
+	require.Empty(t, list.Sessions)
+
+	require.Equal(t, http.StatusNotFound, do(http.MethodGet, "/api/sessions/chat", "b", "").Code)
+	require.Equal(t, http.StatusNotFound, do(http.MethodPost, "/api/sessions/chat/fork", "b", "").Code)
+	require.Equal(t, http.StatusNotFound, do(http.MethodDelete, "/api/sessions/chat", "b", "").Code)
+
+	// a fork belongs to the key that made it
+	w = do(http.MethodPost, "/api/sessions/chat/fork", "a", `{"id": "fork"}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&sess))
+	require.Equal(t, "alice", sess.Owner)
+
+	w = do(http.MethodGet, "/api/sessions", "a", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&list))
+	require.Len(t, list.Sessions, 2)
+
+	require.Equal(t, http.StatusOK, do(http.MethodGet, "/api/sessions/chat", "a", "").Code)
+	require.Equal(t, http.StatusOK, do(http.MethodDelete, "/api/sessions/chat", "a", "").Code)
+}
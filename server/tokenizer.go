@@ -0,0 +1,91 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+
+	"github.com/ollama/ollama/llm"
+	"github.com/ollama/ollama/tokenizer"
+)
+
+// tokenizers holds the tokenizer, or the error loading it, of each model blob.
+// Blobs are content addressed so entries never go stale.
+var tokenizers sync.Map
+
+type tokenizerResult struct {
+	tok *tokenizer.Tokenizer
+	err error
+}
+
+func loadTokenizer(path string) (*tokenizer.Tokenizer, error) {
+	if v, ok := tokenizers.Load(path); ok {
+		r := v.(tokenizerResult)
+		return r.tok, r.err
+	}
+
+	var r tokenizerResult
+	ggml, err := llm.LoadModel(path, -1)
+	if err != nil {
+		r.err = err
+	} else {
+		r.tok, r.err = tokenizer.New(ggml.KV())
+	}
+
+	if r.err != nil && !errors.Is(r.err, tokenizer.ErrUnsupported) {
+		slog.Warn("couldn't load tokenizer, tokenizing with the runner", "model", path, "error", r.err)
+	}
+
+	v, _ := tokenizers.LoadOrStore(path, r)
+	r = v.(tokenizerResult)
+	return r.tok, r.err
+}
+
+// goTokenizer returns the tokenizer of the model called name if the tokenizer
+// package supports its vocabulary, so tokenizing doesn't need a runner
+func goTokenizer(name string) (*tokenizer.Tokenizer, bool) {
+	if name == "" {
+		return nil, false
+	}
+
+	m, err := GetModel(name)
+	if err != nil {
+		return nil, false
+	}
+
+	tok, err := loadTokenizer(m.ModelPath)
+	return tok, err == nil
+}
+
+// tokenizePieces encodes s like the runner's tokenize endpoint, returning the
+// text of each token alongside it
+func tokenizePieces(tok *tokenizer.Tokenizer, s string) ([]int, []string, error) {
+	tokens, err := tok.Encode(s)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pieces := make([]string, len(tokens))
+	for i, t := range tokens {
+		if pieces[i], err = tok.Decode([]int{t}); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return tokens, pieces, nil
+}
+
+// modelTokenize returns a tokenizeFunc that counts tokens in Go with the
+// model's vocabulary, falling back to fallback for vocabularies the tokenizer
+// package doesn't support
+func modelTokenize(m *Model, fallback tokenizeFunc) tokenizeFunc {
+	tok, err := loadTokenizer(m.ModelPath)
+	if err != nil {
+		return fallback
+	}
+
+	return func(_ context.Context, s string) ([]int, error) {
+		return tok.Encode(s)
+	}
+}
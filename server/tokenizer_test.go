@@ -0,0 +1,55 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/llm"
+)
+
+func TestModelTokenize(t *testing.T) {
+	var fallbackCalls int
+	fallback := func(context.Context, string) ([]int, error) {
+		fallbackCalls++
+		return []int{0}, nil
+	}
+
+	spm := createBinFile(t, llm.KV{
+		"general.architecture":      "llama",
+		"tokenizer.ggml.model":      "llama",
+		"tokenizer.ggml.tokens":     []string{"<unk>", "▁", "h", "i", "▁h", "▁hi"},
+		"tokenizer.ggml.scores":     []float32{0, -3, -3, -3, -2, -1},
+		"tokenizer.ggml.token_type": []int32{2, 1, 1, 1, 1, 1},
+	}, nil)
+
+	tokens, err := modelTokenize(&Model{ModelPath: spm}, fallback)(context.TODO(), "hi hi")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff([]int{5, 5}, tokens); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+
+	if fallbackCalls != 0 {
+		t.Errorf("expected the runner not to be used, got %d calls", fallbackCalls)
+	}
+
+	unsupported := createBinFile(t, llm.KV{
+		"general.architecture":  "llama",
+		"tokenizer.ggml.model":  "bert",
+		"tokenizer.ggml.tokens": []string{"a"},
+	}, nil)
+
+	for range 2 {
+		if _, err := modelTokenize(&Model{ModelPath: unsupported}, fallback)(context.TODO(), "a"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if fallbackCalls != 2 {
+		t.Errorf("expected the runner to be used, got %d calls", fallbackCalls)
+	}
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/gpu"
+	"github.com/ollama/ollama/llm"
+	"github.com/ollama/ollama/template"
+)
+
+// newTestTracer records spans in memory for the duration of the test
+func newTestTracer(t *testing.T) *tracetest.InMemoryExporter {
+	t.Helper()
+
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(tp)
+	t.Cleanup(func() {
+		otel.SetTracerProvider(prev)
+		tp.Shutdown(context.Background())
+	})
+
+	return exporter
+}
+
+func findSpan(t *testing.T, exporter *tracetest.InMemoryExporter, name string) tracetest.SpanStub {
+	t.Helper()
+
+	for _, span := range exporter.GetSpans() {
+		if span.Name == name {
+			return span
+		}
+	}
+
+	t.Fatalf("span %q not found in %v", name, exporter.GetSpans())
+	return tracetest.SpanStub{}
+}
+
+func hasAttribute(span tracetest.SpanStub, kv attribute.KeyValue) bool {
+	for _, attr := range span.Attributes {
+		if attr == kv {
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestTracingMiddleware(t *testing.T) {
+	exporter := newTestTracer(t)
+
+	s := &Server{sched: InitScheduler()}
+	r := httptest.NewRequest(http.MethodGet, "/api/version", nil)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	w := httptest.NewRecorder()
+	s.GenerateRoutes().ServeHTTP(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	span := findSpan(t, exporter, "GET /api/version")
+	require.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", span.SpanContext.TraceID().String())
+	require.Equal(t, "00f067aa0ba902b7", span.Parent.SpanID().String())
+	require.True(t, span.Parent.IsRemote())
+	require.Equal(t, trace.SpanKindServer, span.SpanKind)
+	require.True(t, hasAttribute(span, attribute.Int("http.response.status_code", http.StatusOK)))
+}
+
+func TestTracingLoad(t *testing.T) {
+	exporter := newTestTracer(t)
+
+	ctx, parent := otel.Tracer("test").Start(context.Background(), "request")
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	s := InitScheduler()
+	s.newServerFn = func(gpu.GpuInfoList, string, *llm.GGML, []string, []string, string, api.Options, int) (llm.LlamaServer, error) {
+		return &mockLlm{done: make(chan struct{})}, nil
+	}
+
+	req := &LlmRequest{
+		ctx:       ctx,
+		model:     &Model{ModelPath: "model", ShortName: "model:latest"},
+		successCh: make(chan *runnerRef, 1),
+		errCh:     make(chan error, 1),
+	}
+
+	s.load(req, nil, nil, 1)
+	select {
+	case <-req.successCh:
+	case err := <-req.errCh:
+		t.Fatal(err)
+	}
+	parent.End()
+
+	span := findSpan(t, exporter, "model.load")
+	require.Equal(t, parent.SpanContext().SpanID(), span.Parent.SpanID())
+	require.True(t, hasAttribute(span, attribute.String("model", "model:latest")))
+}
+
+func TestTracingChatPrompt(t *testing.T) {
+	exporter := newTestTracer(t)
+
+	tmpl, err := template.Parse("{{ .Prompt }}")
+	require.NoError(t, err)
+
+	ctx, parent := otel.Tracer("test").Start(context.Background(), "request")
+	opts := api.DefaultOptions()
+	_, _, err = chatPrompt(ctx, &Model{Template: tmpl}, mockRunner{}.Tokenize, &opts, []api.Message{{Role: "user", Content: "hi"}}, nil)
+	require.NoError(t, err)
+	parent.End()
+
+	span := findSpan(t, exporter, "chatPrompt")
+	require.Equal(t, parent.SpanContext().SpanID(), span.Parent.SpanID())
+	require.True(t, hasAttribute(span, attribute.Int("messages", 1)))
+}
@@ -16,6 +16,9 @@ import (
 	"sync/atomic"
 	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
 	"github.com/ollama/ollama/api"
 	"github.com/ollama/ollama/format"
 	"golang.org/x/sync/errgroup"
@@ -209,7 +212,15 @@ func (b *blobUpload) Run(ctx context.Context, opts *registryOptions) {
 	b.done = true
 }
 
-func (b *blobUpload) uploadPart(ctx context.Context, method string, requestURL *url.URL, part *blobUploadPart, opts *registryOptions) error {
+func (b *blobUpload) uploadPart(ctx context.Context, method string, requestURL *url.URL, part *blobUploadPart, opts *registryOptions) (err error) {
+	ctx, span := startSpan(ctx, "uploadPart", trace.WithAttributes(
+		attribute.String("digest", b.Digest),
+		attribute.Int("part", part.N),
+		attribute.Int64("offset", part.Offset),
+		attribute.Int64("size", part.Size),
+	))
+	defer func() { endSpan(span, err) }()
+
 	headers := make(http.Header)
 	headers.Set("Content-Type", "application/octet-stream")
 	headers.Set("Content-Length", fmt.Sprintf("%d", part.Size))
@@ -352,6 +363,7 @@ func (p *progressWriter) Write(b []byte) (n int, err error) {
 	n = len(b)
 	p.written += int64(n)
 	p.Completed.Add(int64(n))
+	metrics.pushBytes.Add(float64(n))
 	return n, nil
 }
 
@@ -0,0 +1,138 @@
+package tokenizer
+
+import (
+	"container/heap"
+	"strings"
+)
+
+// byteRunes maps each byte to the printable character GPT-2 vocabularies
+// write it as, and runeBytes reverses it
+var byteRunes, runeBytes = func() ([256]rune, map[rune]byte) {
+	var byteRunes [256]rune
+	runeBytes := make(map[rune]byte, 256)
+
+	n := 0
+	for b := range 256 {
+		// printable bytes are themselves, the rest are moved past 255
+		if ('!' <= b && b <= '~') || ('¡' <= b && b <= '¬') || ('®' <= b && b <= 'ÿ') {
+			byteRunes[b] = rune(b)
+		} else {
+			byteRunes[b] = rune(256 + n)
+			n++
+		}
+
+		runeBytes[byteRunes[b]] = byte(b)
+	}
+
+	return byteRunes, runeBytes
+}()
+
+// encodeBytes writes each byte of s as its GPT-2 character
+func encodeBytes(s string) string {
+	var sb strings.Builder
+	for i := range len(s) {
+		sb.WriteRune(byteRunes[s[i]])
+	}
+
+	return sb.String()
+}
+
+// decodeBytes reverses encodeBytes. Characters that don't stand for a byte
+// are kept as they are.
+func decodeBytes(s string) string {
+	var sb strings.Builder
+	for _, r := range s {
+		if b, ok := runeBytes[r]; ok {
+			sb.WriteByte(b)
+		} else {
+			sb.WriteRune(r)
+		}
+	}
+
+	return sb.String()
+}
+
+// encodeBPE appends the tokens of s, following llama.cpp's byte-level BPE
+// tokenizer: s is split into words, and the characters of each word are
+// merged pairwise in the order of the vocabulary's merges.
+func (t *Tokenizer) encodeBPE(ids []int32, s string) ([]int32, error) {
+	for _, word := range t.pretokenize(s) {
+		word = encodeBytes(word)
+
+		if t.ignoreMerges {
+			if id, ok := t.ids[word]; ok {
+				ids = append(ids, id)
+				continue
+			}
+		}
+
+		symbols := newSymbols(word)
+
+		q := &bigramQueue{less: func(a, b bigram) bool {
+			return a.rank < b.rank || (a.rank == b.rank && a.left < b.left)
+		}}
+
+		add := func(left, right int) {
+			if left < 0 || right < 0 {
+				return
+			}
+
+			l := word[symbols[left].start : symbols[left].start+symbols[left].n]
+			r := word[symbols[right].start : symbols[right].start+symbols[right].n]
+			rank, ok := t.ranks[pair{l, r}]
+			if !ok {
+				return
+			}
+
+			heap.Push(q, bigram{left: left, right: right, text: l + r, rank: rank})
+		}
+
+		for i := 1; i < len(symbols); i++ {
+			add(i-1, i)
+		}
+
+		for q.Len() > 0 {
+			b := heap.Pop(q).(bigram)
+			left, right := &symbols[b.left], &symbols[b.right]
+
+			// skip pairs one of whose symbols has changed since
+			if left.n == 0 || right.n == 0 ||
+				word[left.start:left.start+left.n]+word[right.start:right.start+right.n] != b.text {
+				continue
+			}
+
+			left.n += right.n
+			right.n = 0
+
+			left.next = right.next
+			if right.next >= 0 {
+				symbols[right.next].prev = b.left
+			}
+
+			add(left.prev, b.left)
+			add(b.left, left.next)
+		}
+
+		for _, sym := range symbols {
+			if sym.n == 0 {
+				continue
+			}
+
+			text := word[sym.start : sym.start+sym.n]
+			if id, ok := t.ids[text]; ok {
+				ids = append(ids, id)
+				continue
+			}
+
+			// like the runner, fall back to tokens for the single bytes of
+			// the text and drop those that are missing too
+			for i := range len(text) {
+				if id, ok := t.ids[text[i:i+1]]; ok {
+					ids = append(ids, id)
+				}
+			}
+		}
+	}
+
+	return ids, nil
+}
@@ -0,0 +1,235 @@
+package tokenizer
+
+import (
+	"unicode"
+)
+
+// runeClasses looks up the character classes the pre-tokenizer patterns use.
+// Positions outside the text have no classes.
+type runeClasses []rune
+
+const outOfRange = -1
+
+func (rs runeClasses) at(i int) rune {
+	if i < 0 || i >= len(rs) {
+		return outOfRange
+	}
+
+	return rs[i]
+}
+
+func (rs runeClasses) letter(i int) bool {
+	return rs.at(i) != outOfRange && unicode.IsLetter(rs[i])
+}
+
+func (rs runeClasses) number(i int) bool {
+	return rs.at(i) != outOfRange && unicode.IsNumber(rs[i])
+}
+
+func (rs runeClasses) space(i int) bool {
+	return rs.at(i) != outOfRange && unicode.IsSpace(rs[i])
+}
+
+// other reports whether the character at i is in the text and is neither a
+// space, a letter nor a number, matching [^\s\p{L}\p{N}]
+func (rs runeClasses) other(i int) bool {
+	return rs.at(i) != outOfRange && !rs.space(i) && !rs.letter(i) && !rs.number(i)
+}
+
+// contraction returns the length of the English contraction starting at i,
+// such as 's or 're, or 0 if there isn't one
+func (rs runeClasses) contraction(i int, fold bool) int {
+	if rs.at(i) != '\'' {
+		return 0
+	}
+
+	lower := func(r rune) rune {
+		if fold && r != outOfRange {
+			return unicode.ToLower(r)
+		}
+
+		return r
+	}
+
+	switch next := lower(rs.at(i + 1)); next {
+	case 's', 't', 'm', 'd':
+		return 2
+	case 'r', 'v':
+		if lower(rs.at(i+2)) == 'e' {
+			return 3
+		}
+	case 'l':
+		if lower(rs.at(i+2)) == 'l' {
+			return 3
+		}
+	}
+
+	return 0
+}
+
+// words splits s at the given lengths in characters
+func words(rs []rune, lengths []int) []string {
+	words := make([]string, 0, len(lengths))
+	for _, n := range lengths {
+		words = append(words, string(rs[:n]))
+		rs = rs[n:]
+	}
+
+	return words
+}
+
+// splitGPT2 splits s like the pattern
+//
+//	's|'t|'re|'ve|'m|'ll|'d| ?\p{L}+| ?\p{N}+| ?[^\s\p{L}\p{N}]+|\s+(?!\S)|\s+
+//
+// which Go's regexp can't express because of the lookahead.
+func splitGPT2(s string) []string {
+	rs := runeClasses(s)
+
+	var lengths []int
+	start := 0
+	emit := func(end int) {
+		if end > start {
+			lengths = append(lengths, end-start)
+		}
+		start = end
+	}
+
+	for pos := 0; pos < len(rs); {
+		if n := rs.contraction(pos, false); n > 0 {
+			pos += n
+			emit(pos)
+			continue
+		}
+
+		// an optional space before letters, numbers or other characters
+		next := pos
+		if rs[pos] == ' ' {
+			next++
+		}
+
+		switch {
+		case rs.letter(next):
+			for pos = next; rs.letter(pos); pos++ {
+			}
+			emit(pos)
+			continue
+		case rs.number(next):
+			for pos = next; rs.number(pos); pos++ {
+			}
+			emit(pos)
+			continue
+		case rs.other(next):
+			for pos = next; rs.other(pos); pos++ {
+			}
+			emit(pos)
+			continue
+		}
+
+		spaces := 0
+		for rs.space(pos + spaces) {
+			spaces++
+		}
+
+		switch {
+		case spaces > 1 && rs.at(pos+spaces) != outOfRange:
+			// leave the last space to prefix the next word
+			pos += spaces - 1
+		case spaces > 0:
+			pos += spaces
+		default:
+			pos++
+		}
+
+		emit(pos)
+	}
+
+	return words(rs, lengths)
+}
+
+// splitLlama3 splits s like the pattern
+//
+//	(?i:'s|'t|'re|'ve|'m|'ll|'d)|[^\r\n\p{L}\p{N}]?\p{L}+|\p{N}{1,3}| ?[^\s\p{L}\p{N}]+[\r\n]*|\s*[\r\n]+|\s+(?!\S)|\s+
+func splitLlama3(s string) []string {
+	rs := runeClasses(s)
+
+	var lengths []int
+	start := 0
+	emit := func(end int) {
+		if end > start {
+			lengths = append(lengths, end-start)
+		}
+		start = end
+	}
+
+	newline := func(i int) bool {
+		return rs.at(i) == '\r' || rs.at(i) == '\n'
+	}
+
+	for pos := 0; pos < len(rs); {
+		if n := rs.contraction(pos, true); n > 0 {
+			pos += n
+			emit(pos)
+			continue
+		}
+
+		// letters, after any one character other than a newline or number
+		if !newline(pos) && !rs.number(pos) && (rs.letter(pos) || rs.letter(pos+1)) {
+			for pos++; rs.letter(pos); pos++ {
+			}
+			emit(pos)
+			continue
+		}
+
+		// up to three digits at a time
+		if rs.number(pos) {
+			for n := 0; rs.number(pos); n++ {
+				if n > 0 && n%3 == 0 {
+					emit(pos)
+				}
+				pos++
+			}
+			emit(pos)
+			continue
+		}
+
+		next := pos
+		if rs[pos] == ' ' {
+			next++
+		}
+
+		if rs.other(next) {
+			for pos = next; rs.other(pos); pos++ {
+			}
+			for newline(pos) {
+				pos++
+			}
+			emit(pos)
+			continue
+		}
+
+		spaces, lastNewline := 0, 0
+		for rs.space(pos + spaces) {
+			if newline(pos + spaces) {
+				lastNewline = pos + spaces + 1
+			}
+			spaces++
+		}
+
+		switch {
+		case lastNewline > 0:
+			// spaces up to and including the last newline
+			pos = lastNewline
+		case spaces > 1 && rs.at(pos+spaces) != outOfRange:
+			pos += spaces - 1
+		case spaces > 0:
+			pos += spaces
+		default:
+			pos++
+		}
+
+		emit(pos)
+	}
+
+	return words(rs, lengths)
+}
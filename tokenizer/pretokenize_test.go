@@ -0,0 +1,32 @@
+package tokenizer
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSplit(t *testing.T) {
+	cases := []struct {
+		split func(string) []string
+		s     string
+		want  []string
+	}{
+		{splitGPT2, "Hello world", []string{"Hello", " world"}},
+		{splitGPT2, "it's   a test\n\n", []string{"it", "'s", "  ", " a", " test", "\n\n"}},
+		{splitGPT2, "I'LL 123 $$ ok", []string{"I", "'", "LL", " 123", " $$", " ok"}},
+		{splitGPT2, "naïve café", []string{"naïve", " café"}},
+		{splitLlama3, "I'LL 12345 $$\n\nok", []string{"I", "'LL", " ", "123", "45", " $$\n\n", "ok"}},
+		{splitLlama3, "hi  \n there", []string{"hi", "  \n", " there"}},
+		{splitLlama3, "(hello)", []string{"(hello", ")"}},
+		{splitLlama3, "", []string{}},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.s, func(t *testing.T) {
+			if diff := cmp.Diff(tt.want, tt.split(tt.s)); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
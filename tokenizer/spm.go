@@ -0,0 +1,161 @@
+package tokenizer
+
+import (
+	"container/heap"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// spmSpace stands in for spaces in SentencePiece vocabularies
+const spmSpace = "▁"
+
+// symbol is a span of the text being encoded in a doubly linked list of
+// spans. Merging a pair grows the left symbol and empties the right one.
+type symbol struct {
+	start, n   int
+	prev, next int
+}
+
+// bigram is a candidate merge of two neighbouring symbols
+type bigram struct {
+	left, right int
+	text        string
+
+	// SentencePiece merges the highest scoring pairs first, BPE the lowest
+	// ranking
+	score float32
+	rank  int
+}
+
+type bigramQueue struct {
+	items []bigram
+	less  func(a, b bigram) bool
+}
+
+func (q *bigramQueue) Len() int           { return len(q.items) }
+func (q *bigramQueue) Less(i, j int) bool { return q.less(q.items[i], q.items[j]) }
+func (q *bigramQueue) Swap(i, j int)      { q.items[i], q.items[j] = q.items[j], q.items[i] }
+func (q *bigramQueue) Push(x any)         { q.items = append(q.items, x.(bigram)) }
+
+func (q *bigramQueue) Pop() any {
+	b := q.items[len(q.items)-1]
+	q.items = q.items[:len(q.items)-1]
+	return b
+}
+
+// newSymbols splits s into one symbol per UTF-8 character
+func newSymbols(s string) []symbol {
+	var symbols []symbol
+	for i := 0; i < len(s); {
+		n := min(utf8Len(s[i]), len(s)-i)
+		symbols = append(symbols, symbol{start: i, n: n, prev: len(symbols) - 1, next: len(symbols) + 1})
+		i += n
+	}
+
+	if len(symbols) > 0 {
+		symbols[len(symbols)-1].next = -1
+	}
+
+	return symbols
+}
+
+// encodeSPM appends the tokens of s, following llama.cpp's SentencePiece
+// tokenizer: neighbouring characters are merged into the highest scoring
+// tokens, and what can't be merged falls back to byte tokens.
+func (t *Tokenizer) encodeSPM(ids []int32, s string) ([]int32, error) {
+	s = strings.ReplaceAll(s, " ", spmSpace)
+	symbols := newSymbols(s)
+
+	q := &bigramQueue{less: func(a, b bigram) bool {
+		return a.score > b.score || (a.score == b.score && a.left < b.left)
+	}}
+
+	add := func(left, right int) {
+		if left < 0 || right < 0 {
+			return
+		}
+
+		text := s[symbols[left].start : symbols[right].start+symbols[right].n]
+		id, ok := t.ids[text]
+		if !ok {
+			return
+		}
+
+		heap.Push(q, bigram{left: left, right: right, text: text, score: t.scores[id]})
+	}
+
+	for i := 1; i < len(symbols); i++ {
+		add(i-1, i)
+	}
+
+	for q.Len() > 0 {
+		b := heap.Pop(q).(bigram)
+		left, right := &symbols[b.left], &symbols[b.right]
+
+		// skip pairs one of whose symbols has changed since
+		if left.n == 0 || right.n == 0 || left.n+right.n != len(b.text) {
+			continue
+		}
+
+		left.n += right.n
+		right.n = 0
+
+		left.next = right.next
+		if right.next >= 0 {
+			symbols[right.next].prev = b.left
+		}
+
+		add(left.prev, b.left)
+		add(b.left, left.next)
+	}
+
+	// only pairs that are tokens are merged, so any symbol that isn't one
+	// is a single character missing from the vocabulary
+	for i := 0; i >= 0 && i < len(symbols); i = symbols[i].next {
+		text := s[symbols[i].start : symbols[i].start+symbols[i].n]
+		if id, ok := t.ids[text]; ok {
+			ids = append(ids, id)
+			continue
+		}
+
+		for j := range len(text) {
+			id, ok := t.byteToken(text[j])
+			if !ok {
+				return nil, fmt.Errorf("no token for byte 0x%02X", text[j])
+			}
+
+			ids = append(ids, id)
+		}
+	}
+
+	return ids, nil
+}
+
+// byteToken finds the token for a byte, written as <0xXX> or, failing that,
+// as the byte itself
+func (t *Tokenizer) byteToken(b byte) (int32, bool) {
+	if id, ok := t.ids[fmt.Sprintf("<0x%02X>", b)]; ok {
+		return id, true
+	}
+
+	if id, ok := t.ids[string([]byte{b})]; ok {
+		return id, true
+	}
+
+	if t.unknown >= 0 {
+		return t.unknown, true
+	}
+
+	return 0, false
+}
+
+// parseByteToken returns the byte written by a <0xXX> token
+func parseByteToken(s string) (byte, bool) {
+	if len(s) != 6 || !strings.HasPrefix(s, "<0x") || s[5] != '>' {
+		return 0, false
+	}
+
+	b, err := strconv.ParseUint(s[3:5], 16, 8)
+	return byte(b), err == nil
+}
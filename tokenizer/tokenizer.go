@@ -0,0 +1,282 @@
+// Package tokenizer splits text into a model's tokens the way the runner
+// does, using the vocabulary in the model's GGUF metadata, so prompts can be
+// measured without starting a runner.
+package tokenizer
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/ollama/ollama/llm"
+)
+
+// ErrUnsupported is returned by New for vocabularies this package can't
+// reproduce the runner's tokenization of. Callers should tokenize with the
+// runner instead.
+var ErrUnsupported = errors.New("unsupported tokenizer")
+
+// token types, as stored in tokenizer.ggml.token_type
+const (
+	typeUndefined int32 = iota
+	typeNormal
+	typeUnknown
+	typeControl
+	typeUserDefined
+	typeUnused
+	typeByte
+)
+
+// Tokenizer encodes text to token ids and back for one vocabulary. It's safe
+// for concurrent use.
+type Tokenizer struct {
+	model string // "llama" for SentencePiece, "gpt2" for byte-level BPE
+
+	values []string
+	types  []int32
+	scores []float32
+	ids    map[string]int32
+
+	// special holds the tokens that are matched in the text before it's
+	// split up, longest first
+	special []int32
+	unknown int32
+
+	// SentencePiece only
+	addSpacePrefix bool
+
+	// BPE only
+	ranks        map[pair]int
+	pretokenize  func(string) []string
+	ignoreMerges bool
+}
+
+type pair struct {
+	left, right string
+}
+
+// pretokenizers split text into words before BPE merges are applied, keyed
+// by tokenizer.ggml.pre
+var pretokenizers = map[string]struct {
+	split        func(string) []string
+	ignoreMerges bool
+}{
+	"gpt-2":     {split: splitGPT2},
+	"llama-bpe": {split: splitLlama3, ignoreMerges: true},
+}
+
+// New reads the vocabulary in kv, which must have been decoded with all of
+// its arrays.
+func New(kv llm.KV) (*Tokenizer, error) {
+	t := Tokenizer{
+		values:  kv.Strings("tokenizer.ggml.tokens"),
+		types:   kv.Ints("tokenizer.ggml.token_type"),
+		scores:  kv.Floats("tokenizer.ggml.scores"),
+		unknown: -1,
+	}
+
+	if len(t.values) == 0 {
+		return nil, errors.New("model has no vocabulary")
+	}
+
+	if t.types == nil {
+		t.types = make([]int32, len(t.values))
+		for i := range t.types {
+			t.types[i] = typeNormal
+		}
+	} else if len(t.types) != len(t.values) {
+		return nil, fmt.Errorf("vocabulary has %d tokens but %d token types", len(t.values), len(t.types))
+	}
+
+	t.ids = make(map[string]int32, len(t.values))
+	for i, v := range t.values {
+		t.ids[v] = int32(i)
+
+		switch t.types[i] {
+		case typeUnknown, typeControl, typeUserDefined:
+			if v != "" {
+				t.special = append(t.special, int32(i))
+			}
+		}
+	}
+
+	slices.SortStableFunc(t.special, func(a, b int32) int {
+		return len(t.values[b]) - len(t.values[a])
+	})
+
+	if id, ok := kv["tokenizer.ggml.unknown_token_id"]; ok {
+		switch id := id.(type) {
+		case uint32:
+			t.unknown = int32(id)
+		case int32:
+			t.unknown = id
+		}
+	}
+
+	t.model, _ = kv["tokenizer.ggml.model"].(string)
+	switch t.model {
+	case "llama":
+		if len(t.scores) != len(t.values) {
+			return nil, fmt.Errorf("vocabulary has %d tokens but %d scores", len(t.values), len(t.scores))
+		}
+
+		t.addSpacePrefix = true
+		if b, ok := kv["tokenizer.ggml.add_space_prefix"].(bool); ok {
+			t.addSpacePrefix = b
+		}
+	case "gpt2":
+		pre, _ := kv["tokenizer.ggml.pre"].(string)
+		p, ok := pretokenizers[pre]
+		if !ok {
+			return nil, fmt.Errorf("%w: pre-tokenizer %q", ErrUnsupported, pre)
+		}
+
+		t.pretokenize, t.ignoreMerges = p.split, p.ignoreMerges
+
+		merges := kv.Strings("tokenizer.ggml.merges")
+		t.ranks = make(map[pair]int, len(merges))
+		for i, merge := range merges {
+			// the first character can be a space
+			n := strings.IndexByte(merge[min(1, len(merge)):], ' ') + 1
+			if n <= 0 {
+				return nil, fmt.Errorf("invalid merge %q", merge)
+			}
+
+			t.ranks[pair{merge[:n], merge[n+1:]}] = i
+		}
+	default:
+		return nil, fmt.Errorf("%w: model %q", ErrUnsupported, t.model)
+	}
+
+	return &t, nil
+}
+
+// fragment is a piece of the text to encode, either raw text or a special
+// token found in it
+type fragment struct {
+	text  string
+	token int32
+}
+
+// split finds the special tokens in s, trying the longest first like the
+// runner does
+func (t *Tokenizer) split(s string) []fragment {
+	if s == "" {
+		return nil
+	}
+
+	fragments := []fragment{{text: s, token: -1}}
+	for _, id := range t.special {
+		special := t.values[id]
+
+		var next []fragment
+		for _, f := range fragments {
+			if f.token >= 0 || !strings.Contains(f.text, special) {
+				next = append(next, f)
+				continue
+			}
+
+			text := f.text
+			for {
+				before, after, found := strings.Cut(text, special)
+				if before != "" {
+					next = append(next, fragment{text: before, token: -1})
+				}
+
+				if !found {
+					break
+				}
+
+				next = append(next, fragment{token: id})
+				text = after
+			}
+		}
+
+		fragments = next
+	}
+
+	return fragments
+}
+
+// Encode returns the tokens of s. Special tokens written in s are encoded as
+// such, and no beginning or end of sequence tokens are added, which matches
+// what the runner's tokenize endpoint returns.
+func (t *Tokenizer) Encode(s string) ([]int, error) {
+	var ids []int32
+	var err error
+
+	prevSpecial := true
+	for _, f := range t.split(s) {
+		if f.token >= 0 {
+			ids = append(ids, f.token)
+			prevSpecial = true
+			continue
+		}
+
+		switch t.model {
+		case "llama":
+			text := f.text
+			if t.addSpacePrefix && prevSpecial {
+				text = " " + text
+			}
+
+			ids, err = t.encodeSPM(ids, text)
+		case "gpt2":
+			ids, err = t.encodeBPE(ids, f.text)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		prevSpecial = false
+	}
+
+	tokens := make([]int, len(ids))
+	for i, id := range ids {
+		tokens[i] = int(id)
+	}
+
+	return tokens, nil
+}
+
+// Decode turns tokens back into text. Special tokens are written out.
+func (t *Tokenizer) Decode(tokens []int) (string, error) {
+	var sb strings.Builder
+	for _, id := range tokens {
+		if id < 0 || id >= len(t.values) {
+			return "", fmt.Errorf("token %d is out of range for the model's vocabulary", id)
+		}
+
+		value := t.values[id]
+		switch t.types[id] {
+		case typeControl, typeUserDefined:
+			sb.WriteString(value)
+		case typeNormal:
+			if t.model == "llama" {
+				sb.WriteString(strings.ReplaceAll(value, spmSpace, " "))
+			} else {
+				sb.WriteString(decodeBytes(value))
+			}
+		case typeByte:
+			if b, ok := parseByteToken(value); ok {
+				sb.WriteByte(b)
+			}
+		case typeUnknown:
+			if t.model == "llama" {
+				sb.WriteString("▅")
+			} else {
+				sb.WriteString(value)
+			}
+		}
+	}
+
+	return sb.String(), nil
+}
+
+// utf8Len is the length of the UTF-8 sequence starting with b. Invalid
+// sequences are split into single bytes later on as needed.
+func utf8Len(b byte) int {
+	return [16]int{1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 2, 2, 3, 4}[b>>4]
+}
@@ -0,0 +1,210 @@
+package tokenizer
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/llm"
+)
+
+// decode writes kv to a GGUF file and reads it back, the way models are read
+func decode(t *testing.T, kv llm.KV) llm.KV {
+	t.Helper()
+
+	f, err := os.CreateTemp(t.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if err := llm.NewGGUFV3(binary.LittleEndian).Encode(f, kv, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+
+	ggml, _, err := llm.DecodeGGML(f, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ggml.KV()
+}
+
+func spmVocab(t *testing.T, addSpacePrefix bool) *Tokenizer {
+	t.Helper()
+
+	vocab := []struct {
+		value string
+		score float32
+		typ   int32
+	}{
+		{"<unk>", 0, typeUnknown},
+		{"<s>", 0, typeControl},
+		{"</s>", 0, typeControl},
+		{"<0x0A>", 0, typeByte},
+		{"<0xC3>", 0, typeByte},
+		{"<0xA9>", 0, typeByte},
+		{"▁", -1, typeNormal},
+		{"h", -2, typeNormal},
+		{"e", -2, typeNormal},
+		{"l", -2, typeNormal},
+		{"o", -2, typeNormal},
+		{"w", -2, typeNormal},
+		{"r", -2, typeNormal},
+		{"d", -2, typeNormal},
+		{"ll", -1.5, typeNormal},
+		{"▁h", -1.2, typeNormal},
+		{"▁he", -1.1, typeNormal},
+		{"llo", -1, typeNormal},
+		{"▁hello", -0.5, typeNormal},
+		{"▁w", -1.3, typeNormal},
+		{"or", -1.4, typeNormal},
+		{"▁wor", -0.9, typeNormal},
+		{"ld", -1.6, typeNormal},
+		{"▁world", -0.4, typeNormal},
+		{"[INST]", 0, typeControl},
+	}
+
+	kv := llm.KV{
+		"general.architecture":            "llama",
+		"tokenizer.ggml.model":            "llama",
+		"tokenizer.ggml.unknown_token_id": uint32(0),
+		"tokenizer.ggml.add_space_prefix": addSpacePrefix,
+		"tokenizer.ggml.tokens":           []string{},
+		"tokenizer.ggml.scores":           []float32{},
+		"tokenizer.ggml.token_type":       []int32{},
+	}
+
+	for _, v := range vocab {
+		kv["tokenizer.ggml.tokens"] = append(kv["tokenizer.ggml.tokens"].([]string), v.value)
+		kv["tokenizer.ggml.scores"] = append(kv["tokenizer.ggml.scores"].([]float32), v.score)
+		kv["tokenizer.ggml.token_type"] = append(kv["tokenizer.ggml.token_type"].([]int32), v.typ)
+	}
+
+	tok, err := New(decode(t, kv))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tok
+}
+
+func bpeVocab(t *testing.T, pre string) *Tokenizer {
+	t.Helper()
+
+	// Ġ and Ċ are how byte-level vocabularies write space and newline
+	tokens := []string{
+		"h", "e", "l", "o", "Ġ", "w", "r", "d", "he", "ll", "llo", "hello", "Ġw", "or", "Ġwor", "ld", "Ġworld",
+		"<|endoftext|>", "Ċ", "'s", "'", "s", "1", "2", "3", "4", "34",
+	}
+
+	types := make([]int32, len(tokens))
+	for i := range types {
+		types[i] = typeNormal
+	}
+	types[17] = typeControl
+
+	tok, err := New(decode(t, llm.KV{
+		"general.architecture":      "llama",
+		"tokenizer.ggml.model":      "gpt2",
+		"tokenizer.ggml.pre":        pre,
+		"tokenizer.ggml.tokens":     tokens,
+		"tokenizer.ggml.token_type": types,
+		"tokenizer.ggml.merges": []string{
+			"h e", "l l", "ll o", "he llo", "Ġ w", "o r", "Ġw or", "l d", "Ġwor ld", "' s", "3 4",
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tok
+}
+
+// The expected tokens below follow llama.cpp's tokenizers, which the runner
+// uses, step by step: SentencePiece merges the highest scoring pair first,
+// BPE the earliest merge, and special tokens are split out beforehand.
+func TestEncode(t *testing.T) {
+	spm := spmVocab(t, true)
+	bpe := bpeVocab(t, "gpt-2")
+	llama3 := bpeVocab(t, "llama-bpe")
+
+	cases := []struct {
+		name string
+		tok  *Tokenizer
+		s    string
+		want []int
+	}{
+		{"spm", spm, "hello world", []int{18, 23}},
+		{"spm empty", spm, "", []int{}},
+		{"spm special", spm, "[INST]hello", []int{24, 18}},
+		{"spm byte fallback", spm, "<s>hi\n", []int{1, 15, 0, 3}},
+		{"spm multibyte fallback", spm, "hé", []int{15, 4, 5}},
+		{"spm no space prefix", spmVocab(t, false), "hello", []int{7, 8, 17}},
+		{"bpe", bpe, "hello world", []int{11, 16}},
+		{"bpe special", bpe, "it's<|endoftext|>\n", []int{19, 17, 18}},
+		{"bpe numbers", bpe, "1234", []int{22, 23, 26}},
+		{"llama3", llama3, "hello world", []int{11, 16}},
+		{"llama3 numbers", llama3, "1234", []int{22, 23, 24, 25}},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			tokens, err := tt.tok.Encode(tt.s)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(tt.want, tokens); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestDecode(t *testing.T) {
+	s, err := spmVocab(t, true).Decode([]int{1, 18, 23, 3, 4, 5, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s != "<s> hello world\né▅" {
+		t.Errorf("unexpected text %q", s)
+	}
+
+	s, err = bpeVocab(t, "gpt-2").Decode([]int{11, 16, 17, 18})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s != "hello world<|endoftext|>\n" {
+		t.Errorf("unexpected text %q", s)
+	}
+
+	if _, err := bpeVocab(t, "gpt-2").Decode([]int{27}); err == nil {
+		t.Error("expected an error for a token out of range")
+	}
+}
+
+func TestNewUnsupported(t *testing.T) {
+	for _, kv := range []llm.KV{
+		{"tokenizer.ggml.model": "gpt2", "tokenizer.ggml.pre": "qwen2", "tokenizer.ggml.tokens": []string{"a"}},
+		{"tokenizer.ggml.model": "bert", "tokenizer.ggml.tokens": []string{"a"}},
+	} {
+		if _, err := New(kv); !errors.Is(err, ErrUnsupported) {
+			t.Errorf("expected ErrUnsupported, got %v", err)
+		}
+	}
+
+	if _, err := New(llm.KV{"tokenizer.ggml.model": "llama"}); err == nil {
+		t.Error("expected an error for a model without a vocabulary")
+	}
+}